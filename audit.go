@@ -0,0 +1,171 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+const defaultAuditLog = "/var/log/embiggen-disk/audit.log"
+
+var (
+	auditLog     = flag.String("audit-log", defaultAuditLog, "append a JSON line to this file for every change made, or attempted; empty to disable")
+	auditMaxSize = bytesFlag(10 << 20)
+)
+
+func init() {
+	flag.Var(&auditMaxSize, "audit-log-max-size", "rotate -audit-log when it would grow past this size")
+}
+
+// auditKeep is how many rotated audit logs to keep, as audit.log.1
+// (newest) through audit.log.5.
+const auditKeep = 5
+
+// An auditEntry is one line of the audit log: a change made to a
+// layer, or an attempt that failed.
+type auditEntry struct {
+	Time        time.Time     `json:"time"`
+	Host        string        `json:"host"`
+	Mount       string        `json:"mount"`
+	Action      string        `json:"action"` // "grow" or "shrink"
+	Layer       string        `json:"layer,omitempty"`
+	Device      string        `json:"device,omitempty"`
+	Commands    []string      `json:"commands"`
+	BeforeBytes int64         `json:"beforeBytes,omitempty"`
+	AfterBytes  int64         `json:"afterBytes,omitempty"`
+	Duration    time.Duration `json:"durationNanos,omitempty"`
+	Outcome     string        `json:"outcome"` // "ok" or "failed"
+	Error       string        `json:"error,omitempty"`
+}
+
+// auditResize records the outcome of growing mnt: an entry per
+// changed layer and, if it failed, one for the rest of cmds, the
+// commands it ran. Nothing is recorded in dry-run, as nothing was
+// changed.
+func auditResize(ctx context.Context, mnt string, changes []embiggen.Change, cmds []embiggen.Command, err error) {
+	if dryRun(ctx) {
+		return
+	}
+	var entries []auditEntry
+	seen := map[string]int{}
+	for _, c := range changes {
+		ae := auditEntry{
+			Mount:       mnt,
+			Action:      "grow",
+			Layer:       c.Layer,
+			Device:      c.Device,
+			Commands:    []string{},
+			BeforeBytes: c.BeforeBytes,
+			AfterBytes:  c.AfterBytes,
+			Duration:    c.Duration,
+			Outcome:     "ok",
+		}
+		for _, lc := range c.Commands {
+			ae.Commands = append(ae.Commands, lc.Command)
+			seen[lc.Command]++
+		}
+		entries = append(entries, ae)
+	}
+	if err != nil {
+		ae := auditEntry{Mount: mnt, Action: "grow", Commands: []string{}, Outcome: "failed", Error: err.Error()}
+		for _, lc := range cmds {
+			if seen[lc.Command] > 0 {
+				seen[lc.Command]--
+				continue
+			}
+			ae.Commands = append(ae.Commands, lc.Command)
+		}
+		entries = append(entries, ae)
+	}
+	audit(entries...)
+}
+
+// audit appends entries to the -audit-log file, rotating it first if
+// they'd take it past -audit-log-max-size. Errors are only logged:
+// failing to audit a change shouldn't stop it.
+func audit(entries ...auditEntry) {
+	path := *auditLog
+	if !flagGiven("audit-log") && cfg.AuditLog != "" {
+		path = cfg.AuditLog
+	}
+	if path == "" || len(entries) == 0 {
+		return
+	}
+	if err := writeAudit(path, int64(auditMaxSize), entries); err != nil {
+		warnf("writing audit log: %v", err)
+	}
+}
+
+// auditMu serializes writeAudit, as targets grown in parallel audit
+// at once; rotating and appending must not interleave.
+var auditMu sync.Mutex
+
+func writeAudit(path string, maxSize int64, entries []auditEntry) error {
+	host, _ := os.Hostname()
+	var buf []byte
+	for _, ae := range entries {
+		if ae.Time.IsZero() {
+			ae.Time = time.Now().UTC()
+		}
+		ae.Host = host
+		b, err := json.Marshal(ae)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil && maxSize > 0 && fi.Size()+int64(len(buf)) > maxSize {
+		if err := rotateAudit(path); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotateAudit moves path to path.1, path.1 to path.2 and so on,
+// dropping the oldest beyond auditKeep.
+func rotateAudit(path string) error {
+	for i := auditKeep - 1; i >= 1; i-- {
+		from, to := fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
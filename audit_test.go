@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log", "audit.log")
+
+	ae := auditEntry{Mount: "/", Action: "grow", Layer: "filesystem", Commands: []string{"resize2fs /dev/sda1"}, BeforeBytes: 10, AfterBytes: 20, Outcome: "ok"}
+	for i := 0; i < 3; i++ {
+		if err := writeAudit(path, 400, []auditEntry{ae}); err != nil {
+			t.Fatalf("writeAudit: %v", err)
+		}
+	}
+	cur, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("no rotated log: %v", err)
+	}
+	if n := bytes.Count(cur, []byte("\n")) + bytes.Count(old, []byte("\n")); n != 3 {
+		t.Errorf("got %d audit lines across %s and .1; want 3", n, path)
+	}
+	if len(cur) > 400 || len(old) > 400 {
+		t.Errorf("audit logs of %d and %d bytes; want at most 400", len(cur), len(old))
+	}
+	var got auditEntry
+	if err := json.Unmarshal(bytes.SplitN(cur, []byte("\n"), 2)[0], &got); err != nil {
+		t.Fatalf("bad audit line %q: %v", cur, err)
+	}
+	if got.Mount != "/" || got.AfterBytes != 20 || got.Outcome != "ok" || got.Time.IsZero() {
+		t.Errorf("audit entry = %+v", got)
+	}
+}
+
+func TestWriteAuditParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// Four lines to a log, so the 24 lines just fill it and the five
+	// rotated ones.
+	ae := auditEntry{Time: time.Unix(0, 0).UTC(), Mount: "/", Action: "grow", Layer: "filesystem", Outcome: "ok"}
+	ae.Host, _ = os.Hostname()
+	line, err := json.Marshal(ae)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxSize := int64(4 * (len(line) + 1))
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				if err := writeAudit(path, maxSize, []auditEntry{ae}); err != nil {
+					t.Errorf("writeAudit: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var n int
+	for _, p := range []string{path, path + ".1", path + ".2", path + ".3", path + ".4", path + ".5"} {
+		b, err := ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(b)) > maxSize {
+			t.Errorf("%s is %d bytes; want at most %d", p, len(b), maxSize)
+		}
+		for _, line := range bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")) {
+			var got auditEntry
+			if err := json.Unmarshal(line, &got); err != nil {
+				t.Errorf("bad audit line %q in %s: %v", line, p, err)
+			}
+			n++
+		}
+	}
+	if n != 24 {
+		t.Errorf("got %d audit lines; want 24", n)
+	}
+}
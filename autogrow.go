@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var (
+	autoGrowAt       percentFlag
+	autoGrowBy       growthFlag
+	autoGrowMax      bytesFlag
+	autoGrowInterval = flag.Duration("auto-grow-interval", 6*time.Hour, "with -auto-grow-at, the least time between enlargements of a target's cloud volume; EBS allows one modification per volume every 6 hours")
+)
+
+func init() {
+	flag.Var(&autoGrowAt, "auto-grow-at", "in daemon mode, enlarge the cloud volume under a target once its filesystem is more than this full (e.g. \"85%\"), then grow into it")
+	flag.Var(&autoGrowBy, "auto-grow-by", "with -auto-grow-at, how much to enlarge the cloud volume by, e.g. \"+50G\" (default \"+20%\")")
+	flag.Var(&autoGrowMax, "auto-grow-max", "with -auto-grow-at, never enlarge the cloud volume beyond this size (e.g. \"1T\")")
+}
+
+// defaultAutoGrowBy is how much to enlarge a cloud volume by when
+// -auto-grow-by isn't set.
+const defaultAutoGrowBy = "+20%"
+
+// autoGrowFailureWait is how long to wait before trying again after
+// failing to enlarge a cloud volume.
+const autoGrowFailureWait = 15 * time.Minute
+
+// A growthFlag is how much to enlarge a volume by: "+50G" or "+20%".
+type growthFlag string
+
+func (f *growthFlag) String() string { return string(*f) }
+
+func (f *growthFlag) Set(s string) error {
+	if !strings.HasPrefix(s, "+") {
+		return fmt.Errorf("invalid growth %q; want e.g. \"+20%%\" or \"+50G\"", s)
+	}
+	if _, err := ebsTargetGiB(1<<10, s); err != nil {
+		return err
+	}
+	*f = growthFlag(s)
+	return nil
+}
+
+// cloudGrow enlarges the cloud volume behind disk to, or by, size.
+func cloudGrow(disk, size string) error {
+	if _, err := ebsVolumeID(disk); err == nil {
+		return growEBS(disk, size)
+	}
+	if _, err := gceDeviceName(disk); err == nil {
+		return growGCE(disk, size)
+	}
+	if _, err := azureLun(disk); err == nil {
+		return growAzure(disk, size)
+	}
+	if _, err := cinderSerial(disk); err == nil && os.Getenv("OS_AUTH_URL") != "" {
+		return growCinder(disk, size)
+	}
+	return embiggen.Unsupportedf("%s isn't a cloud volume embiggen-disk can enlarge", disk)
+}
+
+// autoGrowSize returns the size in GiB to enlarge a volume of cur
+// bytes to per p, or 0 if it's already as big as p allows.
+func autoGrowSize(cur int64, p policy) int64 {
+	by := string(p.autoGrowBy)
+	if by == "" {
+		by = defaultAutoGrowBy
+	}
+	gib, err := ebsTargetGiB(cur>>30, by)
+	if err != nil {
+		return 0
+	}
+	if max := int64(p.autoGrowMax) >> 30; max > 0 && gib > max {
+		gib = max
+	}
+	if gib<<30 <= cur {
+		return 0
+	}
+	return gib
+}
+
+// autoGrow enlarges the cloud volume under mnt if its filesystem is
+// fuller than its -auto-grow-at policy allows and there's no room
+// left to grow into locally, so the grow that follows uses the new
+// space. It returns whether it changed st.
+func autoGrow(mnt string, lim embiggen.Limit, st *targetState) bool {
+	p, err := policyFor(mnt)
+	if err != nil || p.autoGrowAt == 0 || time.Now().Before(st.NextAutoGrow) {
+		return false
+	}
+	fs, err := embiggen.StatFS(mnt)
+	if err != nil || fs.Statfs.Blocks == 0 {
+		return false
+	}
+	used := float64(fs.Statfs.Blocks - fs.Statfs.Bfree)
+	pct := used / (used + float64(fs.Statfs.Bavail)) * 100
+	if pct <= float64(p.autoGrowAt) {
+		return false
+	}
+	if lim, err = withLVFree(mnt, lim); err != nil {
+		return false
+	}
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		return false
+	}
+	if n, err := reclaimable(e); err != nil || n > 0 {
+		return false // grow first
+	}
+	disk, err := backingDisk(mnt, lim)
+	if err != nil {
+		vlogf("%s: %.0f%% full, but can't auto-grow: %v", mnt, pct, err)
+		return false
+	}
+	cur, err := embiggen.BlockDevSize(disk)
+	if err != nil {
+		return false
+	}
+	gib := autoGrowSize(cur, p)
+	if gib == 0 {
+		vlogf("%s: %.0f%% full, but %s is already at -auto-grow-max", mnt, pct, disk)
+		return false
+	}
+	infof("%s: %.0f%% full, over %v; enlarging %s to %d GiB", mnt, pct, &p.autoGrowAt, disk, gib)
+	if err := cloudGrow(disk, fmt.Sprintf("%dG", gib)); err != nil {
+		logEvent(levelError, "auto-grow failed", logFields{"mount": mnt, "device": disk, "action": "auto-grow", "result": "failed", "error": err})
+		st.NextAutoGrow = time.Now().Add(autoGrowFailureWait)
+		return true
+	}
+	st.NextAutoGrow = time.Now().Add(*autoGrowInterval)
+	return true
+}
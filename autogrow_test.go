@@ -0,0 +1,40 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestAutoGrowSize(t *testing.T) {
+	tests := []struct {
+		cur  int64 // GiB
+		by   string
+		max  int64 // GiB
+		want int64
+	}{
+		{100, "", 0, 120},
+		{100, "+50G", 0, 150},
+		{100, "+20%", 110, 110},
+		{100, "+20%", 100, 0},
+		{1000, "+20%", 1024, 1024},
+	}
+	for _, tt := range tests {
+		p := policy{autoGrowBy: growthFlag(tt.by), autoGrowMax: bytesFlag(tt.max << 30)}
+		if got := autoGrowSize(tt.cur<<30, p); got != tt.want {
+			t.Errorf("autoGrowSize(%d GiB, %q, max %d GiB) = %d; want %d", tt.cur, tt.by, tt.max, got, tt.want)
+		}
+	}
+}
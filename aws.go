@@ -0,0 +1,269 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// A minimal AWS client: instance metadata, instance role credentials
+// and Signature Version 4, enough for the few API calls embiggen-disk
+// makes, without pulling in the AWS SDK.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imdsEndpoint is the EC2 instance metadata service.
+var imdsEndpoint = "http://169.254.169.254"
+
+var imdsClient = &http.Client{Timeout: 2 * time.Second}
+
+// imdsGet returns the instance metadata at path, like
+// "/latest/meta-data/placement/region", using IMDSv2.
+func imdsGet(path string) (string, error) {
+	req, err := http.NewRequest("PUT", imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	res, err := imdsClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("getting IMDS token: %v", err)
+	}
+	token, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || res.StatusCode != 200 {
+		return "", fmt.Errorf("getting IMDS token: %s", res.Status)
+	}
+	req, err = http.NewRequest("GET", imdsEndpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	res, err = imdsClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("reading IMDS %s: %v", path, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("reading IMDS %s: %s", path, res.Status)
+	}
+	return string(body), nil
+}
+
+// awsRegion returns $AWS_REGION, or else the instance's region.
+func awsRegion() (string, error) {
+	if r := os.Getenv("AWS_REGION"); r != "" {
+		return r, nil
+	}
+	return imdsGet("/latest/meta-data/placement/region")
+}
+
+// awsCreds are AWS credentials.
+type awsCreds struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+var (
+	awsCredsMu     sync.Mutex
+	awsCredsCached *awsCreds
+)
+
+// awsCredentials returns credentials from the usual environment
+// variables, or else the instance role's, cached until shortly before
+// they expire.
+func awsCredentials() (*awsCreds, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCreds{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	awsCredsMu.Lock()
+	defer awsCredsMu.Unlock()
+	if c := awsCredsCached; c != nil && time.Until(c.Expiration) > 5*time.Minute {
+		return c, nil
+	}
+	role, err := imdsGet("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("finding instance role: %v", err)
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	js, err := imdsGet("/latest/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return nil, fmt.Errorf("getting instance role credentials: %v", err)
+	}
+	c := &awsCreds{}
+	if err := json.Unmarshal([]byte(js), c); err != nil {
+		return nil, fmt.Errorf("parsing instance role credentials: %v", err)
+	}
+	awsCredsCached = c
+	return c, nil
+}
+
+// awsDo signs and sends an AWS API request, returning the response
+// body, or an error for a non-2xx response.
+func awsDo(service, region, method, endpoint, contentType string, headers map[string]string, body []byte) ([]byte, error) {
+	creds, err := awsCredentials()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	signV4(req, body, creds, service, region, time.Now())
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	out, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return out, fmt.Errorf("%s %s: %s: %s", service, method, res.Status, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// awsQuery calls an AWS query API action, like SNS Publish, with the
+// given parameters, in region.
+func awsQuery(service, region, version, action string, params url.Values) ([]byte, error) {
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("Action", action)
+	form.Set("Version", version)
+	endpoint := fmt.Sprintf("https://%s.%s.amazonaws.com/", service, region)
+	return awsDo(service, region, "POST", endpoint, "application/x-www-form-urlencoded; charset=utf-8", nil, []byte(form.Encode()))
+}
+
+// awsJSON calls an AWS JSON 1.1 API action, like EventBridge
+// PutEvents, with target as the X-Amz-Target header.
+func awsJSON(service, region, target string, req interface{}) ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("https://%s.%s.amazonaws.com/", service, region)
+	return awsDo(service, region, "POST", endpoint, "application/x-amz-json-1.1", map[string]string{"X-Amz-Target": target}, body)
+}
+
+// signV4 signs req, whose body is body, with AWS Signature Version 4.
+func signV4(req *http.Request, body []byte, creds *awsCreds, service, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	host := req.URL.Host
+	if req.Host != "" {
+		host = req.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonReq := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, sig))
+}
+
+// awsCanonicalQuery returns q sorted and escaped as SigV4 wants.
+func awsCanonicalQuery(q url.Values) string {
+	var parts []string
+	for k, vs := range q {
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes s per RFC 3986, as SigV4 wants.
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
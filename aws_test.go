@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// TestSignV4 checks signV4 against the example in the AWS General
+// Reference's "Signature Version 4 signing process".
+func TestSignV4(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds := &awsCreds{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signV4(req, nil, creds, "iam", "us-east-1", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAWSEscape(t *testing.T) {
+	if got, want := awsEscape("a b/c~d*e"), "a%20b%2Fc~d%2Ae"; got != want {
+		t.Errorf("awsEscape = %q; want %q", got, want)
+	}
+}
+
+func TestEBSTargetGiB(t *testing.T) {
+	tests := []struct {
+		cur  int64
+		size string
+		want int64 // 0 for an error
+	}{
+		{100, "200G", 200},
+		{100, "+50G", 150},
+		{100, "+20%", 120},
+		{100, "+0.5%", 101},
+		{100, "100G", 0},
+		{100, "+lots", 0},
+	}
+	for _, tt := range tests {
+		got, err := ebsTargetGiB(tt.cur, tt.size)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("ebsTargetGiB(%d, %q) = %d; want an error", tt.cur, tt.size, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ebsTargetGiB(%d, %q) = %d, %v; want %d", tt.cur, tt.size, got, err, tt.want)
+		}
+	}
+}
+
+func TestXenAttachNames(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"xvdf", []string{"/dev/xvdf", "/dev/sdf"}},
+		{"xvdba", []string{"/dev/xvdba", "/dev/sdba"}},
+		{"xvda", []string{"/dev/xvda", "/dev/sda", "/dev/sda1", "/dev/xvda1"}},
+	}
+	for _, tt := range tests {
+		if got := xenAttachNames(tt.name); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("xenAttachNames(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEBSReady(t *testing.T) {
+	defer func() { ebsTargets = map[string]*ebsTarget{} }()
+	tests := []struct {
+		state string
+		want  bool
+	}{
+		{"modifying", false},
+		{"optimizing", true},
+		{"completed", true},
+		{"failed", true},
+	}
+	for _, tt := range tests {
+		ebsTargets["/data"] = &ebsTarget{
+			checked: time.Now(),
+			disk:    "/dev/nonexistent",
+			vol:     "vol-0123456789abcdef0",
+			mod:     &ec2Modification{State: tt.state, TargetSize: 200},
+		}
+		if got := ebsReady("/data", embiggen.Limit{}); got != tt.want {
+			t.Errorf("ebsReady with modification %s = %v; want %v", tt.state, got, tt.want)
+		}
+	}
+}
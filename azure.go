@@ -0,0 +1,350 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// A minimal Azure client: the instance metadata service, the VM's
+// managed identity, and the Disks API calls needed to enlarge a
+// managed disk.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var azureWait = flag.Duration("azure-wait", 15*time.Minute, "with azure grow, how long to wait for the managed disk update to take effect")
+
+var (
+	// azureIMDSEndpoint is the Azure instance metadata service.
+	azureIMDSEndpoint = "http://169.254.169.254"
+	// azureManagementEndpoint is Azure Resource Manager.
+	azureManagementEndpoint = "https://management.azure.com"
+)
+
+// azurePollInterval is how often azure grow checks on an update.
+var azurePollInterval = 5 * time.Second
+
+// azureDisksAPIVersion is the Disks API version used.
+const azureDisksAPIVersion = "2022-07-02"
+
+// azureLiveResizeLimit is the largest size, in GiB, a disk can be
+// grown to without deallocating the VM, if it started at or below it.
+const azureLiveResizeLimit = 4095
+
+var azureIMDSClient = &http.Client{Timeout: 2 * time.Second}
+
+// azureIMDS returns the instance metadata at path, like
+// "/metadata/instance?api-version=2021-02-01".
+func azureIMDS(path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", azureIMDSEndpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	res, err := azureIMDSClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading Azure IMDS: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("reading Azure IMDS %s: %s", path, res.Status)
+	}
+	return body, nil
+}
+
+// An azureVMDisk is an OS or data disk in the instance metadata.
+type azureVMDisk struct {
+	Lun         string `json:"lun"`
+	Name        string `json:"name"`
+	DiskSizeGB  string `json:"diskSizeGB"`
+	ManagedDisk struct {
+		ID string `json:"id"`
+	} `json:"managedDisk"`
+}
+
+// azureVM is the part of the instance metadata azure grow uses.
+type azureVM struct {
+	Name           string `json:"name"`
+	VMSize         string `json:"vmSize"`
+	ResourceGroup  string `json:"resourceGroupName"`
+	StorageProfile struct {
+		OSDisk    azureVMDisk   `json:"osDisk"`
+		DataDisks []azureVMDisk `json:"dataDisks"`
+	} `json:"storageProfile"`
+}
+
+// azureInstance returns the VM's instance metadata, or an error if
+// this isn't an Azure VM.
+func azureInstance() (*azureVM, error) {
+	b, err := azureIMDS("/metadata/instance/compute?api-version=2021-02-01")
+	if err != nil {
+		return nil, err
+	}
+	vm := new(azureVM)
+	if err := json.Unmarshal(b, vm); err != nil {
+		return nil, fmt.Errorf("parsing Azure instance metadata: %v", err)
+	}
+	return vm, nil
+}
+
+// An azureError is an error from Azure Resource Manager.
+type azureError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *azureError) Error() string { return e.Code + ": " + e.Message }
+
+// needsDeallocation reports whether e is Azure refusing to resize a
+// disk while the VM is running.
+func (e *azureError) needsDeallocation() bool {
+	return e.Code == "OperationNotAllowed" && strings.Contains(strings.ToLower(e.Message), "deallocat")
+}
+
+// azureDo calls Azure Resource Manager as the VM's managed identity,
+// decoding the JSON response into out if it's not nil. It returns the
+// response's Azure-AsyncOperation URL, if any.
+func azureDo(method, url string, in, out interface{}) (string, error) {
+	b, err := azureIMDS("/metadata/identity/oauth2/token?api-version=2018-02-01&resource=" + azureManagementEndpoint + "/")
+	if err != nil {
+		return "", fmt.Errorf("getting a managed identity token: %v", err)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(b, &tok); err != nil {
+		return "", fmt.Errorf("parsing managed identity token: %v", err)
+	}
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		url = azureManagementEndpoint + url
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return "", err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	b, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode/100 != 2 {
+		var e struct {
+			Error *azureError `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != nil {
+			return "", e.Error
+		}
+		return "", fmt.Errorf("%s %s: %s: %s", method, url, res.Status, bytes.TrimSpace(b))
+	}
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return "", err
+		}
+	}
+	return res.Header.Get("Azure-AsyncOperation"), nil
+}
+
+// azureMain implements the "azure grow <mount-point> <size>"
+// subcommand, like aws grow for an Azure managed disk.
+func azureMain(args []string) {
+	if len(args) != 3 || args[0] != "grow" {
+		usage()
+	}
+	mnt, size := args[1], args[2]
+	lim, err := resolveLimit(mnt)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	disk, err := backingDisk(mnt, lim)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	if err := growAzure(disk, size); err != nil {
+		exitf(exitCode(nil, err), "error enlarging the managed disk under %s: %v", mnt, err)
+	}
+	changes, err := grow(mnt, lim)
+	if err != nil {
+		exitf(exitCode(changes, err), "error enlarging %s: %v", mnt, err)
+	}
+	os.Exit(exitCode(changes, nil))
+}
+
+// azureLun returns the LUN of disk as a data disk, or "" if it's the
+// OS disk, from the links the Azure udev rules make.
+func azureLun(disk string) (string, error) {
+	real, err := filepath.EvalSymlinks(disk)
+	if err != nil {
+		return "", err
+	}
+	for _, pat := range []string{"/dev/disk/azure/root", "/dev/disk/azure/os", "/dev/disk/azure/scsi1/lun*", "/dev/disk/azure/data/by-lun/*"} {
+		links, _ := filepath.Glob(pat)
+		for _, l := range links {
+			if t, err := filepath.EvalSymlinks(l); err != nil || t != real {
+				continue
+			}
+			if strings.HasPrefix(pat, "/dev/disk/azure/root") || strings.HasPrefix(pat, "/dev/disk/azure/os") {
+				return "", nil
+			}
+			return strings.TrimPrefix(filepath.Base(l), "lun"), nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't an Azure managed disk", disk)
+}
+
+// azureDisk returns the managed disk of vm with the LUN lun, or its
+// OS disk if lun is "".
+func azureDisk(vm *azureVM, lun string) (*azureVMDisk, error) {
+	d := &vm.StorageProfile.OSDisk
+	if lun != "" {
+		d = nil
+		for i := range vm.StorageProfile.DataDisks {
+			if vm.StorageProfile.DataDisks[i].Lun == lun {
+				d = &vm.StorageProfile.DataDisks[i]
+			}
+		}
+		if d == nil {
+			return nil, fmt.Errorf("no data disk at LUN %s", lun)
+		}
+	}
+	if d.ManagedDisk.ID == "" {
+		return nil, embiggen.Unsupportedf("disk %s isn't a managed disk", d.Name)
+	}
+	return d, nil
+}
+
+// azureDeallocateError explains how to grow a disk Azure won't resize
+// while vm is running.
+func azureDeallocateError(vm *azureVM, name string, gib int64, why string) error {
+	return embiggen.Unsupportedf("Azure can't resize disk %s of VM %s (%s) while it's running: %s. "+
+		"Deallocate it (az vm deallocate -g %s -n %s), resize the disk (az disk update -g %s -n %s --size-gb %d), "+
+		"start it again, and then run embiggen-disk to grow the layers above",
+		name, vm.Name, vm.VMSize, why, vm.ResourceGroup, vm.Name, vm.ResourceGroup, name, gib)
+}
+
+// growAzure enlarges the managed disk behind disk per size, waits
+// for the update to finish, and rescans the disk until the kernel
+// sees it.
+func growAzure(disk, size string) error {
+	vm, err := azureInstance()
+	if err != nil {
+		return err
+	}
+	lun, err := azureLun(disk)
+	if err != nil {
+		return err
+	}
+	d, err := azureDisk(vm, lun)
+	if err != nil {
+		return err
+	}
+	var md struct {
+		Name       string `json:"name"`
+		Properties struct {
+			DiskSizeGB int64 `json:"diskSizeGB"`
+		} `json:"properties"`
+	}
+	if _, err := azureDo("GET", d.ManagedDisk.ID+"?api-version="+azureDisksAPIVersion, nil, &md); err != nil {
+		return err
+	}
+	cur := md.Properties.DiskSizeGB
+	gib, err := ebsTargetGiB(cur, size)
+	if err != nil {
+		return err
+	}
+	if cur <= azureLiveResizeLimit && gib > azureLiveResizeLimit {
+		return azureDeallocateError(vm, md.Name, gib, "growing past 4 TiB needs it deallocated")
+	}
+	if *dry {
+		dryRunf("would've resized managed disk %s (%s) from %d GiB to %d GiB", md.Name, disk, cur, gib)
+		return nil
+	}
+	infof("resizing managed disk %s (%s) from %d GiB to %d GiB", md.Name, disk, cur, gib)
+	body := map[string]interface{}{"properties": map[string]int64{"diskSizeGB": gib}}
+	async, err := azureDo("PATCH", d.ManagedDisk.ID+"?api-version="+azureDisksAPIVersion, body, nil)
+	if ae, ok := err.(*azureError); ok && ae.needsDeallocation() {
+		return azureDeallocateError(vm, md.Name, gib, ae.Message)
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(*azureWait)
+	for async != "" {
+		var op struct {
+			Status string      `json:"status"` // InProgress, Succeeded, Failed or Canceled
+			Error  *azureError `json:"error"`
+		}
+		if _, err := azureDo("GET", async, nil, &op); err != nil {
+			return err
+		}
+		vlogf("%s: update %s", md.Name, op.Status)
+		if op.Status == "Succeeded" {
+			break
+		}
+		if op.Status == "Failed" || op.Status == "Canceled" {
+			if op.Error != nil && op.Error.needsDeallocation() {
+				return azureDeallocateError(vm, md.Name, gib, op.Error.Message)
+			}
+			return fmt.Errorf("resizing %s: %s: %v", md.Name, op.Status, op.Error)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("resizing %s: still %s after %v", md.Name, op.Status, *azureWait)
+		}
+		time.Sleep(azurePollInterval)
+	}
+	for {
+		if n, err := embiggen.BlockDevSize(disk); err == nil && n >= gib<<30 {
+			return nil
+		}
+		if err := rescanDisk(disk); err != nil {
+			vlogf("%s: %v", disk, err)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s grew but the kernel still doesn't see it after %v", md.Name, *azureWait)
+		}
+		time.Sleep(azurePollInterval)
+	}
+}
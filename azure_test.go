@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAzureDisk(t *testing.T) {
+	vm := &azureVM{Name: "vm"}
+	vm.StorageProfile.OSDisk.Name = "os"
+	vm.StorageProfile.OSDisk.ManagedDisk.ID = "/subscriptions/s/resourceGroups/g/providers/Microsoft.Compute/disks/os"
+	vm.StorageProfile.DataDisks = []azureVMDisk{{Lun: "0", Name: "data0"}, {Lun: "1", Name: "data1"}}
+	vm.StorageProfile.DataDisks[1].ManagedDisk.ID = "/subscriptions/s/resourceGroups/g/providers/Microsoft.Compute/disks/data1"
+	tests := []struct {
+		lun, want string // want "" for an error
+	}{
+		{"", "os"},
+		{"1", "data1"},
+		{"0", ""}, // unmanaged
+		{"2", ""},
+	}
+	for _, tt := range tests {
+		d, err := azureDisk(vm, tt.lun)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("azureDisk(%q) = %s; want an error", tt.lun, d.Name)
+			}
+			continue
+		}
+		if err != nil || d.Name != tt.want {
+			t.Errorf("azureDisk(%q) = %v, %v; want %s", tt.lun, d, err, tt.want)
+		}
+	}
+}
+
+func TestAzureDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" {
+				http.Error(w, "no Metadata header", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"tok"}`)
+		case r.Header.Get("Authorization") != "Bearer tok":
+			http.Error(w, "bad token", http.StatusUnauthorized)
+		case r.Method == "PATCH":
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":{"code":"OperationNotAllowed","message":"Disk resizing is allowed only when creating a VM or when the VM is deallocated."}}`)
+		default:
+			w.Header().Set("Azure-AsyncOperation", "https://example.com/op")
+			fmt.Fprint(w, `{"name":"data1","properties":{"diskSizeGB":100}}`)
+		}
+	}))
+	defer srv.Close()
+	defer func(i, m string) { azureIMDSEndpoint, azureManagementEndpoint = i, m }(azureIMDSEndpoint, azureManagementEndpoint)
+	azureIMDSEndpoint, azureManagementEndpoint = srv.URL, srv.URL
+
+	var md struct {
+		Properties struct {
+			DiskSizeGB int64 `json:"diskSizeGB"`
+		} `json:"properties"`
+	}
+	async, err := azureDo("GET", "/disks/data1", nil, &md)
+	if err != nil || md.Properties.DiskSizeGB != 100 || async != "https://example.com/op" {
+		t.Errorf("GET = %q, %+v, %v; want the op URL and 100 GiB", async, md, err)
+	}
+	_, err = azureDo("PATCH", "/disks/data1", map[string]int{"diskSizeGB": 200}, nil)
+	ae, ok := err.(*azureError)
+	if !ok || !ae.needsDeallocation() {
+		t.Fatalf("PATCH error = %v; want one needing deallocation", err)
+	}
+	vm := &azureVM{Name: "vm", VMSize: "Standard_D2s_v3", ResourceGroup: "g"}
+	if msg := azureDeallocateError(vm, "data1", 200, ae.Message).Error(); !strings.Contains(msg, "az vm deallocate -g g -n vm") {
+		t.Errorf("deallocate error %q doesn't say how", msg)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// Exit codes for the check subcommand, following the Nagios plugin
+// conventions so it can be used as a check as-is.
+const (
+	checkOK      = 0 // the filesystem uses all the capacity available to it
+	checkWarning = 1 // some capacity is reclaimable
+	checkUnknown = 3 // couldn't tell
+)
+
+// reclaimable returns how many bytes the filesystem at the top of e's
+// chain could grow by.
+func reclaimable(e embiggen.Resizer) (int64, error) {
+	nodes, err := planStack(e)
+	if err != nil {
+		return 0, err
+	}
+	// Growth available from the layers below...
+	var n int64
+	if len(nodes) > 1 {
+		below := nodes[len(nodes)-2]
+		if below.err != nil {
+			return 0, below.err
+		}
+		if below.attainable && below.att > below.cur {
+			n = below.att - below.cur
+		}
+	}
+	// ... plus any of the device the filesystem doesn't cover yet.
+	fsr, ok := e.(embiggen.FSResizer)
+	if !ok {
+		return n, nil
+	}
+	devSize, err := embiggen.BlockDevSize(fsr.FS().Dev)
+	if err != nil {
+		return 0, err
+	}
+	cur, err := fsr.FSBytes(runCtx)
+	if err != nil {
+		return 0, err
+	}
+	if devSize > cur {
+		n += devSize - cur
+	}
+	if fsr.Limit().Max > 0 && cur+n > fsr.Limit().Max {
+		n = fsr.Limit().Max - cur
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, nil
+}
+
+// reclaimThreshold returns how many reclaimable bytes are worth
+// growing for, given -min-growth.
+func reclaimThreshold(minGrowth int64) int64 {
+	// Ignore slop from alignment and rounding to LVM extents.
+	if minGrowth < 4<<20 {
+		return 4 << 20
+	}
+	return minGrowth
+}
+
+// checkMain implements the "check <mount-point>" subcommand.
+func checkMain(args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+	mnt := args[0]
+	n, err := checkMount(mnt)
+	if err != nil {
+		fmt.Printf("UNKNOWN: %s: %v\n", mnt, err)
+		os.Exit(checkUnknown)
+	}
+	if n < reclaimThreshold(int64(minGrowth)) {
+		fmt.Printf("OK: %s uses all available capacity | reclaimable=%dB\n", mnt, n)
+		os.Exit(checkOK)
+	}
+	fmt.Printf("WARNING: %s has %d bytes (%s) reclaimable | reclaimable=%dB\n", mnt, n, embiggen.HumanSize(n), n)
+	os.Exit(checkWarning)
+}
+
+func checkMount(mnt string) (int64, error) {
+	lim, err := resolveLimit(mnt)
+	if err == nil {
+		lim, err = withLVFree(mnt, lim)
+	}
+	if err != nil {
+		return 0, err
+	}
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		return 0, err
+	}
+	return reclaimable(e)
+}
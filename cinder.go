@@ -0,0 +1,392 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// A minimal OpenStack client: Keystone v3 authentication from the
+// usual OS_* variables, the instance's identity from the metadata
+// service or config drive, and the Nova and Cinder calls needed to
+// extend an attached volume.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var openstackWait = flag.Duration("openstack-wait", 15*time.Minute, "with openstack grow, how long to wait for the Cinder volume extension to take effect")
+
+// openstackMetadataEndpoint is the OpenStack metadata service.
+var openstackMetadataEndpoint = "http://169.254.169.254"
+
+// cinderPollInterval is how often openstack grow checks on an
+// extension.
+var cinderPollInterval = 5 * time.Second
+
+var errNoOpenStackCreds = errors.New("no OpenStack credentials; set OS_AUTH_URL and the rest, as in an openrc file")
+
+// openstackInstanceID returns the instance's UUID, from the metadata
+// service, or else the config drive.
+func openstackInstanceID() (string, error) {
+	var md struct {
+		UUID string `json:"uuid"`
+	}
+	c := &http.Client{Timeout: 2 * time.Second}
+	if res, err := c.Get(openstackMetadataEndpoint + "/openstack/latest/meta_data.json"); err == nil {
+		defer res.Body.Close()
+		if res.StatusCode == 200 && json.NewDecoder(res.Body).Decode(&md) == nil && md.UUID != "" {
+			return md.UUID, nil
+		}
+	}
+	b, err := readConfigDrive("openstack/latest/meta_data.json")
+	if err != nil {
+		return "", fmt.Errorf("no metadata service or config drive: %v", err)
+	}
+	if err := json.Unmarshal(b, &md); err != nil || md.UUID == "" {
+		return "", fmt.Errorf("bad config drive meta_data.json: %v", err)
+	}
+	return md.UUID, nil
+}
+
+// readConfigDrive returns the file at path on the config drive,
+// mounting it read-only for a moment.
+func readConfigDrive(path string) ([]byte, error) {
+	var dev string
+	for _, l := range []string{"/dev/disk/by-label/config-2", "/dev/disk/by-label/CONFIG-2"} {
+		if _, err := os.Stat(l); err == nil {
+			dev = l
+		}
+	}
+	if dev == "" {
+		return nil, errors.New("no config drive")
+	}
+	dir, err := ioutil.TempDir("", "embiggen-config-drive")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	if out, err := exec.Command("mount", "-o", "ro", dev, dir).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("mounting %s: %v: %s", dev, err, bytes.TrimSpace(out))
+	}
+	defer exec.Command("umount", dir).Run()
+	return ioutil.ReadFile(filepath.Join(dir, path))
+}
+
+// An openstackCatalog is the services in a Keystone token.
+type openstackCatalog []struct {
+	Type      string `json:"type"`
+	Endpoints []struct {
+		Interface string `json:"interface"`
+		Region    string `json:"region"`
+		URL       string `json:"url"`
+	} `json:"endpoints"`
+}
+
+// An openstackSession is a Keystone token and the service catalog
+// that came with it.
+type openstackSession struct {
+	token   string
+	catalog openstackCatalog
+}
+
+// openstackAuth logs in to Keystone v3 with the OS_* variables:
+// an application credential, or a user name and password.
+func openstackAuth() (*openstackSession, error) {
+	authURL := os.Getenv("OS_AUTH_URL")
+	if authURL == "" {
+		return nil, errNoOpenStackCreds
+	}
+	var identity, scope interface{}
+	if id := os.Getenv("OS_APPLICATION_CREDENTIAL_ID"); id != "" {
+		identity = map[string]interface{}{
+			"methods":                []string{"application_credential"},
+			"application_credential": map[string]string{"id": id, "secret": os.Getenv("OS_APPLICATION_CREDENTIAL_SECRET")},
+		}
+	} else {
+		domain := func(v string) map[string]string {
+			if d := os.Getenv(v); d != "" {
+				return map[string]string{"name": d}
+			}
+			return map[string]string{"id": "default"}
+		}
+		identity = map[string]interface{}{
+			"methods": []string{"password"},
+			"password": map[string]interface{}{"user": map[string]interface{}{
+				"name":     os.Getenv("OS_USERNAME"),
+				"password": os.Getenv("OS_PASSWORD"),
+				"domain":   domain("OS_USER_DOMAIN_NAME"),
+			}},
+		}
+		if p := os.Getenv("OS_PROJECT_ID"); p != "" {
+			scope = map[string]interface{}{"project": map[string]string{"id": p}}
+		} else if p := os.Getenv("OS_PROJECT_NAME"); p != "" {
+			scope = map[string]interface{}{"project": map[string]interface{}{"name": p, "domain": domain("OS_PROJECT_DOMAIN_NAME")}}
+		}
+	}
+	auth := map[string]interface{}{"identity": identity}
+	if scope != nil {
+		auth["scope"] = scope
+	}
+	b, err := json.Marshal(map[string]interface{}{"auth": auth})
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.Post(strings.TrimSuffix(strings.TrimSuffix(authURL, "/"), "/v3")+"/v3/auth/tokens", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("Keystone login: %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+	var tok struct {
+		Token struct {
+			Catalog openstackCatalog `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("parsing Keystone token: %v", err)
+	}
+	return &openstackSession{token: res.Header.Get("X-Subject-Token"), catalog: tok.Token.Catalog}, nil
+}
+
+// endpoint returns the URL of the first service of one of types in
+// the catalog, for $OS_INTERFACE (public by default) and
+// $OS_REGION_NAME.
+func (s *openstackSession) endpoint(types ...string) (string, error) {
+	iface := os.Getenv("OS_INTERFACE")
+	if iface == "" {
+		iface = "public"
+	}
+	iface = strings.TrimSuffix(iface, "URL")
+	region := os.Getenv("OS_REGION_NAME")
+	for _, typ := range types {
+		for _, svc := range s.catalog {
+			if svc.Type != typ {
+				continue
+			}
+			for _, ep := range svc.Endpoints {
+				if ep.Interface == iface && (region == "" || ep.Region == region) {
+					return strings.TrimSuffix(ep.URL, "/"), nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no %s %s endpoint in the service catalog", iface, types[0])
+}
+
+// do calls an OpenStack API, decoding the JSON response into out if
+// it's not nil.
+func (s *openstackSession) do(method, url string, headers map[string]string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", s.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", method, url, res.Status, bytes.TrimSpace(b))
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// openstackMain implements the "openstack grow <mount-point> <size>"
+// subcommand, like aws grow for a Cinder volume.
+func openstackMain(args []string) {
+	if len(args) != 3 || args[0] != "grow" {
+		usage()
+	}
+	mnt, size := args[1], args[2]
+	lim, err := resolveLimit(mnt)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	disk, err := backingDisk(mnt, lim)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	if err := growCinder(disk, size); err != nil {
+		exitf(exitFailed, "error enlarging the Cinder volume under %s: %v", mnt, err)
+	}
+	changes, err := grow(mnt, lim)
+	if err != nil {
+		exitf(exitCode(changes, err), "error enlarging %s: %v", mnt, err)
+	}
+	os.Exit(exitCode(changes, nil))
+}
+
+// cinderSerial returns the serial number Nova gives disk: the start
+// of its Cinder volume ID, truncated to 20 characters for virtio-blk.
+func cinderSerial(disk string) (string, error) {
+	sys := filepath.Join("/sys/class/block", filepath.Base(disk))
+	if b, err := ioutil.ReadFile(filepath.Join(sys, "serial")); err == nil && len(bytes.TrimSpace(b)) > 0 {
+		return string(bytes.TrimSpace(b)), nil // virtio-blk
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(sys, "device/vpd_pg80")); err == nil && len(b) > 4 {
+		return string(bytes.TrimSpace(b[4:])), nil // SCSI unit serial number page
+	}
+	return "", fmt.Errorf("%s has no serial number to find its Cinder volume by", disk)
+}
+
+// An openstackAttachment is a volume attached to a Nova server.
+type openstackAttachment struct {
+	VolumeID string `json:"volumeId"`
+	Device   string `json:"device"`
+}
+
+// cinderVolumeFor returns the ID of the attached volume whose ID
+// starts with serial.
+func cinderVolumeFor(atts []openstackAttachment, serial string) (string, error) {
+	for _, a := range atts {
+		if serial != "" && strings.HasPrefix(a.VolumeID, serial) {
+			return a.VolumeID, nil
+		}
+	}
+	return "", fmt.Errorf("no volume attached to this instance with serial %s", serial)
+}
+
+// A cinderVolume is the part of a Cinder volume openstack grow uses.
+type cinderVolume struct {
+	ID     string `json:"id"`
+	Size   int64  `json:"size"`   // GiB
+	Status string `json:"status"` // in-use, extending, error_extending, ...
+}
+
+// growCinder extends the Cinder volume behind disk per size, waits for
+// Cinder to finish, and then for the kernel to see it, rescanning SCSI
+// disks such as iSCSI ones.
+func growCinder(disk, size string) error {
+	serial, err := cinderSerial(disk)
+	if err != nil {
+		return err
+	}
+	server, err := openstackInstanceID()
+	if err != nil {
+		return err
+	}
+	s, err := openstackAuth()
+	if err != nil {
+		return err
+	}
+	nova, err := s.endpoint("compute")
+	if err != nil {
+		return err
+	}
+	cinder, err := s.endpoint("block-storage", "volumev3")
+	if err != nil {
+		return err
+	}
+	var atts struct {
+		Attachments []openstackAttachment `json:"volumeAttachments"`
+	}
+	if err := s.do("GET", nova+"/servers/"+server+"/os-volume_attachments", nil, nil, &atts); err != nil {
+		return err
+	}
+	id, err := cinderVolumeFor(atts.Attachments, serial)
+	if err != nil {
+		return err
+	}
+	var v struct {
+		Volume cinderVolume `json:"volume"`
+	}
+	if err := s.do("GET", cinder+"/volumes/"+id, nil, nil, &v); err != nil {
+		return err
+	}
+	cur := v.Volume.Size
+	gib, err := ebsTargetGiB(cur, size)
+	if err != nil {
+		return err
+	}
+	if *dry {
+		dryRunf("would've extended Cinder volume %s (%s) from %d GiB to %d GiB", id, disk, cur, gib)
+		return nil
+	}
+	infof("extending Cinder volume %s (%s) from %d GiB to %d GiB", id, disk, cur, gib)
+	// Extending an in-use volume needs microversion 3.42.
+	hdr := map[string]string{"OpenStack-API-Version": "volume 3.42"}
+	if err := s.do("POST", cinder+"/volumes/"+id+"/action", hdr, map[string]interface{}{"os-extend": map[string]int64{"new_size": gib}}, nil); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(*openstackWait)
+	for {
+		if err := s.do("GET", cinder+"/volumes/"+id, nil, nil, &v); err != nil {
+			return err
+		}
+		vlogf("%s: %s, %d GiB", id, v.Volume.Status, v.Volume.Size)
+		if v.Volume.Status == "error_extending" {
+			return fmt.Errorf("extending %s failed", id)
+		}
+		if v.Volume.Status != "extending" && v.Volume.Size >= gib {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("extending %s: still %s after %v", id, v.Volume.Status, *openstackWait)
+		}
+		time.Sleep(cinderPollInterval)
+	}
+	for {
+		if n, err := embiggen.BlockDevSize(disk); err == nil && n >= gib<<30 {
+			return nil
+		}
+		if strings.HasPrefix(filepath.Base(disk), "sd") {
+			if err := rescanDisk(disk); err != nil {
+				vlogf("%s: %v", disk, err)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s grew but the kernel still doesn't see it after %v", id, *openstackWait)
+		}
+		time.Sleep(cinderPollInterval)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCinderVolumeFor(t *testing.T) {
+	atts := []openstackAttachment{
+		{VolumeID: "4e2a1b38-94b1-4c0f-9d1a-0c3f6f1b8a11", Device: "/dev/vdb"},
+		{VolumeID: "9f0e7c2d-5a6b-4d3e-8f1a-2b3c4d5e6f70", Device: "/dev/vdc"},
+	}
+	tests := []struct {
+		serial, want string // want "" for an error
+	}{
+		{"9f0e7c2d-5a6b-4d3e-8", "9f0e7c2d-5a6b-4d3e-8f1a-2b3c4d5e6f70"}, // virtio-blk
+		{"4e2a1b38-94b1-4c0f-9d1a-0c3f6f1b8a11", "4e2a1b38-94b1-4c0f-9d1a-0c3f6f1b8a11"},
+		{"00000000-0000-0000-0", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := cinderVolumeFor(atts, tt.serial)
+		if (err != nil) != (tt.want == "") || got != tt.want {
+			t.Errorf("cinderVolumeFor(%q) = %q, %v; want %q", tt.serial, got, err, tt.want)
+		}
+	}
+}
+
+func TestOpenStackAuth(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/identity/v3/auth/tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Auth struct {
+				Identity struct {
+					Methods []string `json:"methods"`
+				} `json:"identity"`
+			} `json:"auth"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Auth.Identity.Methods) != 1 || req.Auth.Identity.Methods[0] != "application_credential" {
+			http.Error(w, "bad auth request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Subject-Token", "tok")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":{"catalog":[
+			{"type":"compute","endpoints":[{"interface":"internal","region":"one","url":"http://internal/compute"},{"interface":"public","region":"one","url":"%s/compute/"}]},
+			{"type":"volumev3","endpoints":[{"interface":"public","region":"two","url":"http://two/volume"},{"interface":"public","region":"one","url":"%s/volume"}]}
+		]}}`, srv.URL, srv.URL)
+	}))
+	defer srv.Close()
+	for k, v := range map[string]string{
+		"OS_AUTH_URL":                      srv.URL + "/identity/v3",
+		"OS_APPLICATION_CREDENTIAL_ID":     "id",
+		"OS_APPLICATION_CREDENTIAL_SECRET": "secret",
+		"OS_REGION_NAME":                   "one",
+		"OS_INTERFACE":                     "",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	s, err := openstackAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.token != "tok" {
+		t.Errorf("token = %q; want tok", s.token)
+	}
+	if got, err := s.endpoint("compute"); err != nil || got != srv.URL+"/compute" {
+		t.Errorf("compute endpoint = %q, %v", got, err)
+	}
+	if got, err := s.endpoint("block-storage", "volumev3"); err != nil || got != srv.URL+"/volume" {
+		t.Errorf("volume endpoint = %q, %v", got, err)
+	}
+}
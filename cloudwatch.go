@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var cloudwatchNamespace = flag.String("cloudwatch-namespace", "", "on AWS, in daemon mode, push each target's used, available and grown bytes to CloudWatch under this namespace (e.g. \"EmbiggenDisk\") using the instance role")
+
+// cloudwatchPeriod is how often to push to CloudWatch per target,
+// however often the daemon checks, to keep PutMetricData costs down.
+const cloudwatchPeriod = time.Minute
+
+// A cloudwatchTarget is what's waiting to be pushed for a target.
+type cloudwatchTarget struct {
+	lastPush time.Time
+	grown    int64 // since lastPush
+}
+
+var cloudwatchTargets = map[string]*cloudwatchTarget{}
+
+// cloudwatchCheck records the outcome of growing mnt and, at most once
+// per cloudwatchPeriod, pushes its sizes to CloudWatch.
+func cloudwatchCheck(mnt string, changes []embiggen.Change) {
+	ns := flagOr("cloudwatch-namespace", *cloudwatchNamespace, cfg.CloudWatch.Namespace)
+	if ns == "" {
+		return
+	}
+	cs := cloudwatchTargets[mnt]
+	if cs == nil {
+		cs = &cloudwatchTarget{}
+		cloudwatchTargets[mnt] = cs
+	}
+	for _, c := range changes {
+		if c.Layer == "filesystem" {
+			cs.grown += c.AfterBytes - c.BeforeBytes
+		}
+	}
+	if time.Since(cs.lastPush) < cloudwatchPeriod {
+		return
+	}
+	if err := cloudwatchPush(ns, mnt, cs.grown); err != nil {
+		warnf("pushing %s metrics to CloudWatch: %v", mnt, err)
+		return
+	}
+	cs.lastPush, cs.grown = time.Now(), 0
+}
+
+var cloudwatchInstanceID string
+
+// cloudwatchPush sends mnt's used, available and grown bytes to
+// CloudWatch, with Mount and InstanceId dimensions.
+func cloudwatchPush(ns, mnt string, grown int64) error {
+	st, err := embiggen.StatFS(mnt)
+	if err != nil {
+		return err
+	}
+	bs := int64(st.Statfs.Bsize)
+	used := int64(st.Statfs.Blocks-st.Statfs.Bfree) * bs
+	avail := int64(st.Statfs.Bavail) * bs
+	region, err := awsRegion()
+	if err != nil {
+		return err
+	}
+	if cloudwatchInstanceID == "" {
+		if cloudwatchInstanceID, err = imdsGet("/latest/meta-data/instance-id"); err != nil {
+			return err
+		}
+	}
+	params := url.Values{"Namespace": {ns}}
+	for i, m := range []struct {
+		name string
+		val  int64
+	}{
+		{"UsedBytes", used},
+		{"AvailableBytes", avail},
+		{"GrownBytes", grown},
+	} {
+		p := fmt.Sprintf("MetricData.member.%d.", i+1)
+		params.Set(p+"MetricName", m.name)
+		params.Set(p+"Value", strconv.FormatInt(m.val, 10))
+		params.Set(p+"Unit", "Bytes")
+		params.Set(p+"Dimensions.member.1.Name", "Mount")
+		params.Set(p+"Dimensions.member.1.Value", mnt)
+		params.Set(p+"Dimensions.member.2.Name", "InstanceId")
+		params.Set(p+"Dimensions.member.2.Value", cloudwatchInstanceID)
+	}
+	_, err = awsQuery("monitoring", region, "2010-08-01", "PutMetricData", params)
+	return err
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Whether to colorize stdout and stderr. Set by setupColor.
+var colorStdout, colorStderr bool
+
+// setupColor turns on color for whichever of stdout and stderr are
+// terminals, unless -no-color or $NO_COLOR say not to.
+func setupColor() {
+	if *noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return
+	}
+	colorStdout = isTerminal(os.Stdout)
+	colorStderr = isTerminal(os.Stderr)
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), ioctlGetTermios)
+	return err == nil
+}
+
+const (
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiReset  = "\x1b[0m"
+)
+
+// colorize wraps s in the ANSI color code if on is true.
+func colorize(on bool, code, s string) string {
+	if !on {
+		return s
+	}
+	return code + s + ansiReset
+}
@@ -0,0 +1,436 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigPath = "/etc/embiggen-disk/config.yaml"
+
+var configPath = flag.String("config", defaultConfigPath, "YAML config file defining targets and their size policies; a missing default file is ignored")
+
+// cfg is the loaded config file, or an empty config if there's none.
+var cfg = &config{}
+
+// A config is the contents of the config file, like:
+//
+//	interval: 30s
+//	jitter: 10s
+//	max-interval: 10m
+//	cooldown: 5m
+//	max-failures: 3
+//	use: 90%
+//	targets:
+//	  - mount: /
+//	  - mount: /var/lib/docker
+//	    max-size: 500G
+//	    min-growth: 1G
+//	    interval: 10s
+//	    hooks:
+//	      post-resize: systemctl restart docker
+//	add-disks-to: [datavg]
+//	hooks:
+//	  pre-resize: /usr/local/bin/not-during-backups
+//	  post-resize: systemctl restart kubelet
+//	notify:
+//	  webhook:
+//	    url: https://hooks.example.com/embiggen
+//	    secret-file: /etc/embiggen-disk/webhook.key
+//	  slack:
+//	    url: https://hooks.slack.com/services/...
+//	    on: failed
+//
+// The size policy settings mirror the flags of the same name. Those at
+// the top level apply to every target, and a target's own settings
+// override them. Flags given on the command line override both.
+type config struct {
+	Interval     string `yaml:"interval"`
+	Jitter       string `yaml:"jitter"`
+	MaxInterval  string `yaml:"max-interval"`
+	Cooldown     string `yaml:"cooldown"`
+	MaxFailures  *int   `yaml:"max-failures"`
+	HTTPAddr     string `yaml:"http-addr"` // only read at startup
+	Metrics      string `yaml:"metrics"`   // like "statsd://localhost:8125"
+	AuditLog     string `yaml:"audit-log"`
+	policyConfig `yaml:",inline"`
+	Targets      []targetConfig `yaml:"targets"`
+	Hooks        hooksConfig    `yaml:"hooks"`
+	Notify       notifyConfig   `yaml:"notify"`
+	CloudWatch   struct {
+		Namespace string `yaml:"namespace"`
+	} `yaml:"cloudwatch"`
+	Kubelet struct {
+		Mode string `yaml:"mode"` // like -kubelet-mode
+		Wait string `yaml:"wait"`
+	} `yaml:"kubelet"`
+	Tracing struct {
+		Endpoint string            `yaml:"endpoint"` // OTLP/HTTP, like -otlp-endpoint
+		Headers  map[string]string `yaml:"headers"`
+	} `yaml:"tracing"`
+	Tools struct {
+		Paths map[string]string `yaml:"paths"` // like -tool-path
+		Dirs  []string          `yaml:"dirs"`  // like -tool-dirs
+	} `yaml:"tools"`
+	AddDisksTo []string `yaml:"add-disks-to"` // like -add-disks-to
+
+	PartitionRateLimit string   `yaml:"partition-rate-limit"` // like "1/30m"
+	MaintenanceWindows []string `yaml:"maintenance-windows"`  // like "Sat,Sun 02:00-04:00"
+}
+
+// A notifyConfig is where to send events when targets are resized.
+type notifyConfig struct {
+	Webhook struct {
+		URL        string            `yaml:"url"`
+		Headers    map[string]string `yaml:"headers"`
+		SecretFile string            `yaml:"secret-file"`
+	} `yaml:"webhook"`
+	Slack struct {
+		URL string `yaml:"url"`
+		On  string `yaml:"on"` // "all" or "failed"
+	} `yaml:"slack"`
+	SNS struct {
+		TopicARN string `yaml:"topic-arn"`
+	} `yaml:"sns"`
+	EventBridge struct {
+		Bus string `yaml:"bus"`
+	} `yaml:"eventbridge"`
+	Kubernetes struct {
+		Events     *bool  `yaml:"events"`
+		Annotate   *bool  `yaml:"annotate"`
+		Kubeconfig string `yaml:"kubeconfig"`
+		Node       string `yaml:"node"`
+	} `yaml:"kubernetes"`
+}
+
+// A hooksConfig is the shell commands to run at points in a resize.
+// Each setting mirrors the flag of the same name, plus "-hook".
+type hooksConfig struct {
+	PreResize      string `yaml:"pre-resize"`
+	AfterPartition string `yaml:"after-partition"`
+	AfterLVM       string `yaml:"after-lvm"`
+	AfterFS        string `yaml:"after-fs"`
+	PostResize     string `yaml:"post-resize"`
+	Quiesce        string `yaml:"quiesce"`
+
+	Timeout string `yaml:"timeout"` // like -hook-timeout
+}
+
+// A targetConfig is a mount point to grow and its size policy, and
+// settings of its own that take the place of the top-level ones.
+type targetConfig struct {
+	Mount        string `yaml:"mount"`
+	policyConfig `yaml:",inline"`
+
+	Interval string       `yaml:"interval"`
+	Hooks    hooksConfig  `yaml:"hooks"`  // each hook set here replaces the top-level one
+	Notify   notifyConfig `yaml:"notify"` // each destination set here replaces the top-level one
+}
+
+// A policyConfig is a size policy in the config file. Each setting
+// uses the same syntax as its flag.
+type policyConfig struct {
+	Size      string `yaml:"size"`
+	Use       string `yaml:"use"`
+	Reserve   string `yaml:"reserve"`
+	VGReserve string `yaml:"vg-reserve"`
+	MinGrowth string `yaml:"min-growth"`
+	MaxSize   string `yaml:"max-size"`
+	LVFree    string `yaml:"lv-free"`
+
+	AutoGrowAt  string `yaml:"auto-grow-at"`
+	AutoGrowBy  string `yaml:"auto-grow-by"`
+	AutoGrowMax string `yaml:"auto-grow-max"`
+}
+
+// A policy is a parsed size policy: the values of the size flags for
+// one target.
+type policy struct {
+	size      sizeFlag
+	use       percentFlag
+	reserve   bytesFlag
+	vgReserve amountFlag
+	minGrowth bytesFlag
+	maxSize   bytesFlag
+	lvFree    percentFlag
+
+	autoGrowAt  percentFlag
+	autoGrowBy  growthFlag
+	autoGrowMax bytesFlag
+}
+
+// apply sets the fields of p given in pc.
+func (p *policy) apply(pc policyConfig) error {
+	for _, s := range []struct {
+		name, val string
+		v         flag.Value
+	}{
+		{"size", pc.Size, &p.size},
+		{"use", pc.Use, &p.use},
+		{"reserve", pc.Reserve, &p.reserve},
+		{"vg-reserve", pc.VGReserve, &p.vgReserve},
+		{"min-growth", pc.MinGrowth, &p.minGrowth},
+		{"max-size", pc.MaxSize, &p.maxSize},
+		{"lv-free", pc.LVFree, &p.lvFree},
+		{"auto-grow-at", pc.AutoGrowAt, &p.autoGrowAt},
+		{"auto-grow-by", pc.AutoGrowBy, &p.autoGrowBy},
+		{"auto-grow-max", pc.AutoGrowMax, &p.autoGrowMax},
+	} {
+		if s.val == "" {
+			continue
+		}
+		if err := s.v.Set(s.val); err != nil {
+			return fmt.Errorf("bad %s %q: %v", s.name, s.val, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads and checks the config file at path. A missing file
+// is only an error if it was asked for with -config.
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && path == defaultConfigPath {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if c.Interval != "" {
+		d, err := time.ParseDuration(c.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: bad interval %q", path, c.Interval)
+		}
+	}
+	for _, d := range []struct{ name, val string }{
+		{"jitter", c.Jitter},
+		{"max-interval", c.MaxInterval},
+		{"cooldown", c.Cooldown},
+		{"hooks: timeout", c.Hooks.Timeout},
+	} {
+		if d.val == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.val); err != nil || v < 0 {
+			return nil, fmt.Errorf("%s: bad %s %q", path, d.name, d.val)
+		}
+	}
+	if c.MaxFailures != nil && *c.MaxFailures < 0 {
+		return nil, fmt.Errorf("%s: bad max-failures %d", path, *c.MaxFailures)
+	}
+	if _, err := c.policy(""); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, t := range c.Targets {
+		if t.Mount == "" {
+			return nil, fmt.Errorf("%s: target with no mount", path)
+		}
+		if _, err := c.policy(t.Mount); err != nil {
+			return nil, fmt.Errorf("%s: target %s: %v", path, t.Mount, err)
+		}
+		if t.Interval != "" {
+			if d, err := time.ParseDuration(t.Interval); err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s: target %s: bad interval %q", path, t.Mount, t.Interval)
+			}
+		}
+		if t.Hooks.Timeout != "" {
+			if d, err := time.ParseDuration(t.Hooks.Timeout); err != nil || d < 0 {
+				return nil, fmt.Errorf("%s: target %s: bad hooks: timeout %q", path, t.Mount, t.Hooks.Timeout)
+			}
+		}
+	}
+	return c, nil
+}
+
+// setupConfig loads the -config file and applies its global settings.
+func setupConfig() error {
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	cfg = c
+	polling = pollSettings{
+		interval:    *interval,
+		jitter:      *jitter,
+		maxInterval: *maxInterval,
+		cooldown:    *cooldown,
+		maxFailures: *maxFailures,
+	}
+	for _, d := range []struct {
+		flag, val string
+		v         *time.Duration
+	}{
+		{"interval", c.Interval, &polling.interval},
+		{"jitter", c.Jitter, &polling.jitter},
+		{"max-interval", c.MaxInterval, &polling.maxInterval},
+		{"cooldown", c.Cooldown, &polling.cooldown},
+	} {
+		if d.val != "" && !flagGiven(d.flag) {
+			*d.v, _ = time.ParseDuration(d.val)
+		}
+	}
+	if c.MaxFailures != nil && !flagGiven("max-failures") {
+		polling.maxFailures = *c.MaxFailures
+	}
+	if err := setupTools(c); err != nil {
+		return err
+	}
+	setupAddDisks(c)
+	if err := setupRateLimit(c); err != nil {
+		return err
+	}
+	if err := setupStatsd(); err != nil {
+		return err
+	}
+	return setupNotifiers()
+}
+
+// reloadConfig re-reads the -config file, as on SIGHUP, and returns
+// the new targets and their limits. If the new config is bad, the old
+// one stays in effect.
+func reloadConfig() ([]string, map[string]embiggen.Limit, error) {
+	oldCfg, oldPolling, oldNotifiers, oldStatsd := cfg, polling, notifiers, statsd
+	oldTargetNotifiers, oldRewriteLimit, oldWindows := targetNotifiers, rewriteLimit, windows
+	oldToolPaths, oldToolDirs, oldAddDisksTo := engineOpts.ToolPaths, engineOpts.ToolDirs, engineOpts.AddDisksTo
+	err := setupConfig()
+	var mnts []string
+	var lims map[string]embiggen.Limit
+	if err == nil {
+		mnts, lims, err = targets()
+	}
+	if err != nil {
+		cfg, polling, notifiers, statsd = oldCfg, oldPolling, oldNotifiers, oldStatsd
+		targetNotifiers, rewriteLimit, windows = oldTargetNotifiers, oldRewriteLimit, oldWindows
+		engineOpts.ToolPaths, engineOpts.ToolDirs, engineOpts.AddDisksTo = oldToolPaths, oldToolDirs, oldAddDisksTo
+		return nil, nil, err
+	}
+	if oldStatsd != nil {
+		oldStatsd.conn.Close()
+	}
+	return mnts, lims, nil
+}
+
+// mounts returns the mount points of the config's targets.
+func (c *config) mounts() []string {
+	var mnts []string
+	for _, t := range c.Targets {
+		mnts = append(mnts, t.Mount)
+	}
+	return mnts
+}
+
+// policy returns the size policy for mnt from the config file alone.
+// mnt may be a target's device, or the mount point it resolves to.
+func (c *config) policy(mnt string) (policy, error) {
+	var p policy
+	if err := p.apply(c.policyConfig); err != nil {
+		return p, err
+	}
+	for _, t := range c.Targets {
+		if mnt != "" && (filepath.Clean(t.Mount) == filepath.Clean(mnt) || mountsDevice(mnt, t.Mount)) {
+			if err := p.apply(t.policyConfig); err != nil {
+				return p, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// target returns the config of the target mnt, which may be its device
+// or the mount point that resolves to, or nil if there's none.
+func (c *config) target(mnt string) *targetConfig {
+	for i, t := range c.Targets {
+		if filepath.Clean(t.Mount) == filepath.Clean(mnt) || mountsDevice(mnt, t.Mount) {
+			return &c.Targets[i]
+		}
+	}
+	return nil
+}
+
+// policyFor returns the size policy for mnt: the config file's,
+// overridden by any size flags given on the command line.
+func policyFor(mnt string) (policy, error) {
+	p, err := cfg.policy(mnt)
+	if err != nil {
+		return p, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "size":
+			p.size = targetSize
+		case "use":
+			p.use = usePercent
+		case "reserve":
+			p.reserve = reserveSize
+		case "vg-reserve":
+			p.vgReserve = vgReserve
+		case "min-growth":
+			p.minGrowth = minGrowth
+		case "lv-free":
+			p.lvFree = lvFree
+		case "auto-grow-at":
+			p.autoGrowAt = autoGrowAt
+		case "auto-grow-by":
+			p.autoGrowBy = autoGrowBy
+		case "auto-grow-max":
+			p.autoGrowMax = autoGrowMax
+		}
+	})
+	if max, ok := maxSizes[filepath.Clean(mnt)]; ok {
+		p.maxSize = bytesFlag(max)
+	}
+	return p, nil
+}
+
+// flagGiven reports whether the named flag was given on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// flagOr returns the named flag's value if it was given on the command
+// line, else the config file's setting for it.
+func flagOr(flagName, flagVal, configVal string) string {
+	if flagGiven(flagName) {
+		return flagVal
+	}
+	return configVal
+}
+
+var errNoTargets = errors.New("no mount point given and no targets in the config file")
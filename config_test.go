@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embiggen-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		yaml    string
+		mnt     string
+		want    policy
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			yaml: "",
+			mnt:  "/",
+		},
+		{
+			name: "target overrides top level",
+			yaml: "use: 80%\nmin-growth: 1G\ntargets:\n  - mount: /data\n    min-growth: 2G\n    max-size: 100G\n",
+			mnt:  "/data/",
+			want: policy{use: 80, minGrowth: 2 << 30, maxSize: 100 << 30},
+		},
+		{
+			name: "other target",
+			yaml: "use: 80%\ntargets:\n  - mount: /data\n    use: 50%\n",
+			mnt:  "/",
+			want: policy{use: 80},
+		},
+		{
+			name:    "bad size",
+			yaml:    "targets:\n  - mount: /\n    size: lots\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			yaml:    "intervall: 10s\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad interval",
+			yaml:    "interval: soon\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad target interval",
+			yaml:    "targets:\n  - mount: /data\n    interval: 0s\n",
+			wantErr: true,
+		},
+		{
+			name:    "target without mount",
+			yaml:    "targets:\n  - use: 50%\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "config.yaml")
+		if err := ioutil.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadConfig(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadConfig error = %v; want error: %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got, err := c.policy(tt.mnt)
+		if err != nil {
+			t.Errorf("%s: policy(%q): %v", tt.name, tt.mnt, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: policy(%q) = %+v; want %+v", tt.name, tt.mnt, got, tt.want)
+		}
+	}
+
+	if _, err := loadConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("loadConfig of a missing -config file succeeded; want error")
+	}
+}
+
+func TestHooksFor(t *testing.T) {
+	defer func(c *config) { cfg = c }(cfg)
+	cfg = &config{
+		Hooks: hooksConfig{PreResize: "sync", PostResize: "echo grown"},
+		Targets: []targetConfig{
+			{Mount: "/data", Hooks: hooksConfig{PostResize: "systemctl reload db"}},
+		},
+	}
+	tests := []struct {
+		mnt  string
+		want hooksConfig
+	}{
+		{"/", hooksConfig{PreResize: "sync", PostResize: "echo grown"}},
+		{"/data/", hooksConfig{PreResize: "sync", PostResize: "systemctl reload db"}},
+	}
+	for _, tt := range tests {
+		if got := hooksFor(tt.mnt); got != tt.want {
+			t.Errorf("hooksFor(%q) = %+v; want %+v", tt.mnt, got, tt.want)
+		}
+	}
+}
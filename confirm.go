@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// errNotConfirmed is returned by a Resizer when the operator answers
+// no to a -confirm prompt.
+var errNotConfirmed = errors.New("not confirmed by operator")
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// confirmStep asks the operator whether to go ahead with step, if
+// -confirm was given. It returns errNotConfirmed unless they say yes.
+func confirmStep(format string, args ...interface{}) error {
+	if !*confirm || *dry {
+		return nil
+	}
+	fmt.Printf("About to %s. Continue? [y/N] ", fmt.Sprintf(format, args...))
+	line, _ := stdinReader.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return nil
+	}
+	return errNotConfirmed
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var controlSocket = flag.String("control-socket", "/run/embiggen-disk.sock", "in daemon mode, serve the control API used by the ctl subcommand on this unix socket; empty to disable")
+
+// A controlRequest is a control API call for the daemon's loop to
+// carry out: "trigger", "pause", "resume" or "reload", optionally for
+// one target, or "resize" for the gRPC API.
+type controlRequest struct {
+	op, mnt string
+	dryRun  bool    // for resize, on top of -dry-run
+	report  *report // for resize, filled in with the result
+	reply   chan error
+}
+
+// controls carries control API calls to the daemon's loop.
+var controls = make(chan controlRequest)
+
+// errUnknownTarget is returned by the control API for a mount point
+// the daemon isn't watching.
+var errUnknownTarget = errors.New("not a target of the daemon")
+
+// listenControl returns the listener for the control API: sockets
+// passed by systemd, or else the -control-socket.
+func listenControl() []net.Listener {
+	if lns := sdListeners(); len(lns) > 0 {
+		return lns
+	}
+	if *controlSocket == "" {
+		return nil
+	}
+	os.Remove(*controlSocket) // left over from a previous run
+	ln, err := net.Listen("unix", *controlSocket)
+	if err != nil {
+		warnf("not serving the control API: %v", err)
+		return nil
+	}
+	os.Chmod(*controlSocket, 0660)
+	return []net.Listener{ln}
+}
+
+// handleControl adds the control API to mux. Each call waits for the
+// daemon's loop to carry it out, which may mean waiting for a check in
+// progress to finish.
+func handleControl(mux *http.ServeMux) {
+	for _, op := range []string{"trigger", "pause", "resume", "reload"} {
+		op := op
+		mux.HandleFunc("/"+op, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			req := controlRequest{op: op, mnt: r.FormValue("mount"), reply: make(chan error, 1)}
+			if (op == "pause" || op == "resume") && req.mnt == "" {
+				http.Error(w, "missing mount", http.StatusBadRequest)
+				return
+			}
+			select {
+			case controls <- req:
+			case <-shutdown:
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			case <-r.Context().Done():
+				return
+			}
+			if err := <-req.reply; err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, errUnknownTarget) {
+					code = http.StatusNotFound
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+	}
+}
+
+// controlResize has the daemon's loop grow target mnt now, or with
+// dryRun only show what it would do, for the gRPC and D-Bus APIs. It
+// returns nil if it didn't get as far as trying.
+func controlResize(mnt string, dryRun bool) (*report, error) {
+	req := controlRequest{op: "resize", mnt: mnt, dryRun: dryRun, report: &report{}, reply: make(chan error, 1)}
+	select {
+	case controls <- req:
+	case <-shutdown:
+		return nil, errShuttingDown
+	}
+	err := <-req.reply
+	if req.report.Mount == "" {
+		return nil, err
+	}
+	return req.report, err
+}
+
+// ctlMain implements the "ctl <command> [mount-point]" subcommand, a
+// client for the control API.
+func ctlMain(args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		usage()
+	}
+	cmd, mnt := args[0], ""
+	if len(args) == 2 {
+		mnt = args[1]
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *controlSocket)
+		},
+	}}
+	var res *http.Response
+	var err error
+	switch cmd {
+	case "status":
+		if mnt != "" {
+			usage()
+		}
+		res, err = client.Get("http://embiggen-disk/status")
+	case "trigger", "reload", "pause", "resume":
+		if (cmd == "reload" && mnt != "") || ((cmd == "pause" || cmd == "resume") && mnt == "") {
+			usage()
+		}
+		res, err = client.PostForm("http://embiggen-disk/"+cmd, url.Values{"mount": {mnt}})
+	default:
+		usage()
+	}
+	if err != nil {
+		fatalf("error talking to the daemon on %s: %v", *controlSocket, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		fatalf("%s: %s", cmd, strings.TrimSpace(string(body)))
+	}
+	os.Stdout.Write(body)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHandleControl(t *testing.T) {
+	mux := http.NewServeMux()
+	handleControl(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var got []string
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case req := <-controls:
+				got = append(got, req.op+" "+req.mnt)
+				if req.mnt == "/nope" {
+					req.reply <- fmt.Errorf("%s: %w", req.mnt, errUnknownTarget)
+					continue
+				}
+				req.reply <- nil
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	tests := []struct {
+		op, mnt string
+		want    int
+	}{
+		{"trigger", "", http.StatusOK},
+		{"pause", "/var", http.StatusOK},
+		{"resume", "", http.StatusBadRequest},
+		{"trigger", "/nope", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		res, err := http.PostForm(srv.URL+"/"+tt.op, url.Values{"mount": {tt.mnt}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("%s %q: status %d; want %d", tt.op, tt.mnt, res.StatusCode, tt.want)
+		}
+	}
+	res, err := http.Get(srv.URL + "/trigger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /trigger: status %d; want 405", res.StatusCode)
+	}
+	if want := []string{"trigger ", "pause /var", "trigger /nope"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("loop got %q; want %q", got, want)
+	}
+}
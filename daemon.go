@@ -0,0 +1,530 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var (
+	interval    = flag.Duration("interval", 10*time.Second, "how often to check for growth")
+	jitter      = flag.Duration("jitter", 0, "wait up to this much longer than -interval between checks, picked at random each time, so a fleet's checks don't line up")
+	maxInterval = flag.Duration("max-interval", 0, "in daemon mode, double the wait between checks while nothing changes, up to this much; 0 disables backoff")
+	cooldown    = flag.Duration("cooldown", 0, "in daemon mode, after resizing a target, leave it alone for this long (e.g. \"5m\")")
+	maxFailures = flag.Int("max-failures", 5, "in daemon mode, stop trying to resize a target after this many failures in a row, until its devices change, SIGUSR1 or the control API's trigger (restarting doesn't reset it); 0 means never stop")
+	diffSizes   = flag.Bool("diff-sizes", true, "in daemon mode, skip a target's full check while the sizes of its filesystem and devices haven't changed since a check found nothing to do, rechecking fully every hour")
+	uevents     = flag.Bool("uevents", true, "in daemon mode, check right away when the kernel reports a block device resize, and poll only every 5m unless -interval is given")
+)
+
+// pollSettings are the daemon's timing settings.
+type pollSettings struct {
+	interval, jitter, maxInterval, cooldown time.Duration
+	maxFailures                             int
+}
+
+// polling is -interval, -jitter, -max-interval, -cooldown and
+// -max-failures, or the config file's settings for those the flags
+// didn't give. Set by setupConfig.
+var polling pollSettings
+
+// shutdown is closed when the daemon is asked to stop.
+var shutdown = make(chan struct{})
+
+// runCtx is the context resizes run with, carrying engineOpts. A
+// second SIGTERM or SIGINT cancels it, killing the step in progress.
+var runCtx, cancelRun = context.WithCancel(embiggen.WithOptions(context.Background(), engineOpts))
+
+// errShuttingDown is returned by Resize when it stops early because
+// the daemon is shutting down.
+var errShuttingDown = errors.New("shutting down")
+
+func shuttingDown() bool {
+	select {
+	case <-shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchingUevents is whether the daemon is getting resize uevents.
+var watchingUevents bool
+
+// baseInterval returns the interval between checks of targets without
+// an interval of their own.
+func baseInterval() time.Duration {
+	if watchingUevents && !flagGiven("interval") && cfg.Interval == "" {
+		return ueventScanInterval
+	}
+	return polling.interval
+}
+
+// scanInterval returns the interval between checks: the base one, or
+// the shortest of the config file targets' own, if that's shorter.
+func scanInterval() time.Duration {
+	iv := baseInterval()
+	for _, t := range cfg.Targets {
+		if d, err := time.ParseDuration(t.Interval); err == nil && d > 0 && d < iv {
+			iv = d
+		}
+	}
+	return iv
+}
+
+// targetInterval returns the interval between checks of target.
+func targetInterval(target string) time.Duration {
+	if t := cfg.target(target); t != nil && t.Interval != "" {
+		if d, err := time.ParseDuration(t.Interval); err == nil && d > 0 {
+			return d
+		}
+	}
+	return baseInterval()
+}
+
+// nextPoll returns how long to wait before the next check, given the
+// current (possibly backed off) interval, jittered using rng.
+func nextPoll(rng *rand.Rand, wait time.Duration) time.Duration {
+	if polling.jitter <= 0 {
+		return wait
+	}
+	return wait + time.Duration(rng.Int63n(int64(polling.jitter)))
+}
+
+// backoff returns the interval to use after a check that changed
+// nothing, given the current one.
+func backoff(wait time.Duration) time.Duration {
+	base := scanInterval()
+	if !*daemon || polling.maxInterval <= base {
+		return base
+	}
+	if wait *= 2; wait > polling.maxInterval {
+		wait = polling.maxInterval
+	}
+	return wait
+}
+
+// checkTarget returns an error if the layers under mnt aren't ones
+// embiggen-disk can resize, which no amount of retrying will fix. Other
+// errors, such as mnt not being mounted yet, are only logged, and
+// filesystems that can never grow, like tmpfs, are skipped quietly.
+func checkTarget(target string, lim embiggen.Limit) error {
+	mnt, err := targetMount(target)
+	if err != nil {
+		warnf("%s: %v; will keep trying", target, err)
+		return nil
+	}
+	if what := embiggen.NonGrowable(mnt); what != "" {
+		vlogf("%s is %s, which can't be grown; skipping it", mnt, what)
+		return nil
+	}
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err == nil {
+		_, err = embiggen.Chain(runCtx, e)
+	}
+	var ue embiggen.UnsupportedError
+	if errors.As(err, &ue) {
+		return err
+	}
+	if err != nil {
+		warnf("%s: %v; will keep trying", mnt, err)
+	}
+	return nil
+}
+
+// poll implements -daemon. It grows each of mnts now and then every
+// poll interval, forever, backing off while nothing changes. It also
+// checks as soon as the kernel reports a resize or it gets SIGUSR1,
+// and SIGHUP reloads the config file. A target that fails to resize
+// -max-failures times in a row is left alone until SIGUSR1 or its
+// devices change, and one that fails is retried less and less often.
+// Failures are remembered across restarts in the -state-dir. SIGTERM
+// and SIGINT make it exit once the step in progress, if any, is done.
+func poll(mnts []string, lims map[string]embiggen.Limit) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, mnt := range mnts {
+		if err := checkTarget(mnt, lims[mnt]); err != nil {
+			exitf(exitCode(nil, err), "can't enlarge %s: %v", mnt, err)
+		}
+	}
+	hup := make(chan os.Signal, 1)
+	usr1 := make(chan os.Signal, 1)
+	term := make(chan os.Signal, 1)
+	var resized <-chan string
+	if *daemon {
+		signal.Notify(hup, syscall.SIGHUP)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			sig := <-term
+			infof("%v: exiting once the step in progress is done", sig)
+			close(shutdown)
+			sig = <-term
+			warnf("%v again: stopping the step in progress", sig)
+			cancelRun()
+		}()
+		if *uevents {
+			var err error
+			if resized, err = watchResizes(); err != nil {
+				warnf("not watching uevents: %v; polling every %v", err, polling.interval)
+			}
+			watchingUevents = err == nil
+		}
+	}
+	var pvs *localPVWatcher
+	if *k8sLocalPVs {
+		var err error
+		if pvs, err = newLocalPVWatcher(); err != nil {
+			exitf(exitUsage, "%v", err)
+		}
+	}
+	// pvMnts are the filesystems of local PVs that aren't targets.
+	var pvMnts []string
+	allTargets := func() []string {
+		return append(append([]string(nil), mnts...), pvMnts...)
+	}
+	setStatsTargets(mnts, lims)
+	if addr := flagOr("http-addr", *httpAddr, cfg.HTTPAddr); addr != "" {
+		serveHTTP(addr)
+	}
+
+	wait := scanInterval()
+	timer := time.NewTimer(nextPoll(rng, wait))
+	// rearm restarts the timer after something other than it firing.
+	rearm := func() {
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(nextPoll(rng, wait))
+	}
+	start, checks, grown, failed := time.Now(), 0, 0, 0
+	states := loadStates()
+	for mnt, st := range states {
+		recordGiveUp(mnt, st.Failures, st.Tripped)
+		recordPause(mnt, st.Paused)
+	}
+	// unchanged holds the sizes of targets whose last check found
+	// nothing to do, for -diff-sizes.
+	unchanged := map[string]sizeSnapshot{}
+	// lastChecked is when each target was last checked, so that those
+	// with a longer interval than the daemon wakes up for are skipped
+	// until they're due.
+	lastChecked := map[string]time.Time{}
+	// limited holds the targets whose last check hit the
+	// -partition-rate-limit, to say so only once.
+	limited := map[string]bool{}
+	// check grows each target, or just only if it's set.
+	check := func(only string) {
+		recordLoop()
+		setBusy(true)
+		defer setBusy(false)
+		checks++
+		changed := false
+		if now := time.Now(); !inWindows(windows, now) {
+			vlogf("outside the maintenance windows; the next opens at %s", nextWindow(windows, now).Format("Mon 15:04"))
+			return
+		}
+		if pvs != nil {
+			pvMnts = pvs.targets(mnts, lims)
+			setStatsTargets(allTargets(), lims)
+		}
+		for _, target := range allTargets() {
+			if shuttingDown() {
+				return
+			}
+			if only != "" && target != only {
+				continue
+			}
+			iv := targetInterval(target)
+			if only == "" && time.Since(lastChecked[target]) < iv*9/10 {
+				continue
+			}
+			st := states[target]
+			if st == nil {
+				st = &targetState{}
+				states[target] = st
+			}
+			if st.Paused {
+				vlogf("%s: paused", target)
+				continue
+			}
+			mnt, err := targetMount(target)
+			if err != nil {
+				vlogf("%s: %v; will keep trying", target, err)
+				continue
+			}
+			lim := lims[target]
+			if st.Failures > 0 {
+				if gen, err := deviceGeneration(mnt, lim); err == nil && gen != st.Generation {
+					infof("%s: devices changed since it last failed; trying again", mnt)
+					st.Failures, st.Tripped = 0, false
+					recordGiveUp(target, 0, false)
+				}
+			}
+			if st.Tripped {
+				vlogf("%s: skipping after %d failures in a row", mnt, st.Failures)
+				continue
+			}
+			lastChecked[target] = time.Now()
+			if at := st.retryAt(iv); time.Now().Before(at) {
+				vlogf("%s: failed %d time(s) in a row; next try in %v", mnt, st.Failures, time.Until(at).Round(time.Second))
+				continue
+			}
+			if left := polling.cooldown - time.Since(st.LastResize); left > 0 {
+				vlogf("%s: resized recently; cooling down for %v more", mnt, left.Round(time.Second))
+				continue
+			}
+			if what := embiggen.NonGrowable(mnt); what != "" {
+				vlogf("%s is %s, which can't be grown; skipping it", mnt, what)
+				continue
+			}
+			if *vmwareRescan && onVMware() {
+				rescanVMwareDisk(mnt, lim)
+			}
+			if *ebsModifications && !ebsReady(mnt, lim) {
+				continue
+			}
+			if autoGrow(mnt, lim, st) {
+				saveStates(states)
+			}
+			var sizes string
+			if *diffSizes {
+				sizes, _ = sizeFingerprint(mnt)
+				if last, ok := unchanged[target]; ok && sizes != "" && sizes == last.sizes && time.Since(last.at) < fullCheckInterval {
+					vlogf("%s: sizes unchanged; skipping", mnt)
+					continue
+				}
+				delete(unchanged, target)
+			}
+			st.LastAttempt = time.Now()
+			changes, err := grow(mnt, lim)
+			// A rate limited partition is grown on a later check; it
+			// hasn't failed.
+			wasLimited := limited[target]
+			limited[target] = errors.Is(err, errRateLimited)
+			if limited[target] {
+				if wasLimited {
+					vlogf("%s: %v", mnt, err)
+				} else {
+					infof("%s: %v", mnt, err)
+				}
+				err = nil
+			}
+			recordCheck(target, changes, err)
+			statsdCheck(mnt, lim, changes, err)
+			cloudwatchCheck(mnt, changes)
+			dbusChanged(mnt, changes)
+			if n := len(changes); n > 0 {
+				st.LastResize = time.Now()
+				grown += n
+				changed = true
+			}
+			if err == nil && len(changes) == 0 && sizes != "" && !limited[target] {
+				unchanged[target] = sizeSnapshot{sizes, time.Now()}
+			}
+			if err == nil {
+				if st.Failures > 0 {
+					st.Failures, st.LastError, st.Generation = 0, "", ""
+					saveStates(states)
+				}
+				recordGiveUp(target, 0, false)
+				continue
+			}
+			// Whatever went wrong may well be transient, like an LVM
+			// lock held by someone else, so try again later.
+			failed++
+			st.Failures++
+			st.LastError = err.Error()
+			st.Generation, _ = deviceGeneration(mnt, lim)
+			logEvent(levelError, "resize failed", logFields{"mount": mnt, "action": "grow", "result": "failed", "failures": st.Failures, "error": err})
+			if polling.maxFailures > 0 && st.Failures >= polling.maxFailures {
+				st.Tripped = true
+				logEvent(levelError, fmt.Sprintf("giving up on %s after %d failures in a row, until its devices change; send SIGUSR1 to retry now", mnt, st.Failures),
+					logFields{"mount": mnt, "action": "grow", "failures": st.Failures, "error": err})
+			}
+			recordGiveUp(target, st.Failures, st.Tripped)
+			saveStates(states)
+		}
+		if changed {
+			wait = scanInterval()
+		} else if next := backoff(wait); next != wait {
+			vlogf("nothing changed; next check in %v", next)
+			wait = next
+		}
+	}
+	// reload re-reads the config file, as for SIGHUP.
+	reload := func() error {
+		sdNotify("RELOADING=1")
+		m, l, err := reloadConfig()
+		sdNotify("READY=1")
+		if err != nil {
+			return err
+		}
+		mnts, lims = m, l
+		unchanged = map[string]sizeSnapshot{}
+		lastChecked = map[string]time.Time{}
+		setStatsTargets(mnts, lims)
+		wait = scanInterval()
+		rearm()
+		infof("reloaded %s; %d target(s), polling every %v", *configPath, len(mnts), wait)
+		return nil
+	}
+	// control carries out a control API call.
+	control := func(req controlRequest) error {
+		if req.mnt != "" && !containsString(allTargets(), req.mnt) {
+			return fmt.Errorf("%s: %w", req.mnt, errUnknownTarget)
+		}
+		st := states[req.mnt]
+		if req.mnt != "" && st == nil {
+			st = &targetState{}
+			states[req.mnt] = st
+		}
+		switch req.op {
+		case "trigger":
+			if req.mnt == "" {
+				infof("control: checking now")
+			} else {
+				infof("control: checking %s now", req.mnt)
+			}
+			for mnt, st := range states {
+				if req.mnt == "" || mnt == req.mnt {
+					delete(unchanged, mnt)
+					delete(lastChecked, mnt)
+					st.Failures, st.Tripped = 0, false
+					recordGiveUp(mnt, 0, false)
+				}
+			}
+			saveStates(states)
+			wait = scanInterval()
+			check(req.mnt)
+			rearm()
+		case "pause", "resume":
+			st.Paused = req.op == "pause"
+			recordPause(req.mnt, st.Paused)
+			saveStates(states)
+			infof("control: %sd %s", req.op, req.mnt)
+		case "reload":
+			return reload()
+		case "resize":
+			if req.mnt == "" {
+				return fmt.Errorf("resize needs a mount point")
+			}
+			ctx := runCtx
+			if req.dryRun {
+				o := embiggen.OptionsFrom(runCtx)
+				o.DryRun = true
+				ctx = embiggen.WithOptions(runCtx, &o)
+			}
+			rep, err := growReport(ctx, req.mnt, lims[req.mnt])
+			if rep != nil {
+				*req.report = *rep
+			}
+			if !req.dryRun {
+				recordCheck(req.mnt, req.report.Changes, err)
+				dbusChanged(req.mnt, req.report.Changes)
+				if len(req.report.Changes) > 0 {
+					st.LastResize = time.Now()
+					saveStates(states)
+				}
+			}
+			return err
+		}
+		return nil
+	}
+	if *grpcAddr != "" {
+		if err := serveGRPC(); err != nil {
+			fatalf("gRPC: %v", err)
+		}
+		infof("serving the gRPC management API on %s", *grpcAddr)
+	}
+	if *dbusService {
+		if err := serveDBus(); err != nil {
+			fatalf("D-Bus: %v", err)
+		}
+		infof("serving %s on the D-Bus system bus", dbusName)
+	}
+	for _, ln := range listenControl() {
+		infof("serving the control API on %s", ln.Addr())
+		serveHTTPOn(ln, true)
+	}
+	// Ready as soon as it's watching; the first check may take a while.
+	startWatchdog()
+	sdNotify("READY=1")
+	check("")
+	for {
+		select {
+		case <-shutdown:
+			sdNotify("STOPPING=1")
+			infof("shutting down after %v: %d check(s), %d layer(s) resized, %d failure(s)", time.Since(start).Round(time.Second), checks, grown, failed)
+			os.Exit(0)
+		case <-timer.C:
+			check("")
+			timer.Reset(nextPoll(rng, wait))
+		case dev, ok := <-resized:
+			if !ok {
+				resized, watchingUevents = nil, false
+				continue
+			}
+			infof("kernel reports %s resized; checking now", dev)
+			// Let the rest of the burst arrive, then check once.
+			time.Sleep(ueventSettle)
+			for drained := false; !drained; {
+				select {
+				case _, ok := <-resized:
+					if !ok {
+						resized, watchingUevents = nil, false
+						drained = true
+					}
+				default:
+					drained = true
+				}
+			}
+			lastChecked = map[string]time.Time{}
+			wait = scanInterval()
+			check("")
+			rearm()
+		case <-usr1:
+			infof("SIGUSR1: checking now")
+			for mnt, st := range states {
+				st.Failures, st.Tripped = 0, false
+				recordGiveUp(mnt, 0, false)
+			}
+			unchanged = map[string]sizeSnapshot{}
+			lastChecked = map[string]time.Time{}
+			saveStates(states)
+			wait = scanInterval()
+			check("")
+			rearm()
+		case <-hup:
+			infof("SIGHUP: reloading")
+			if err := reload(); err != nil {
+				warnf("SIGHUP: keeping the old config: %v", err)
+			}
+		case req := <-controls:
+			req.reply <- control(req)
+		}
+	}
+}
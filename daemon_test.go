@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	defer func(d bool, i, m time.Duration) { *daemon, polling.interval, polling.maxInterval = d, i, m }(*daemon, polling.interval, polling.maxInterval)
+	*daemon = true
+	polling.interval = 10 * time.Second
+
+	tests := []struct {
+		max, wait, want time.Duration
+	}{
+		{0, 10 * time.Second, 10 * time.Second},
+		{time.Minute, 10 * time.Second, 20 * time.Second},
+		{time.Minute, 20 * time.Second, 40 * time.Second},
+		{time.Minute, 40 * time.Second, time.Minute},
+		{time.Minute, time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		polling.maxInterval = tt.max
+		if got := backoff(tt.wait); got != tt.want {
+			t.Errorf("backoff(%v) with max %v = %v; want %v", tt.wait, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestParseUevent(t *testing.T) {
+	msg := "change@/devices/pci0000:00/0000:00:04.0/virtio1/block/vda\x00ACTION=change\x00DEVPATH=/devices/pci0000:00/0000:00:04.0/virtio1/block/vda\x00SUBSYSTEM=block\x00RESIZE=1\x00DEVNAME=vda\x00DEVTYPE=disk\x00SEQNUM=2145\x00"
+	ev := parseUevent([]byte(msg))
+	want := map[string]string{
+		"ACTION":    "change",
+		"SUBSYSTEM": "block",
+		"RESIZE":    "1",
+		"DEVNAME":   "vda",
+		"DEVTYPE":   "disk",
+	}
+	for k, v := range want {
+		if ev[k] != v {
+			t.Errorf("parseUevent: %s = %q; want %q", k, ev[k], v)
+		}
+	}
+}
+
+func TestCapacityChanged(t *testing.T) {
+	ua := "change@/devices/pci0000:00/0000:00:15.0/0000:03:00.0/host2/target2:0:1/2:0:1:0\x00ACTION=change\x00DEVPATH=/devices/pci0000:00/0000:00:15.0/0000:03:00.0/host2/target2:0:1/2:0:1:0\x00SUBSYSTEM=scsi\x00SDEV_UA=CAPACITY_DATA_HAS_CHANGED\x00DEVTYPE=scsi_device\x00SEQNUM=4012\x00"
+	rescan, ok := capacityChanged(parseUevent([]byte(ua)))
+	if want := "/sys/devices/pci0000:00/0000:00:15.0/0000:03:00.0/host2/target2:0:1/2:0:1:0/rescan"; !ok || rescan != want {
+		t.Errorf("capacityChanged = %q, %v; want %q", rescan, ok, want)
+	}
+	resize := "change@/devices/virtual/block/vda\x00ACTION=change\x00SUBSYSTEM=block\x00RESIZE=1\x00DEVNAME=vda\x00"
+	if _, ok := capacityChanged(parseUevent([]byte(resize))); ok {
+		t.Errorf("capacityChanged of a block resize uevent = true")
+	}
+}
+
+func TestRetryAt(t *testing.T) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{20, maxRetryWait},
+	}
+	for _, tt := range tests {
+		st := &targetState{LastAttempt: t0, Failures: tt.failures}
+		if got := st.retryAt(10 * time.Second).Sub(t0); got != tt.want {
+			t.Errorf("after %d failures, retry in %v; want %v", tt.failures, got, tt.want)
+		}
+	}
+	if at := (&targetState{LastAttempt: t0}).retryAt(10 * time.Second); !at.IsZero() {
+		t.Errorf("retryAt with no failures = %v; want zero", at)
+	}
+}
+
+func TestFormatSizes(t *testing.T) {
+	a := formatSizes(map[string]int64{"/": 10 << 30, "/dev/sda1": 11 << 30, "/dev/sda": 20 << 30})
+	b := formatSizes(map[string]int64{"/dev/sda": 20 << 30, "/dev/sda1": 11 << 30, "/": 10 << 30})
+	if a != b {
+		t.Errorf("formatSizes depends on map order: %q != %q", a, b)
+	}
+	if c := formatSizes(map[string]int64{"/": 10 << 30, "/dev/sda1": 11 << 30, "/dev/sda": 30 << 30}); c == a {
+		t.Errorf("formatSizes didn't change when the disk grew: %q", c)
+	}
+}
@@ -0,0 +1,534 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var dbusService = flag.Bool("dbus", false, "in daemon mode, publish the "+dbusName+" service on the D-Bus system bus")
+
+// The D-Bus service. Like sd_notify and the journal, the wire protocol
+// is spoken directly; it only needs a little of it.
+const (
+	dbusName  = "com.github.embiggen_disk"
+	dbusPath  = "/com/github/embiggen_disk"
+	dbusIface = "com.github.embiggen_disk.Manager"
+)
+
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="com.github.embiggen_disk.Manager">
+    <method name="Resize">
+      <arg name="mount" type="s" direction="in"/>
+      <arg name="dry_run" type="b" direction="in"/>
+      <arg name="changes" type="a(sssxx)" direction="out"/>
+    </method>
+    <method name="GetStatus">
+      <arg name="status" type="s" direction="out"/>
+    </method>
+    <signal name="Changed">
+      <arg name="mount" type="s"/>
+      <arg name="changes" type="a(sssxx)"/>
+    </signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect">
+      <arg name="xml" type="s" direction="out"/>
+    </method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+  </interface>
+</node>
+`
+
+// D-Bus message types.
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusSignal       = 4
+
+	dbusNoReplyExpected = 0x1
+)
+
+// A dbusMsg is a D-Bus message, with the header fields it uses.
+type dbusMsg struct {
+	typ, flags  byte
+	serial      uint32
+	path, iface string
+	member      string
+	errName     string
+	dest        string
+	sender      string
+	replySerial uint32
+	sig         string // of body
+	body        []byte
+	order       binary.ByteOrder // of body
+}
+
+// A dbusEnc marshals D-Bus values, little-endian. Alignment is from
+// the start of b, which must be the start of a message or its body.
+type dbusEnc struct{ b []byte }
+
+func (e *dbusEnc) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *dbusEnc) byte(v byte) { e.b = append(e.b, v) }
+
+func (e *dbusEnc) uint32(v uint32) {
+	e.align(4)
+	e.b = append(e.b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(e.b[len(e.b)-4:], v)
+}
+
+func (e *dbusEnc) uint64(v uint64) {
+	e.align(8)
+	e.b = append(e.b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(e.b[len(e.b)-8:], v)
+}
+
+// str marshals a string or object path.
+func (e *dbusEnc) str(s string) {
+	e.uint32(uint32(len(s)))
+	e.b = append(append(e.b, s...), 0)
+}
+
+func (e *dbusEnc) sig(s string) {
+	e.byte(byte(len(s)))
+	e.b = append(append(e.b, s...), 0)
+}
+
+// arrayStart starts an array of elements aligned to elemAlign. Pass
+// what it returns to arrayEnd after marshaling the elements.
+func (e *dbusEnc) arrayStart(elemAlign int) [2]int {
+	e.uint32(0)
+	lenAt := len(e.b) - 4
+	e.align(elemAlign)
+	return [2]int{lenAt, len(e.b)}
+}
+
+func (e *dbusEnc) arrayEnd(a [2]int) {
+	binary.LittleEndian.PutUint32(e.b[a[0]:], uint32(len(e.b)-a[1]))
+}
+
+// A dbusDec unmarshals D-Bus values. The first error sticks.
+type dbusDec struct {
+	b     []byte
+	off   int
+	order binary.ByteOrder
+	err   error
+}
+
+var errDBusShort = errors.New("dbus: truncated message")
+
+func (d *dbusDec) align(n int) {
+	for d.off%n != 0 {
+		d.off++
+	}
+}
+
+func (d *dbusDec) next(n int) []byte {
+	if d.err != nil || n < 0 || d.off+n > len(d.b) {
+		if d.err == nil {
+			d.err = errDBusShort
+		}
+		return nil
+	}
+	d.off += n
+	return d.b[d.off-n : d.off]
+}
+
+func (d *dbusDec) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *dbusDec) uint32() uint32 {
+	d.align(4)
+	b := d.next(4)
+	if d.err != nil {
+		return 0
+	}
+	return d.order.Uint32(b)
+}
+
+func (d *dbusDec) uint64() uint64 {
+	d.align(8)
+	b := d.next(8)
+	if d.err != nil {
+		return 0
+	}
+	return d.order.Uint64(b)
+}
+
+func (d *dbusDec) str() string {
+	n := d.uint32()
+	b := d.next(int(n) + 1)
+	if d.err != nil {
+		return ""
+	}
+	return string(b[:n])
+}
+
+func (d *dbusDec) sig() string {
+	n := d.byte()
+	b := d.next(int(n) + 1)
+	if d.err != nil {
+		return ""
+	}
+	return string(b[:n])
+}
+
+// encode marshals m, giving it serial.
+func (m *dbusMsg) encode(serial uint32) []byte {
+	var e dbusEnc
+	e.byte('l')
+	e.byte(m.typ)
+	e.byte(m.flags)
+	e.byte(1) // protocol version
+	e.uint32(uint32(len(m.body)))
+	e.uint32(serial)
+	a := e.arrayStart(8)
+	field := func(code byte, sig string) {
+		e.align(8)
+		e.byte(code)
+		e.sig(sig)
+	}
+	for _, f := range []struct {
+		code byte
+		sig  string
+		v    string
+	}{
+		{1, "o", m.path}, {2, "s", m.iface}, {3, "s", m.member},
+		{4, "s", m.errName}, {6, "s", m.dest}, {8, "g", m.sig},
+	} {
+		if f.v == "" {
+			continue
+		}
+		field(f.code, f.sig)
+		if f.sig == "g" {
+			e.sig(f.v)
+		} else {
+			e.str(f.v)
+		}
+	}
+	if m.replySerial != 0 {
+		field(5, "u")
+		e.uint32(m.replySerial)
+	}
+	e.arrayEnd(a)
+	e.align(8)
+	return append(e.b, m.body...)
+}
+
+// readDBusMsg reads one message from r.
+func readDBusMsg(r io.Reader) (*dbusMsg, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if hdr[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodyLen, fieldsLen := order.Uint32(hdr[4:]), order.Uint32(hdr[12:])
+	if bodyLen > 1<<20 || fieldsLen > 1<<16 {
+		return nil, fmt.Errorf("dbus: message too big")
+	}
+	n := 16 + int(fieldsLen)
+	if n%8 != 0 {
+		n += 8 - n%8
+	}
+	b := make([]byte, n+int(bodyLen))
+	copy(b, hdr)
+	if _, err := io.ReadFull(r, b[16:]); err != nil {
+		return nil, err
+	}
+	m := &dbusMsg{typ: hdr[1], flags: hdr[2], serial: order.Uint32(hdr[8:]), body: b[n:], order: order}
+	d := &dbusDec{b: b[:16+fieldsLen], off: 16, order: order}
+	for d.off < len(d.b) && d.err == nil {
+		d.align(8)
+		code := d.byte()
+		switch sig := d.sig(); sig {
+		case "s", "o":
+			v := d.str()
+			switch code {
+			case 1:
+				m.path = v
+			case 2:
+				m.iface = v
+			case 3:
+				m.member = v
+			case 4:
+				m.errName = v
+			case 6:
+				m.dest = v
+			case 7:
+				m.sender = v
+			}
+		case "g":
+			v := d.sig()
+			if code == 8 {
+				m.sig = v
+			}
+		case "u":
+			v := d.uint32()
+			if code == 5 {
+				m.replySerial = v
+			}
+		default:
+			return nil, fmt.Errorf("dbus: unsupported header field type %q", sig)
+		}
+	}
+	return m, d.err
+}
+
+// A dbusConn is a connection to a message bus.
+type dbusConn struct {
+	mu     sync.Mutex // guards writes and serial
+	c      net.Conn
+	r      *bufio.Reader
+	serial uint32
+}
+
+// dialSystemBus connects to the system bus and authenticates as the
+// current user.
+func dialSystemBus() (*dbusConn, error) {
+	addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+	if addr == "" {
+		addr = "unix:path=/run/dbus/system_bus_socket"
+	}
+	var path string
+	for _, a := range strings.Split(addr, ";") {
+		if !strings.HasPrefix(a, "unix:") {
+			continue
+		}
+		for _, kv := range strings.Split(a[len("unix:"):], ",") {
+			if strings.HasPrefix(kv, "path=") {
+				path = kv[len("path="):]
+			} else if strings.HasPrefix(kv, "abstract=") {
+				path = "@" + kv[len("abstract="):]
+			}
+		}
+		if path != "" {
+			break
+		}
+	}
+	if path == "" {
+		return nil, fmt.Errorf("dbus: no unix socket in bus address %q", addr)
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	dc := &dbusConn{c: c, r: bufio.NewReader(c)}
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(c, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	line, err := dc.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "OK ") {
+		c.Close()
+		return nil, fmt.Errorf("dbus: authentication failed: %q, %v", strings.TrimSpace(line), err)
+	}
+	if _, err := io.WriteString(c, "BEGIN\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (c *dbusConn) send(m *dbusMsg) (serial uint32, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serial++
+	_, err = c.c.Write(m.encode(c.serial))
+	return c.serial, err
+}
+
+// call calls a method on the bus and waits for its reply. It's only
+// for setting up, before serve starts reading.
+func (c *dbusConn) call(m *dbusMsg) (*dbusMsg, error) {
+	m.typ = dbusMethodCall
+	serial, err := c.send(m)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		r, err := readDBusMsg(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if r.replySerial != serial {
+			continue // like NameAcquired
+		}
+		if r.typ == dbusError {
+			d := &dbusDec{b: r.body, order: r.order}
+			return nil, fmt.Errorf("dbus: %s: %s: %s", m.member, r.errName, d.str())
+		}
+		return r, nil
+	}
+}
+
+// dbusBus is the daemon's system bus connection, if it's serving -dbus.
+var dbusBus *dbusConn
+
+// serveDBus publishes the D-Bus service, in the background.
+func serveDBus() error {
+	c, err := dialSystemBus()
+	if err != nil {
+		return err
+	}
+	bus := &dbusMsg{dest: "org.freedesktop.DBus", path: "/org/freedesktop/DBus", iface: "org.freedesktop.DBus"}
+	hello := *bus
+	hello.member = "Hello"
+	if _, err := c.call(&hello); err != nil {
+		c.c.Close()
+		return err
+	}
+	var e dbusEnc
+	e.str(dbusName)
+	e.uint32(4) // DBUS_NAME_FLAG_DO_NOT_QUEUE
+	req := *bus
+	req.member, req.sig, req.body = "RequestName", "su", e.b
+	r, err := c.call(&req)
+	if err != nil {
+		c.c.Close()
+		return err
+	}
+	if d := (&dbusDec{b: r.body, order: r.order}); d.uint32() != 1 {
+		c.c.Close()
+		return fmt.Errorf("dbus: %s is already taken", dbusName)
+	}
+	dbusBus = c
+	go c.serve()
+	return nil
+}
+
+func (c *dbusConn) serve() {
+	for {
+		m, err := readDBusMsg(c.r)
+		if err != nil {
+			warnf("dbus: %v; no longer serving %s", err, dbusName)
+			return
+		}
+		if m.typ == dbusMethodCall {
+			go c.handle(m) // Resize waits for the daemon's loop
+		}
+	}
+}
+
+// handle answers a method call.
+func (c *dbusConn) handle(m *dbusMsg) {
+	reply := &dbusMsg{typ: dbusMethodReturn, dest: m.sender, replySerial: m.serial}
+	fail := func(name, msg string) {
+		var e dbusEnc
+		e.str(msg)
+		reply.typ, reply.errName, reply.sig, reply.body = dbusError, name, "s", e.b
+	}
+	var e dbusEnc
+	switch {
+	case m.path != dbusPath:
+		fail("org.freedesktop.DBus.Error.UnknownObject", "no object "+m.path)
+	case m.member == "Ping" && (m.iface == "" || m.iface == "org.freedesktop.DBus.Peer"):
+	case m.member == "Introspect" && (m.iface == "" || m.iface == "org.freedesktop.DBus.Introspectable"):
+		e.str(dbusIntrospection)
+		reply.sig, reply.body = "s", e.b
+	case m.member == "GetStatus" && (m.iface == "" || m.iface == dbusIface):
+		j, _ := json.Marshal(status())
+		e.str(string(j))
+		reply.sig, reply.body = "s", e.b
+	case m.member == "Resize" && (m.iface == "" || m.iface == dbusIface):
+		if m.sig != "sb" {
+			fail("org.freedesktop.DBus.Error.InvalidArgs", "want (sb), not ("+m.sig+")")
+			break
+		}
+		d := &dbusDec{b: m.body, order: m.order}
+		mnt, dryRun := d.str(), d.uint32() != 0
+		rep, err := controlResize(mnt, dryRun)
+		switch {
+		case errors.Is(err, errUnknownTarget):
+			fail(dbusName+".Error.UnknownTarget", err.Error())
+		case err != nil:
+			fail(dbusName+".Error.Failed", err.Error())
+		default:
+			dbusChanges(&e, rep.Changes)
+			reply.sig, reply.body = "a(sssxx)", e.b
+		}
+	default:
+		fail("org.freedesktop.DBus.Error.UnknownMethod", fmt.Sprintf("no method %s.%s", m.iface, m.member))
+	}
+	if m.flags&dbusNoReplyExpected != 0 {
+		return
+	}
+	if _, err := c.send(reply); err != nil {
+		vlogf("dbus: replying to %s: %v", m.member, err)
+	}
+}
+
+// dbusChanges marshals changes as a(sssxx): layer, device, resizer,
+// before and after bytes.
+func dbusChanges(e *dbusEnc, changes []embiggen.Change) {
+	a := e.arrayStart(8)
+	for _, c := range changes {
+		e.align(8)
+		e.str(c.Layer)
+		e.str(c.Device)
+		e.str(c.Resizer)
+		e.uint64(uint64(c.BeforeBytes))
+		e.uint64(uint64(c.AfterBytes))
+	}
+	e.arrayEnd(a)
+}
+
+// dbusChanged emits the Changed signal after mnt grows, if serving
+// -dbus.
+func dbusChanged(mnt string, changes []embiggen.Change) {
+	if dbusBus == nil || len(changes) == 0 {
+		return
+	}
+	var e dbusEnc
+	e.str(mnt)
+	dbusChanges(&e, changes)
+	sig := &dbusMsg{typ: dbusSignal, path: dbusPath, iface: dbusIface, member: "Changed", sig: "sa(sssxx)", body: e.b}
+	if _, err := dbusBus.send(sig); err != nil {
+		vlogf("dbus: sending Changed: %v", err)
+	}
+}
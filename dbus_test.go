@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+func TestDBusHandle(t *testing.T) {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case req := <-controls:
+				if req.mnt == "/nope" {
+					req.reply <- fmt.Errorf("%s: %w", req.mnt, errUnknownTarget)
+					continue
+				}
+				*req.report = report{Mount: req.mnt, Changes: []embiggen.Change{
+					{Layer: "filesystem", Device: "/dev/sda1", Resizer: "ext4", BeforeBytes: 1 << 30, AfterBytes: 2 << 30},
+				}}
+				req.reply <- nil
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	tests := []struct {
+		member, mnt string
+		wantType    byte
+		wantErr     string
+		wantSig     string
+	}{
+		{"Resize", "/var", dbusMethodReturn, "", "a(sssxx)"},
+		{"Resize", "/nope", dbusError, dbusName + ".Error.UnknownTarget", "s"},
+		{"Introspect", "", dbusMethodReturn, "", "s"},
+		{"Frob", "", dbusError, "org.freedesktop.DBus.Error.UnknownMethod", "s"},
+	}
+	for _, tt := range tests {
+		bus, ours := net.Pipe()
+		c := &dbusConn{c: ours, r: bufio.NewReader(ours)}
+		call := &dbusMsg{typ: dbusMethodCall, path: dbusPath, member: tt.member, sender: ":1.42"}
+		if tt.member == "Resize" {
+			var e dbusEnc
+			e.str(tt.mnt)
+			e.uint32(1)
+			call.sig, call.body = "sb", e.b
+		}
+		// Round-trip the call, as the bus would deliver it.
+		pr, pw := net.Pipe()
+		go pw.Write(call.encode(7))
+		got, err := readDBusMsg(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.sender = call.sender // set by the bus
+		go c.handle(got)
+		r, err := readDBusMsg(bus)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.typ != tt.wantType || r.errName != tt.wantErr || r.sig != tt.wantSig || r.replySerial != 7 || r.dest != ":1.42" {
+			t.Errorf("%s %q: reply %+v; want type %d, error %q, signature %q", tt.member, tt.mnt, r, tt.wantType, tt.wantErr, tt.wantSig)
+		}
+		if tt.wantSig == "a(sssxx)" {
+			d := &dbusDec{b: r.body, order: r.order}
+			n := d.uint32()
+			d.align(8)
+			if layer := d.str(); n == 0 || layer != "filesystem" {
+				t.Errorf("Resize: changes %d bytes, first layer %q; want filesystem", n, layer)
+			}
+		}
+		bus.Close()
+		pr.Close()
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+	"golang.org/x/sys/unix"
+)
+
+// toolPackages maps the external tools embiggen-disk runs to the
+// package that provides them on most distros.
+var toolPackages = map[string]string{
+	"sfdisk":     "util-linux",
+	"blkid":      "util-linux",
+	"resize2fs":  "e2fsprogs",
+	"dumpe2fs":   "e2fsprogs",
+	"xfs_growfs": "xfsprogs",
+	"xfs_info":   "xfsprogs",
+	"btrfs":      "btrfs-progs",
+	"lvdisplay":  "lvm2",
+	"lvextend":   "lvm2",
+	"vgdisplay":  "lvm2",
+	"pvdisplay":  "lvm2",
+	"pvresize":   "lvm2",
+	"cryptsetup": "cryptsetup",
+}
+
+// A doctorCheck is the result of one preflight check.
+type doctorCheck struct {
+	ok   bool
+	what string // what was checked, or what's wrong
+	fix  string // remediation, if !ok
+}
+
+// doctor checks that everything needed to resize the filesystem at
+// mnt is in place.
+func doctor(mnt string) []doctorCheck {
+	var checks []doctorCheck
+	add := func(ok bool, what, fix string) {
+		checks = append(checks, doctorCheck{ok, what, fix})
+	}
+
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		rel := unix.ByteSliceToString(uts.Release[:])
+		add(kernelAtLeast(rel, 3, 6), "Linux kernel "+rel+" supports BLKPG_RESIZE_PARTITION (3.6+)",
+			"upgrade to Linux 3.6 or newer to resize partitions while they're in use")
+	}
+	_, err := ioutil.ReadFile(embiggen.MountInfoFile)
+	add(err == nil, "/proc is mounted", "mount -t proc proc /proc")
+	_, err = os.Stat("/sys/class/block")
+	add(err == nil, "/sys is mounted", "mount -t sysfs sysfs /sys")
+
+	lim, _ := resolveLimit(mnt)
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		add(false, fmt.Sprintf("%s is resizable: %v", mnt, err),
+			"embiggen-disk supports ext2/3/4, XFS and btrfs on partitions or LVM")
+		return checks
+	}
+	chain, err := embiggen.Chain(runCtx, e)
+	if err != nil {
+		add(false, fmt.Sprintf("detecting the layers under %s: %v", mnt, err),
+			"run `embiggen-disk -verbose plan "+mnt+"` for details")
+	}
+	if err := embiggen.CheckPrivileges(runCtx, e); err != nil {
+		add(false, err.Error(), "run embiggen-disk as root, e.g. with sudo, or with the capability named")
+	} else {
+		add(true, "has the privileges and device access to grow "+mnt, "")
+	}
+	seen := map[string]bool{}
+	for _, r := range chain {
+		add(true, "detected "+r.String(), "")
+		for _, tool := range embiggen.RequiredTools(r) {
+			if seen[tool] {
+				continue
+			}
+			seen[tool] = true
+			_, err := embiggen.LookTool(runCtx, tool)
+			pkg := toolPackages[tool]
+			if err != nil && pkg == "lvm2" && engineOpts.LVMFallback != nil {
+				lerr := lvmdReachable()
+				add(lerr == nil, fmt.Sprintf("%s is missing, but lvmdbusd can stand in for it (for %s)", tool, r.String()),
+					fmt.Sprintf("install the lvm2 package, or start lvmdbusd (%v)", lerr))
+				continue
+			}
+			add(err == nil, fmt.Sprintf("%s is installed (needed for %s)", tool, r.String()),
+				fmt.Sprintf("install the %s package, e.g. `apt install %s` or `yum install %s`", pkg, pkg, pkg))
+		}
+		if dev := r.Device(); dev != "" {
+			if strings.HasPrefix(filepath.Base(devRealPath(dev)), "dm-") && isCryptDev(dev) {
+				add(false, dev+" is a dm-crypt/LUKS device, which isn't supported yet",
+					"grow it by hand with `cryptsetup resize`, then rerun embiggen-disk")
+				_, err := embiggen.LookTool(runCtx, "cryptsetup")
+				add(err == nil, "cryptsetup is installed (needed for "+dev+")",
+					"install the cryptsetup package")
+			}
+			if _, ok := r.(embiggen.PartitionResizer); ok {
+				disk, err := embiggen.DiskDev(dev)
+				if err != nil {
+					add(false, fmt.Sprintf("finding the disk %s is on: %v", dev, err),
+						"grow the partition by hand, then rerun embiggen-disk")
+					continue
+				}
+				dev = disk
+			}
+			add(unix.Access(dev, unix.W_OK) == nil, dev+" is writable",
+				"run as root, and check that "+dev+" isn't read-only (blockdev --getro "+dev+")")
+		}
+	}
+	return checks
+}
+
+// devRealPath resolves symlinks like /dev/mapper/vg-root -> /dev/dm-0,
+// returning dev unchanged if that fails.
+func devRealPath(dev string) string {
+	if real, err := filepath.EvalSymlinks(dev); err == nil {
+		return real
+	}
+	return dev
+}
+
+// isCryptDev reports whether the device-mapper device dev is a
+// dm-crypt mapping.
+func isCryptDev(dev string) bool {
+	uuid, err := ioutil.ReadFile("/sys/class/block/" + filepath.Base(devRealPath(dev)) + "/dm/uuid")
+	return err == nil && strings.HasPrefix(string(uuid), "CRYPT-")
+}
+
+// kernelAtLeast reports whether the kernel release string rel (like
+// "5.10.0-21-amd64") is at least major.minor.
+func kernelAtLeast(rel string, major, minor int) bool {
+	f := strings.SplitN(rel, ".", 3)
+	if len(f) < 2 {
+		return false
+	}
+	digits := func(s string) string {
+		if i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+			return s[:i]
+		}
+		return s
+	}
+	maj, err1 := strconv.Atoi(f[0])
+	min, err2 := strconv.Atoi(digits(f[1]))
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return maj > major || maj == major && min >= minor
+}
+
+// doctorMain implements the "doctor [mount-point]" subcommand.
+func doctorMain(args []string) {
+	mnt := "/"
+	switch len(args) {
+	case 0:
+	case 1:
+		mnt = args[0]
+	default:
+		usage()
+	}
+	failed := 0
+	for _, c := range doctor(mnt) {
+		if c.ok {
+			fmt.Printf("[ok]   %s\n", c.what)
+			continue
+		}
+		failed++
+		fmt.Printf("[FAIL] %s\n       fix: %s\n", c.what, c.fix)
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d problem(s) found.\n", failed)
+		os.Exit(exitFailed)
+	}
+	fmt.Printf("\nEverything needed to resize %s is in place.\n", mnt)
+	os.Exit(0)
+}
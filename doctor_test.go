@@ -0,0 +1,38 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestKernelAtLeast(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"5.10.0-21-amd64", true},
+		{"3.6.0", true},
+		{"3.5.7", false},
+		{"2.6.32-754.el6.x86_64", false},
+		{"4.0-rc1", true},
+		{"bogus", false},
+	}
+	for _, tt := range tests {
+		if got := kernelAtLeast(tt.rel, 3, 6); got != tt.want {
+			t.Errorf("kernelAtLeast(%q, 3, 6) = %v; want %v", tt.rel, got, tt.want)
+		}
+	}
+}
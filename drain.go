@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+var (
+	drain        = flag.Bool("drain", false, "on a Kubernetes node, cordon and drain it before a resize that has to unmount the filesystem, such as an ext4 -shrink, and uncordon it after")
+	drainTimeout = flag.Duration("drain-timeout", 10*time.Minute, "with -drain, how long to wait for pods to be evicted")
+)
+
+// drainPollInterval is how often drainNode retries evictions blocked
+// by a PodDisruptionBudget and checks whether evicted pods are gone.
+var drainPollInterval = 5 * time.Second
+
+// A k8sPod is the part of a Pod that draining looks at.
+type k8sPod struct {
+	Metadata struct {
+		Name, Namespace, UID string
+		Annotations          map[string]string
+		OwnerReferences      []struct{ Kind string } `json:"ownerReferences"`
+	}
+	Status struct{ Phase string }
+}
+
+// evictable reports whether drainNode should evict p. Like kubectl
+// drain, it leaves DaemonSet and static pods, which would only come
+// back, and finished pods.
+func (p *k8sPod) evictable() bool {
+	if p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+		return false
+	}
+	if _, ok := p.Metadata.Annotations["kubernetes.io/config.mirror"]; ok {
+		return false
+	}
+	for _, o := range p.Metadata.OwnerReferences {
+		if o.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	return true
+}
+
+// cordonNode marks node unschedulable, or schedulable again. It
+// reports whether it was unschedulable before.
+func cordonNode(c *kubeClient, node string, unschedulable bool) (was bool, err error) {
+	var n struct {
+		Spec struct{ Unschedulable bool }
+	}
+	path := "/api/v1/nodes/" + url.PathEscape(node)
+	if err := c.do("GET", path, nil, &n); err != nil {
+		return false, err
+	}
+	patch := map[string]interface{}{"spec": map[string]bool{"unschedulable": unschedulable}}
+	return n.Spec.Unschedulable, c.do("PATCH", path, patch, nil)
+}
+
+// drainNode evicts node's pods, through the Eviction API so
+// PodDisruptionBudgets are honored, and waits up to timeout for them
+// to go.
+func drainNode(c *kubeClient, node string, timeout time.Duration) error {
+	var pods struct{ Items []k8sPod }
+	q := url.Values{"fieldSelector": {"spec.nodeName=" + node}}
+	if err := c.do("GET", "/api/v1/pods?"+q.Encode(), nil, &pods); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	var left []k8sPod
+	for _, p := range pods.Items {
+		if p.evictable() {
+			left = append(left, p)
+		}
+	}
+	for len(left) > 0 {
+		var still []k8sPod
+		for _, p := range left {
+			m := p.Metadata
+			podPath := "/api/v1/namespaces/" + url.PathEscape(m.Namespace) + "/pods/" + url.PathEscape(m.Name)
+			var cur k8sPod
+			err := c.do("GET", podPath, nil, &cur)
+			if errors.Is(err, errKubeNotFound) || (err == nil && cur.Metadata.UID != m.UID) {
+				vlogf("drain: %s/%s is gone", m.Namespace, m.Name)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			ev := map[string]interface{}{
+				"apiVersion": "policy/v1",
+				"kind":       "Eviction",
+				"metadata":   map[string]string{"name": m.Name, "namespace": m.Namespace},
+			}
+			switch err := c.do("POST", podPath+"/eviction", ev, nil); {
+			case err == nil, errors.Is(err, errKubeNotFound):
+			case errors.Is(err, errKubeTooManyRequests):
+				vlogf("drain: evicting %s/%s: blocked by its disruption budget; retrying", m.Namespace, m.Name)
+			default:
+				return fmt.Errorf("evicting %s/%s: %v", m.Namespace, m.Name, err)
+			}
+			still = append(still, p)
+		}
+		if left = still; len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d pod(s) still on %s after %v, such as %s/%s", len(left), node, timeout, left[0].Metadata.Namespace, left[0].Metadata.Name)
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return nil
+}
+
+// drained runs f with this host's Node cordoned and drained, then
+// uncordons it. If f fails, the Node is left cordoned, so nothing is
+// scheduled onto a filesystem that may not be back.
+func drained(f func() error) error {
+	c, err := newKubeClient(kubeconfigPath())
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errors.New("-drain needs Kubernetes credentials; see -kubeconfig")
+	}
+	node := nodeName()
+	if *dry {
+		dryRunf("would've cordoned and drained node %s, then uncordoned it", node)
+		return f()
+	}
+	was, err := cordonNode(c, node, true)
+	if err != nil {
+		return fmt.Errorf("cordoning %s: %v", node, err)
+	}
+	infof("cordoned node %s; draining it", node)
+	if err := drainNode(c, node, *drainTimeout); err != nil {
+		return fmt.Errorf("draining %s: %v; it's still cordoned", node, err)
+	}
+	if err := f(); err != nil {
+		return fmt.Errorf("%v; node %s is still cordoned", err, node)
+	}
+	if was {
+		infof("node %s was already cordoned; leaving it so", node)
+		return nil
+	}
+	if _, err := cordonNode(c, node, false); err != nil {
+		return fmt.Errorf("uncordoning %s: %v", node, err)
+	}
+	infof("uncordoned node %s", node)
+	return nil
+}
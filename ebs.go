@@ -0,0 +1,432 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var awsWait = flag.Duration("aws-wait", 15*time.Minute, "with aws grow, how long to wait for the EBS volume modification to take effect")
+
+// ebsPollInterval is how often aws grow checks on a modification.
+var ebsPollInterval = 5 * time.Second
+
+// awsMain implements the "aws grow <mount-point> <size>" subcommand:
+// it enlarges the EBS volume under the mount point to size ("200G"),
+// or by it ("+50G", "+20%"), then grows everything above the volume.
+func awsMain(args []string) {
+	if len(args) != 3 || args[0] != "grow" {
+		usage()
+	}
+	mnt, size := args[1], args[2]
+	lim, err := resolveLimit(mnt)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	disk, err := backingDisk(mnt, lim)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	if err := growEBS(disk, size); err != nil {
+		exitf(exitFailed, "error enlarging the EBS volume under %s: %v", mnt, err)
+	}
+	changes, err := grow(mnt, lim)
+	if err != nil {
+		exitf(exitCode(changes, err), "error enlarging %s: %v", mnt, err)
+	}
+	os.Exit(exitCode(changes, nil))
+}
+
+// backingDisk returns the whole disk at the bottom of the layers under
+// mnt.
+func backingDisk(mnt string, lim embiggen.Limit) (string, error) {
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		return "", err
+	}
+	chain, err := embiggen.Chain(runCtx, e)
+	if err != nil {
+		return "", err
+	}
+	bottom := chain[len(chain)-1]
+	if _, ok := bottom.(embiggen.PartitionResizer); ok {
+		return embiggen.DiskDev(bottom.Device())
+	}
+	dev, err := filepath.EvalSymlinks(bottom.Device())
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/block", filepath.Base(dev), "partition")); err == nil {
+		return "", embiggen.Unsupportedf("%s is a partition of a disk embiggen-disk can't find", dev)
+	}
+	return dev, nil
+}
+
+// ebsVolumeID returns the EBS volume ID of disk. Nitro instances show
+// EBS volumes as NVMe devices with the volume ID as their serial; on
+// Xen instances it's looked up by the device name the volume was
+// attached as.
+func ebsVolumeID(disk string) (string, error) {
+	name := filepath.Base(disk)
+	serial, err := ioutil.ReadFile(filepath.Join("/sys/class/block", name, "device/serial"))
+	if err != nil {
+		if strings.HasPrefix(name, "xvd") {
+			return xenEBSVolumeID(name)
+		}
+		return "", fmt.Errorf("%s isn't an EBS NVMe device: %v", disk, err)
+	}
+	s := strings.TrimSpace(string(serial))
+	if !strings.HasPrefix(s, "vol") {
+		return "", fmt.Errorf("%s isn't an EBS volume; its serial is %q", disk, s)
+	}
+	return "vol-" + strings.TrimPrefix(strings.TrimPrefix(s, "vol"), "-"), nil
+}
+
+// xenAttachNames returns the device names an EBS volume the Xen
+// kernel calls name (like "xvdf") may have been attached as.
+func xenAttachNames(name string) []string {
+	letters := strings.TrimPrefix(name, "xvd")
+	names := []string{"/dev/" + name, "/dev/sd" + letters}
+	if letters == "a" {
+		names = append(names, "/dev/sda1", "/dev/xvda1")
+	}
+	return names
+}
+
+// xenEBSVolumeID returns the ID of the EBS volume the Xen kernel
+// calls name. The instance metadata's block device mapping says
+// whether it's EBS at all; EC2 says which volume is attached there.
+func xenEBSVolumeID(name string) (string, error) {
+	if uuid, err := ioutil.ReadFile("/sys/hypervisor/uuid"); err != nil || !strings.HasPrefix(string(uuid), "ec2") {
+		return "", fmt.Errorf("/dev/%s isn't on an EC2 instance", name)
+	}
+	names := xenAttachNames(name)
+	mapping, err := imdsGet("/latest/meta-data/block-device-mapping/")
+	if err != nil {
+		return "", err
+	}
+	ebs := false
+	for _, m := range strings.Fields(mapping) {
+		if m != "root" && !strings.HasPrefix(m, "ebs") {
+			continue
+		}
+		dev, err := imdsGet("/latest/meta-data/block-device-mapping/" + m)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(dev, "/dev/") {
+			dev = "/dev/" + dev
+		}
+		for _, n := range names {
+			ebs = ebs || dev == n
+		}
+	}
+	if !ebs {
+		return "", fmt.Errorf("/dev/%s isn't an EBS volume", name)
+	}
+	instance, err := imdsGet("/latest/meta-data/instance-id")
+	if err != nil {
+		return "", err
+	}
+	region, err := awsRegion()
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"Filter.1.Name":    {"attachment.instance-id"},
+		"Filter.1.Value.1": {instance},
+		"Filter.2.Name":    {"attachment.device"},
+	}
+	for i, n := range names {
+		params.Set(fmt.Sprintf("Filter.2.Value.%d", i+1), n)
+	}
+	out, err := awsQuery("ec2", region, "2016-11-15", "DescribeVolumes", params)
+	if err != nil {
+		return "", err
+	}
+	var dv struct {
+		Volumes []ec2Volume `xml:"volumeSet>item"`
+	}
+	if err := xml.Unmarshal(out, &dv); err != nil || len(dv.Volumes) != 1 {
+		return "", fmt.Errorf("finding the EBS volume attached as /dev/%s: %v, %d volume(s)", name, err, len(dv.Volumes))
+	}
+	return dv.Volumes[0].ID, nil
+}
+
+// volumeIDs caches volumeID's answers by disk, "" for ones that
+// aren't EBS.
+var volumeIDs = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// volumeID returns the EBS volume ID of dev, a disk or a partition
+// of one, or "" if it isn't on EBS, so reports, logs and metrics can
+// name the volume an operator sees in the EC2 console.
+func volumeID(dev string) string {
+	real, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(real)
+	if !strings.HasPrefix(name, "nvme") && !strings.HasPrefix(name, "xvd") {
+		return ""
+	}
+	if _, err := os.Stat(filepath.Join("/sys/class/block", name, "partition")); err == nil {
+		sys, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", name))
+		if err != nil {
+			return ""
+		}
+		name = filepath.Base(filepath.Dir(sys))
+	}
+	volumeIDs.Lock()
+	defer volumeIDs.Unlock()
+	id, ok := volumeIDs.m[name]
+	if !ok {
+		if id, err = ebsVolumeID("/dev/" + name); err != nil {
+			vlogf("%s: no EBS volume ID: %v", name, err)
+			id = ""
+		}
+		volumeIDs.m[name] = id
+	}
+	return id
+}
+
+// targetVolumeID returns the EBS volume ID of the disk at the bottom
+// of e's chain, or "".
+func targetVolumeID(e embiggen.Resizer) string {
+	chain, err := embiggen.Chain(runCtx, e)
+	if err != nil {
+		return ""
+	}
+	return volumeID(chain[len(chain)-1].Device())
+}
+
+// ebsTargetGiB returns the size in GiB to make a volume of cur GiB,
+// given size as for aws grow.
+func ebsTargetGiB(cur int64, size string) (int64, error) {
+	var want int64
+	if strings.HasPrefix(size, "+") && strings.HasSuffix(size, "%") {
+		pct, err := strconv.ParseFloat(size[1:len(size)-1], 64)
+		if err != nil || pct <= 0 {
+			return 0, fmt.Errorf("bad growth %q", size)
+		}
+		want = int64(float64(cur<<30) * (1 + pct/100))
+	} else {
+		var f sizeFlag
+		if err := f.Set(size); err != nil {
+			return 0, err
+		}
+		want = f.resolve(cur << 30)
+	}
+	gib := (want + 1<<30 - 1) >> 30
+	if gib <= cur {
+		return 0, fmt.Errorf("%s isn't bigger than the volume's %d GiB", size, cur)
+	}
+	return gib, nil
+}
+
+// ec2Volume is the part of an EC2 DescribeVolumes item aws grow uses.
+type ec2Volume struct {
+	ID   string `xml:"volumeId"`
+	Size int64  `xml:"size"` // GiB
+}
+
+// ec2Modification is an EC2 volume modification.
+type ec2Modification struct {
+	State      string `xml:"modificationState"` // modifying, optimizing, completed or failed
+	Status     string `xml:"statusMessage"`
+	TargetSize int64  `xml:"targetSize"`
+}
+
+// growEBS enlarges the EBS volume behind disk per size, waits for
+// the modification to reach "optimizing", when the new size can be
+// used, and then for the kernel to see it.
+func growEBS(disk, size string) error {
+	vol, err := ebsVolumeID(disk)
+	if err != nil {
+		return err
+	}
+	region, err := awsRegion()
+	if err != nil {
+		return err
+	}
+	out, err := awsQuery("ec2", region, "2016-11-15", "DescribeVolumes", url.Values{"VolumeId.1": {vol}})
+	if err != nil {
+		return err
+	}
+	var dv struct {
+		Volumes []ec2Volume `xml:"volumeSet>item"`
+	}
+	if err := xml.Unmarshal(out, &dv); err != nil || len(dv.Volumes) != 1 {
+		return fmt.Errorf("describing %s: %v, %d volume(s)", vol, err, len(dv.Volumes))
+	}
+	cur := dv.Volumes[0].Size
+	gib, err := ebsTargetGiB(cur, size)
+	if err != nil {
+		return err
+	}
+	if *dry {
+		dryRunf("would've modified EBS volume %s (%s) from %d GiB to %d GiB", vol, disk, cur, gib)
+		return nil
+	}
+	infof("modifying EBS volume %s (%s) from %d GiB to %d GiB", vol, disk, cur, gib)
+	if _, err := awsQuery("ec2", region, "2016-11-15", "ModifyVolume", url.Values{
+		"VolumeId": {vol},
+		"Size":     {strconv.FormatInt(gib, 10)},
+	}); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(*awsWait)
+	for {
+		m, err := ebsModification(region, vol)
+		if err != nil {
+			return err
+		}
+		vlogf("%s: modification %s %s", vol, m.State, m.Status)
+		if m.State == "failed" {
+			return fmt.Errorf("modifying %s failed: %s", vol, m.Status)
+		}
+		if m.State == "optimizing" || m.State == "completed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("modifying %s: still %s after %v", vol, m.State, *awsWait)
+		}
+		time.Sleep(ebsPollInterval)
+	}
+	for {
+		if n, err := embiggen.BlockDevSize(disk); err == nil && n >= gib<<30 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s grew but the kernel still doesn't see it after %v", vol, *awsWait)
+		}
+		time.Sleep(ebsPollInterval)
+	}
+}
+
+// ebsModification returns the latest modification of the EBS volume
+// vol.
+func ebsModification(region, vol string) (*ec2Modification, error) {
+	out, err := awsQuery("ec2", region, "2016-11-15", "DescribeVolumesModifications", url.Values{"VolumeId.1": {vol}})
+	if err != nil {
+		return nil, err
+	}
+	var dm struct {
+		Mods []ec2Modification `xml:"volumeModificationSet>item"`
+	}
+	if err := xml.Unmarshal(out, &dm); err != nil {
+		return nil, err
+	}
+	if len(dm.Mods) == 0 {
+		return nil, errors.New("no modification found for " + vol)
+	}
+	return &dm.Mods[len(dm.Mods)-1], nil
+}
+
+var ebsModifications = flag.Bool("ebs-modifications", true, "in daemon mode on EC2, check on EBS volume modifications before growing: wait out ones still in progress, and rescan disks whose growth the kernel missed")
+
+// ebsCheckInterval is how often the daemon asks EC2 about a target's
+// volume.
+const ebsCheckInterval = time.Minute
+
+// An ebsTarget is what the daemon last learned about the EBS volume
+// under a target.
+type ebsTarget struct {
+	checked   time.Time
+	disk, vol string // vol is "" if it's not EBS
+	mod       *ec2Modification
+}
+
+var ebsTargets = map[string]*ebsTarget{}
+
+// ebsReady reports whether the daemon should try growing mnt now: not
+// while the EBS volume under it is still being modified, when its new
+// size can't be used yet. If the modification is done but the kernel
+// hasn't seen the disk grow, it rescans the disk.
+func ebsReady(mnt string, lim embiggen.Limit) bool {
+	t := ebsTargets[mnt]
+	if t == nil {
+		t = &ebsTarget{}
+		ebsTargets[mnt] = t
+	}
+	if time.Since(t.checked) >= ebsCheckInterval {
+		t.checked, t.mod = time.Now(), nil
+		var err error
+		if t.disk, err = backingDisk(mnt, lim); err != nil {
+			return true // grow will say what's wrong
+		}
+		if t.vol, err = ebsVolumeID(t.disk); err != nil {
+			t.vol = ""
+			return true
+		}
+		region, err := awsRegion()
+		if err == nil {
+			t.mod, err = ebsModification(region, t.vol)
+		}
+		if err != nil {
+			vlogf("%s: checking EBS volume %s for modifications: %v", mnt, t.vol, err)
+			t.mod = nil
+		}
+	}
+	m := t.mod
+	if m == nil {
+		return true
+	}
+	switch m.State {
+	case "modifying":
+		vlogf("%s: EBS volume %s is still being modified to %d GiB; waiting", mnt, t.vol, m.TargetSize)
+		return false
+	case "optimizing", "completed":
+		if n, err := embiggen.BlockDevSize(t.disk); err == nil && n < m.TargetSize<<30 {
+			infof("%s: EBS volume %s is now %d GiB but %s is %s; rescanning it", mnt, t.vol, m.TargetSize, t.disk, embiggen.HumanSize(n))
+			if err := rescanDisk(t.disk); err != nil {
+				warnf("rescanning %s: %v", t.disk, err)
+			}
+		}
+	}
+	return true
+}
+
+// rescanDisk asks the kernel to re-read disk's size.
+func rescanDisk(disk string) error {
+	dev := filepath.Join("/sys/class/block", filepath.Base(disk), "device")
+	for _, f := range []string{"rescan", "rescan_controller"} { // SCSI, NVMe
+		if _, err := os.Stat(filepath.Join(dev, f)); err == nil {
+			if *dry {
+				dryRunf("would've rescanned %s", disk)
+				return nil
+			}
+			return ioutil.WriteFile(filepath.Join(dev, f), []byte("1"), 0200)
+		}
+	}
+	return fmt.Errorf("don't know how to rescan %s", disk)
+}
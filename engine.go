@@ -0,0 +1,223 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var (
+	disableResizers stringsFlag
+	remountRW       = flag.Bool("remount-rw", false, "remount a read-only filesystem read-write before growing it, if the kernel found no errors on it and /etc/fstab doesn't mount it read-only, as with a root filesystem still read-only early in boot")
+	healthCheck     = flag.Bool("health-check", false, "before growing a filesystem, check its superblock and the kernel log for errors, and refuse to grow it if there are any")
+	watchKernelLog  = flag.Bool("watch-kernel-log", true, "while resizing, watch /dev/kmsg for I/O or filesystem errors on the devices being resized, and stop before the next step if there are any")
+	snapshot        = flag.Bool("snapshot", false, "before growing a filesystem on an LVM LV, take a snapshot of the LV, if its VG has -snapshot-size free, to roll back to if the grow fails")
+	snapshotSize    = bytesFlag(1 << 30)
+	snapshotKeep    = flag.Duration("snapshot-keep", time.Hour, "how long to keep a -snapshot after a successful grow before removing it")
+	freeze          = flag.Bool("freeze", false, "freeze the filesystem with fsfreeze while the partition table under it is rewritten, for a crash-consistent window")
+	freezeTimeout   = flag.Duration("freeze-timeout", 30*time.Second, "thaw a -freeze or -quiesce-hook after this long even if the step isn't done")
+	toolDirs        = flag.String("tool-dirs", "", "colon-separated directories to find external tools in, instead of $PATH, which the tools are run with too, like /run/current-system/sw/bin on NixOS")
+	toolPaths       = map[string]string{} // from -tool-path
+	addDisksTo      = flag.String("add-disks-to", "", "comma-separated LVM volume groups to add blank disks to, as new PVs, before growing an LV in them, to grow by attaching another volume; any disk without a partition table, filesystem or other signature is claimed")
+	retries         = flag.Int("retries", 3, "how many times to retry a step that fails transiently, on a busy device or LVM lock, waiting 1s, 2s, 4s, ... between tries")
+)
+
+func init() {
+	flag.Var(commandTimeoutFlag{}, "command-timeout", "how long an external tool may run before it's taken to be hung, killed and its kernel state reported, like 10m, or tool=duration to set one tool's, like resize2fs=1h; 0 for no limit; may be repeated or comma-separated. Partition table writers (sfdisk, partx, gpart) are only warned about, not killed")
+	flag.Var(toolPathFlag{}, "tool-path", "run this program for an external tool, like resize2fs=/opt/e2fsprogs/sbin/resize2fs; may be repeated or comma-separated")
+	flag.Var(&snapshotSize, "snapshot-size", "copy-on-write space to give a -snapshot")
+	flag.Var(&disableResizers, "disable-resizer", "turn off a built-in layer: filesystem, lvm-lv, lvm-vg, lvm-pv or partition (on FreeBSD, ufs, zfs-pool or gpart), leaving it and the layers under it alone; may be repeated or comma-separated")
+}
+
+// engineOpts are the Options the embiggen package resizes with,
+// carried by runCtx. They're set from the flags and config before the
+// first resize.
+var engineOpts = embiggen.DefaultOptions()
+
+// dryRun reports whether resizing with ctx is a dry run, as with
+// -dry-run or a control request for one.
+func dryRun(ctx context.Context) bool {
+	return embiggen.OptionsFrom(ctx).DryRun
+}
+
+// commandTimeoutFlag sets engineOpts.CommandTimeout, or with a "tool="
+// prefix, that tool's entry in engineOpts.CommandTimeouts. Values may
+// be comma-separated.
+type commandTimeoutFlag struct{}
+
+func (commandTimeoutFlag) String() string {
+	vs := []string{engineOpts.CommandTimeout.String()}
+	for tool, d := range engineOpts.CommandTimeouts {
+		vs = append(vs, tool+"="+d.String())
+	}
+	sort.Strings(vs[1:])
+	return strings.Join(vs, ",")
+}
+
+func (commandTimeoutFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		tool, dur := "", v
+		if i := strings.Index(v, "="); i >= 0 {
+			tool, dur = v[:i], v[i+1:]
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad duration %q", dur)
+		}
+		if tool == "" {
+			engineOpts.CommandTimeout = d
+		} else {
+			if engineOpts.CommandTimeouts == nil {
+				engineOpts.CommandTimeouts = map[string]time.Duration{}
+			}
+			engineOpts.CommandTimeouts[tool] = d
+		}
+	}
+	return nil
+}
+
+// toolPathFlag sets entries of toolPaths, from "tool=path" values that
+// may be comma-separated.
+type toolPathFlag struct{}
+
+func (toolPathFlag) String() string {
+	var vs []string
+	for tool, path := range toolPaths {
+		vs = append(vs, tool+"="+path)
+	}
+	sort.Strings(vs)
+	return strings.Join(vs, ",")
+}
+
+func (toolPathFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		i := strings.Index(v, "=")
+		if i <= 0 || !filepath.IsAbs(v[i+1:]) {
+			return fmt.Errorf("%q isn't tool=/absolute/path", v)
+		}
+		toolPaths[v[:i]] = v[i+1:]
+	}
+	return nil
+}
+
+// setupTools sets where the embiggen package finds external tools,
+// from -tool-path and -tool-dirs, or else the config file.
+func setupTools(c *config) error {
+	paths := map[string]string{}
+	for tool, path := range c.Tools.Paths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("tools: paths: %s: %q isn't an absolute path", tool, path)
+		}
+		paths[tool] = path
+	}
+	for tool, path := range toolPaths {
+		paths[tool] = path
+	}
+	dirs := c.Tools.Dirs
+	if flagGiven("tool-dirs") {
+		dirs = filepath.SplitList(*toolDirs)
+	}
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("tool directory %q isn't an absolute path", dir)
+		}
+	}
+	engineOpts.ToolPaths, engineOpts.ToolDirs = paths, dirs
+	return nil
+}
+
+// setupAddDisks sets the VGs the embiggen package adds blank disks
+// to, from -add-disks-to or else the config's add-disks-to.
+func setupAddDisks(c *config) {
+	vgs := c.AddDisksTo
+	if flagGiven("add-disks-to") {
+		vgs = nil
+		for _, vg := range strings.Split(*addDisksTo, ",") {
+			if vg = strings.TrimSpace(vg); vg != "" {
+				vgs = append(vgs, vg)
+			}
+		}
+	}
+	engineOpts.AddDisksTo = vgs
+}
+
+// engineLevels maps the embiggen package's log levels to ours.
+var engineLevels = map[embiggen.Level]logLevel{
+	embiggen.LevelWarn:  levelWarn,
+	embiggen.LevelInfo:  levelInfo,
+	embiggen.LevelDebug: levelDebug,
+}
+
+// setupEngine sets engineOpts, which configure the embiggen package
+// that does the resizing, from the flags.
+func setupEngine() error {
+	o := engineOpts
+	o.DryRun = *dry
+	o.Verbose = *verbose
+	o.Logf = func(l embiggen.Level, format string, args ...interface{}) {
+		logf(engineLevels[l], format, args...)
+	}
+	o.DryRunf = dryRunf
+	o.Confirm = func(step string) error { return confirmStep("%s", step) }
+	o.Lease = func(_ context.Context, disk string) (func() error, error) {
+		l, err := acquireLease(disk)
+		if l == nil || err != nil {
+			return nil, err
+		}
+		return l.release, nil
+	}
+	o.BeforeRewrite = beforeRewrite
+	o.StartSpan = func(name string, kv ...string) func(error) {
+		return startSpan(name, kv...).finish
+	}
+	o.Interrupt = func() error {
+		if shuttingDown() {
+			return errShuttingDown
+		}
+		return nil
+	}
+	o.VolumeID = volumeID
+	o.Retries = *retries
+	o.RemountRW = *remountRW
+	o.HealthCheck = *healthCheck
+	o.WatchKernelLog = *watchKernelLog
+	o.Snapshot = *snapshot
+	o.SnapshotSize = int64(snapshotSize)
+	o.SnapshotKeep = *snapshotKeep
+	o.Freeze = *freeze
+	o.FreezeTimeout = *freezeTimeout
+	o.Quiesce = quiesce
+	if *lvmDBus {
+		o.LVMFallback = lvmd{}
+	}
+	for _, v := range disableResizers {
+		names := strings.Split(v, ",")
+		if err := embiggen.CheckLayers(names...); err != nil {
+			return fmt.Errorf("-disable-resizer: %v", err)
+		}
+		o.Disable = append(o.Disable, names...)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// Exit codes, in the style of growpart(1), so scripts can branch on
+// what happened without parsing output.
+const (
+	exitChanged     = 0 // something was resized
+	exitNoChange    = 1 // everything was already as big as it could be
+	exitUsage       = 2 // bad flags or arguments
+	exitUnsupported = 3 // unsupported filesystem, device or partition table
+	exitToolFailed  = 4 // an external tool (sfdisk, lvextend, resize2fs, ...) failed or is missing
+	exitFailed      = 5 // any other error
+)
+
+// exitCode returns the process exit code for the result of a resize.
+func exitCode(changes []embiggen.Change, err error) int {
+	var ue embiggen.UnsupportedError
+	var ee *exec.ExitError
+	switch {
+	case (err == nil || errors.Is(err, errNotConfirmed)) && len(changes) > 0:
+		return exitChanged
+	case err == nil || errors.Is(err, errNotConfirmed):
+		return exitNoChange
+	case errors.As(err, &ue):
+		return exitUnsupported
+	case errors.As(err, &ee), errors.Is(err, exec.ErrNotFound), errors.Is(err, embiggen.ErrCommandTimeout):
+		return exitToolFailed
+	}
+	return exitFailed
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+func TestExitCode(t *testing.T) {
+	toolErr := exec.Command("false").Run()
+	tests := []struct {
+		changes []embiggen.Change
+		err     error
+		want    int
+	}{
+		{[]embiggen.Change{{}}, nil, exitChanged},
+		{nil, nil, exitNoChange},
+		{nil, fmt.Errorf("wrapped: %w", embiggen.Unsupportedf("unsupported filesystem type %q", "zfs")), exitUnsupported},
+		{nil, fmt.Errorf("running false: %w", toolErr), exitToolFailed},
+		{nil, fmt.Errorf("running resize2fs: %w", embiggen.ErrToolMissing{Tool: "resize2fs"}), exitToolFailed},
+		{nil, embiggen.Unsupportedf("can't grow /dev/sda1: %w", embiggen.ErrNotLastPartition), exitUnsupported},
+		{nil, fmt.Errorf("growing: %w", embiggen.ErrCommandTimeout), exitToolFailed},
+		{nil, errors.New("boom"), exitFailed},
+	}
+	for i, tt := range tests {
+		if got := exitCode(tt.changes, tt.err); got != tt.want {
+			t.Errorf("%d. exitCode(%v, %v) = %d; want %d", i, tt.changes, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// A minimal GCE client: the metadata server, the instance's default
+// service account token, and the few Compute Engine API calls needed
+// to resize a persistent disk.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var gceWait = flag.Duration("gce-wait", 15*time.Minute, "with gce grow, how long to wait for the persistent disk resize to take effect")
+
+var (
+	// gceMetadataEndpoint is the GCE metadata server.
+	gceMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1"
+	// gceComputeEndpoint is the Compute Engine API.
+	gceComputeEndpoint = "https://compute.googleapis.com/compute/v1"
+)
+
+// gcePollInterval is how often gce grow checks on a resize.
+var gcePollInterval = 2 * time.Second
+
+var gceMetadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// gceMetadata returns the instance metadata at path, like
+// "/instance/zone".
+func gceMetadata(path string) (string, error) {
+	req, err := http.NewRequest("GET", gceMetadataEndpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	res, err := gceMetadataClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("reading GCE metadata %s: %v", path, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("reading GCE metadata %s: %s", path, res.Status)
+	}
+	return string(body), nil
+}
+
+// gceDo calls the Compute Engine API as the instance's default service
+// account, decoding the JSON response into out if it's not nil. url is
+// either relative to gceComputeEndpoint or a full selfLink.
+func gceDo(method, url string, in, out interface{}) error {
+	js, err := gceMetadata("/instance/service-accounts/default/token")
+	if err != nil {
+		return err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(js), &tok); err != nil {
+		return fmt.Errorf("parsing service account token: %v", err)
+	}
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		url = gceComputeEndpoint + url
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s: %s", method, url, res.Status, bytes.TrimSpace(b))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// gceMain implements the "gce grow <mount-point> <size>" subcommand,
+// like aws grow for a GCE persistent disk.
+func gceMain(args []string) {
+	if len(args) != 3 || args[0] != "grow" {
+		usage()
+	}
+	mnt, size := args[1], args[2]
+	lim, err := resolveLimit(mnt)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	disk, err := backingDisk(mnt, lim)
+	if err != nil {
+		exitf(exitCode(nil, err), "error enlarging %s: %v", mnt, err)
+	}
+	if err := growGCE(disk, size); err != nil {
+		exitf(exitFailed, "error enlarging the persistent disk under %s: %v", mnt, err)
+	}
+	changes, err := grow(mnt, lim)
+	if err != nil {
+		exitf(exitCode(changes, err), "error enlarging %s: %v", mnt, err)
+	}
+	os.Exit(exitCode(changes, nil))
+}
+
+// gceDeviceName returns the device name disk was attached to the
+// instance as, from the links udev makes in /dev/disk/by-id.
+func gceDeviceName(disk string) (string, error) {
+	real, err := filepath.EvalSymlinks(disk)
+	if err != nil {
+		return "", err
+	}
+	links, _ := filepath.Glob("/dev/disk/by-id/google-*")
+	for _, l := range links {
+		if strings.Contains(filepath.Base(l), "-part") {
+			continue
+		}
+		if t, err := filepath.EvalSymlinks(l); err == nil && t == real {
+			return strings.TrimPrefix(filepath.Base(l), "google-"), nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't a GCE persistent disk", disk)
+}
+
+// A gceAttachedDisk is an entry in a GCE instance's disks.
+type gceAttachedDisk struct {
+	DeviceName string `json:"deviceName"`
+	Source     string `json:"source"` // the disk's URL
+	Type       string `json:"type"`   // PERSISTENT or SCRATCH
+}
+
+// gceDiskSource returns the URL of the persistent disk attached to
+// the instance as device.
+func gceDiskSource(disks []gceAttachedDisk, device string) (string, error) {
+	for _, d := range disks {
+		if d.DeviceName != device {
+			continue
+		}
+		if d.Type != "PERSISTENT" || d.Source == "" {
+			return "", fmt.Errorf("disk %s isn't a persistent disk", device)
+		}
+		return d.Source, nil
+	}
+	return "", fmt.Errorf("no disk %s attached to this instance", device)
+}
+
+// gceOperation is a Compute Engine long-running operation.
+type gceOperation struct {
+	SelfLink string `json:"selfLink"`
+	Status   string `json:"status"` // PENDING, RUNNING or DONE
+	Error    *struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// err returns the operation's error, if it failed.
+func (op *gceOperation) err() error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", op.Error.Errors[0].Message)
+}
+
+// growGCE enlarges the persistent disk behind disk per size, waits for
+// the resize operation to finish, and then for the kernel to see it.
+func growGCE(disk, size string) error {
+	device, err := gceDeviceName(disk)
+	if err != nil {
+		return err
+	}
+	project, err := gceMetadata("/project/project-id")
+	if err != nil {
+		return err
+	}
+	zone, err := gceMetadata("/instance/zone") // "projects/123/zones/us-central1-a"
+	if err != nil {
+		return err
+	}
+	name, err := gceMetadata("/instance/name")
+	if err != nil {
+		return err
+	}
+	var inst struct {
+		Disks []gceAttachedDisk `json:"disks"`
+	}
+	if err := gceDo("GET", "/projects/"+project+"/zones/"+filepath.Base(zone)+"/instances/"+name, nil, &inst); err != nil {
+		return err
+	}
+	src, err := gceDiskSource(inst.Disks, device)
+	if err != nil {
+		return err
+	}
+	var pd struct {
+		Name   string `json:"name"`
+		SizeGB string `json:"sizeGb"`
+	}
+	if err := gceDo("GET", src, nil, &pd); err != nil {
+		return err
+	}
+	cur, err := strconv.ParseInt(pd.SizeGB, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad size %q of disk %s", pd.SizeGB, pd.Name)
+	}
+	gib, err := ebsTargetGiB(cur, size)
+	if err != nil {
+		return err
+	}
+	if *dry {
+		dryRunf("would've resized persistent disk %s (%s) from %d GiB to %d GiB", pd.Name, disk, cur, gib)
+		return nil
+	}
+	infof("resizing persistent disk %s (%s) from %d GiB to %d GiB", pd.Name, disk, cur, gib)
+	var op gceOperation
+	if err := gceDo("POST", src+"/resize", map[string]string{"sizeGb": strconv.FormatInt(gib, 10)}, &op); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(*gceWait)
+	for op.Status != "DONE" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("resizing %s: still %s after %v", pd.Name, op.Status, *gceWait)
+		}
+		time.Sleep(gcePollInterval)
+		if err := gceDo("GET", op.SelfLink, nil, &op); err != nil {
+			return err
+		}
+		vlogf("%s: resize %s", pd.Name, op.Status)
+	}
+	if err := op.err(); err != nil {
+		return fmt.Errorf("resizing %s failed: %v", pd.Name, err)
+	}
+	for {
+		if n, err := embiggen.BlockDevSize(disk); err == nil && n >= gib<<30 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s grew but the kernel still doesn't see it after %v", pd.Name, *gceWait)
+		}
+		time.Sleep(gcePollInterval)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGCEDiskSource(t *testing.T) {
+	disks := []gceAttachedDisk{
+		{DeviceName: "persistent-disk-0", Source: "https://example.com/disks/boot", Type: "PERSISTENT"},
+		{DeviceName: "local-ssd-0", Type: "SCRATCH"},
+		{DeviceName: "data", Source: "https://example.com/disks/data", Type: "PERSISTENT"},
+	}
+	tests := []struct {
+		device, want string // want "" for an error
+	}{
+		{"data", "https://example.com/disks/data"},
+		{"persistent-disk-0", "https://example.com/disks/boot"},
+		{"local-ssd-0", ""},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		got, err := gceDiskSource(disks, tt.device)
+		if (err != nil) != (tt.want == "") || got != tt.want {
+			t.Errorf("gceDiskSource(%q) = %q, %v; want %q", tt.device, got, err, tt.want)
+		}
+	}
+}
+
+func TestGCEDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/instance/service-accounts/default/token":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "no Metadata-Flavor", http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"tok","expires_in":3599,"token_type":"Bearer"}`)
+		case "/compute/projects/p/zones/z/disks/data/resize":
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				http.Error(w, "bad token", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"status":"DONE","error":{"errors":[{"message":"quota exceeded"}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(m, c string) { gceMetadataEndpoint, gceComputeEndpoint = m, c }(gceMetadataEndpoint, gceComputeEndpoint)
+	gceMetadataEndpoint, gceComputeEndpoint = srv.URL+"/metadata", srv.URL+"/compute"
+
+	var op gceOperation
+	if err := gceDo("POST", "/projects/p/zones/z/disks/data/resize", map[string]string{"sizeGb": "200"}, &op); err != nil {
+		t.Fatal(err)
+	}
+	if op.Status != "DONE" || op.err() == nil || op.err().Error() != "quota exceeded" {
+		t.Errorf("op = %+v, err %v; want DONE with quota exceeded", op, op.err())
+	}
+	if err := gceDo("GET", "/projects/p/zones/z/disks/missing", nil, nil); err == nil {
+		t.Errorf("GET of a missing disk succeeded")
+	}
+}
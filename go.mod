@@ -3,7 +3,7 @@ module github.com/bwagner5/embiggen-disk
 go 1.15
 
 require (
-	github.com/samber/lo v1.38.1
 	github.com/u-root/u-root v0.0.0-20180806213625-12f9029297cf
 	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,366 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// The gRPC management API is the embiggen.v1.Manager service in
+// embiggen.proto. It's served over HTTP/2 with net/http and encoded
+// by hand, like the AWS APIs, rather than pulling in gRPC and
+// protobuf code generation.
+
+var (
+	grpcAddr     = flag.String("grpc-addr", "", "in daemon mode, serve the gRPC management API (see embiggen.proto) on this address, e.g. \":9324\", with mutual TLS")
+	grpcCert     = flag.String("grpc-cert", "", "TLS certificate file for -grpc-addr")
+	grpcKey      = flag.String("grpc-key", "", "TLS key file for -grpc-addr")
+	grpcClientCA = flag.String("grpc-client-ca", "", "CA certificate file that -grpc-addr clients' certificates must be signed by")
+)
+
+// gRPC status codes.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+)
+
+// A grpcError is an RPC failure with a gRPC status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// serveGRPC serves the management API on -grpc-addr in the
+// background. It needs a certificate, key and client CA: it's only
+// served with mutual TLS.
+func serveGRPC() error {
+	if *grpcCert == "" || *grpcKey == "" || *grpcClientCA == "" {
+		return errors.New("-grpc-addr needs -grpc-cert, -grpc-key and -grpc-client-ca")
+	}
+	cert, err := tls.LoadX509KeyPair(*grpcCert, *grpcKey)
+	if err != nil {
+		return err
+	}
+	caPEM, err := ioutil.ReadFile(*grpcClientCA)
+	if err != nil {
+		return err
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no certificates in %s", *grpcClientCA)
+	}
+	ln, err := net.Listen("tcp", *grpcAddr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler: grpcHandler(),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    cas,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			NextProtos:   []string{"h2"},
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	go func() {
+		err := srv.ServeTLS(ln, "", "")
+		warnf("serving gRPC on %s: %v", *grpcAddr, err)
+	}()
+	return nil
+}
+
+// grpcMethods are the management API's methods, by path. Each takes
+// and returns an encoded protobuf message.
+var grpcMethods = map[string]func(req []byte) ([]byte, error){
+	"/embiggen.v1.Manager/Plan":   grpcPlan,
+	"/embiggen.v1.Manager/Resize": grpcResize,
+	"/embiggen.v1.Manager/Status": grpcStatus,
+}
+
+func grpcHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.ProtoMajor != 2 {
+			http.Error(w, "gRPC needs POST over HTTP/2", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		resp, err := grpcCall(r)
+		if err == nil {
+			frame := make([]byte, 5, 5+len(resp))
+			binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+			w.Write(append(frame, resp...))
+		}
+		code, msg := grpcOK, ""
+		var ge *grpcError
+		switch {
+		case errors.As(err, &ge):
+			code, msg = ge.code, ge.msg
+		case err != nil:
+			code, msg = grpcInternal, err.Error()
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+	})
+}
+
+// grpcCall reads the single request message in r and calls the method
+// it's for.
+func grpcCall(r *http.Request) ([]byte, error) {
+	m, ok := grpcMethods[r.URL.Path]
+	if !ok {
+		return nil, grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 1<<20))
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "reading request: %v", err)
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return nil, grpcErrorf(grpcInvalidArgument, "want one length-prefixed message")
+	}
+	if body[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages aren't supported")
+	}
+	return m(body[5:])
+}
+
+// grpcEscape percent-encodes a grpc-message.
+func grpcEscape(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+// grpcMount returns the mount field (1) of a PlanRequest or
+// ResizeRequest, and ResizeRequest's dry_run (2).
+func grpcMount(req []byte) (mnt string, dryRun bool, err error) {
+	err = pbDecode(req, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			mnt = string(b)
+		case 2:
+			dryRun = v != 0
+		}
+	})
+	if err == nil && mnt == "" {
+		err = grpcErrorf(grpcInvalidArgument, "missing mount")
+	}
+	return
+}
+
+func grpcPlan(req []byte) ([]byte, error) {
+	mnt, _, err := grpcMount(req)
+	if err != nil {
+		return nil, err
+	}
+	lim, err := resolveLimit(mnt)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		return nil, grpcErrorf(grpcFailedPrecondition, "%v", err)
+	}
+	nodes, err := planStack(e)
+	if err != nil {
+		return nil, grpcErrorf(grpcFailedPrecondition, "%v", err)
+	}
+	var resp pbBuf
+	for _, n := range nodes {
+		var l pbBuf
+		l.str(1, n.name)
+		l.int(2, n.cur)
+		if n.attainable {
+			l.int(3, n.att)
+		}
+		l.str(4, n.info)
+		if n.err != nil {
+			l.str(5, n.err.Error())
+		}
+		l.bool(6, n.growable())
+		resp.msg(1, l)
+	}
+	return resp, nil
+}
+
+// grpcResize grows a target through the daemon's loop, so it's never
+// resized twice at once, and with the request's dry_run, or if the
+// daemon has -dry-run, changes nothing.
+func grpcResize(req []byte) ([]byte, error) {
+	mnt, dryRun, err := grpcMount(req)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := controlResize(mnt, dryRun)
+	switch {
+	case errors.Is(err, errShuttingDown):
+		return nil, grpcErrorf(grpcUnavailable, "%v", err)
+	case errors.Is(err, errUnknownTarget):
+		return nil, grpcErrorf(grpcNotFound, "%v", err)
+	case rep == nil:
+		return nil, grpcErrorf(grpcFailedPrecondition, "%v", err)
+	}
+	var resp pbBuf
+	for _, c := range rep.Changes {
+		var m pbBuf
+		m.str(1, c.Layer)
+		m.str(2, c.Device)
+		m.str(3, c.Resizer)
+		m.int(4, c.BeforeBytes)
+		m.int(5, c.AfterBytes)
+		m.int(6, int64(c.Duration))
+		resp.msg(1, m)
+	}
+	resp.str(2, rep.Error)
+	resp.bool(3, rep.DryRun)
+	for _, lc := range rep.Commands {
+		resp.str(4, lc.Command)
+	}
+	return resp, nil
+}
+
+func grpcStatus(req []byte) ([]byte, error) {
+	ds := status()
+	var resp pbBuf
+	resp.bool(1, ds.Healthy)
+	for _, ts := range ds.Targets {
+		var m pbBuf
+		m.str(1, ts.Mount)
+		m.str(2, ts.LastError)
+		m.int(3, int64(ts.FailuresInARow))
+		m.bool(4, ts.GaveUp)
+		m.bool(5, ts.Paused)
+		if ts.LastCheck != nil {
+			m.int(6, ts.LastCheck.Unix())
+		}
+		resp.msg(2, m)
+	}
+	return resp, nil
+}
+
+// A pbBuf is an encoded protobuf message. Zero values are left out, as
+// proto3 does.
+type pbBuf []byte
+
+func (b *pbBuf) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*b = append(*b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (b *pbBuf) tag(field, wireType int) { b.varint(uint64(field<<3 | wireType)) }
+
+func (b *pbBuf) int(field int, v int64) {
+	if v != 0 {
+		b.tag(field, 0)
+		b.varint(uint64(v))
+	}
+}
+
+func (b *pbBuf) bool(field int, v bool) {
+	if v {
+		b.int(field, 1)
+	}
+}
+
+func (b *pbBuf) str(field int, s string) {
+	if s != "" {
+		b.tag(field, 2)
+		b.varint(uint64(len(s)))
+		*b = append(*b, s...)
+	}
+}
+
+// msg appends an embedded message, even if it's empty, as it may be
+// one of a repeated field.
+func (b *pbBuf) msg(field int, m pbBuf) {
+	b.tag(field, 2)
+	b.varint(uint64(len(m)))
+	*b = append(*b, m...)
+}
+
+// pbDecode calls f with each field of the protobuf message b: v for
+// varints and b for length-delimited fields. Fixed-width fields are
+// skipped.
+func pbDecode(b []byte, f func(field int, v uint64, b []byte)) error {
+	errBad := grpcErrorf(grpcInvalidArgument, "malformed message")
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errBad
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errBad
+			}
+			b = b[n:]
+			f(field, v, nil)
+		case 1:
+			if len(b) < 8 {
+				return errBad
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errBad
+			}
+			f(field, 0, b[n:n+int(l)])
+			b = b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errBad
+			}
+			b = b[4:]
+		default:
+			return errBad
+		}
+	}
+	return nil
+}
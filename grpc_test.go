@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+func TestGRPC(t *testing.T) {
+	srv := httptest.NewUnstartedServer(grpcHandler())
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case req := <-controls:
+				if req.mnt == "/nope" {
+					req.reply <- fmt.Errorf("%s: %w", req.mnt, errUnknownTarget)
+					continue
+				}
+				*req.report = report{Mount: req.mnt, DryRun: req.dryRun, Changes: []embiggen.Change{
+					{Layer: "filesystem", Device: "/dev/sda1", BeforeBytes: 1 << 30, AfterBytes: 2 << 30},
+				}}
+				req.reply <- nil
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	call := func(method string, msg pbBuf) (resp []byte, code string) {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		res, err := srv.Client().Post(srv.URL+"/embiggen.v1.Manager/"+method, "application/grpc", bytes.NewReader(append(frame, msg...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) >= 5 {
+			resp = body[5:]
+		}
+		return resp, res.Trailer.Get("Grpc-Status")
+	}
+
+	var req pbBuf
+	req.str(1, "/var")
+	req.bool(2, true)
+	resp, code := call("Resize", req)
+	if code != "0" {
+		t.Fatalf("Resize: grpc-status %s; want 0", code)
+	}
+	var change []byte
+	var dryRun bool
+	if err := pbDecode(resp, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			change = b
+		case 3:
+			dryRun = v != 0
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var after uint64
+	pbDecode(change, func(field int, v uint64, b []byte) {
+		if field == 5 {
+			after = v
+		}
+	})
+	if !dryRun || after != 2<<30 {
+		t.Errorf("Resize: dry_run %v, after_bytes %d; want true, %d", dryRun, after, 2<<30)
+	}
+
+	tests := []struct {
+		method string
+		mnt    string
+		want   string
+	}{
+		{"Resize", "/nope", "5"},
+		{"Plan", "", "3"},
+		{"Status", "", "0"},
+		{"Shrink", "/", "12"},
+	}
+	for _, tt := range tests {
+		var req pbBuf
+		req.str(1, tt.mnt)
+		if _, code := call(tt.method, req); code != tt.want {
+			t.Errorf("%s %q: grpc-status %s; want %s", tt.method, tt.mnt, code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var guestExecTimeout = flag.Duration("guest-exec-timeout", time.Minute, "with guest-exec, how long to run before stopping once the step in progress is done and printing the result so far")
+
+// A guestExecResult is the single JSON object guest-exec prints.
+type guestExecResult struct {
+	OK       bool      `json:"ok"` // nothing failed
+	Changed  bool      `json:"changed"`
+	ExitCode int       `json:"exitCode"`
+	TimedOut bool      `json:"timedOut,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Reports  []*report `json:"reports"`
+}
+
+// guestExecMain implements the "guest-exec [mount-point...]"
+// subcommand, for running through qemu-guest-agent's guest-exec or
+// similar: it grows the targets and prints one line of JSON on stdout,
+// with nothing else there and no colors, stopping after
+// -guest-exec-timeout once the step in progress is done.
+func guestExecMain(args []string) {
+	colorStdout, colorStderr = false, false
+	*quiet, curLevel = true, levelError
+	// Anything else that would be printed, like -dry-run messages,
+	// goes to stderr.
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	res := guestExec(args, *guestExecTimeout)
+	writeGuestExecResult(stdout, res)
+	os.Exit(res.ExitCode)
+}
+
+// guestExec grows the targets, mnts or else the config's, within
+// timeout.
+func guestExec(mnts []string, timeout time.Duration) *guestExecResult {
+	res := &guestExecResult{Reports: []*report{}}
+	if len(mnts) == 0 {
+		mnts = cfg.mounts()
+	}
+	if len(mnts) == 0 {
+		res.ExitCode, res.Error = exitUsage, errNoTargets.Error()
+		return res
+	}
+	// Each target's report is sent when it's done, so a timeout still
+	// reports the ones that finished.
+	reports := make(chan *report)
+	errc := make(chan error, 1)
+	go func() {
+		for _, mnt := range mnts {
+			if shuttingDown() {
+				break
+			}
+			lim, err := resolveLimit(mnt)
+			if err != nil {
+				errc <- fmt.Errorf("%s: %w", mnt, err)
+				return
+			}
+			rep, err := growReport(runCtx, mnt, lim)
+			if rep == nil {
+				rep = &report{Mount: mnt, DryRun: *dry, Changes: []embiggen.Change{}}
+			}
+			if err != nil {
+				rep.Error = err.Error()
+			}
+			reports <- rep
+			if err != nil {
+				errc <- fmt.Errorf("%s: %w", mnt, err)
+				return
+			}
+		}
+		errc <- nil
+	}()
+	// At the deadline, the resize stops once the step in progress is
+	// done, as on the daemon's SIGTERM, rather than being cut off.
+	deadline := time.After(timeout)
+	var changes []embiggen.Change
+	for {
+		select {
+		case rep := <-reports:
+			res.Reports = append(res.Reports, rep)
+			changes = append(changes, rep.Changes...)
+			continue
+		case <-deadline:
+			res.TimedOut = true
+			close(shutdown)
+			continue
+		case err := <-errc:
+			res.ExitCode = exitCode(changes, err)
+			if err != nil {
+				res.Error = err.Error()
+			}
+		}
+		break
+	}
+	if res.TimedOut {
+		res.ExitCode = exitFailed
+		res.Error = fmt.Sprintf("timed out after %v; stopped once the step in progress was done", timeout)
+	}
+	res.OK = res.Error == ""
+	res.Changed = len(changes) > 0
+	return res
+}
+
+// writeGuestExecResult writes res as one line of JSON.
+func writeGuestExecResult(w io.Writer, res *guestExecResult) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"ok":false,"exitCode":%d,"error":%q}`, exitFailed, err.Error()))
+	}
+	fmt.Fprintf(w, "%s\n", b)
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestGuestExec(t *testing.T) {
+	tests := []struct {
+		name     string
+		mnts     []string
+		exitCode int
+	}{
+		{"no targets", nil, exitUsage},
+		{"not a mount point", []string{"/nonexistent/embiggen-test"}, exitFailed},
+	}
+	for _, tt := range tests {
+		res := guestExec(tt.mnts, time.Minute)
+		if res.OK || res.ExitCode != tt.exitCode || res.Error == "" {
+			t.Errorf("%s: result %+v; want a failure with exit code %d", tt.name, res, tt.exitCode)
+		}
+		var buf bytes.Buffer
+		writeGuestExecResult(&buf, res)
+		if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 1 {
+			t.Errorf("%s: output has %d lines; want 1", tt.name, n)
+		}
+		var got guestExecResult
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got.ExitCode != tt.exitCode || got.Reports == nil {
+			t.Errorf("%s: output %q doesn't round-trip: %v", tt.name, buf.Bytes(), err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var (
+	preResizeHook      = flag.String("pre-resize-hook", "", "shell command to run before resizing a target that has room to grow; if it exits non-zero, the target isn't resized this time")
+	afterPartitionHook = flag.String("after-partition-hook", "", "shell command to run after a partition is grown, e.g. to reinstall a bootloader; gets the changes like -post-resize-hook")
+	afterLVMHook       = flag.String("after-lvm-hook", "", "shell command to run after an LVM PV or LV is grown; gets the changes like -post-resize-hook")
+	afterFSHook        = flag.String("after-fs-hook", "", "shell command to run after a filesystem is grown; gets the changes like -post-resize-hook")
+	quiesceHook        = flag.String("quiesce-hook", "", "shell command to run with EMBIGGEN_QUIESCE=freeze before a partition table under a mounted filesystem is rewritten, for applications to quiesce, and with EMBIGGEN_QUIESCE=thaw after; both are bounded by -freeze-timeout")
+	postResizeHook     = flag.String("post-resize-hook", "", "shell command to run after a target is resized, e.g. \"systemctl restart kubelet\"; it gets the changes as JSON on stdin and in EMBIGGEN_* environment variables")
+	hookTimeout        = flag.Duration("hook-timeout", 5*time.Minute, "how long a hook may run before it and the processes it started are killed; 0 for no limit")
+)
+
+// hooksFor returns the hooks for the target mnt: the config file's
+// top-level ones, with those the target sets itself in their place.
+func hooksFor(mnt string) hooksConfig {
+	h := cfg.Hooks
+	t := cfg.target(mnt)
+	if t == nil {
+		return h
+	}
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&h.PreResize, t.Hooks.PreResize},
+		{&h.AfterPartition, t.Hooks.AfterPartition},
+		{&h.AfterLVM, t.Hooks.AfterLVM},
+		{&h.AfterFS, t.Hooks.AfterFS},
+		{&h.PostResize, t.Hooks.PostResize},
+		{&h.Quiesce, t.Hooks.Quiesce},
+		{&h.Timeout, t.Hooks.Timeout},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+	return h
+}
+
+// hookTimeoutFor returns how long hooks for the target mnt may run,
+// from -hook-timeout or else the config file.
+func hookTimeoutFor(mnt string) time.Duration {
+	if s := hooksFor(mnt).Timeout; s != "" && !flagGiven("hook-timeout") {
+		d, _ := time.ParseDuration(s) // checked by loadConfig
+		return d
+	}
+	return *hookTimeout
+}
+
+// runHook runs the shell command hook, named name in messages, for the
+// target mnt. The changes are passed as JSON on stdin, and summarized
+// in the environment along with env. It's killed, with any processes
+// it started, when ctx is done or it runs past the hook timeout.
+func runHook(ctx context.Context, name, hook, mnt string, changes []embiggen.Change, env ...string) error {
+	if hook == "" {
+		return nil
+	}
+	stdin, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	if d := hookTimeoutFor(mnt); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(append(os.Environ(), hookEnv(mnt, changes)...), env...)
+	// In its own process group, so that what it started is killed with
+	// it rather than holding its output open.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	vlogf("running %s hook: %s", name, hook)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s hook %q: %v", name, hook, err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-stop:
+		}
+	}()
+	err = cmd.Wait()
+	if out.Len() > 0 {
+		vlogf("%s hook output: %s", name, out.Bytes())
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s hook %q: killed: %v; output: %s", name, hook, ctx.Err(), out.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %q: %v; output: %s", name, hook, err, out.Bytes())
+	}
+	return nil
+}
+
+// preResize runs the pre-resize hook, if any, for the target mnt that
+// e is the top of. It returns false if the hook vetoed growing it.
+func preResize(ctx context.Context, mnt string, e embiggen.Resizer, lim embiggen.Limit) bool {
+	hook := flagOr("pre-resize-hook", *preResizeHook, hooksFor(mnt).PreResize)
+	if hook == "" {
+		return true
+	}
+	// Only bother the hook if there's something to do.
+	n, err := reclaimable(e)
+	if err != nil || n < reclaimThreshold(lim.MinGrowth) {
+		return true
+	}
+	if dryRun(ctx) {
+		dryRunf("would've run pre-resize hook: %s", hook)
+		return true
+	}
+	if err := runHook(ctx, "pre-resize", hook, mnt, nil, "EMBIGGEN_RECLAIMABLE_BYTES="+strconv.FormatInt(n, 10)); err != nil {
+		infof("%s: not growing this time: %v", mnt, err)
+		return false
+	}
+	return true
+}
+
+// quiesce is engineOpts.Quiesce: it runs the quiesce hook, if any, for
+// the target mnt, and returns a func that runs it again to thaw. The
+// hook is killed when ctx, which -freeze-timeout bounds, is done, and
+// the thaw is bounded by -freeze-timeout on its own.
+func quiesce(ctx context.Context, mnt string) (func() error, error) {
+	hook := flagOr("quiesce-hook", *quiesceHook, hooksFor(mnt).Quiesce)
+	if hook == "" {
+		return nil, nil
+	}
+	if dryRun(ctx) {
+		dryRunf("would've run quiesce hook: %s", hook)
+		return nil, nil
+	}
+	if err := runHook(ctx, "quiesce", hook, mnt, nil, "EMBIGGEN_QUIESCE=freeze"); err != nil {
+		return nil, err
+	}
+	return func() error {
+		// Not ctx, which is done by the time it's thawed.
+		tctx, cancel := context.WithTimeout(context.Background(), embiggen.OptionsFrom(ctx).FreezeTimeout)
+		defer cancel()
+		return runHook(tctx, "quiesce", hook, mnt, nil, "EMBIGGEN_QUIESCE=thaw")
+	}, nil
+}
+
+// layerHooks runs the per-layer hooks, if any, for those layers that
+// changed, each with just the changes to its layers.
+func layerHooks(mnt string, changes []embiggen.Change) {
+	hooks := hooksFor(mnt)
+	for _, h := range []struct {
+		name, hook string
+		layers     []string
+	}{
+		{"after-partition", flagOr("after-partition-hook", *afterPartitionHook, hooks.AfterPartition), []string{"partition"}},
+		{"after-lvm", flagOr("after-lvm-hook", *afterLVMHook, hooks.AfterLVM), []string{"lvm-pv", "lvm-vg", "lvm-lv"}},
+		{"after-fs", flagOr("after-fs-hook", *afterFSHook, hooks.AfterFS), []string{"filesystem"}},
+	} {
+		if h.hook == "" {
+			continue
+		}
+		var mine []embiggen.Change
+		for _, c := range changes {
+			for _, l := range h.layers {
+				if c.Layer == l {
+					mine = append(mine, c)
+				}
+			}
+		}
+		if len(mine) == 0 {
+			continue
+		}
+		if err := runHook(runCtx, h.name, h.hook, mnt, mine); err != nil {
+			warnf("%v", err)
+		}
+	}
+}
+
+// hookEnv returns the environment variables describing changes to
+// mnt, for hooks.
+func hookEnv(mnt string, changes []embiggen.Change) []string {
+	env := []string{
+		"EMBIGGEN_MOUNT=" + mnt,
+		"EMBIGGEN_CHANGES=" + strconv.Itoa(len(changes)),
+		"EMBIGGEN_DRY_RUN=" + strconv.FormatBool(*dry),
+	}
+	// Changes are bottom layer first, so the last is the top.
+	if n := len(changes); n > 0 {
+		c := changes[n-1]
+		env = append(env,
+			"EMBIGGEN_LAYER="+c.Layer,
+			"EMBIGGEN_DEVICE="+c.Device,
+			"EMBIGGEN_BEFORE_BYTES="+strconv.FormatInt(c.BeforeBytes, 10),
+			"EMBIGGEN_AFTER_BYTES="+strconv.FormatInt(c.AfterBytes, 10),
+		)
+	}
+	return env
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHookTimeout(t *testing.T) {
+	defer func(d time.Duration) { *hookTimeout = d }(*hookTimeout)
+	*hookTimeout = 200 * time.Millisecond
+
+	if err := runHook(context.Background(), "test", "echo $EMBIGGEN_MOUNT", "/data", nil); err != nil {
+		t.Errorf("quick hook: %v", err)
+	}
+	// The background sleep holds the hook's output open; it must be
+	// killed too.
+	t0 := time.Now()
+	err := runHook(context.Background(), "test", "sleep 10 & sleep 10", "/data", nil)
+	if err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("hung hook error = %v; want it killed", err)
+	}
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Errorf("hung hook took %v to kill", d)
+	}
+}
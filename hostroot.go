@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+	"golang.org/x/sys/unix"
+)
+
+var hostRoot = flag.String("host-root", "", "when running in a privileged container, where the host's root filesystem is, like /host (a bind mount of /) or /proc/1/root (with the host's PID namespace); embiggen-disk chroots there first, so mount points, devices, config and tools are the host's")
+
+// enterHostRoot switches to the -host-root filesystem, if any. A Go
+// program can't setns(2) into another mount namespace, as it's always
+// multithreaded, but chrooting into the host's root reaches the host's
+// mounts: through the bind mount's submounts, or through /proc/1/root,
+// which is in the host's mount namespace.
+func enterHostRoot() error {
+	if *hostRoot == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(*hostRoot, "proc/1/mounts")); err != nil {
+		return fmt.Errorf("-host-root %s doesn't look like the host's root, with /proc mounted: %v", *hostRoot, err)
+	}
+	if err := unix.Chroot(*hostRoot); err != nil {
+		return fmt.Errorf("chroot %s: %v", *hostRoot, err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	// Our own mount table is the container's; the host's is init's.
+	embiggen.MountInfoFile = "/proc/1/mountinfo"
+	return nil
+}
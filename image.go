@@ -0,0 +1,295 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var imagePartition = flag.Int("image-partition", 0, "with image, the number of the partition to grow; 0 for the last one")
+
+// imageSettle is how long to wait for an attached image's device and
+// partitions to appear.
+const imageSettle = 10 * time.Second
+
+// qcow2Magic starts a qcow2 image file.
+var qcow2Magic = []byte("QFI\xfb")
+
+// imageMain implements the "image <file> <size>" subcommand: it
+// enlarges the raw or qcow2 disk image file to size ("20G") or by it
+// ("+5G"), attaches it with a loop device or qemu-nbd, grows a
+// partition and the filesystem on it, and detaches it again.
+func imageMain(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	if runtime.GOOS != "linux" {
+		exitf(exitUsage, "image needs Linux loop and NBD devices")
+	}
+	img, size := args[0], args[1]
+	changes, err := growImage(img, size)
+	if err != nil {
+		exitf(exitCode(changes, err), "error enlarging %s: %v", img, err)
+	}
+	os.Exit(exitCode(changes, nil))
+}
+
+// imageFormat returns "qcow2" or "raw", from img's header.
+func imageFormat(img string) (string, error) {
+	f, err := os.Open(img)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hdr := make([]byte, len(qcow2Magic))
+	if _, err := f.Read(hdr); err == nil && bytes.Equal(hdr, qcow2Magic) {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+// imageSize returns the size of the disk in img, in bytes.
+func imageSize(img, format string) (int64, error) {
+	if format == "raw" {
+		fi, err := os.Stat(img)
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	out, err := runImageTool("qemu-img", "info", "--output=json", "-f", format, img)
+	if err != nil {
+		return 0, err
+	}
+	var info struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return 0, fmt.Errorf("qemu-img info: %v", err)
+	}
+	return info.VirtualSize, nil
+}
+
+// runImageTool runs the external tool name, returning its output, and
+// its output in the error if it fails.
+func runImageTool(name string, args ...string) ([]byte, error) {
+	path, err := embiggen.LookTool(runCtx, name)
+	if err != nil {
+		return nil, embiggen.ErrToolMissing{Tool: name}
+	}
+	cmd := exec.Command(path, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
+
+// growImage implements imageMain.
+func growImage(img, size string) ([]embiggen.Change, error) {
+	format, err := imageFormat(img)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := imageSize(img, format)
+	if err != nil {
+		return nil, err
+	}
+	var sf sizeFlag
+	if err := sf.Set(size); err != nil {
+		return nil, err
+	}
+	want := (sf.resolve(cur) + 511) &^ 511
+	if want < cur {
+		return nil, fmt.Errorf("%s is smaller than the image's %s; images aren't shrunk", size, embiggen.HumanSize(cur))
+	}
+	if *dry {
+		dryRunf("would've grown %s image %s from %s to %s, and the partition and filesystem in it", format, img, embiggen.HumanSize(cur), embiggen.HumanSize(want))
+		return nil, nil
+	}
+	if want > cur {
+		infof("growing %s image %s from %s to %s", format, img, embiggen.HumanSize(cur), embiggen.HumanSize(want))
+		if format == "raw" {
+			err = os.Truncate(img, want)
+		} else {
+			_, err = runImageTool("qemu-img", "resize", "-f", format, img, strconv.FormatInt(want, 10))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dev, detach, err := attachImage(img, format)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := detach(); err != nil {
+			warnf("detaching %s: %v", dev, err)
+		}
+	}()
+	part, err := imagePartitionDev(dev, *imagePartition)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "embiggen-image")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	if _, err := runImageTool("mount", part, dir); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if _, err := runImageTool("umount", dir); err != nil {
+			warnf("%v", err)
+		}
+	}()
+	lim, err := resolveLimit(dir)
+	if err != nil {
+		return nil, err
+	}
+	return grow(dir, lim)
+}
+
+// attachImage attaches img as a block device, with partitions: a raw
+// image as a loop device, and a qcow2 one with qemu-nbd. It returns the
+// device and a func to detach it.
+func attachImage(img, format string) (dev string, detach func() error, err error) {
+	if format == "raw" {
+		out, err := runImageTool("losetup", "--find", "--show", "--partscan", img)
+		if err != nil {
+			return "", nil, err
+		}
+		dev = strings.TrimSpace(string(out))
+		return dev, func() error {
+			_, err := runImageTool("losetup", "--detach", dev)
+			return err
+		}, nil
+	}
+	if _, err := os.Stat("/sys/block/nbd0"); err != nil {
+		if _, err := runImageTool("modprobe", "nbd", "max_part=16"); err != nil {
+			return "", nil, err
+		}
+	}
+	if dev, err = freeNBD(); err != nil {
+		return "", nil, err
+	}
+	if _, err := runImageTool("qemu-nbd", "--connect="+dev, "--format="+format, img); err != nil {
+		return "", nil, err
+	}
+	detach = func() error {
+		_, err := runImageTool("qemu-nbd", "--disconnect", dev)
+		return err
+	}
+	for t0 := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		if n, err := embiggen.BlockDevSize(dev); err == nil && n > 0 {
+			return dev, detach, nil
+		}
+		if time.Since(t0) > imageSettle {
+			detach()
+			return "", nil, fmt.Errorf("%s didn't appear after qemu-nbd connected it", dev)
+		}
+	}
+}
+
+// freeNBD returns an NBD device that isn't connected.
+func freeNBD() (string, error) {
+	nbds, _ := filepath.Glob("/sys/block/nbd*")
+	sort.Slice(nbds, func(i, j int) bool {
+		ni, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(nbds[i]), "nbd"))
+		nj, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(nbds[j]), "nbd"))
+		return ni < nj
+	})
+	for _, sys := range nbds {
+		if _, err := os.Stat(sys + "/pid"); err == nil {
+			continue // connected
+		}
+		if b, err := ioutil.ReadFile(sys + "/size"); err == nil && strings.TrimSpace(string(b)) == "0" {
+			return "/dev/" + filepath.Base(sys), nil
+		}
+	}
+	return "", errors.New("no free NBD device")
+}
+
+// imagePartitionDev returns the device of partition n of the attached
+// image dev, or of its last partition if n is 0, waiting for the
+// kernel to find them. An image without partitions is taken to hold a
+// filesystem itself.
+func imagePartitionDev(dev string, n int) (string, error) {
+	for t0 := time.Now(); ; time.Sleep(100 * time.Millisecond) {
+		parts := diskPartitions(filepath.Base(dev))
+		if len(parts) > 0 {
+			if n == 0 {
+				return "/dev/" + parts[len(parts)-1].name, nil
+			}
+			for _, p := range parts {
+				if p.n == n {
+					return "/dev/" + p.name, nil
+				}
+			}
+			return "", fmt.Errorf("%s has no partition %d", dev, n)
+		}
+		if time.Since(t0) > imageSettle {
+			if n != 0 {
+				return "", fmt.Errorf("%s has no partitions", dev)
+			}
+			return dev, nil
+		}
+	}
+}
+
+// An imagePart is a partition of an attached image.
+type imagePart struct {
+	name string // "loop0p2"
+	n    int    // 2
+}
+
+// diskPartitions returns the partitions the kernel knows of on the
+// disk named disk, like "loop0", in order.
+func diskPartitions(disk string) []imagePart {
+	var parts []imagePart
+	fis, _ := ioutil.ReadDir("/sys/block/" + disk)
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join("/sys/block", disk, fi.Name(), "partition"))
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			parts = append(parts, imagePart{fi.Name(), n})
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].n < parts[j].n })
+	return parts
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embiggen-image-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range []struct {
+		data string
+		want string
+	}{
+		{"QFI\xfb\x00\x00\x00\x03", "qcow2"},
+		{"\xeb\x63\x90", "raw"},
+		{"", "raw"},
+	} {
+		img := filepath.Join(dir, "img")
+		if err := ioutil.WriteFile(img, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := imageFormat(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("imageFormat(%q) = %q; want %q", tt.data, got, tt.want)
+		}
+	}
+}
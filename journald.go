@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/sys/unix"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalConn is the connection to journald with -log-format=journald.
+var journalConn *net.UnixConn
+
+// underJournal reports whether stderr is connected to journald, as it
+// is for a systemd service by default.
+func underJournal() bool {
+	js := os.Getenv("JOURNAL_STREAM") // "dev:ino"
+	if js == "" {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return js == fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// setupJournal connects to journald for -log-format=journald.
+func setupJournal() error {
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	journalConn = c
+	return nil
+}
+
+// journalPriorities maps log levels to syslog priorities.
+var journalPriorities = map[logLevel]int{
+	levelError: 3,
+	levelWarn:  4,
+	levelInfo:  6,
+	levelDebug: 7,
+}
+
+// journalField returns the journal field name for a logFields key,
+// like "BEFORE_BYTES" for "beforeBytes".
+func journalField(k string) string {
+	var sb strings.Builder
+	for i, r := range k {
+		switch {
+		case unicode.IsUpper(r) && i > 0:
+			sb.WriteByte('_')
+			sb.WriteRune(r)
+		case r >= 'a' && r <= 'z':
+			sb.WriteRune(unicode.ToUpper(r))
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9' && i > 0:
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return strings.TrimLeft(sb.String(), "_")
+}
+
+// journalEntry encodes a log event in journald's native protocol.
+func journalEntry(level logLevel, msg string, f logFields) []byte {
+	var buf bytes.Buffer
+	add := func(k, v string) {
+		if !strings.Contains(v, "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+			return
+		}
+		buf.WriteString(k + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(v)))
+		buf.WriteString(v + "\n")
+	}
+	add("MESSAGE", msg)
+	add("PRIORITY", fmt.Sprint(journalPriorities[level]))
+	add("SYSLOG_IDENTIFIER", "embiggen-disk")
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := f[k]
+		if d, ok := v.(time.Duration); ok {
+			v = d.Seconds()
+		}
+		if name := journalField(k); name != "" {
+			add(name, fmt.Sprint(v))
+		}
+	}
+	return buf.Bytes()
+}
+
+// journalSend sends a log event to journald, returning false if it
+// couldn't, in which case it should go to stderr instead.
+func journalSend(level logLevel, msg string, f logFields) bool {
+	if journalConn == nil {
+		return false
+	}
+	_, err := journalConn.Write(journalEntry(level, msg, f))
+	return err == nil
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestJournalEntry(t *testing.T) {
+	got := string(journalEntry(levelError, "resize failed", logFields{
+		"mount":       "/var",
+		"beforeBytes": 10,
+		"error":       errors.New("lvextend:\nexit status 5"),
+	}))
+	want := "MESSAGE=resize failed\n" +
+		"PRIORITY=3\n" +
+		"SYSLOG_IDENTIFIER=embiggen-disk\n" +
+		"BEFORE_BYTES=10\n" +
+		"ERROR\n\x17\x00\x00\x00\x00\x00\x00\x00lvextend:\nexit status 5\n" +
+		"MOUNT=/var\n"
+	if got != want {
+		t.Errorf("journalEntry =\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	k8sEvents   = flag.Bool("k8s-events", true, "on a Kubernetes node, post an Event on the Node whenever a target is resized or fails to resize")
+	k8sAnnotate = flag.Bool("k8s-annotate", false, "on a Kubernetes node, also annotate the Node with embiggen-disk/last-resize")
+	kubeconfig  = flag.String("kubeconfig", "", "kubeconfig file for the Kubernetes API, such as kubelet's; by default, the pod's service account if running in a cluster")
+	k8sNode     = flag.String("k8s-node", os.Getenv("NODE_NAME"), "this host's Kubernetes Node name; by default the hostname")
+)
+
+// saDir is where a pod's service account credentials are mounted.
+const saDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// A kubeClient calls the Kubernetes API. Like the AWS APIs, it's
+// spoken directly rather than with client-go.
+type kubeClient struct {
+	server    string // "https://10.0.0.1:443"
+	client    *http.Client
+	token     string
+	tokenFile string // re-read for each call, as it's rotated
+}
+
+// newKubeClient returns a client using kubeconfigPath if set, or else
+// the pod's service account. It returns nil and no error if there are
+// no credentials, as when not running on Kubernetes.
+func newKubeClient(kubeconfigPath string) (*kubeClient, error) {
+	if kubeconfigPath != "" {
+		return loadKubeconfig(kubeconfigPath)
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	dir := serviceAccountDir()
+	if host == "" || dir == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+	if err := addCA(tc, filepath.Join(dir, "ca.crt"), ""); err != nil {
+		return nil, err
+	}
+	return &kubeClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		client:    &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: tc}},
+		tokenFile: filepath.Join(dir, "token"),
+	}, nil
+}
+
+// serviceAccountDir returns the directory holding the pod's service
+// account token and CA, or "". The DaemonSet runs the daemon in the
+// node's mount namespace, where the pod's mounts are under kubelet's
+// directory instead, found by the pod UID it passes in $POD_UID.
+func serviceAccountDir() string {
+	if _, err := os.Stat(filepath.Join(saDir, "token")); err == nil {
+		return saDir
+	}
+	uid := os.Getenv("POD_UID")
+	if uid == "" {
+		return ""
+	}
+	m, _ := filepath.Glob(filepath.Join("/var/lib/kubelet/pods", uid, "volumes/kubernetes.io~projected/*/token"))
+	if len(m) == 0 {
+		return ""
+	}
+	return filepath.Dir(m[0])
+}
+
+// addCA makes tc trust the PEM CA certificates in file or, if file is
+// empty, data.
+func addCA(tc *tls.Config, file string, data string) error {
+	pem := []byte(data)
+	if file != "" {
+		var err error
+		if pem, err = ioutil.ReadFile(file); err != nil {
+			return err
+		}
+	}
+	tc.RootCAs = x509.NewCertPool()
+	if !tc.RootCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no CA certificates in %s", file)
+	}
+	return nil
+}
+
+// loadKubeconfig returns a client for path's current context. Only
+// tokens and client certificates are supported, not exec plugins.
+func loadKubeconfig(path string) (*kubeClient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc struct {
+		CurrentContext string `yaml:"current-context"`
+		Contexts       []struct {
+			Name    string
+			Context struct{ Cluster, User string }
+		}
+		Clusters []struct {
+			Name    string
+			Cluster struct {
+				Server   string
+				CA       string `yaml:"certificate-authority"`
+				CAData   string `yaml:"certificate-authority-data"`
+				Insecure bool   `yaml:"insecure-skip-tls-verify"`
+			}
+		}
+		Users []struct {
+			Name string
+			User struct {
+				Token          string
+				TokenFile      string      `yaml:"tokenFile"`
+				ClientCert     string      `yaml:"client-certificate"`
+				ClientCertData string      `yaml:"client-certificate-data"`
+				ClientKey      string      `yaml:"client-key"`
+				ClientKeyData  string      `yaml:"client-key-data"`
+				Exec           interface{} `yaml:"exec"`
+			}
+		}
+	}
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// Paths in a kubeconfig are relative to it.
+	rel := func(p string) string {
+		if p != "" && !filepath.IsAbs(p) {
+			return filepath.Join(filepath.Dir(path), p)
+		}
+		return p
+	}
+	unbase64 := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("%s: no current context", path)
+	}
+	kcl := &kubeClient{}
+	tc := &tls.Config{}
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		kcl.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		tc.InsecureSkipVerify = c.Cluster.Insecure
+		if c.Cluster.CA != "" || c.Cluster.CAData != "" {
+			if err := addCA(tc, rel(c.Cluster.CA), unbase64(c.Cluster.CAData)); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+	}
+	if kcl.server == "" {
+		return nil, fmt.Errorf("%s: no server for cluster %q", path, clusterName)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil {
+			return nil, fmt.Errorf("%s: exec credential plugins aren't supported", path)
+		}
+		kcl.token, kcl.tokenFile = u.User.Token, rel(u.User.TokenFile)
+		if u.User.ClientCert != "" || u.User.ClientCertData != "" {
+			certPEM, keyPEM := []byte(unbase64(u.User.ClientCertData)), []byte(unbase64(u.User.ClientKeyData))
+			if u.User.ClientCert != "" {
+				if certPEM, err = ioutil.ReadFile(rel(u.User.ClientCert)); err != nil {
+					return nil, err
+				}
+			}
+			if u.User.ClientKey != "" {
+				if keyPEM, err = ioutil.ReadFile(rel(u.User.ClientKey)); err != nil {
+					return nil, err
+				}
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			tc.Certificates = []tls.Certificate{cert}
+		}
+	}
+	kcl.client = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: tc}}
+	return kcl, nil
+}
+
+// Errors returned by do for a 404, a 409 and a 429.
+var (
+	errKubeNotFound        = errors.New("not found")
+	errKubeConflict        = errors.New("conflict")
+	errKubeTooManyRequests = errors.New("too many requests")
+)
+
+// do calls the API, sending in as JSON, or as a merge patch for
+// PATCH, and decoding the response into out if it's not nil.
+func (c *kubeClient) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.server+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "embiggen-disk")
+	switch {
+	case method == "PATCH":
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	case in != nil:
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token := c.token
+	if c.tokenFile != "" {
+		t, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(t))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, 8<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		var st struct{ Message string }
+		json.Unmarshal(resBody, &st)
+		if st.Message == "" {
+			st.Message = string(bytes.TrimSpace(resBody))
+		}
+		switch res.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%s %s: %w: %s", method, path, errKubeNotFound, st.Message)
+		case http.StatusConflict:
+			return fmt.Errorf("%s %s: %w: %s", method, path, errKubeConflict, st.Message)
+		case http.StatusTooManyRequests:
+			return fmt.Errorf("%s %s: %w: %s", method, path, errKubeTooManyRequests, st.Message)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, st.Message)
+	}
+	if out != nil {
+		return json.Unmarshal(resBody, out)
+	}
+	return nil
+}
+
+// kubeconfigPath returns the kubeconfig to use, if any.
+func kubeconfigPath() string {
+	if !flagGiven("kubeconfig") && cfg.Notify.Kubernetes.Kubeconfig != "" {
+		return cfg.Notify.Kubernetes.Kubeconfig
+	}
+	return *kubeconfig
+}
+
+// nodeName returns this host's Node name: -k8s-node, $NODE_NAME or
+// the hostname, as kubelet defaults to.
+func nodeName() string {
+	n := *k8sNode
+	if !flagGiven("k8s-node") && cfg.Notify.Kubernetes.Node != "" {
+		n = cfg.Notify.Kubernetes.Node
+	}
+	if n != "" {
+		return n
+	}
+	host, _ := os.Hostname()
+	return strings.ToLower(host)
+}
+
+// A k8sNotifier posts events as Kubernetes Events on this host's
+// Node, where "kubectl describe node" shows them, and optionally
+// annotates the Node with the last resize.
+type k8sNotifier struct {
+	c        *kubeClient
+	node     string
+	annotate bool
+}
+
+func (k *k8sNotifier) String() string { return "Kubernetes node " + k.node }
+
+func (k *k8sNotifier) notify(ev *event) error {
+	var node struct {
+		Metadata struct{ UID string }
+	}
+	if err := k.c.do("GET", "/api/v1/nodes/"+url.PathEscape(k.node), nil, &node); err != nil {
+		return err
+	}
+	typ, reason := "Normal", "FilesystemResized"
+	if ev.Status == "failed" {
+		typ, reason = "Warning", "FilesystemResizeFailed"
+	}
+	ts := ev.Time.UTC().Format(time.RFC3339)
+	kev := map[string]interface{}{
+		"metadata": map[string]string{"generateName": k.node + ".embiggen-disk."},
+		"involvedObject": map[string]string{
+			"kind":       "Node",
+			"apiVersion": "v1",
+			"name":       k.node,
+			"uid":        node.Metadata.UID,
+		},
+		"type":               typ,
+		"reason":             reason,
+		"message":            k8sMessage(ev),
+		"source":             map[string]string{"component": "embiggen-disk", "host": k.node},
+		"reportingComponent": "embiggen-disk",
+		"reportingInstance":  k.node,
+		"firstTimestamp":     ts,
+		"lastTimestamp":      ts,
+		"count":              1,
+	}
+	if err := k.c.do("POST", "/api/v1/namespaces/default/events", kev, nil); err != nil {
+		return err
+	}
+	if !k.annotate || ev.Status != "resized" {
+		return nil
+	}
+	last, err := json.Marshal(struct {
+		Time        string `json:"time"`
+		Mount       string `json:"mount"`
+		BeforeBytes int64  `json:"beforeBytes"`
+		AfterBytes  int64  `json:"afterBytes"`
+	}{ts, ev.Mount, ev.BeforeBytes, ev.AfterBytes})
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{"embiggen-disk/last-resize": string(last)},
+		},
+	}
+	return k.c.do("PATCH", "/api/v1/nodes/"+url.PathEscape(k.node), patch, nil)
+}
+
+// k8sMessage returns an Event message for ev.
+func k8sMessage(ev *event) string {
+	if ev.Status == "failed" {
+		return fmt.Sprintf("Failed to grow %s: %s", ev.Mount, ev.Error)
+	}
+	if ev.AfterBytes > ev.BeforeBytes {
+		return fmt.Sprintf("Grew %s from %s to %s (+%s) in %v", ev.Mount, embiggen.HumanSize(ev.BeforeBytes),
+			embiggen.HumanSize(ev.AfterBytes), embiggen.HumanSize(ev.AfterBytes-ev.BeforeBytes), ev.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("Resized %d layer(s) under %s", len(ev.Changes), ev.Mount)
+}
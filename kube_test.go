@@ -0,0 +1,194 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestK8sNotifier(t *testing.T) {
+	var calls []string
+	var kev struct {
+		InvolvedObject struct{ Kind, Name, UID string }
+		Type, Reason   string
+	}
+	var patch struct {
+		Metadata struct{ Annotations map[string]string }
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.Path)
+		if got := r.Header.Get("Authorization"); got != "Bearer t0ken" {
+			t.Errorf("Authorization = %q", got)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(`{"metadata":{"name":"node-1","uid":"1234"}}`))
+		case "POST":
+			json.Unmarshal(body, &kev)
+		case "PATCH":
+			json.Unmarshal(body, &patch)
+		}
+	}))
+	defer srv.Close()
+
+	kc := filepath.Join(t.TempDir(), "kubeconfig")
+	ioutil.WriteFile(kc, []byte(`apiVersion: v1
+kind: Config
+current-context: node
+contexts:
+  - name: node
+    context: {cluster: c, user: u}
+clusters:
+  - name: c
+    cluster: {server: `+srv.URL+`}
+users:
+  - name: u
+    user: {token: t0ken}
+`), 0600)
+	c, err := newKubeClient(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &k8sNotifier{c: c, node: "node-1", annotate: true}
+	if err := k.notify(&event{Mount: "/", Status: "resized", BeforeBytes: 1 << 30, AfterBytes: 2 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"GET /api/v1/nodes/node-1", "POST /api/v1/namespaces/default/events", "PATCH /api/v1/nodes/node-1"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q; want %q", calls, want)
+	}
+	if o := kev.InvolvedObject; o.Kind != "Node" || o.Name != "node-1" || o.UID != "1234" || kev.Reason != "FilesystemResized" {
+		t.Errorf("event = %+v", kev)
+	}
+	if _, ok := patch.Metadata.Annotations["embiggen-disk/last-resize"]; !ok {
+		t.Errorf("patch = %+v; want a last-resize annotation", patch)
+	}
+
+	calls = nil
+	if err := k.notify(&event{Mount: "/", Status: "failed", Error: "boom"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || kev.Type != "Warning" {
+		t.Errorf("failure: calls %q, event type %q; want no PATCH and a Warning", calls, kev.Type)
+	}
+}
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"102687672Ki", 102687672 << 10},
+		{"100Gi", 100 << 30},
+		{"5G", 5e9},
+		{"5e9", 5e9},
+		{"1024", 1024},
+	}
+	for _, tt := range tests {
+		if got, err := parseQuantity(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseQuantity(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := parseQuantity("lots"); err == nil {
+		t.Error("parseQuantity(\"lots\") succeeded")
+	}
+}
+
+func TestDrainNode(t *testing.T) {
+	defer func(d time.Duration) { drainPollInterval = d }(drainPollInterval)
+	drainPollInterval = time.Millisecond
+	var evictions []string
+	evicted := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/pods":
+			if got := r.URL.Query().Get("fieldSelector"); got != "spec.nodeName=node-1" {
+				t.Errorf("fieldSelector = %q", got)
+			}
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "web", "namespace": "app", "uid": "1"}, "status": {"phase": "Running"}},
+				{"metadata": {"name": "db", "namespace": "app", "uid": "2"}, "status": {"phase": "Running"}},
+				{"metadata": {"name": "proxy", "namespace": "kube-system", "uid": "3", "ownerReferences": [{"kind": "DaemonSet"}]}, "status": {"phase": "Running"}},
+				{"metadata": {"name": "job", "namespace": "app", "uid": "4"}, "status": {"phase": "Succeeded"}}
+			]}`))
+		case r.Method == "GET":
+			name := path.Base(r.URL.Path)
+			if evicted[name] {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, `{"metadata": {"name": %q, "uid": %q}}`, name, map[string]string{"web": "1", "db": "2"}[name])
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/eviction"):
+			name := path.Base(path.Dir(r.URL.Path))
+			evictions = append(evictions, name)
+			// db's disruption budget blocks its first eviction.
+			if name == "db" && len(evictions) < 3 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			evicted[name] = true
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+		}
+	}))
+	defer srv.Close()
+
+	c := &kubeClient{server: srv.URL, client: srv.Client()}
+	if err := drainNode(c, "node-1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"web", "db", "db"}; !reflect.DeepEqual(evictions, want) {
+		t.Errorf("evictions = %q; want %q", evictions, want)
+	}
+}
+
+func TestLocalPVOnNode(t *testing.T) {
+	affinity := func(node string) string {
+		return `"nodeAffinity": {"required": {"nodeSelectorTerms": [{"matchExpressions": [
+			{"key": "kubernetes.io/hostname", "operator": "In", "values": ["` + node + `"]}]}]}}`
+	}
+	tests := []struct {
+		spec string
+		want bool
+	}{
+		{`{"local": {"path": "/mnt/disks/ssd0"}, ` + affinity("node-1") + `}`, true},
+		{`{"local": {"path": "/mnt/disks/ssd0"}, ` + affinity("node-2") + `}`, false},
+		{`{"local": {"path": "/dev/nvme1n1"}, "volumeMode": "Block", ` + affinity("node-1") + `}`, false},
+		{`{"hostPath": {"path": "/data"}, ` + affinity("node-1") + `}`, false},
+	}
+	for _, tt := range tests {
+		var pv k8sPV
+		if err := json.Unmarshal([]byte(`{"spec": `+tt.spec+`}`), &pv); err != nil {
+			t.Fatal(err)
+		}
+		if got := pv.onNode("node-1"); got != tt.want {
+			t.Errorf("onNode(node-1) for %s = %v; want %v", tt.spec, got, tt.want)
+		}
+	}
+}
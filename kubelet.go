@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	kubeletMode = flag.String("kubelet-mode", "off", "after growing the filesystem under kubelet's root dir or the container runtime's storage: off, to leave kubelet alone; auto, to restart kubelet only if it doesn't see the new size by itself within -kubelet-wait (without Kubernetes credentials, like restart); or restart, to always restart it")
+	kubeletWait = flag.Duration("kubelet-wait", 2*time.Minute, "with -kubelet-mode=auto, how long to give kubelet to see the new size before restarting it")
+)
+
+// runtimeDirs are where container runtimes keep images and
+// containers.
+var runtimeDirs = []string{"/var/lib/containerd", "/var/lib/docker", "/var/lib/containers/storage"}
+
+// kubeletRootDir returns the running kubelet's --root-dir.
+func kubeletRootDir() string {
+	pids, _ := filepath.Glob("/proc/[0-9]*/comm")
+	for _, p := range pids {
+		comm, err := ioutil.ReadFile(p)
+		if err != nil || string(bytes.TrimSpace(comm)) != "kubelet" {
+			continue
+		}
+		cmdline, _ := ioutil.ReadFile(filepath.Join(filepath.Dir(p), "cmdline"))
+		args := strings.Split(string(cmdline), "\x00")
+		for i, a := range args {
+			if strings.HasPrefix(a, "--root-dir=") {
+				return a[len("--root-dir="):]
+			}
+			if a == "--root-dir" && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		break
+	}
+	return "/var/lib/kubelet"
+}
+
+// sameFS reports whether path is on the filesystem mounted at mnt.
+func sameFS(path, mnt string) bool {
+	var a, b unix.Stat_t
+	return unix.Stat(path, &a) == nil && unix.Stat(mnt, &b) == nil && a.Dev == b.Dev
+}
+
+// kubeletAfterResize deals with kubelet after mnt grows, per
+// -kubelet-mode. Kubelet sees the container runtime's storage grow by
+// itself, but may keep reporting the Node's old ephemeral-storage
+// capacity until it restarts. It has no signal to re-read it, so the
+// least it can do is restart it, and only when that's needed.
+func kubeletAfterResize(mnt string) {
+	mode := *kubeletMode
+	if !flagGiven("kubelet-mode") && cfg.Kubelet.Mode != "" {
+		mode = cfg.Kubelet.Mode
+	}
+	switch mode {
+	case "off":
+		return
+	case "auto", "restart":
+	default:
+		warnf("kubelet: unknown -kubelet-mode %q; want off, auto or restart", mode)
+		return
+	}
+	root := kubeletRootDir()
+	backsRoot, backsRuntime := sameFS(root, mnt), false
+	for _, d := range runtimeDirs {
+		backsRuntime = backsRuntime || sameFS(d, mnt)
+	}
+	if !backsRoot && !backsRuntime {
+		vlogf("kubelet: %s doesn't back %s or the container runtime; leaving kubelet alone", mnt, root)
+		return
+	}
+	if *dry {
+		dryRunf("would've restarted kubelet (-kubelet-mode=%s)", mode)
+		return
+	}
+	if mode == "auto" {
+		if !backsRoot {
+			vlogf("kubelet: %s backs only the container runtime, which kubelet re-reads by itself", mnt)
+			return
+		}
+		wait := *kubeletWait
+		if d, err := time.ParseDuration(cfg.Kubelet.Wait); err == nil && !flagGiven("kubelet-wait") {
+			wait = d
+		}
+		switch ok, err := kubeletSawGrowth(root, wait); {
+		case err != nil:
+			warnf("kubelet: can't tell whether it saw %s grow, so restarting it: %v", mnt, err)
+		case ok:
+			infof("kubelet: it saw %s grow; not restarting it", mnt)
+			return
+		default:
+			infof("kubelet: still reports the old capacity after %v; restarting it", wait)
+		}
+	}
+	if err := systemctl("restart", "kubelet"); err != nil {
+		warnf("kubelet: %v", err)
+		return
+	}
+	infof("kubelet: restarted after %s grew", mnt)
+}
+
+// kubeletSawGrowth waits up to wait for the Node's ephemeral-storage
+// capacity to reach the size of the filesystem under root.
+func kubeletSawGrowth(root string, wait time.Duration) (bool, error) {
+	c, err := newKubeClient(kubeconfigPath())
+	if err != nil {
+		return false, err
+	}
+	if c == nil {
+		return false, fmt.Errorf("no Kubernetes credentials; see -kubeconfig")
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(root, &st); err != nil {
+		return false, err
+	}
+	want := int64(st.Blocks) * int64(st.Bsize)
+	deadline := time.Now().Add(wait)
+	for {
+		var node struct {
+			Status struct{ Capacity map[string]string }
+		}
+		if err := c.do("GET", "/api/v1/nodes/"+url.PathEscape(nodeName()), nil, &node); err != nil {
+			return false, err
+		}
+		got, err := parseQuantity(node.Status.Capacity["ephemeral-storage"])
+		if err != nil {
+			return false, fmt.Errorf("ephemeral-storage capacity: %v", err)
+		}
+		// Allow for rounding in the quantity.
+		if got >= want-want/1000 {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// parseQuantity parses a Kubernetes resource quantity, like "100Gi"
+// or "5e9", in bytes.
+func parseQuantity(s string) (int64, error) {
+	mult := map[string]float64{
+		"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40, "Pi": 1 << 50, "Ei": 1 << 60,
+		"k": 1e3, "M": 1e6, "G": 1e9, "T": 1e12, "P": 1e15, "E": 1e18, "m": 1e-3,
+	}
+	num, m := s, 1.0
+	for suffix, v := range mult {
+		if strings.HasSuffix(s, suffix) {
+			num, m = strings.TrimSuffix(s, suffix), v
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("bad quantity %q", s)
+	}
+	return int64(f * m), nil
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var (
+	k8sImage     = flag.String("image", "embiggen-disk:latest", "with the kubernetes subcommand, the container image to run; build it from the Dockerfile")
+	k8sNamespace = flag.String("namespace", "kube-system", "with the kubernetes subcommand, the namespace to run the DaemonSet in")
+)
+
+// k8sHostBinary is where the DaemonSet's init container copies the
+// binary on each node, to run it there in the host's namespaces.
+const k8sHostBinary = "/var/lib/embiggen-disk/bin/embiggen-disk"
+
+// k8sManifest is the DaemonSet and what it needs. The pod runs the
+// daemon in the node's mount namespace, like the systemd unit: that
+// way it sees the real mount points and uses the node's own LVM and
+// filesystem tools, whatever the image has.
+var k8sManifest = template.Must(template.New("k8s").Funcs(template.FuncMap{"quote": yamlQuote}).Parse(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: embiggen-disk
+  namespace: {{.Namespace}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: embiggen-disk
+rules:
+  - apiGroups: [""]
+    resources: ["nodes"]
+    verbs: ["get", "patch"]
+  - apiGroups: [""]
+    resources: ["events"]
+    verbs: ["create"]
+  - apiGroups: [""]
+    resources: ["persistentvolumes"]
+    verbs: ["list"]
+  - apiGroups: ["coordination.k8s.io"]
+    resources: ["leases"]
+    verbs: ["get", "create", "update"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: embiggen-disk
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: embiggen-disk
+subjects:
+  - kind: ServiceAccount
+    name: embiggen-disk
+    namespace: {{.Namespace}}
+---
+apiVersion: scheduling.k8s.io/v1
+kind: PriorityClass
+metadata:
+  name: embiggen-disk
+value: 1000000000
+globalDefault: false
+description: "Grows nodes' filesystems before they fill; keep it running under pressure."
+---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: embiggen-disk
+  namespace: {{.Namespace}}
+  labels:
+    app.kubernetes.io/name: embiggen-disk
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: embiggen-disk
+  updateStrategy:
+    type: RollingUpdate
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: embiggen-disk
+    spec:
+      serviceAccountName: embiggen-disk
+      priorityClassName: embiggen-disk
+      hostPID: true
+      nodeSelector:
+        kubernetes.io/os: linux
+      tolerations:
+        - operator: Exists
+      # Let a resize in progress finish.
+      terminationGracePeriodSeconds: 300
+      initContainers:
+        - name: install
+          image: {{quote .Image}}
+          command: ["cp", "/usr/local/bin/embiggen-disk", "/host-bin/"]
+          volumeMounts:
+            - name: bin
+              mountPath: /host-bin
+      containers:
+        - name: embiggen-disk
+          image: {{quote .Image}}
+          command:
+            - nsenter
+            - --target=1
+            - --mount
+            - --uts
+            - --ipc
+            - --net
+            - --
+            - {{.HostBinary}}
+            - -daemon
+{{- range .Args}}
+            - {{quote .}}
+{{- end}}
+          env:
+            # For Events on the Node, and to find the service account
+            # token from the node's mount namespace.
+            - name: NODE_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: spec.nodeName
+            - name: POD_UID
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.uid
+          securityContext:
+            privileged: true
+          resources:
+            requests:
+              cpu: 10m
+              memory: 32Mi
+            limits:
+              memory: 256Mi
+      volumes:
+        - name: bin
+          hostPath:
+            path: {{.HostBinaryDir}}
+            type: DirectoryOrCreate
+`))
+
+// yamlQuote quotes s as a YAML string. JSON strings are YAML strings.
+func yamlQuote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// kubernetesManifest returns the manifest running the daemon with
+// args in the DaemonSet.
+func kubernetesManifest(image, namespace string, args []string) string {
+	var buf bytes.Buffer
+	err := k8sManifest.Execute(&buf, struct {
+		Image, Namespace          string
+		HostBinary, HostBinaryDir string
+		Args                      []string
+	}{image, namespace, k8sHostBinary, filepath.Dir(k8sHostBinary), args})
+	if err != nil {
+		panic(err)
+	}
+	return buf.String()
+}
+
+// kubernetesMain implements the "kubernetes [apply|delete]"
+// subcommand: with neither, it prints the manifest. Flags are passed
+// on to the daemon, as with systemd.
+func kubernetesMain(args []string) {
+	cmd := "print"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	daemonArgs, err := unitArgs(givenFlags(), args)
+	if err != nil {
+		exitf(exitUsage, "kubernetes: %v", err)
+	}
+	manifest := kubernetesManifest(*k8sImage, *k8sNamespace, daemonArgs)
+	switch cmd {
+	case "print":
+		fmt.Print(manifest)
+	case "apply", "delete":
+		kargs := []string{cmd, "-f", "-"}
+		if cmd == "delete" {
+			kargs = append(kargs, "--ignore-not-found")
+		}
+		c := exec.Command("kubectl", kargs...)
+		c.Stdin = strings.NewReader(manifest)
+		c.Stdout, c.Stderr = os.Stdout, os.Stderr
+		if err := c.Run(); err != nil {
+			exitf(exitToolFailed, "running kubectl %s: %v", cmd, err)
+		}
+	default:
+		usage()
+	}
+}
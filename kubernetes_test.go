@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestKubernetesManifest(t *testing.T) {
+	m := kubernetesManifest("example.com/embiggen-disk:v1", "storage", []string{"-post-resize-hook=echo 'grew: yes'", "/"})
+	dec := yaml.NewDecoder(strings.NewReader(m))
+	var kinds []string
+	for {
+		var doc struct {
+			Kind     string
+			Metadata struct{ Namespace string }
+			Spec     struct {
+				Template struct {
+					Spec struct {
+						Containers []struct {
+							Image   string
+							Command []string
+						}
+					}
+				}
+			}
+		}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("manifest isn't YAML: %v\n%s", err, m)
+		}
+		kinds = append(kinds, doc.Kind)
+		if doc.Kind != "DaemonSet" {
+			continue
+		}
+		if doc.Metadata.Namespace != "storage" {
+			t.Errorf("DaemonSet namespace = %q; want storage", doc.Metadata.Namespace)
+		}
+		c := doc.Spec.Template.Spec.Containers[0]
+		if c.Image != "example.com/embiggen-disk:v1" {
+			t.Errorf("image = %q", c.Image)
+		}
+		want := []string{k8sHostBinary, "-daemon", "-post-resize-hook=echo 'grew: yes'", "/"}
+		if got := c.Command[len(c.Command)-len(want):]; !reflect.DeepEqual(got, want) {
+			t.Errorf("command ends %q; want %q", got, want)
+		}
+	}
+	if want := []string{"ServiceAccount", "ClusterRole", "ClusterRoleBinding", "PriorityClass", "DaemonSet"}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("kinds = %q; want %q", kinds, want)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	leaseBackend  = flag.String("lease", "", "for disks shared between hosts (multipath SAN, shared VMDK), take a lease before rewriting a partition table so only one host does: kubernetes, for a coordination.k8s.io Lease, or file:<dir>, for a lease file in a directory all the hosts share; empty for none")
+	leaseNS       = flag.String("lease-namespace", "kube-system", "with -lease=kubernetes, the namespace for Leases")
+	leaseDuration = flag.Duration("lease-duration", 5*time.Minute, "with -lease, how long a lease lasts if its holder dies holding it")
+)
+
+// errLeaseHeld is returned when another host holds a disk's lease.
+var errLeaseHeld = errors.New("lease held by another host")
+
+// A lease is held on a shared disk while rewriting its partition
+// table. Its token increases with each new holder, for fencing.
+type lease interface {
+	token() int64
+	release() error
+}
+
+// sharedDiskID returns an identifier for disk that's the same on
+// every host that sees it, or "" if it has none.
+func sharedDiskID(disk string) string {
+	base := filepath.Join("/sys/class/block", filepath.Base(disk))
+	for _, f := range []string{"wwid", "device/wwid", "dm/uuid", "device/serial"} {
+		if b, err := ioutil.ReadFile(filepath.Join(base, f)); err == nil {
+			if id := strings.TrimSpace(string(b)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// leaseName returns the name of the lease for the disk with id.
+func leaseName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "embiggen-disk-" + hex.EncodeToString(sum[:8])
+}
+
+// acquireLease takes the -lease for disk, or returns a nil lease if
+// there's no -lease or the disk has no identity to share one by.
+func acquireLease(disk string) (lease, error) {
+	if *leaseBackend == "" || *dry {
+		return nil, nil
+	}
+	id := sharedDiskID(disk)
+	if id == "" {
+		vlogf("%s has no WWID or serial; not taking a lease for it", disk)
+		return nil, nil
+	}
+	name, holder := leaseName(id), nodeName()
+	var l lease
+	var err error
+	switch {
+	case *leaseBackend == "kubernetes":
+		var c *kubeClient
+		if c, err = newKubeClient(kubeconfigPath()); err == nil && c == nil {
+			err = errors.New("-lease=kubernetes needs Kubernetes credentials; see -kubeconfig")
+		}
+		if err == nil {
+			l, err = acquireK8sLease(c, *leaseNS, name, holder, *leaseDuration)
+		}
+	case strings.HasPrefix(*leaseBackend, "file:"):
+		l, err = acquireFileLease(filepath.Join(strings.TrimPrefix(*leaseBackend, "file:"), name), holder, *leaseDuration, time.Now())
+	default:
+		return nil, fmt.Errorf("unsupported -lease %q; want kubernetes or file:<dir>", *leaseBackend)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lease for %s (%s): %w", disk, id, err)
+	}
+	vlogf("took lease %s for %s, token %d", name, disk, l.token())
+	return l, nil
+}
+
+// A fileLease is a lease file in a shared directory, holding
+// "holder token expiry". Taking one is an atomic link, which works on
+// NFS too; an expired one is renamed away first.
+type fileLease struct {
+	path, holder string
+	tok          int64
+}
+
+func acquireFileLease(path, holder string, d time.Duration, now time.Time) (*fileLease, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	var tok int64
+	for tries := 0; tries < 3; tries++ {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			f := strings.Fields(string(b))
+			if len(f) != 3 {
+				return nil, fmt.Errorf("%s: malformed lease %q", path, b)
+			}
+			tok, _ = strconv.ParseInt(f[1], 10, 64)
+			expiry, _ := strconv.ParseInt(f[2], 10, 64)
+			if f[0] != holder && now.Unix() < expiry {
+				return nil, fmt.Errorf("%w: %s until %s", errLeaseHeld, f[0], time.Unix(expiry, 0).Format(time.RFC3339))
+			}
+			// Expired or ours from before: only one host's rename
+			// wins.
+			if err := os.Rename(path, fmt.Sprintf("%s.stale.%s", path, holder)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			os.Remove(fmt.Sprintf("%s.stale.%s", path, holder))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		tmp := fmt.Sprintf("%s.%s.%d", path, holder, os.Getpid())
+		content := fmt.Sprintf("%s %d %d\n", holder, tok+1, now.Add(d).Unix())
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			return nil, err
+		}
+		err := os.Link(tmp, path)
+		os.Remove(tmp)
+		if err == nil {
+			return &fileLease{path: path, holder: holder, tok: tok + 1}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		// Someone else got there first; see who.
+	}
+	return nil, fmt.Errorf("%w: %s keeps changing", errLeaseHeld, path)
+}
+
+func (l *fileLease) token() int64 { return l.tok }
+
+func (l *fileLease) release() error {
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	if f := strings.Fields(string(b)); len(f) != 3 || f[0] != l.holder {
+		return fmt.Errorf("%s: lease taken over by %q", l.path, b)
+	}
+	// Keep the token, so the next holder's is higher.
+	return ioutil.WriteFile(l.path, []byte(fmt.Sprintf("%s %d 0\n", l.holder, l.tok)), 0644)
+}
+
+// A k8sLease is a coordination.k8s.io/v1 Lease.
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int64  `json:"leaseTransitions"`
+	} `json:"spec"`
+	c *kubeClient
+}
+
+const k8sMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (l *k8sLease) path() string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + l.Metadata.Namespace + "/leases/" + l.Metadata.Name
+}
+
+// acquireK8sLease takes the Lease name, creating it if need be. The
+// API server's resourceVersion check makes the takeover atomic.
+func acquireK8sLease(c *kubeClient, ns, name, holder string, d time.Duration) (*k8sLease, error) {
+	l := &k8sLease{c: c}
+	l.Metadata.Name, l.Metadata.Namespace = name, ns
+	err := c.do("GET", l.path(), nil, l)
+	exists := err == nil
+	if err != nil && !errors.Is(err, errKubeNotFound) {
+		return nil, err
+	}
+	now := time.Now()
+	if s := l.Spec; exists && s.HolderIdentity != "" && s.HolderIdentity != holder {
+		renewed, _ := time.Parse(k8sMicroTime, s.RenewTime)
+		if until := renewed.Add(time.Duration(s.LeaseDurationSeconds) * time.Second); now.Before(until) {
+			return nil, fmt.Errorf("%w: %s until %s", errLeaseHeld, s.HolderIdentity, until.Format(time.RFC3339))
+		}
+	}
+	if l.Spec.HolderIdentity != holder {
+		l.Spec.LeaseTransitions++
+	}
+	l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease"
+	l.Spec.HolderIdentity = holder
+	l.Spec.LeaseDurationSeconds = int(d / time.Second)
+	l.Spec.AcquireTime = now.UTC().Format(k8sMicroTime)
+	l.Spec.RenewTime = l.Spec.AcquireTime
+	if exists {
+		err = c.do("PUT", l.path(), l, nil)
+	} else {
+		err = c.do("POST", strings.TrimSuffix(l.path(), "/"+name), l, nil)
+	}
+	if errors.Is(err, errKubeConflict) {
+		return nil, fmt.Errorf("%w: another host took it first", errLeaseHeld)
+	}
+	return l, err
+}
+
+func (l *k8sLease) token() int64 { return l.Spec.LeaseTransitions }
+
+func (l *k8sLease) release() error {
+	if err := l.c.do("GET", l.path(), nil, l); err != nil {
+		return err
+	}
+	l.Spec.HolderIdentity = ""
+	return l.c.do("PUT", l.path(), l, nil)
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), leaseName("3600a098038303053453f463045727a6b"))
+	now := time.Now()
+	a, err := acquireFileLease(path, "node-a", time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireFileLease(path, "node-b", time.Minute, now); !errors.Is(err, errLeaseHeld) {
+		t.Fatalf("node-b took a held lease: %v", err)
+	}
+	if err := a.release(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := acquireFileLease(path, "node-b", time.Minute, now)
+	if err != nil {
+		t.Fatalf("node-b couldn't take a released lease: %v", err)
+	}
+	if b.token() <= a.token() {
+		t.Errorf("token went from %d to %d; want it to increase", a.token(), b.token())
+	}
+	// node-b dies holding it; once it expires, node-a can take it.
+	if _, err := acquireFileLease(path, "node-a", time.Minute, now.Add(2*time.Minute)); err != nil {
+		t.Errorf("node-a couldn't take an expired lease: %v", err)
+	}
+	if err := b.release(); err == nil {
+		t.Error("node-b released a lease taken over by node-a")
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+	"golang.org/x/sys/unix"
+)
+
+var k8sLocalPVs = flag.Bool("k8s-local-pvs", false, "in daemon mode on a Kubernetes node, also grow the filesystems of this node's local PersistentVolumes when their devices grow, for storage drivers without online expansion")
+
+// localPVRefresh is how often the local PVs are listed.
+const localPVRefresh = time.Minute
+
+// A localPVWatcher finds the filesystems backing local
+// PersistentVolumes on this node, for -k8s-local-pvs.
+type localPVWatcher struct {
+	c       *kubeClient
+	node    string
+	listed  time.Time
+	mnts    []string // from the last listing
+	watched map[string]bool
+}
+
+func newLocalPVWatcher() (*localPVWatcher, error) {
+	c, err := newKubeClient(kubeconfigPath())
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("-k8s-local-pvs needs Kubernetes credentials; see -kubeconfig")
+	}
+	return &localPVWatcher{c: c, node: nodeName(), watched: map[string]bool{}}, nil
+}
+
+// A k8sPV is the part of a PersistentVolume that -k8s-local-pvs looks
+// at.
+type k8sPV struct {
+	Metadata struct{ Name string }
+	Spec     struct {
+		Local *struct {
+			Path string
+		}
+		VolumeMode   string `json:"volumeMode"`
+		NodeAffinity struct {
+			Required struct {
+				NodeSelectorTerms []struct {
+					MatchExpressions []struct {
+						Key, Operator string
+						Values        []string
+					} `json:"matchExpressions"`
+				} `json:"nodeSelectorTerms"`
+			}
+		} `json:"nodeAffinity"`
+	}
+}
+
+// onNode reports whether pv is a local filesystem volume pinned to
+// node by the usual kubernetes.io/hostname affinity.
+func (pv *k8sPV) onNode(node string) bool {
+	if pv.Spec.Local == nil || pv.Spec.VolumeMode == "Block" {
+		return false
+	}
+	for _, t := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, e := range t.MatchExpressions {
+			if e.Key == "kubernetes.io/hostname" && e.Operator == "In" && containsString(e.Values, node) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// targets returns the mount points of this node's local PVs that
+// aren't already in mnts, setting their limits in lims. It lists the
+// PVs at most every localPVRefresh; if that fails, it keeps the last
+// list.
+func (w *localPVWatcher) targets(mnts []string, lims map[string]embiggen.Limit) []string {
+	if time.Since(w.listed) >= localPVRefresh {
+		var pvs struct{ Items []k8sPV }
+		if err := w.c.do("GET", "/api/v1/persistentvolumes", nil, &pvs); err != nil {
+			warnf("listing local PVs: %v", err)
+		} else {
+			w.listed, w.mnts = time.Now(), nil
+			for _, pv := range pvs.Items {
+				if !pv.onNode(w.node) {
+					continue
+				}
+				p := filepath.Clean(pv.Spec.Local.Path)
+				if !isMountPoint(p) {
+					vlogf("local PV %s: %s isn't a mount point; skipping it", pv.Metadata.Name, p)
+					continue
+				}
+				w.mnts = append(w.mnts, p)
+			}
+			sort.Strings(w.mnts)
+		}
+	}
+	var out []string
+	now := map[string]bool{}
+	for _, mnt := range w.mnts {
+		if containsString(mnts, mnt) {
+			continue
+		}
+		if _, ok := lims[mnt]; !ok {
+			lim, err := resolveLimit(mnt)
+			if err != nil {
+				warnf("local PV at %s: %v", mnt, err)
+				continue
+			}
+			lims[mnt] = lim
+		}
+		if !w.watched[mnt] {
+			infof("watching local PV filesystem %s", mnt)
+		}
+		now[mnt] = true
+		out = append(out, mnt)
+	}
+	for mnt := range w.watched {
+		if !now[mnt] {
+			infof("no longer watching %s; its local PV is gone", mnt)
+		}
+	}
+	w.watched = now
+	return out
+}
+
+// isMountPoint reports whether p is the root of a filesystem.
+func isMountPoint(p string) bool {
+	var st, parent unix.Stat_t
+	if unix.Stat(p, &st) != nil || unix.Stat(filepath.Dir(p), &parent) != nil {
+		return false
+	}
+	return p == string(os.PathSeparator) || st.Dev != parent.Dev
+}
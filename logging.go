@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A logLevel is how much embiggen-disk logs, set with -log-level.
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+var curLevel = levelInfo
+
+func (l logLevel) String() string { return levelNames[l] }
+
+func (l *logLevel) Set(s string) error {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			*l = logLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q; want one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// setupLogging reconciles -verbose and -quiet with -log-level.
+func setupLogging() {
+	switch {
+	case *quiet:
+		curLevel = levelError
+	case *verbose:
+		curLevel = levelDebug
+	}
+	*verbose = curLevel >= levelDebug
+}
+
+// setupLogFormat checks and sets up -log-format, exiting if it's bad.
+func setupLogFormat() {
+	if !flagGiven("log-format") && underJournal() {
+		*logFormat = "journald"
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.SetFlags(0) // logEvent adds the time
+	case "journald":
+		if err := setupJournal(); err != nil {
+			*logFormat = "text"
+			warnf("not logging to journald: %v", err)
+		}
+		log.SetFlags(0) // the journal has the time
+	default:
+		bad := *logFormat
+		*logFormat = "text"
+		exitf(exitUsage, "unsupported -log-format %q; want text, json or journald", bad)
+	}
+}
+
+// logFields are the structured fields of a log event, such as
+// "mount", "device", "layer", "action", "duration" and "error".
+type logFields map[string]interface{}
+
+func logf(level logLevel, format string, args ...interface{}) {
+	logEvent(level, fmt.Sprintf(format, args...), nil)
+}
+
+// logEvent logs msg with structured fields. With -log-format=json
+// it's written as one JSON object per line, and with journald the
+// fields become journal fields like MOUNT=; otherwise the fields are
+// appended to msg as key=value pairs.
+func logEvent(level logLevel, msg string, f logFields) {
+	if level > curLevel {
+		return
+	}
+	if *logFormat == "journald" && journalSend(level, msg, f) {
+		return
+	}
+	if *logFormat == "json" {
+		m := map[string]interface{}{
+			"time":  time.Now().UTC().Format(time.RFC3339Nano),
+			"level": level.String(),
+			"msg":   msg,
+		}
+		for k, v := range f {
+			if d, ok := v.(time.Duration); ok {
+				v = d.Seconds()
+			}
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			m[k] = v
+		}
+		b, _ := json.Marshal(m)
+		log.Writer().Write(append(b, '\n'))
+		return
+	}
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg += fmt.Sprintf(" %s=%v", k, f[k])
+	}
+	switch level {
+	case levelError:
+		msg = colorize(colorStderr, ansiRed, msg)
+	case levelWarn:
+		msg = colorize(colorStderr, ansiYellow, msg)
+	}
+	log.Print(msg)
+}
+
+func warnf(format string, args ...interface{}) { logf(levelWarn, format, args...) }
+func infof(format string, args ...interface{}) { logf(levelInfo, format, args...) }
+func vlogf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+
+// dryRunf prints a -dry-run message. With -output=json it goes to
+// stderr, to keep stdout parseable.
+func dryRunf(format string, args ...interface{}) {
+	w := os.Stdout
+	if *output == "json" {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, "[dry-run] "+format+"\n", args...)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var lvmDBus = flag.Bool("lvm-dbus", true, "if the LVM commands are missing, as in minimal containers, grow LVM layers through lvmdbusd's D-Bus API")
+
+// lvmdbusd's D-Bus API.
+const (
+	lvmdName    = "com.redhat.lvmdbus1"
+	lvmdManager = "/com/redhat/lvmdbus1/Manager"
+	lvmdIface   = "com.redhat.lvmdbus1."
+)
+
+// lvmd is an embiggen.LVMService that asks lvmdbusd.
+type lvmd struct{}
+
+var _ embiggen.LVMService = lvmd{}
+
+// session connects to the system bus for the duration of f, which
+// is cut short if ctx is done.
+func (lvmd) session(ctx context.Context, f func(c *dbusConn) error) error {
+	c, err := dialSystemBus()
+	if err != nil {
+		return fmt.Errorf("lvmdbusd: %v", err)
+	}
+	defer c.c.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		c.c.SetDeadline(dl)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.c.Close()
+		case <-done:
+		}
+	}()
+	hello := &dbusMsg{dest: "org.freedesktop.DBus", path: "/org/freedesktop/DBus", iface: "org.freedesktop.DBus", member: "Hello"}
+	if _, err := c.call(hello); err != nil {
+		return fmt.Errorf("lvmdbusd: %v", err)
+	}
+	if err := f(c); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("lvmdbusd: %v", err)
+	}
+	return nil
+}
+
+// lookUp returns the object path of the PV, VG or LV with the LVM id
+// key, like "/dev/sda3", "vg0" or "vg0/root".
+func lookUp(c *dbusConn, key string) (string, error) {
+	var e dbusEnc
+	e.str(key)
+	r, err := c.call(&dbusMsg{dest: lvmdName, path: lvmdManager, iface: lvmdIface + "Manager", member: "LookUpByLvmId", sig: "s", body: e.b})
+	if err != nil {
+		return "", err
+	}
+	d := &dbusDec{b: r.body, order: r.order}
+	path := d.str()
+	if d.err != nil {
+		return "", d.err
+	}
+	if path == "/" {
+		return "", fmt.Errorf("%s not found", key)
+	}
+	return path, nil
+}
+
+// uint64Prop returns the uint64 property prop of the object at path.
+func uint64Prop(c *dbusConn, path, iface, prop string) (int64, error) {
+	var e dbusEnc
+	e.str(lvmdIface + iface)
+	e.str(prop)
+	r, err := c.call(&dbusMsg{dest: lvmdName, path: path, iface: "org.freedesktop.DBus.Properties", member: "Get", sig: "ss", body: e.b})
+	if err != nil {
+		return 0, err
+	}
+	d := &dbusDec{b: r.body, order: r.order}
+	if sig := d.sig(); d.err == nil && sig != "t" {
+		return 0, fmt.Errorf("%s.%s is a %q, not a uint64", iface, prop, sig)
+	}
+	v := d.uint64()
+	return int64(v), d.err
+}
+
+// resizeOpts marshals the trailing timeout and options arguments of
+// lvmdbusd's resize methods: wait for the job, and no options.
+func resizeOpts(e *dbusEnc) {
+	e.uint32(0xffffffff) // tmo -1: wait until the job's done
+	e.arrayEnd(e.arrayStart(8))
+}
+
+func (l lvmd) VG(ctx context.Context, vg string) (extentSize, extents, free int64, err error) {
+	err = l.session(ctx, func(c *dbusConn) error {
+		path, err := lookUp(c, vg)
+		if err != nil {
+			return err
+		}
+		if extentSize, err = uint64Prop(c, path, "Vg", "ExtentSizeBytes"); err != nil {
+			return err
+		}
+		if extents, err = uint64Prop(c, path, "Vg", "ExtentCount"); err != nil {
+			return err
+		}
+		free, err = uint64Prop(c, path, "Vg", "FreeCount")
+		return err
+	})
+	return
+}
+
+func (l lvmd) PVSize(ctx context.Context, dev string) (n int64, err error) {
+	err = l.session(ctx, func(c *dbusConn) error {
+		path, err := lookUp(c, dev)
+		if err != nil {
+			return err
+		}
+		n, err = uint64Prop(c, path, "Pv", "SizeBytes")
+		return err
+	})
+	return
+}
+
+func (l lvmd) ResizeLV(ctx context.Context, vg, lv string, size int64) error {
+	return l.session(ctx, func(c *dbusConn) error {
+		path, err := lookUp(c, vg+"/"+lv)
+		if err != nil {
+			return err
+		}
+		var e dbusEnc
+		e.uint64(uint64(size))
+		e.arrayEnd(e.arrayStart(8)) // no PVs in particular
+		resizeOpts(&e)
+		_, err = c.call(&dbusMsg{dest: lvmdName, path: path, iface: lvmdIface + "Lv", member: "Resize", sig: "ta(ott)ia{sv}", body: e.b})
+		return err
+	})
+}
+
+func (l lvmd) ResizePV(ctx context.Context, dev string) error {
+	return l.session(ctx, func(c *dbusConn) error {
+		path, err := lookUp(c, dev)
+		if err != nil {
+			return err
+		}
+		var e dbusEnc
+		e.uint64(0) // fill the device
+		resizeOpts(&e)
+		_, err = c.call(&dbusMsg{dest: lvmdName, path: path, iface: lvmdIface + "Pv", member: "ReSize", sig: "tia{sv}", body: e.b})
+		return err
+	})
+}
+
+// lvmdReachable returns an error if lvmdbusd can't be asked anything.
+func lvmdReachable() error {
+	ctx, cancel := context.WithTimeout(runCtx, 10*time.Second)
+	defer cancel()
+	return lvmd{}.session(ctx, func(c *dbusConn) error {
+		_, err := c.call(&dbusMsg{dest: lvmdName, path: lvmdManager, iface: "org.freedesktop.DBus.Peer", member: "Ping"})
+		return err
+	})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+// fakeLVMD answers LookUpByLvmId for vg0, and Properties.Get for
+// ExtentSizeBytes, on bus.
+func fakeLVMD(bus net.Conn) {
+	for {
+		m, err := readDBusMsg(bus)
+		if err != nil {
+			return
+		}
+		d := &dbusDec{b: m.body, order: m.order}
+		r := &dbusMsg{typ: dbusMethodReturn, replySerial: m.serial}
+		var e dbusEnc
+		switch m.member {
+		case "LookUpByLvmId":
+			if d.str() == "vg0" {
+				e.str("/com/redhat/lvmdbus1/Vg/0")
+			} else {
+				e.str("/")
+			}
+			r.sig = "o"
+		case "Get":
+			d.str()
+			if prop := d.str(); prop == "ExtentSizeBytes" {
+				e.sig("t")
+				e.uint64(4 << 20)
+			} else {
+				e.sig("s")
+				e.str("wat")
+			}
+			r.sig = "v"
+		}
+		r.body = e.b
+		bus.Write(r.encode(1))
+	}
+}
+
+func TestLVMD(t *testing.T) {
+	bus, ours := net.Pipe()
+	defer bus.Close()
+	go fakeLVMD(bus)
+	c := &dbusConn{c: ours, r: bufio.NewReader(ours)}
+
+	path, err := lookUp(c, "vg0")
+	if path != "/com/redhat/lvmdbus1/Vg/0" || err != nil {
+		t.Errorf("lookUp(vg0) = %q, %v", path, err)
+	}
+	if _, err := lookUp(c, "nope"); err == nil {
+		t.Errorf("lookUp(nope) succeeded")
+	}
+	n, err := uint64Prop(c, path, "Vg", "ExtentSizeBytes")
+	if n != 4<<20 || err != nil {
+		t.Errorf("ExtentSizeBytes = %d, %v; want %d", n, err, 4<<20)
+	}
+	if _, err := uint64Prop(c, path, "Vg", "Name"); err == nil {
+		t.Errorf("uint64Prop of a string succeeded")
+	}
+}
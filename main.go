@@ -23,148 +23,413 @@ package main
 // TODO: test/fix on disks with non-512 byte sectors ( /sys/block/sda/queue/hw_sector_size)
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"runtime"
+	"sync"
 	"time"
 
-	"github.com/samber/lo"
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
 )
 
 var (
-	dry     = flag.Bool("dry-run", false, "don't make changes")
-	verbose = flag.Bool("verbose", false, "verbose output")
-	daemon  = flag.Bool("daemon", false, "daemon mode")
+	dry       = flag.Bool("dry-run", false, "don't make changes")
+	verbose   = flag.Bool("verbose", false, "verbose output; same as -log-level=debug")
+	quiet     = flag.Bool("quiet", false, "only print errors; same as -log-level=error")
+	logFormat = flag.String("log-format", "text", "log format: text, json, or journald for native journal fields (the default under systemd)")
+	noColor   = flag.Bool("no-color", false, "don't colorize output, even on a terminal")
+	daemon    = flag.Bool("daemon", false, "daemon mode")
+	shrink    = flag.Bool("shrink", false, "shrink the filesystem (and LVM LV) to -size instead of growing; asks for confirmation")
+	output    = flag.String("output", "text", "output format: text or json")
+	all       = flag.Bool("all", false, "grow every mounted filesystem embiggen-disk can grow, rather than the mount points given")
+	confirm   = flag.Bool("confirm", false, "show the plan and ask before each change (partition table rewrite, lvextend, filesystem resize)")
+
+	targetSize  sizeFlag
+	usePercent  percentFlag
+	reserveSize bytesFlag
+	vgReserve   amountFlag
+	minGrowth   bytesFlag
+	lvFree      percentFlag
+	maxSizes    = mountSizesFlag{}
 )
 
 func init() {
+	flag.Var(&targetSize, "size", "grow to this size (e.g. \"100G\") or by this much (e.g. \"+20G\") rather than to fill the disk")
+	flag.Var(&usePercent, "use", "only use this percentage (e.g. \"80%\") of the disk or LVM VG free space, keeping the rest as headroom")
+	flag.Var(&reserveSize, "reserve", "leave this much (e.g. \"10G\") unallocated at the end of the disk when growing the last partition")
+	flag.Var(&vgReserve, "vg-reserve", "keep this much (e.g. \"10G\" or \"15%\" of the VG) free in the LVM volume group, e.g. for snapshots")
+	flag.Var(&minGrowth, "min-growth", "don't grow a layer by less than this much (e.g. \"1G\"), to avoid churn from rounding noise")
+	flag.Var(&lvFree, "lv-free", "keep this much (e.g. \"20%\") of a filesystem on an LVM LV free by extending the LV from its VG's free space only as far as needed, rather than giving it all of it, as for thin-provisioned storage shared by several LVs")
+	flag.Var(maxSizes, "max-size", "never grow the filesystem at a mount point beyond a size, as \"/var/log=50G\"; may be repeated")
+	flag.Var(&curLevel, "log-level", "log level: error, warn, info or debug")
 	flag.Usage = usage
 }
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of embiggen-disk:\n\n")
-	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] <mount-point-to-enlarge>\n\n")
-	fmt.Fprintf(os.Stderr, "# embiggen-disk systemd - installs systemd unit file, enables, and starts service in daemon mode \n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] <mount-point-to-enlarge>...\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] systemd [install] [flags] [-target mount-point...] - installs systemd unit file running the daemon with those flags and targets, enables, and starts it; with -mode=timer, a oneshot service and a timer running it -on-calendar\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk systemd uninstall - stops and disables the service and removes its unit file\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk systemd status - shows the service's status\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] aws grow <mount-point> <size> - on EC2, enlarges the EBS volume under the mount point to size (\"200G\") or by it (\"+50G\", \"+20%%\"), waits for it, and grows the layers above\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] gce grow <mount-point> <size> - on GCE, likewise resizes the persistent disk under the mount point\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] azure grow <mount-point> <size> - on Azure, likewise resizes the managed disk under the mount point, if the VM allows it while running\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] openstack grow <mount-point> <size> - on OpenStack, likewise extends the Cinder volume under the mount point, with credentials from the OS_* variables\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] image <file> <size> - enlarges a raw or qcow2 disk image file to size or by it, attaches it with a loop device or qemu-nbd, grows the partition and filesystem in it, and detaches it\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] guest-exec [mount-point...] - grows the mount points (or configured targets) and prints one line of JSON, for qemu-guest-agent's guest-exec; gives up after -guest-exec-timeout\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] kubernetes [apply|delete] [flags] [-target mount-point...] - prints a DaemonSet manifest running the daemon on every node with those flags and targets, or applies or deletes it with kubectl\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk ctl status|trigger [mount-point]|pause <mount-point>|resume <mount-point>|reload - controls the running daemon over its -control-socket\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] plan <mount-point> - shows the layers under a mount point and how far each could grow, changing nothing\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] check <mount-point> - exits 0 if the filesystem uses all available capacity, else 1 with the reclaimable bytes (Nagios-style)\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk doctor [mount-point] - checks that the tools, kernel features and permissions needed are in place\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] tui [mount-point...] - shows the layers under each mount point as a live tree, and grows the selected one on request\n\n")
 	flag.PrintDefaults()
-	os.Exit(1)
+	os.Exit(exitUsage)
 }
 
 func fatalf(format string, args ...interface{}) {
-	log.SetFlags(0)
-	log.Fatalf(format, args...)
+	exitf(exitFailed, format, args...)
 }
 
-func vlogf(format string, args ...interface{}) {
-	if *verbose {
-		log.Printf(format, args...)
+// exitf logs and exits with the given exit code.
+func exitf(code int, format string, args ...interface{}) {
+	log.SetFlags(0)
+	var f logFields
+	if *logFormat == "json" {
+		f = logFields{"exitCode": code}
 	}
+	logEvent(levelError, fmt.Sprintf(format, args...), f)
+	os.Exit(code)
 }
 
 func main() {
 	flag.Parse()
-	if flag.NArg() != 1 {
+	setupLogging()
+	setupLogFormat()
+	setupColor()
+	if err := setupEngine(); err != nil {
+		exitf(exitUsage, "%v", err)
+	}
+	if err := enterHostRoot(); err != nil {
+		exitf(exitUsage, "%v", err)
+	}
+	if err := setupConfig(); err != nil {
+		exitf(exitUsage, "error loading config: %v", err)
+	}
+	if flag.NArg() == 0 && len(cfg.Targets) == 0 && !*all && !(*daemon && *k8sLocalPVs) {
 		usage()
 	}
-	if runtime.GOOS != "linux" {
-		fatalf("embiggen-disk only runs on Linux.")
+	if runtime.GOOS != "linux" && runtime.GOOS != "freebsd" {
+		fatalf("embiggen-disk only runs on Linux and FreeBSD.")
 	}
 
 	switch flag.Arg(0) {
+	case "plan":
+		planMain(flag.Args()[1:])
+	case "check":
+		checkMain(flag.Args()[1:])
+	case "doctor":
+		doctorMain(flag.Args()[1:])
+	case "tui":
+		tuiMain(flag.Args()[1:])
+		os.Exit(0)
+	case "aws":
+		awsMain(flag.Args()[1:])
+	case "gce":
+		gceMain(flag.Args()[1:])
+	case "azure":
+		azureMain(flag.Args()[1:])
+	case "openstack":
+		openstackMain(flag.Args()[1:])
+	case "image":
+		imageMain(flag.Args()[1:])
+	case "guest-exec":
+		guestExecMain(flag.Args()[1:])
+	case "kubernetes":
+		kubernetesMain(flag.Args()[1:])
+		os.Exit(0)
 	case "systemd":
-		unitFile := []byte(`[Unit]
-Description=embiggen-disk
-
-[Service]
-ExecStart=/root/go/bin/embiggen-disk -verbose -daemon /
-
-[Install]
-WantedBy=multi-user.target`)
-		os.WriteFile("/etc/systemd/system/embiggen-disk.service", unitFile, 0644)
-		lo.Must0(exec.Command("systemctl", "daemon-reload").Run())
-		lo.Must0(exec.Command("systemctl", "enable", "embiggen-disk.service").Run())
-		lo.Must0(exec.Command("systemctl", "start", "embiggen-disk.service").Run())
-		statusCmd := exec.Command("systemctl", "status", "embiggen-disk.service")
-		lo.Must0(statusCmd.Run())
-		output, err := statusCmd.CombinedOutput()
-		if err != nil {
-			log.Printf("unable to systemctl status embiggen-disk.service: %s", err)
-		}
-		fmt.Println(string(output))
-		fmt.Println("Successfully setup embiggen-disk.service")
+		systemdMain(flag.Args()[1:])
 		os.Exit(0)
+	case "ctl":
+		ctlMain(flag.Args()[1:])
+		os.Exit(0)
+	}
+	switch *output {
+	case "text", "json":
+	default:
+		exitf(exitUsage, "unsupported -output %q; want text or json", *output)
+	}
+	if *interval <= 0 || *jitter < 0 || *maxInterval < 0 || *cooldown < 0 || *maxFailures < 0 {
+		exitf(exitUsage, "-interval must be positive, and -jitter, -max-interval, -cooldown and -max-failures can't be negative")
 	}
 
-	mnt := flag.Arg(0)
-	ticker := time.NewTicker(10 * time.Second)
-	for range ticker.C {
-		e, err := getFileSystemResizer(mnt)
-		vlogf("getFileSystemResizer(%q) = %#v, %v", mnt, e, err)
+	mnts := flag.Args()
+	if len(mnts) == 0 {
+		mnts = cfg.mounts()
+	}
+	if *drain && !*shrink {
+		exitf(exitUsage, "-drain only applies to -shrink; growing never unmounts")
+	}
+	if *shrink {
+		if *daemon {
+			exitf(exitUsage, "-shrink can't be used with -daemon")
+		}
+		if len(mnts) != 1 {
+			exitf(exitUsage, "-shrink needs exactly one mount point")
+		}
+		if !targetSize.set || targetSize.relative {
+			exitf(exitUsage, "-shrink requires an absolute -size, such as -size=50G")
+		}
+		mnt := mnts[0]
+		changes, err := shrinkFS(mnt, targetSize.bytes)
+		for _, c := range changes {
+			fmt.Printf("  * %s\n", c)
+		}
 		if err != nil {
-			fatalf("error preparing to enlarge %s: %v", mnt, err)
+			exitf(exitCode(nil, err), "error shrinking %s: %v", mnt, err)
 		}
-		changes, err := Resize(e)
-		if len(changes) > 0 {
-			fmt.Printf("Changes made:\n")
-			for _, c := range changes {
-				fmt.Printf("  * %s\n", c)
+		os.Exit(0)
+	}
+	if *confirm && *daemon {
+		exitf(exitUsage, "-confirm can't be used with -daemon")
+	}
+	mnts, lims, err := targets()
+	if err != nil {
+		exitf(exitCode(nil, err), "error preparing to enlarge %v", err)
+	}
+	if !*daemon {
+		// Device targets are looked up on each check in the daemon.
+		for i, target := range mnts {
+			mnt, err := targetMount(target)
+			if err != nil {
+				exitf(exitCode(nil, err), "error preparing to enlarge %s: %v", target, err)
+			}
+			mnts[i], lims[mnt] = mnt, lims[target]
+		}
+	}
+	if !*dry {
+		// Fail now, not midway through a resize.
+		for _, mnt := range mnts {
+			if e, err := embiggen.FileSystemResizer(runCtx, mnt, lims[mnt]); err == nil {
+				if err := embiggen.CheckPrivileges(runCtx, e); err != nil {
+					exitf(exitCode(nil, err), "can't enlarge %s: %v", mnt, err)
+				}
 			}
-			time.Sleep(10 * time.Second)
-			restartKubeletCmd := exec.Command("systemctl", "restart", "kubelet")
-			lo.Must0(restartKubeletCmd.Run())
-			output, err := restartKubeletCmd.CombinedOutput()
+		}
+	}
+	if *confirm {
+		for _, mnt := range mnts {
+			e, err := embiggen.FileSystemResizer(runCtx, mnt, lims[mnt])
 			if err != nil {
-				log.Printf("there was a problem gathering combined output from `systemctl restart kubelet`: %s", err.Error())
-			} else {
-				fmt.Printf("Restarted Kubelet! %s\n", string(output))
+				exitf(exitCode(nil, err), "error preparing to enlarge %s: %v", mnt, err)
 			}
-		} else if err == nil {
-			fmt.Printf("No changes made.\n")
+			nodes, err := planStack(e)
+			if err != nil {
+				exitf(exitCode(nil, err), "error preparing to enlarge %s: %v", mnt, err)
+			}
+			fmt.Println("Plan:")
+			writePlan(os.Stdout, nodes)
+			fmt.Println()
+		}
+	}
+	if *daemon {
+		poll(mnts, lims)
+	}
+	var changes []embiggen.Change
+	results := growAll(mnts, lims)
+	for _, r := range results {
+		changes = append(changes, r.changes...)
+	}
+	for i, mnt := range mnts {
+		if err := results[i].err; err != nil {
+			exitf(exitCode(changes, err), "error enlarging %s: %v", mnt, err)
+		}
+	}
+	os.Exit(exitCode(changes, nil))
+}
+
+// targets returns the mount points to grow, from the command line or
+// else the config file, and the limit for each.
+func targets() ([]string, map[string]embiggen.Limit, error) {
+	mnts := flag.Args()
+	if *all {
+		if len(mnts) > 0 {
+			return nil, nil, fmt.Errorf("-all can't be used with mount points")
 		}
+		var err error
+		if mnts, err = embiggen.ResizableMounts(runCtx); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(mnts) == 0 {
+		mnts = cfg.mounts()
+	}
+	if len(mnts) == 0 && !(*daemon && *k8sLocalPVs) {
+		return nil, nil, errNoTargets
+	}
+	lims := map[string]embiggen.Limit{}
+	for _, mnt := range mnts {
+		lim, err := resolveLimit(mnt)
 		if err != nil {
-			fatalf("error: %v", err)
+			return nil, nil, fmt.Errorf("%s: %w", mnt, err)
 		}
+		lims[mnt] = lim
 	}
+	return mnts, lims, nil
 }
 
-// An Resizer is anything that can enlarge something and describe its state.
-// An Resizer can depend on another Resizer to run first.
-type Resizer interface {
-	String() string                       // "ext4 filesystem at /", "LVM PV foo"
-	State() (string, error)               // "534 blocks"
-	Resize() error                        // both may be non-zero
-	DepResizer() (dep Resizer, err error) // can return (nil, nil) for none
+// grow grows the filesystem at mnt, and the layers under it, as far
+// as lim allows, reporting and returning what changed.
+func grow(mnt string, lim embiggen.Limit) ([]embiggen.Change, error) {
+	rep, err := growReport(runCtx, mnt, lim)
+	if rep == nil {
+		return nil, err
+	}
+	return rep.Changes, err
 }
 
-// Resize resizes e's dependencies and then resizes e.
-func Resize(e Resizer) (changes []string, err error) {
-	s0, err := e.State()
+// growReport is like grow but returns a report of the resize, or nil
+// if it didn't get as far as trying. It resizes with ctx's Options.
+func growReport(ctx context.Context, mnt string, lim embiggen.Limit) (*report, error) {
+	lk, err := embiggen.LockGlobal(ctx)
 	if err != nil {
-		return
+		return nil, err
 	}
-	dep, err := e.DepResizer()
+	defer lk.Unlock()
+	return growReportLocked(ctx, mnt, lim)
+}
+
+// growReportLocked is growReport, for callers holding the global lock.
+func growReportLocked(ctx context.Context, mnt string, lim embiggen.Limit) (*report, error) {
+	mnt, err := targetMount(mnt)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if dep != nil {
-		changes, err = Resize(dep)
-		if err != nil {
-			return
-		}
+	if lim, err = withLVFree(mnt, lim); err != nil {
+		return nil, err
 	}
-	err = e.Resize()
+	e, err := embiggen.FileSystemResizer(ctx, mnt, lim)
+	vlogf("embiggen.FileSystemResizer(ctx, %q) = %#v, %v", mnt, e, err)
 	if err != nil {
-		return
+		return nil, err
 	}
-	s1, err := e.State()
-	if err != nil {
-		err = fmt.Errorf("error after successful resize of %v: %v", e, err)
-		return
+	if !preResize(ctx, mnt, e, lim) {
+		return &report{Mount: mnt, DryRun: dryRun(ctx), Changes: []embiggen.Change{}}, nil
+	}
+	t0 := time.Now()
+	root := startTrace(mnt)
+	rep, err := resizeReport(ctx, mnt, e)
+	changes := rep.Changes
+	endTrace(root, err)
+	printReport(e, rep, err)
+	// In text mode the changes are printed below anyway.
+	changeLevel := levelDebug
+	if *logFormat != "text" {
+		changeLevel = levelInfo
+	}
+	for _, c := range changes {
+		f := logFields{
+			"mount":       mnt,
+			"device":      c.Device,
+			"layer":       c.Layer,
+			"action":      "grow",
+			"result":      "resized",
+			"duration":    c.Duration,
+			"stateTime":   c.StateTime,
+			"beforeBytes": c.BeforeBytes,
+			"afterBytes":  c.AfterBytes,
+			"gainedBytes": c.GainedBytes,
+		}
+		if c.VolumeID != "" {
+			f["volumeId"] = c.VolumeID
+		}
+		level := changeLevel
+		if len(c.KernelErrors) > 0 {
+			f["kernelErrors"] = c.KernelErrors
+			level = levelError
+		}
+		logEvent(level, "resized "+c.Resizer, f)
+	}
+	if len(changes) > 0 {
+		layerHooks(mnt, changes)
+		if err := runHook(ctx, "post-resize", flagOr("post-resize-hook", *postResizeHook, hooksFor(mnt).PostResize), mnt, changes); err != nil {
+			warnf("%v", err)
+		}
+		kubeletAfterResize(mnt)
 	}
-	if s0 != s1 {
-		changes = append(changes, fmt.Sprintf("%v: before: %v, after: %v", e, s0, s1))
+	if errors.Is(err, errShuttingDown) {
+		err = nil
+	}
+	auditResize(ctx, mnt, changes, rep.Commands, err)
+	if len(changes) > 0 || (err != nil && !errors.Is(err, errRateLimited)) {
+		notify(newEvent(mnt, changes, err, time.Since(t0)))
+	}
+	return rep, err
+}
+
+// stdoutMu serializes printing the reports of targets grown in
+// parallel.
+var stdoutMu sync.Mutex
+
+// printReport prints rep, the report of growing e, per -output.
+func printReport(e embiggen.Resizer, rep *report, err error) {
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	if *output == "json" {
+		rep.WriteJSON(os.Stdout)
+	}
+	changes := rep.Changes
+	if len(changes) > 0 {
+		if *output == "text" && !*quiet {
+			fmt.Printf("Changes made:\n")
+			for _, c := range changes {
+				fmt.Println(colorize(colorStdout, ansiGreen, fmt.Sprintf("  * %s, gained %s (%s)", c, embiggen.HumanSize(c.GainedBytes), changeTiming(c))))
+				for _, ke := range c.KernelErrors {
+					fmt.Println(colorize(colorStdout, ansiRed, "      kernel error: "+ke))
+				}
+				if *verbose {
+					for _, lc := range c.Commands {
+						fmt.Printf("      %s: %v\n", lc.Command, lc.Duration.Round(time.Millisecond))
+					}
+				}
+			}
+			if colorStdout {
+				// For people at a terminal, also show what didn't change.
+				printUnchanged(e, changes)
+			}
+		}
+	} else if err == nil && *output == "text" {
+		if *daemon || *quiet {
+			// Don't fill the journal every tick.
+			vlogf("No changes made.")
+		} else {
+			fmt.Println(colorize(colorStdout, ansiYellow, "No changes made."))
+		}
+	}
+}
+
+// changeTiming returns how long c's steps took, like
+// "resize 3.2s, state 40ms".
+func changeTiming(c embiggen.Change) string {
+	return fmt.Sprintf("resize %v, state %v", c.Duration.Round(time.Millisecond), c.StateTime.Round(time.Millisecond))
+}
+
+// printUnchanged prints, in yellow, the layers in e's chain that
+// aren't in changes.
+func printUnchanged(e embiggen.Resizer, changes []embiggen.Change) {
+	changed := map[string]bool{}
+	for _, c := range changes {
+		changed[c.Resizer] = true
+	}
+	chain, _ := embiggen.Chain(runCtx, e)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if r := chain[i]; !changed[r.String()] {
+			fmt.Println(colorize(true, ansiYellow, fmt.Sprintf("  - %s: unchanged", r)))
+		}
 	}
-	return
 }
@@ -0,0 +1,403 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var httpAddr = flag.String("http-addr", "", "in daemon mode, serve /metrics, /healthz and /status on this address, e.g. \":9323\", or on a unix socket, e.g. \"unix:/run/embiggen-disk-metrics.sock\"")
+
+// durationBuckets are the upper bounds, in seconds, of the per-layer
+// resize duration histogram.
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// targetStats are the daemon's counters for one target.
+type targetStats struct {
+	attempts, successes, failures int64
+	lastCheck, lastSuccess        time.Time
+	lastChange                    time.Time
+	lastChanges                   []embiggen.Change
+	lastError                     string
+	lastErrorTime                 time.Time
+	failuresInARow                int
+	gaveUp                        bool
+	paused                        bool
+	resized                       map[string]int64 // by layer
+}
+
+// A histogram counts observations into durationBuckets.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, b := range durationBuckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// stats is what the daemon has done, for /metrics.
+var stats = struct {
+	sync.Mutex
+	targets   map[string]*targetStats
+	durations map[string]*histogram // by layer
+	mnts      []string
+	lims      map[string]embiggen.Limit
+	started   time.Time
+	lastLoop  time.Time // when a check last started or finished
+}{
+	targets:   map[string]*targetStats{},
+	durations: map[string]*histogram{},
+}
+
+// setStatsTargets sets the targets whose sizes /metrics reports.
+func setStatsTargets(mnts []string, lims map[string]embiggen.Limit) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.mnts, stats.lims = mnts, lims
+}
+
+// recordCheck records the outcome of growing mnt.
+func recordCheck(mnt string, changes []embiggen.Change, err error) {
+	stats.Lock()
+	defer stats.Unlock()
+	ts := stats.targets[mnt]
+	if ts == nil {
+		ts = &targetStats{resized: map[string]int64{}}
+		stats.targets[mnt] = ts
+	}
+	now := time.Now()
+	ts.attempts++
+	ts.lastCheck = now
+	stats.lastLoop = now
+	if err != nil {
+		ts.failures++
+		ts.lastError, ts.lastErrorTime = err.Error(), now
+	} else {
+		ts.successes++
+		ts.lastSuccess = now
+	}
+	if len(changes) > 0 {
+		ts.lastChange, ts.lastChanges = now, changes
+	}
+	for _, c := range changes {
+		ts.resized[c.Layer]++
+		h := stats.durations[c.Layer]
+		if h == nil {
+			h = &histogram{}
+			stats.durations[c.Layer] = h
+		}
+		h.observe(c.Duration.Seconds())
+	}
+}
+
+// recordGiveUp records the daemon's circuit breaker state for mnt.
+func recordGiveUp(mnt string, failuresInARow int, gaveUp bool) {
+	stats.Lock()
+	defer stats.Unlock()
+	if ts := stats.targets[mnt]; ts != nil {
+		ts.failuresInARow, ts.gaveUp = failuresInARow, gaveUp
+	}
+}
+
+// recordPause records whether mnt is paused by the control API.
+func recordPause(mnt string, paused bool) {
+	stats.Lock()
+	defer stats.Unlock()
+	ts := stats.targets[mnt]
+	if ts == nil {
+		ts = &targetStats{resized: map[string]int64{}}
+		stats.targets[mnt] = ts
+	}
+	ts.paused = paused
+}
+
+// recordLoop notes that the daemon's loop is alive, for /healthz.
+func recordLoop() {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.lastLoop = time.Now()
+}
+
+// writeMetrics writes the daemon's metrics in the Prometheus text
+// exposition format.
+func writeMetrics(w io.Writer) {
+	stats.Lock()
+	mnts, lims := stats.mnts, stats.lims
+	stats.Unlock()
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	// Sizes are read fresh, outside the lock, as they run tools.
+	type sizes struct {
+		mnt, vol              string
+		size, free, unclaimed int64
+		ok, unclaimedOK       bool
+	}
+	var ss []sizes
+	for _, target := range mnts {
+		s := sizes{mnt: target}
+		mnt, err := targetMount(target)
+		if err != nil {
+			ss = append(ss, s)
+			continue
+		}
+		if st, err := embiggen.StatFS(mnt); err == nil {
+			bs := int64(st.Statfs.Bsize)
+			s.size, s.free, s.ok = int64(st.Statfs.Blocks)*bs, int64(st.Statfs.Bavail)*bs, true
+		}
+		if e, err := embiggen.FileSystemResizer(runCtx, mnt, lims[target]); err == nil {
+			if n, err := reclaimable(e); err == nil {
+				s.unclaimed, s.unclaimedOK = n, true
+			}
+			s.vol = targetVolumeID(e)
+		}
+		ss = append(ss, s)
+	}
+	metric("embiggen_filesystem_size_bytes", "gauge", "Size of the target filesystem.")
+	for _, s := range ss {
+		if s.ok {
+			fmt.Fprintf(bw, "embiggen_filesystem_size_bytes{mount=%s} %d\n", promLabel(s.mnt), s.size)
+		}
+	}
+	metric("embiggen_filesystem_free_bytes", "gauge", "Space available to unprivileged users on the target filesystem.")
+	for _, s := range ss {
+		if s.ok {
+			fmt.Fprintf(bw, "embiggen_filesystem_free_bytes{mount=%s} %d\n", promLabel(s.mnt), s.free)
+		}
+	}
+	metric("embiggen_unclaimed_bytes", "gauge", "How much the target filesystem could still grow by.")
+	for _, s := range ss {
+		if s.unclaimedOK {
+			fmt.Fprintf(bw, "embiggen_unclaimed_bytes{mount=%s} %d\n", promLabel(s.mnt), s.unclaimed)
+		}
+	}
+	metric("embiggen_volume_info", "gauge", "The EBS volume under the target, if any.")
+	for _, s := range ss {
+		if s.vol != "" {
+			fmt.Fprintf(bw, "embiggen_volume_info{mount=%s,volume_id=%s} 1\n", promLabel(s.mnt), promLabel(s.vol))
+		}
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+	var tmnts []string
+	for mnt := range stats.targets {
+		tmnts = append(tmnts, mnt)
+	}
+	sort.Strings(tmnts)
+	for _, c := range []struct {
+		name, help string
+		val        func(*targetStats) int64
+	}{
+		{"embiggen_resize_attempts_total", "Checks of the target.", func(t *targetStats) int64 { return t.attempts }},
+		{"embiggen_resize_successes_total", "Checks of the target that didn't fail.", func(t *targetStats) int64 { return t.successes }},
+		{"embiggen_resize_failures_total", "Checks of the target that failed.", func(t *targetStats) int64 { return t.failures }},
+	} {
+		metric(c.name, "counter", c.help)
+		for _, mnt := range tmnts {
+			fmt.Fprintf(bw, "%s{mount=%s} %d\n", c.name, promLabel(mnt), c.val(stats.targets[mnt]))
+		}
+	}
+	metric("embiggen_layers_resized_total", "counter", "Layers resized under the target, by layer.")
+	for _, mnt := range tmnts {
+		ts := stats.targets[mnt]
+		var layers []string
+		for l := range ts.resized {
+			layers = append(layers, l)
+		}
+		sort.Strings(layers)
+		for _, l := range layers {
+			fmt.Fprintf(bw, "embiggen_layers_resized_total{mount=%s,layer=%s} %d\n", promLabel(mnt), promLabel(l), ts.resized[l])
+		}
+	}
+	metric("embiggen_last_success_timestamp_seconds", "gauge", "When the target was last checked without error.")
+	for _, mnt := range tmnts {
+		if t := stats.targets[mnt].lastSuccess; !t.IsZero() {
+			fmt.Fprintf(bw, "embiggen_last_success_timestamp_seconds{mount=%s} %d\n", promLabel(mnt), t.Unix())
+		}
+	}
+	metric("embiggen_layer_resize_duration_seconds", "histogram", "How long resizing a layer took.")
+	var layers []string
+	for l := range stats.durations {
+		layers = append(layers, l)
+	}
+	sort.Strings(layers)
+	for _, l := range layers {
+		h := stats.durations[l]
+		var cum uint64
+		for i, b := range durationBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(bw, "embiggen_layer_resize_duration_seconds_bucket{layer=%s,le=\"%s\"} %d\n", promLabel(l), strconv.FormatFloat(b, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(bw, "embiggen_layer_resize_duration_seconds_bucket{layer=%s,le=\"+Inf\"} %d\n", promLabel(l), h.count)
+		fmt.Fprintf(bw, "embiggen_layer_resize_duration_seconds_sum{layer=%s} %g\n", promLabel(l), h.sum)
+		fmt.Fprintf(bw, "embiggen_layer_resize_duration_seconds_count{layer=%s} %d\n", promLabel(l), h.count)
+	}
+}
+
+// promLabel returns s quoted as a Prometheus label value.
+func promLabel(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// A targetStatus is one target in /status.
+type targetStatus struct {
+	Mount          string            `json:"mount"`
+	LastCheck      *time.Time        `json:"lastCheck,omitempty"`
+	LastChange     *time.Time        `json:"lastChange,omitempty"`
+	LastChanges    []embiggen.Change `json:"lastChanges,omitempty"`
+	LastError      string            `json:"lastError,omitempty"`
+	LastErrorTime  *time.Time        `json:"lastErrorTime,omitempty"`
+	FailuresInARow int               `json:"failuresInARow"`
+	GaveUp         bool              `json:"gaveUp"`
+	Paused         bool              `json:"paused"`
+}
+
+// daemonStatus is the body of /status.
+type daemonStatus struct {
+	Healthy  bool           `json:"healthy"`
+	Started  time.Time      `json:"started"`
+	LastLoop time.Time      `json:"lastLoop"`
+	Interval string         `json:"interval"`
+	Targets  []targetStatus `json:"targets"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// status returns the daemon's status, for /status and /healthz.
+func status() daemonStatus {
+	stats.Lock()
+	defer stats.Unlock()
+	ds := daemonStatus{
+		Started:  stats.started,
+		LastLoop: stats.lastLoop,
+		Interval: scanInterval().String(),
+	}
+	// The loop should come round at least every longest wait; allow
+	// for a slow resize on top of that.
+	longest := scanInterval()
+	if polling.maxInterval > longest {
+		longest = polling.maxInterval
+	}
+	ds.Healthy = time.Since(stats.lastLoop) < 2*(longest+polling.jitter)+5*time.Minute
+	for _, mnt := range stats.mnts {
+		ts := targetStatus{Mount: mnt}
+		if t := stats.targets[mnt]; t != nil {
+			ts.LastCheck = timePtr(t.lastCheck)
+			ts.LastChange = timePtr(t.lastChange)
+			ts.LastChanges = t.lastChanges
+			ts.LastError = t.lastError
+			ts.LastErrorTime = timePtr(t.lastErrorTime)
+			ts.FailuresInARow = t.failuresInARow
+			ts.GaveUp = t.gaveUp
+			ts.Paused = t.paused
+		}
+		ds.Targets = append(ds.Targets, ts)
+	}
+	return ds
+}
+
+// serveHTTP serves the daemon's HTTP endpoints on addr, in the
+// background. An addr of "unix:/path" serves on a unix socket.
+func serveHTTP(addr string) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		os.Remove(addr) // left over from a previous run
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		warnf("not serving HTTP: %v", err)
+		return
+	}
+	if network == "unix" {
+		os.Chmod(addr, 0660)
+	}
+	serveHTTPOn(ln, false)
+}
+
+// serveHTTPOn serves the HTTP API on ln in the background, with the
+// control API too if control is set.
+func serveHTTPOn(ln net.Listener, control bool) {
+	stats.Lock()
+	if stats.started.IsZero() {
+		stats.started, stats.lastLoop = time.Now(), time.Now()
+	}
+	stats.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !status().Healthy {
+			http.Error(w, "no check has finished recently", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(status())
+	})
+	if control {
+		handleControl(mux)
+	}
+	go func() {
+		err := http.Serve(ln, mux)
+		warnf("serving HTTP on %s: %v", ln.Addr(), err)
+	}()
+}
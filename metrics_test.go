@@ -0,0 +1,67 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	recordCheck("/data", []embiggen.Change{{Layer: "partition", Duration: 2 * time.Second}, {Layer: "filesystem", Duration: 200 * time.Millisecond}}, nil)
+	recordCheck("/data", nil, errors.New("lvextend failed"))
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	for _, want := range []string{
+		`embiggen_resize_attempts_total{mount="/data"} 2`,
+		`embiggen_resize_successes_total{mount="/data"} 1`,
+		`embiggen_resize_failures_total{mount="/data"} 1`,
+		`embiggen_layers_resized_total{mount="/data",layer="partition"} 1`,
+		`embiggen_layer_resize_duration_seconds_bucket{layer="filesystem",le="0.1"} 0`,
+		`embiggen_layer_resize_duration_seconds_bucket{layer="filesystem",le="0.5"} 1`,
+		`embiggen_layer_resize_duration_seconds_bucket{layer="partition",le="5"} 1`,
+		`embiggen_layer_resize_duration_seconds_count{layer="partition"} 1`,
+		`# TYPE embiggen_layer_resize_duration_seconds histogram`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("metrics missing %q; got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestPromLabel(t *testing.T) {
+	if got, want := promLabel(`/mnt/a"b\c`), `"/mnt/a\"b\\c"`; got != want {
+		t.Errorf("promLabel = %s; want %s", got, want)
+	}
+}
+
+func TestStatsdLine(t *testing.T) {
+	s := &statsdSink{tags: []string{"env:prod"}}
+	if got, want := s.line("resize.attempts", 1, "c", "mount:/"), "embiggen.resize.attempts:1|c|#env:prod,mount:/"; got != want {
+		t.Errorf("line = %q; want %q", got, want)
+	}
+	s = &statsdSink{}
+	if got, want := s.line("unclaimed_bytes", int64(42), "g"), "embiggen.unclaimed_bytes:42|g"; got != want {
+		t.Errorf("line = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,420 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var (
+	webhookURL        = flag.String("webhook-url", "", "POST a JSON event to this URL whenever a target is resized or fails to resize")
+	webhookSecretFile = flag.String("webhook-secret-file", "", "sign -webhook-url requests with HMAC-SHA256 using the key in this file, in an X-Embiggen-Signature header")
+	webhookHeaders    = headersFlag{}
+	slackURL          = flag.String("slack-webhook-url", "", "post a summary to this Slack incoming webhook when a target is resized or fails to resize")
+	slackOn           = flag.String("slack-on", "all", "which events to post to Slack: all, or failed")
+	snsTopic          = flag.String("sns-topic-arn", "", "on AWS, publish events to this SNS topic using the instance role")
+	eventBridgeBus    = flag.String("eventbridge-bus", "", "on AWS, put events on this EventBridge bus (e.g. \"default\") using the instance role")
+)
+
+func init() {
+	flag.Var(webhookHeaders, "webhook-header", "extra header to send with -webhook-url requests, as \"Name: value\"; may be repeated")
+}
+
+// headersFlag is a repeatable flag.Value of HTTP headers, given as
+// "Name: value".
+type headersFlag map[string]string
+
+func (f headersFlag) String() string { return strings.Join(f.values(), ", ") }
+
+func (f headersFlag) values() []string {
+	var hs []string
+	for k, v := range f {
+		hs = append(hs, k+": "+v)
+	}
+	sort.Strings(hs)
+	return hs
+}
+
+func (f headersFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("want \"Name: value\", not %q", s)
+	}
+	f[strings.TrimSpace(s[:i])] = strings.TrimSpace(s[i+1:])
+	return nil
+}
+
+// An event describes what happened to a target, for notifications.
+type event struct {
+	Time        time.Time         `json:"time"`
+	Host        string            `json:"host"`
+	Mount       string            `json:"mount"`
+	Status      string            `json:"status"` // "resized" or "failed"
+	BeforeBytes int64             `json:"beforeBytes,omitempty"`
+	AfterBytes  int64             `json:"afterBytes,omitempty"`
+	Duration    time.Duration     `json:"durationNanos"`
+	Changes     []embiggen.Change `json:"changes,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+func newEvent(mnt string, changes []embiggen.Change, err error, d time.Duration) *event {
+	host, _ := os.Hostname()
+	ev := &event{
+		Time:     time.Now(),
+		Host:     host,
+		Mount:    mnt,
+		Status:   "resized",
+		Duration: d,
+		Changes:  changes,
+	}
+	// Changes are bottom layer first, so the last is the top.
+	if n := len(changes); n > 0 {
+		ev.BeforeBytes, ev.AfterBytes = changes[n-1].BeforeBytes, changes[n-1].AfterBytes
+	}
+	if err != nil {
+		ev.Status, ev.Error = "failed", err.Error()
+	}
+	return ev
+}
+
+// A notifier sends events somewhere.
+type notifier interface {
+	String() string
+	notify(ev *event) error
+}
+
+// notifiers are where to send events. Set by setupNotifiers.
+var notifiers []notifier
+
+// targetNotifiers are where to send events for the config file targets
+// with notify settings of their own, by target. Set by setupNotifiers.
+var targetNotifiers map[string][]notifier
+
+// setupNotifiers sets notifiers and targetNotifiers from the flags and
+// config file.
+func setupNotifiers() error {
+	ns, err := newNotifiers(cfg.Notify)
+	if err != nil {
+		return err
+	}
+	k8s, err := newK8sNotifier()
+	if err != nil {
+		return err
+	}
+	if k8s != nil {
+		ns = append(ns, k8s)
+	}
+	tns := map[string][]notifier{}
+	for _, t := range cfg.Targets {
+		nc, ok := targetNotify(cfg.Notify, t.Notify)
+		if !ok {
+			continue
+		}
+		n, err := newNotifiers(nc)
+		if err != nil {
+			return fmt.Errorf("target %s: %v", t.Mount, err)
+		}
+		if k8s != nil {
+			n = append(n, k8s)
+		}
+		tns[t.Mount] = n
+	}
+	notifiers, targetNotifiers = ns, tns
+	return nil
+}
+
+// targetNotify returns the notify settings for a target: base, with
+// each destination the target's own t sets in place of base's. It
+// reports whether t sets any.
+func targetNotify(base, t notifyConfig) (notifyConfig, bool) {
+	nc, ok := base, false
+	if t.Webhook.URL != "" {
+		nc.Webhook, ok = t.Webhook, true
+	}
+	if t.Slack.URL != "" {
+		nc.Slack, ok = t.Slack, true
+	}
+	if t.SNS.TopicARN != "" {
+		nc.SNS, ok = t.SNS, true
+	}
+	if t.EventBridge.Bus != "" {
+		nc.EventBridge, ok = t.EventBridge, true
+	}
+	return nc, ok
+}
+
+// newNotifiers returns the webhook, Slack, SNS and EventBridge
+// notifiers for the flags and nc.
+func newNotifiers(nc notifyConfig) ([]notifier, error) {
+	var ns []notifier
+	wc := nc.Webhook
+	url := wc.URL
+	if *webhookURL != "" {
+		url = *webhookURL
+	}
+	if url != "" {
+		w := &webhook{url: url, headers: map[string]string{}}
+		for k, v := range wc.Headers {
+			w.headers[k] = v
+		}
+		for k, v := range webhookHeaders {
+			w.headers[k] = v
+		}
+		secretFile := flagOr("webhook-secret-file", *webhookSecretFile, wc.SecretFile)
+		if secretFile != "" {
+			key, err := ioutil.ReadFile(secretFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading webhook secret: %v", err)
+			}
+			w.key = bytes.TrimSpace(key)
+		}
+		ns = append(ns, w)
+	}
+	sc := nc.Slack
+	if url := flagOr("slack-webhook-url", *slackURL, sc.URL); url != "" {
+		on := *slackOn
+		if sc.On != "" && !flagGiven("slack-on") {
+			on = sc.On
+		}
+		if on != "all" && on != "failed" {
+			return nil, fmt.Errorf("bad slack-on %q; want all or failed", on)
+		}
+		ns = append(ns, &slack{url: url, failedOnly: on == "failed"})
+	}
+	if arn := flagOr("sns-topic-arn", *snsTopic, nc.SNS.TopicARN); arn != "" {
+		// arn:aws:sns:us-east-1:123456789012:topic
+		f := strings.Split(arn, ":")
+		if len(f) != 6 || f[2] != "sns" {
+			return nil, fmt.Errorf("bad SNS topic ARN %q", arn)
+		}
+		ns = append(ns, &snsNotifier{arn: arn, region: f[3]})
+	}
+	if bus := flagOr("eventbridge-bus", *eventBridgeBus, nc.EventBridge.Bus); bus != "" {
+		ns = append(ns, &eventBridgeNotifier{bus: bus})
+	}
+	return ns, nil
+}
+
+// newK8sNotifier returns the Kubernetes notifier for the flags and
+// config file, or nil if there's none.
+func newK8sNotifier() (notifier, error) {
+	kc := cfg.Notify.Kubernetes
+	events, annotate := *k8sEvents, *k8sAnnotate
+	if kc.Events != nil && !flagGiven("k8s-events") {
+		events = *kc.Events
+	}
+	if kc.Annotate != nil && !flagGiven("k8s-annotate") {
+		annotate = *kc.Annotate
+	}
+	if events {
+		c, err := newKubeClient(kubeconfigPath())
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: %v", err)
+		}
+		if c != nil {
+			return &k8sNotifier{c: c, node: nodeName(), annotate: annotate}, nil
+		}
+	}
+	return nil, nil
+}
+
+// notify sends ev to each of the notifiers for its target, logging any
+// that fail.
+func notify(ev *event) {
+	ns := notifiers
+	if t := cfg.target(ev.Mount); t != nil {
+		if tns, ok := targetNotifiers[t.Mount]; ok {
+			ns = tns
+		}
+	}
+	for _, n := range ns {
+		if err := n.notify(ev); err != nil {
+			warnf("notifying %v: %v", n, err)
+		}
+	}
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON POSTs body to url with the given headers, failing unless
+// the response is a 2xx.
+func postJSON(url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "embiggen-disk")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// A webhook POSTs events as JSON to a URL.
+type webhook struct {
+	url     string
+	headers map[string]string
+	key     []byte // for HMAC signatures, if set
+}
+
+func (w *webhook) String() string { return "webhook " + w.url }
+
+func (w *webhook) notify(ev *event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	headers := w.headers
+	if w.key != nil {
+		headers = map[string]string{}
+		for k, v := range w.headers {
+			headers[k] = v
+		}
+		headers["X-Embiggen-Signature"] = "sha256=" + signBody(w.key, body)
+	}
+	return postJSON(w.url, body, headers)
+}
+
+// A slack posts a summary of events to a Slack incoming webhook.
+type slack struct {
+	url        string
+	failedOnly bool
+}
+
+func (s *slack) String() string { return "Slack" }
+
+func (s *slack) notify(ev *event) error {
+	if s.failedOnly && ev.Status != "failed" {
+		return nil
+	}
+	body, err := json.Marshal(map[string]string{"text": slackText(ev)})
+	if err != nil {
+		return err
+	}
+	return postJSON(s.url, body, nil)
+}
+
+// slackText returns a one-line summary of ev for Slack.
+func slackText(ev *event) string {
+	if ev.Status == "failed" {
+		return fmt.Sprintf(":warning: embiggen-disk on %s failed to grow %s: %s", ev.Host, ev.Mount, ev.Error)
+	}
+	if ev.AfterBytes > ev.BeforeBytes {
+		return fmt.Sprintf(":white_check_mark: embiggen-disk on %s grew %s from %s to %s (+%s) in %v",
+			ev.Host, ev.Mount, embiggen.HumanSize(ev.BeforeBytes), embiggen.HumanSize(ev.AfterBytes),
+			embiggen.HumanSize(ev.AfterBytes-ev.BeforeBytes), ev.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf(":white_check_mark: embiggen-disk on %s resized %d layer(s) under %s", ev.Host, len(ev.Changes), ev.Mount)
+}
+
+// An snsNotifier publishes events as JSON to an SNS topic.
+type snsNotifier struct {
+	arn, region string
+}
+
+func (s *snsNotifier) String() string { return "SNS topic " + s.arn }
+
+func (s *snsNotifier) notify(ev *event) error {
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("embiggen-disk %s %s on %s", ev.Status, ev.Mount, ev.Host)
+	if len(subject) > 100 {
+		subject = subject[:100] // SNS's limit
+	}
+	_, err = awsQuery("sns", s.region, "2010-03-31", "Publish", url.Values{
+		"TopicArn": {s.arn},
+		"Subject":  {subject},
+		"Message":  {string(msg)},
+	})
+	return err
+}
+
+// An eventBridgeNotifier puts events on an EventBridge bus, with
+// source "embiggen-disk" and detail type "Filesystem Resized" or
+// "Filesystem Resize Failed".
+type eventBridgeNotifier struct {
+	bus string
+}
+
+func (e *eventBridgeNotifier) String() string { return "EventBridge bus " + e.bus }
+
+func (e *eventBridgeNotifier) notify(ev *event) error {
+	region, err := awsRegion()
+	if err != nil {
+		return err
+	}
+	detail, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	detailType := "Filesystem Resized"
+	if ev.Status == "failed" {
+		detailType = "Filesystem Resize Failed"
+	}
+	type entry struct {
+		Source       string
+		DetailType   string
+		Detail       string
+		EventBusName string
+		Time         int64
+	}
+	out, err := awsJSON("events", region, "AWSEvents.PutEvents", map[string][]entry{
+		"Entries": {{"embiggen-disk", detailType, string(detail), e.bus, ev.Time.Unix()}},
+	})
+	if err != nil {
+		return err
+	}
+	var res struct{ FailedEntryCount int }
+	if json.Unmarshal(out, &res) == nil && res.FailedEntryCount > 0 {
+		return fmt.Errorf("PutEvents failed: %s", out)
+	}
+	return nil
+}
+
+// signBody returns the hex HMAC-SHA256 of body with key.
+func signBody(key, body []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
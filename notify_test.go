@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+func TestWebhook(t *testing.T) {
+	var got event
+	var sig, hdr string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sig, hdr = r.Header.Get("X-Embiggen-Signature"), r.Header.Get("X-Team")
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("bad webhook body %q: %v", body, err)
+		}
+		if want := "sha256=" + signBody([]byte("sekrit"), body); sig != want {
+			t.Errorf("signature = %q; want %q", sig, want)
+		}
+	}))
+	defer srv.Close()
+
+	w := &webhook{url: srv.URL, headers: map[string]string{"X-Team": "storage"}, key: []byte("sekrit")}
+	ev := newEvent("/data", []embiggen.Change{{Layer: "filesystem", BeforeBytes: 10, AfterBytes: 20}}, nil, 0)
+	if err := w.notify(ev); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if got.Mount != "/data" || got.Status != "resized" || got.BeforeBytes != 10 || got.AfterBytes != 20 {
+		t.Errorf("webhook got %+v", got)
+	}
+	if hdr != "storage" {
+		t.Errorf("X-Team header = %q; want storage", hdr)
+	}
+
+	ev = newEvent("/data", nil, errors.New("lvextend failed"), 0)
+	if err := w.notify(ev); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if got.Status != "failed" || got.Error != "lvextend failed" {
+		t.Errorf("webhook got %+v; want failed event", got)
+	}
+}
+
+func TestSlackText(t *testing.T) {
+	ev := &event{Host: "node1", Mount: "/", Status: "resized", BeforeBytes: 10 << 30, AfterBytes: 20 << 30}
+	if got, want := slackText(ev), ":white_check_mark: embiggen-disk on node1 grew / from 10.0G to 20.0G (+10.0G) in 0s"; got != want {
+		t.Errorf("slackText = %q; want %q", got, want)
+	}
+	ev = &event{Host: "node1", Mount: "/", Status: "failed", Error: "sfdisk: exit status 1"}
+	if got, want := slackText(ev), ":warning: embiggen-disk on node1 failed to grow /: sfdisk: exit status 1"; got != want {
+		t.Errorf("slackText = %q; want %q", got, want)
+	}
+}
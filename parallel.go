@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var parallel = flag.Int("parallel", 4, "grow up to this many targets at once, if they share no disk or LVM volume group; 1 grows them one at a time")
+
+// A growResult is the outcome of growing one target.
+type growResult struct {
+	changes []embiggen.Change
+	err     error
+}
+
+// growAll grows each of mnts, returning their results in the same
+// order. Targets on different disks and VGs are grown concurrently,
+// up to -parallel at once; those sharing one are grown one after the
+// other, in order, stopping at the first failure.
+func growAll(mnts []string, lims map[string]embiggen.Limit) []growResult {
+	results := make([]growResult, len(mnts))
+	n := *parallel
+	if *confirm || otlpURL() != "" {
+		// Prompts and traces are one resize at a time.
+		n = 1
+	}
+	groups := independentGroups(mnts)
+	if n <= 1 || len(groups) <= 1 {
+		for i, mnt := range mnts {
+			results[i].changes, results[i].err = grow(mnt, lims[mnt])
+			if results[i].err != nil {
+				break
+			}
+		}
+		return results
+	}
+	// Take the lock once for all of them; each would wait on the
+	// others' otherwise.
+	lk, err := embiggen.LockGlobal(runCtx)
+	if err != nil {
+		results[0].err = err
+		return results
+	}
+	defer lk.Unlock()
+	vlogf("growing %d target(s) in %d independent group(s), %d at a time", len(mnts), len(groups), n)
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		go func(g []int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			for _, i := range g {
+				rep, err := growReportLocked(runCtx, mnts[i], lims[mnts[i]])
+				if rep != nil {
+					results[i].changes = rep.Changes
+				}
+				if results[i].err = err; err != nil {
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	return results
+}
+
+// independentGroups splits mnts into groups, as indexes into mnts, such
+// that no two groups share a device: a disk, a partition, or a PV under
+// a VG. Targets whose devices can't be found cheaply are all put in
+// one group.
+func independentGroups(mnts []string) [][]int {
+	devs := make([][]string, len(mnts))
+	for i, mnt := range mnts {
+		sizes, err := embiggen.StackSizes(mnt)
+		if err != nil {
+			vlogf("%s: %v; not growing it in parallel", mnt, err)
+			continue
+		}
+		for dev := range sizes {
+			if dev != mnt {
+				devs[i] = append(devs[i], dev)
+			}
+		}
+	}
+	return groupByDevice(devs)
+}
+
+// groupByDevice groups the targets whose devices are devs[i], as
+// indexes into devs, so that any two sharing a device, directly or
+// through others, are in the same group. Targets with no devices
+// known are grouped together.
+func groupByDevice(devs [][]string) [][]int {
+	parent := make([]int, len(devs)) // union-find
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	owner := map[string]int{} // device to the first target using it
+	unknown := -1
+	for i, ds := range devs {
+		if len(ds) == 0 {
+			if unknown >= 0 {
+				parent[find(i)] = find(unknown)
+			}
+			unknown = i
+		}
+		for _, dev := range ds {
+			if j, ok := owner[dev]; ok {
+				parent[find(i)] = find(j)
+			} else {
+				owner[dev] = i
+			}
+		}
+	}
+	var groups [][]int
+	index := map[int]int{} // root to its group
+	for i := range devs {
+		r := find(i)
+		k, ok := index[r]
+		if !ok {
+			k = len(groups)
+			index[r] = k
+			groups = append(groups, nil)
+		}
+		groups[k] = append(groups[k], i)
+	}
+	return groups
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupByDevice(t *testing.T) {
+	tests := []struct {
+		devs [][]string
+		want [][]int
+	}{
+		{
+			// Two disks.
+			devs: [][]string{{"/dev/sda1", "/dev/sda"}, {"/dev/sdb1", "/dev/sdb"}},
+			want: [][]int{{0}, {1}},
+		},
+		{
+			// Two partitions of one disk, and an LV on another.
+			devs: [][]string{{"/dev/sda1", "/dev/sda"}, {"/dev/dm-0", "/dev/sdb"}, {"/dev/sda2", "/dev/sda"}},
+			want: [][]int{{0, 2}, {1}},
+		},
+		{
+			// LVs in one VG share its PV; the third joins them through a
+			// second PV of the VG.
+			devs: [][]string{{"/dev/dm-0", "/dev/sdb"}, {"/dev/dm-1", "/dev/sdc"}, {"/dev/dm-2", "/dev/sdb", "/dev/sdc"}},
+			want: [][]int{{0, 1, 2}},
+		},
+		{
+			// Unknown devices go together.
+			devs: [][]string{nil, {"/dev/sdb1", "/dev/sdb"}, nil},
+			want: [][]int{{0, 2}, {1}},
+		},
+	}
+	for i, tt := range tests {
+		if got := groupByDevice(tt.devs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: groupByDevice = %v; want %v", i, got, tt.want)
+		}
+	}
+}
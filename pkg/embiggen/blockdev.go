@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import "strings"
+
+// A BlockDevice describes a block device, as the kernel sees it.
+type BlockDevice struct {
+	Path      string   // "/dev/sda1", or "/dev/dm-0" for device-mapper
+	Name      string   // kernel name, like "sda1" or "dm-0"
+	MajMin    string   // device number, like "8:1"
+	Size      int64    // bytes
+	ReadOnly  bool     // the kernel has it read-only
+	Partition int      // partition number, or 0 if it's not a partition
+	Disk      string   // for a partition, its disk, like "/dev/sda"
+	DMName    string   // device-mapper name, like "vg0-root"
+	DMUUID    string   // device-mapper UUID, "LVM-..." for an LVM LV
+	Slaves    []string // for device-mapper, the devices under it, like "/dev/sda2"
+}
+
+// IsLV reports whether d is an LVM logical volume.
+func (d BlockDevice) IsLV() bool { return strings.HasPrefix(d.DMUUID, "LVM-") }
+
+// VGLV returns the volume group and logical volume names of an LVM LV,
+// from its device-mapper name, in which LVM doubles the hyphens in
+// each and joins them with one, like "my--vg-root" for "my-vg/root".
+func (d BlockDevice) VGLV() (vg, lv string, ok bool) {
+	n := d.DMName
+	for i := 0; i < len(n); i++ {
+		if n[i] != '-' {
+			continue
+		}
+		if i+1 < len(n) && n[i+1] == '-' {
+			i++ // an escaped hyphen
+			continue
+		}
+		unescape := func(s string) string { return strings.Replace(s, "--", "-", -1) }
+		return unescape(n[:i]), unescape(n[i+1:]), d.IsLV()
+	}
+	return "", "", false
+}
+
+// A mountInfo is a line of the mount table.
+type mountInfo struct {
+	MajMin  string // "8:1"; "0:N" for filesystems without a block device, like btrfs
+	Mnt     string
+	FSType  string
+	Source  string // "/dev/sda1"
+	Root    string // directory of the filesystem mounted: "/", unless it's a bind mount or btrfs subvolume
+	Opts    string // superblock options, like "rw,lowerdir=/a,upperdir=/b,workdir=/c" for overlayfs
+	MntOpts string // per-mount options, like "rw,nosuid,noatime"
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProbeDevice fails: it reads Linux's sysfs.
+func ProbeDevice(dev string) (BlockDevice, error) {
+	return BlockDevice{}, errors.New("probing block devices is Linux-only")
+}
+
+// mountTable returns the mount table, from getfsstat.
+func mountTable() ([]mountInfo, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]unix.Statfs_t, n)
+	if n, err = unix.Getfsstat(buf, unix.MNT_NOWAIT); err != nil {
+		return nil, err
+	}
+	var ms []mountInfo
+	for _, st := range buf[:n] {
+		ms = append(ms, mountInfo{
+			Mnt:    unix.ByteSliceToString(st.Mntonname[:]),
+			FSType: unix.ByteSliceToString(st.Fstypename[:]),
+			Source: unix.ByteSliceToString(st.Mntfromname[:]),
+		})
+	}
+	return ms, nil
+}
+
+// StackSizes fails: it reads Linux's sysfs.
+func StackSizes(mnt string) (map[string]int64, error) {
+	return nil, errors.New("probing block devices is Linux-only")
+}
+
+// BlankDisks fails: it reads Linux's sysfs.
+func BlankDisks(ctx context.Context) ([]BlockDevice, error) {
+	return nil, errors.New("probing block devices is Linux-only")
+}
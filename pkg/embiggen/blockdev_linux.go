@@ -0,0 +1,263 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProbeDevice describes the block device dev, like "/dev/sda1" or
+// "/dev/mapper/vg0-root", from sysfs, without running any tools.
+func ProbeDevice(dev string) (BlockDevice, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(dev, &st); err != nil {
+		return BlockDevice{}, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return BlockDevice{}, fmt.Errorf("%s isn't a block device", dev)
+	}
+	return probeMajMin(fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))))
+}
+
+// probeMajMin describes the block device numbered majMin, like "8:1".
+func probeMajMin(majMin string) (BlockDevice, error) {
+	sys, err := filepath.EvalSymlinks("/sys/dev/block/" + majMin)
+	if err != nil {
+		return BlockDevice{}, err
+	}
+	d := BlockDevice{MajMin: majMin, Name: filepath.Base(sys)}
+	d.Path = "/dev/" + d.Name
+	if n, err := readInt64File(sys + "/size"); err == nil {
+		d.Size = n * 512 // always 512-byte units
+	}
+	if n, err := readInt64File(sys + "/ro"); err == nil {
+		d.ReadOnly = n == 1
+	}
+	if n, err := readInt64File(sys + "/partition"); err == nil {
+		d.Partition = int(n)
+		d.Disk = "/dev/" + filepath.Base(filepath.Dir(sys))
+	}
+	d.DMName = readSysString(sys + "/dm/name")
+	d.DMUUID = readSysString(sys + "/dm/uuid")
+	if fis, err := ioutil.ReadDir(sys + "/slaves"); err == nil {
+		for _, fi := range fis {
+			d.Slaves = append(d.Slaves, "/dev/"+fi.Name())
+		}
+		sort.Strings(d.Slaves)
+	}
+	return d, nil
+}
+
+func readSysString(f string) string {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// mountTable returns the mount table, from MountInfoFile.
+func mountTable() ([]mountInfo, error) {
+	b, err := ioutil.ReadFile(MountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseMountInfo(string(b)), nil
+}
+
+// parseMountInfo parses the contents of a /proc/PID/mountinfo file,
+// whose lines are like
+//
+//	36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(s string) []mountInfo {
+	var ms []mountInfo
+	for _, line := range strings.Split(s, "\n") {
+		f := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(f); i++ {
+			if f[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(f) < 5 || sep < 0 || sep+2 >= len(f) {
+			continue
+		}
+		var opts string
+		if sep+3 < len(f) {
+			opts = f[sep+3]
+		}
+		ms = append(ms, mountInfo{
+			MajMin:  f[2],
+			Mnt:     unescapeMountField(f[4]),
+			FSType:  f[sep+1],
+			Source:  unescapeMountField(f[sep+2]),
+			Root:    unescapeMountField(f[3]),
+			Opts:    unescapeMountField(opts),
+			MntOpts: f[5],
+		})
+	}
+	return ms
+}
+
+// unescapeMountField undoes the octal escaping of spaces, tabs,
+// newlines and backslashes in mount table fields.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountDev returns the block device of mount m: its source, unless
+// that's not a device path, as with /dev/root, in which case it's found
+// from the device number.
+func mountDev(m mountInfo) (string, error) {
+	if strings.HasPrefix(m.Source, "/dev/") && m.Source != "/dev/root" {
+		if _, err := os.Stat(m.Source); err == nil {
+			return m.Source, nil
+		}
+	}
+	if d, err := probeMajMin(m.MajMin); err == nil {
+		return d.Path, nil
+	}
+	if m.Source == "/dev/root" {
+		return findDevRoot()
+	}
+	return m.Source, nil
+}
+
+// StackSizes returns the sizes in bytes of the filesystem mounted at
+// mnt, keyed by mnt, and of the devices under it, keyed by their
+// paths, including the whole disk under each partition. It reads only
+// statfs and sysfs, so it's cheap enough to call often to see whether
+// anything grew.
+func StackSizes(mnt string) (map[string]int64, error) {
+	fs, err := StatFS(mnt)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{mnt: int64(fs.Statfs.Blocks) * int64(fs.Statfs.Bsize)}
+	var walk func(dev string) error
+	walk = func(dev string) error {
+		if _, ok := sizes[dev]; ok {
+			return nil
+		}
+		d, err := ProbeDevice(dev)
+		if err != nil {
+			return err
+		}
+		sizes[dev] = d.Size
+		if d.Disk != "" {
+			if err := walk(d.Disk); err != nil {
+				return err
+			}
+		}
+		for _, s := range d.Slaves {
+			if err := walk(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(fs.Dev); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// BlankDisks returns the whole disks with nothing on them, in name
+// order: no partitions, holders such as device-mapper, mounts, swap or
+// signature blkid knows, and not read-only or removable. Virtual
+// devices, like loop and zram devices, are left out.
+func BlankDisks(ctx context.Context) ([]BlockDevice, error) {
+	fis, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	ms, err := mountTable()
+	if err != nil {
+		return nil, err
+	}
+	mounted := map[string]bool{}
+	for _, m := range ms {
+		mounted[m.MajMin] = true
+	}
+	swaps := map[string]bool{}
+	if b, err := ioutil.ReadFile("/proc/swaps"); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if f := strings.Fields(line); len(f) > 0 {
+				swaps[f[0]] = true
+			}
+		}
+	}
+	var disks []BlockDevice
+	for _, fi := range fis {
+		sys := "/sys/block/" + fi.Name()
+		if _, err := os.Stat(sys + "/device"); err != nil {
+			continue // virtual
+		}
+		if n, err := readInt64File(sys + "/removable"); err == nil && n == 1 {
+			continue
+		}
+		majMin := readSysString(sys + "/dev")
+		d, err := probeMajMin(majMin)
+		if err != nil || d.Size == 0 || d.ReadOnly || mounted[majMin] || swaps[d.Path] || inUse(sys) {
+			continue
+		}
+		if hasSignature(ctx, d.Path) {
+			continue
+		}
+		disks = append(disks, d)
+	}
+	return disks, nil
+}
+
+// inUse reports whether the disk at sysfs directory sys has partitions
+// or holders.
+func inUse(sys string) bool {
+	if fis, err := ioutil.ReadDir(sys + "/holders"); err == nil && len(fis) > 0 {
+		return true
+	}
+	fis, _ := ioutil.ReadDir(sys)
+	for _, fi := range fis {
+		if _, err := os.Stat(filepath.Join(sys, fi.Name(), "partition")); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	const mi = `22 1 8:3 / / rw,relatime shared:1 - ext4 /dev/root rw,errors=remount-ro
+23 22 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+45 22 253:0 / /var/lib/my\040data rw,relatime shared:30 master:2 - xfs /dev/mapper/vg--data-lv rw,attr2
+46 22 8:3 /srv /mnt/srv rw,relatime shared:1 - ext4 /dev/root rw
+`
+	want := []mountInfo{
+		{"8:3", "/", "ext4", "/dev/root", "/", "rw,errors=remount-ro", "rw,relatime"},
+		{"0:21", "/proc", "proc", "proc", "/", "rw", "rw,nosuid,nodev,noexec,relatime"},
+		{"253:0", "/var/lib/my data", "xfs", "/dev/mapper/vg--data-lv", "/", "rw,attr2", "rw,relatime"},
+		{"8:3", "/mnt/srv", "ext4", "/dev/root", "/srv", "rw", "rw,relatime"},
+	}
+	if got := parseMountInfo(mi); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseMountInfo = %+v; want %+v", got, want)
+	}
+}
+
+func TestVGLV(t *testing.T) {
+	tests := []struct {
+		dmName, dmUUID string
+		vg, lv         string
+		ok             bool
+	}{
+		{"debvg-root", "LVM-abc", "debvg", "root", true},
+		{"my--vg-data--1", "LVM-abc", "my-vg", "data-1", true},
+		{"luks-1234", "CRYPT-LUKS2-1234", "luks", "1234", false},
+		{"root", "LVM-abc", "", "", false},
+	}
+	for _, tt := range tests {
+		vg, lv, ok := BlockDevice{DMName: tt.dmName, DMUUID: tt.dmUUID}.VGLV()
+		if vg != tt.vg || lv != tt.lv || ok != tt.ok {
+			t.Errorf("VGLV(%q) = %q, %q, %v; want %q, %q, %v", tt.dmName, vg, lv, ok, tt.vg, tt.lv, tt.ok)
+		}
+	}
+}
+
+func TestRealMount(t *testing.T) {
+	ms := parseMountInfo(`22 1 8:3 / / rw,relatime shared:1 - ext4 /dev/root rw
+30 22 8:17 / /data rw,relatime shared:2 - xfs /dev/sdb1 rw
+31 22 8:17 /docker /var/lib/docker rw,relatime shared:2 - xfs /dev/sdb1 rw
+32 22 0:40 /@home /home rw,relatime shared:3 - btrfs /dev/sdc1 rw,subvol=/@home
+33 22 0:40 / /mnt/pool rw,relatime shared:3 - btrfs /dev/sdc1 rw,subvol=/
+34 22 0:41 /@logs /var/log rw,relatime shared:4 - btrfs /dev/sdd1 rw,subvol=/@logs
+`)
+	tests := []struct {
+		mnt, real, root string
+	}{
+		{"/", "/", "/"},
+		{"/data", "/data", "/"},
+		{"/var/lib/docker", "/data", "/docker"},
+		{"/home", "/mnt/pool", "/@home"},
+		{"/var/log", "/var/log", "/@logs"}, // the btrfs root isn't mounted
+	}
+	for _, tt := range tests {
+		m, ok := realMount(context.Background(), ms, tt.mnt)
+		if !ok || m.Mnt != tt.real || m.Root != tt.root {
+			t.Errorf("realMount(%q) = %q, root %q, %v; want %q, root %q", tt.mnt, m.Mnt, m.Root, ok, tt.real, tt.root)
+		}
+	}
+	if _, ok := realMount(context.Background(), ms, "/srv"); ok {
+		t.Errorf("realMount(/srv) found a mount; want none")
+	}
+}
+
+func TestOverlayMountEntry(t *testing.T) {
+	f, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`20 1 254:999 / /media/root-rw rw,relatime - ext4 /dev/embiggen-test-vda3 rw
+21 1 7:0 / /media/root-ro ro,relatime - squashfs /dev/loop0 ro
+22 1 0:30 / / rw,relatime - overlay overlay rw,lowerdir=/media/root-ro,upperdir=/media/root-rw/overlay,workdir=/media/root-rw/overlay-workdir
+`)
+	f.Close()
+	defer func(old string) { MountInfoFile = old }(MountInfoFile)
+	MountInfoFile = f.Name()
+
+	real, dev, fstype, err := mountEntry(context.Background(), "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if real != "/media/root-rw" || dev != "/dev/embiggen-test-vda3" || fstype != "ext4" {
+		t.Errorf("mountEntry(/) = %q, %q, %q; want /media/root-rw, /dev/embiggen-test-vda3, ext4", real, dev, fstype)
+	}
+}
+
+func TestInUse(t *testing.T) {
+	sys, err := ioutil.TempDir("", "sysblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sys)
+	mkdir := func(dir string) {
+		if err := os.MkdirAll(filepath.Join(sys, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdir("sdb/holders")
+	mkdir("sdb/queue")
+	if inUse(sys + "/sdb") {
+		t.Errorf("inUse(sdb) = true for a blank disk")
+	}
+	mkdir("sdc/sdc1")
+	ioutil.WriteFile(filepath.Join(sys, "sdc/sdc1/partition"), []byte("1\n"), 0644)
+	if !inUse(sys + "/sdc") {
+		t.Errorf("inUse(sdc) = false for a partitioned disk")
+	}
+	mkdir("sdd/holders/dm-3")
+	if !inUse(sys + "/sdd") {
+		t.Errorf("inUse(sdd) = false for a disk held by dm-3")
+	}
+}
+
+func TestMountPoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mountpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dev := filepath.Join(dir, "nvme1n1")
+	link := filepath.Join(dir, "nvme-Amazon_Elastic_Block_Store_vol0123")
+	ioutil.WriteFile(dev, nil, 0644)
+	if err := os.Symlink(dev, link); err != nil {
+		t.Fatal(err)
+	}
+	mi := filepath.Join(dir, "mountinfo")
+	ioutil.WriteFile(mi, []byte(`22 1 8:3 / / rw,relatime - ext4 /dev/root rw
+31 22 254:999 /docker /var/lib/docker rw,relatime - xfs `+dev+` rw
+30 22 254:999 / /data rw,relatime - xfs `+dev+` rw
+`), 0644)
+	defer func(old string) { MountInfoFile = old }(MountInfoFile)
+	MountInfoFile = mi
+
+	got, err := MountPoint(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "/data" {
+		t.Errorf("MountPoint(%s) = %q; want /data, the whole filesystem's mount", link, got)
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	f, err := ioutil.TempFile("", "mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`22 1 8:3 / / rw,relatime - ext4 /dev/root rw,errors=remount-ro
+30 22 8:17 / /data rw,nosuid,noatime - ext4 /dev/sdb1 rw,seclabel,data=ordered
+31 22 8:18 / /data ro,noatime - ext4 /dev/sdb2 rw,data=journal
+`)
+	f.Close()
+	defer func(old string) { MountInfoFile = old }(MountInfoFile)
+	MountInfoFile = f.Name()
+
+	for mnt, want := range map[string]string{
+		"/":     "rw,relatime,errors=remount-ro",
+		"/data": "ro,noatime,data=journal",
+	} {
+		got, err := MountOptions(mnt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("MountOptions(%s) = %q; want %q", mnt, got, want)
+		}
+	}
+	if _, err := MountOptions("/srv"); err == nil {
+		t.Errorf("MountOptions(/srv) succeeded for a directory that isn't a mount point")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Change describes one layer that Resize grew.
+type Change struct {
+	Layer        string        `json:"layer"`              // "filesystem", "lvm-lv", "lvm-pv", "partition"
+	Device       string        `json:"device"`             // "/dev/sda3"
+	VolumeID     string        `json:"volumeId,omitempty"` // of the EBS volume Device is on
+	Resizer      string        `json:"resizer"`
+	BeforeState  string        `json:"beforeState"` // from Resizer.State
+	AfterState   string        `json:"afterState"`
+	BeforeBytes  int64         `json:"beforeBytes"`
+	AfterBytes   int64         `json:"afterBytes"`
+	GainedBytes  int64         `json:"gainedBytes"`        // AfterBytes - BeforeBytes
+	Duration     time.Duration `json:"durationNanos"`      // of the Resize call
+	StateTime    time.Duration `json:"stateDurationNanos"` // of the State and Size calls, before and after
+	Commands     []Command     `json:"commands,omitempty"`
+	KernelErrors []string      `json:"kernelErrors,omitempty"` // I/O and filesystem errors logged on the devices during the Resize call
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: before: %s, after: %s", c.Resizer, c.BeforeState, c.AfterState)
+}
+
+// A Command is an external command run to change something, or other
+// action such as an ioctl.
+type Command struct {
+	Command  string        `json:"command"`
+	Output   string        `json:"output,omitempty"`
+	Duration time.Duration `json:"durationNanos,omitempty"` // 0 in dry-run
+}
+
+// commandLog is the commands run to change something since the last
+// ResetCommands, by all resizes.
+var (
+	commandLogMu sync.Mutex
+	commandLog   []Command
+)
+
+// Commands returns the commands run to change something since the
+// last ResetCommands. If resizes run concurrently, their commands are
+// mixed; use WithCommandLog to tell them apart.
+func Commands() []Command {
+	commandLogMu.Lock()
+	defer commandLogMu.Unlock()
+	return append([]Command(nil), commandLog...)
+}
+
+// ResetCommands forgets the commands run so far.
+func ResetCommands() {
+	commandLogMu.Lock()
+	defer commandLogMu.Unlock()
+	commandLog = nil
+}
+
+// A CommandLog collects the commands run to change something by
+// resizes using a context from WithCommandLog.
+type CommandLog struct {
+	mu   sync.Mutex
+	cmds []Command
+}
+
+type commandLogKey struct{}
+
+// WithCommandLog returns a context whose resizes record the commands
+// they run in the returned CommandLog, as well as in Commands.
+func WithCommandLog(ctx context.Context) (context.Context, *CommandLog) {
+	l := new(CommandLog)
+	return context.WithValue(ctx, commandLogKey{}, l), l
+}
+
+func commandLogFrom(ctx context.Context) *CommandLog {
+	l, _ := ctx.Value(commandLogKey{}).(*CommandLog)
+	return l
+}
+
+// Commands returns the commands recorded in l so far.
+func (l *CommandLog) Commands() []Command { return l.since(0) }
+
+// since returns the commands recorded in l after the first n.
+func (l *CommandLog) since(n int) []Command {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n >= len(l.cmds) {
+		return nil
+	}
+	return append([]Command(nil), l.cmds[n:]...)
+}
+
+func (l *CommandLog) len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.cmds)
+}
+
+// recordCommand records c in commandLog and the CommandLog of ctx, if
+// any.
+func recordCommand(ctx context.Context, c Command) {
+	commandLogMu.Lock()
+	commandLog = append(commandLog, c)
+	commandLogMu.Unlock()
+	if l := commandLogFrom(ctx); l != nil {
+		l.mu.Lock()
+		l.cmds = append(l.cmds, c)
+		l.mu.Unlock()
+	}
+}
+
+// logCommand records a command run by other means than runLogged,
+// which took d.
+func logCommand(ctx context.Context, d time.Duration, args ...string) {
+	recordCommand(ctx, Command{Command: strings.Join(args, " "), Duration: d})
+}
+
+// DryRunCommand prints the command line that DryRun would've run, and
+// records it in Commands.
+func DryRunCommand(args ...string) {
+	dryRunCommand(context.Background(), args...)
+}
+
+// dryRunCommand is DryRunCommand, also recording the command in the
+// CommandLog of ctx.
+func dryRunCommand(ctx context.Context, args ...string) {
+	dryRunf(ctx, "would've run %s", shellJoin(args))
+	logCommand(ctx, 0, args...)
+}
+
+// shellJoin joins args into a command line that can be pasted into a
+// shell.
+func shellJoin(args []string) string {
+	q := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+			a = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+		q[i] = a
+	}
+	return strings.Join(q, " ")
+}
+
+// runLogged runs cmd, with run's timeout, recording it and its
+// combined output in commandLog. It's retried if it fails transiently.
+func runLogged(ctx context.Context, cmd *exec.Cmd) (out []byte, err error) {
+	err = retry(ctx, shellJoin(cmd.Args), func() error {
+		out, err = runLoggedOnce(ctx, cmd)
+		cmd = cloneCmd(cmd)
+		return err
+	})
+	return out, err
+}
+
+func runLoggedOnce(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	finish := startSpan(ctx, filepath.Base(cmd.Args[0]), "command", strings.Join(cmd.Args, " "))
+	t0 := time.Now()
+	var buf syncBuffer
+	cmd.Stdout, cmd.Stderr = &buf, &buf
+	err := run(ctx, cmd)
+	out := buf.Bytes()
+	d := time.Since(t0)
+	finish(err)
+	recordCommand(ctx, Command{
+		Command:  strings.Join(cmd.Args, " "),
+		Output:   string(out),
+		Duration: d,
+	})
+	if err != nil {
+		err = toolErr(err, out)
+	}
+	return out, err
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package embiggen live resizes a filesystem and the LVM objects and
+// partition tables under it, as the embiggen-disk command does. It's
+// for programs that want to grow disks without running the command.
+//
+// FileSystemResizer finds the stack of layers under a mount point,
+// Chain lists them, and Resize grows them bottom up:
+//
+//	e, err := embiggen.FileSystemResizer(ctx, "/", embiggen.Limit{})
+//	if err != nil {
+//		return err
+//	}
+//	changes, err := embiggen.Resize(ctx, e)
+//
+// External commands are run with the context, so cancelling it, or
+// its deadline passing, kills the step in progress and stops Resize.
+//
+// How it resizes, like whether it's a dry run and where it logs, is
+// set by the Options the context carries, so that callers sharing a
+// process don't share settings:
+//
+//	o := embiggen.DefaultOptions()
+//	o.DryRun = true
+//	ctx = embiggen.WithOptions(ctx, o)
+//
+// A context without Options gets DefaultOptions.
+package embiggen
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// A Level is the severity of a message passed to Options.Logf.
+type Level int
+
+const (
+	LevelWarn Level = iota
+	LevelInfo
+	LevelDebug
+)
+
+// MountInfoFile is the mount table that mount points are looked up in,
+// on Linux.
+var MountInfoFile = "/proc/self/mountinfo"
+
+// logf passes a log message to the Logf of ctx's Options.
+func logf(ctx context.Context, level Level, format string, args ...interface{}) {
+	if f := opts(ctx).Logf; f != nil {
+		f(level, format, args...)
+	}
+}
+
+func warnf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, LevelWarn, format, args...)
+}
+func infof(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, LevelInfo, format, args...)
+}
+func vlogf(ctx context.Context, format string, args ...interface{}) {
+	logf(ctx, LevelDebug, format, args...)
+}
+
+// confirmStep asks Confirm whether to go ahead with a step.
+func confirmStep(ctx context.Context, format string, args ...interface{}) error {
+	o := opts(ctx)
+	if o.Confirm == nil || o.DryRun {
+		return nil
+	}
+	return o.Confirm(fmt.Sprintf(format, args...))
+}
+
+// startSpan calls StartSpan, returning a finish func that's never nil.
+func startSpan(ctx context.Context, name string, kv ...string) func(error) {
+	o := opts(ctx)
+	if o.StartSpan != nil {
+		if finish := o.StartSpan(name, kv...); finish != nil {
+			return finish
+		}
+	}
+	return func(error) {}
+}
+
+// A Resizer is anything that can enlarge something and describe its state.
+// A Resizer can depend on another Resizer to run first.
+type Resizer interface {
+	String() string                                                 // "ext4 filesystem at /", "LVM PV foo"
+	Layer() string                                                  // "filesystem", "lvm-lv", "lvm-pv", "partition"
+	Device() string                                                 // "/dev/sda3"
+	State(ctx context.Context) (string, error)                      // "534 blocks"
+	Size(ctx context.Context) (int64, error)                        // current size in bytes
+	Attainable(ctx context.Context, depGrowth int64) (int64, error) // size in bytes Resize would reach, if the dependency grew by depGrowth
+	Resize(ctx context.Context) error                               // both may be non-zero
+	DepResizer(ctx context.Context) (dep Resizer, err error)        // can return (nil, nil) for none
+}
+
+// Chain returns e and the Resizers it depends on, top layer first.
+func Chain(ctx context.Context, e Resizer) ([]Resizer, error) {
+	var chain []Resizer
+	for r := e; r != nil; {
+		chain = append(chain, r)
+		var err error
+		if r, err = r.DepResizer(ctx); err != nil {
+			return chain, err
+		}
+	}
+	return chain, nil
+}
+
+// Resize resizes e's dependencies and then resizes e. A filesystem
+// mounted read-only isn't grown, unless RemountRW is set, nor is one
+// that fails the HealthCheck.
+func Resize(ctx context.Context, e Resizer) (changes []Change, err error) {
+	o := opts(ctx)
+	if f, ok := e.(interface{ FS() FSStat }); ok {
+		if err := checkMountWritable(ctx, f.FS()); err != nil {
+			return nil, err
+		}
+		if o.HealthCheck {
+			if err := checkHealth(ctx, f.FS()); err != nil {
+				return nil, err
+			}
+		}
+		if o.Freeze || o.Quiesce != nil {
+			ctx = context.WithValue(ctx, frozenMountKey{}, f.FS().Mnt)
+		}
+	}
+	if err := checkTools(ctx, e); err != nil {
+		return nil, err
+	}
+	if !o.DryRun {
+		if err := CheckPrivileges(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+	if commandLogFrom(ctx) == nil {
+		ctx, _ = WithCommandLog(ctx)
+	}
+	var w *kernelLogWatcher
+	if o.WatchKernelLog && !o.DryRun {
+		if w = watchKernelLog(ctx); w != nil {
+			defer w.stop()
+			ctx = context.WithValue(ctx, kernelLogWatcherKey{}, w)
+		}
+	}
+	changes, err = resize(ctx, e)
+	if errs := w.errorsSince(0); len(errs) > 0 {
+		if err != nil {
+			return changes, fmt.Errorf("%w during resize: %s; stopped: %v", ErrKernelError, errs[0], err)
+		}
+		return changes, fmt.Errorf("%w during resize: %s", ErrKernelError, errs[0])
+	}
+	return changes, err
+}
+
+func resize(ctx context.Context, e Resizer) (changes []Change, err error) {
+	o := opts(ctx)
+	ts := time.Now()
+	s0, err := e.State(ctx)
+	if err != nil {
+		return
+	}
+	b0, err := e.Size(ctx)
+	if err != nil {
+		return
+	}
+	stateTime := time.Since(ts)
+	w := watcherFrom(ctx)
+	w.add(e.Device())
+	dep, err := e.DepResizer(ctx)
+	if err != nil {
+		return
+	}
+	if dep != nil {
+		changes, err = resize(ctx, dep)
+		if err != nil {
+			return
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if o.Interrupt != nil {
+		// Stop between steps, never during one.
+		if err = o.Interrupt(); err != nil {
+			return
+		}
+	}
+	if w.errorCount() > 0 {
+		// Likewise; Resize reports the kernel's error.
+		err = fmt.Errorf("not resizing %v", e)
+		return
+	}
+	want, sure := expectedGrowth(ctx, e, b0)
+	cmds := commandLogFrom(ctx)
+	nlog, nerr := cmds.len(), w.errorCount()
+	t0 := time.Now()
+	finish := startSpan(ctx, "resize "+e.Layer(), "device", e.Device(), "resizer", e.String())
+	if mnt, ok := ctx.Value(frozenMountKey{}).(string); ok && freezesFS(e) && want > 0 {
+		var thaw func()
+		if thaw, err = freeze(ctx, mnt); err != nil {
+			finish(err)
+			return
+		}
+		err = e.Resize(ctx)
+		thaw()
+	} else {
+		err = e.Resize(ctx)
+	}
+	finish(err)
+	d := time.Since(t0)
+	kernelErrors := w.errorsSince(nerr)
+	if err != nil {
+		return
+	}
+	ts = time.Now()
+	s1, err := e.State(ctx)
+	if err != nil {
+		err = fmt.Errorf("error after successful resize of %v: %v", e, err)
+		return
+	}
+	b1, err := e.Size(ctx)
+	if err != nil {
+		err = fmt.Errorf("error after successful resize of %v: %v", e, err)
+		return
+	}
+	stateTime += time.Since(ts)
+	if !o.DryRun && sure && want >= minVerifiedGrowth && b1 <= b0 {
+		err = fmt.Errorf("%w: %v: resizing it succeeded, but it's still %s; it should've grown by about %s",
+			ErrNoGrowth, e, HumanSize(b1), HumanSize(want))
+		return
+	}
+	vlogf(ctx, "%v: resize took %v, state %v", e, d.Round(time.Millisecond), stateTime.Round(time.Millisecond))
+	if s0 != s1 {
+		c := Change{
+			Layer:        e.Layer(),
+			Device:       e.Device(),
+			Resizer:      e.String(),
+			BeforeState:  s0,
+			AfterState:   s1,
+			BeforeBytes:  b0,
+			AfterBytes:   b1,
+			GainedBytes:  b1 - b0,
+			Duration:     d,
+			StateTime:    stateTime,
+			Commands:     cmds.since(nlog),
+			KernelErrors: kernelErrors,
+		}
+		if o.VolumeID != nil {
+			c.VolumeID = o.VolumeID(e.Device())
+		}
+		changes = append(changes, c)
+	}
+	return
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// Sentinel errors for common reasons a resize can't proceed. Errors
+// returned by the package wrap them, so callers can test with
+// errors.Is.
+var (
+	// ErrNoFreeSpace means there's no room below a layer for it to
+	// grow into, such as a full volume group.
+	ErrNoFreeSpace = errors.New("no free space")
+
+	// ErrUnsupportedFilesystem means the filesystem type can't be
+	// grown online.
+	ErrUnsupportedFilesystem = errors.New("unsupported filesystem")
+
+	// ErrNotLastPartition means a partition can't grow because
+	// another partition follows it on the disk.
+	ErrNotLastPartition = errors.New("not the last partition")
+
+	// ErrReadOnly means a device or filesystem that needs changing
+	// is read-only.
+	ErrReadOnly = errors.New("read-only")
+
+	// ErrPermission means the process lacks a privilege, such as
+	// CAP_SYS_ADMIN, or access to a device that a layer needs to grow.
+	ErrPermission = errors.New("permission denied")
+
+	// ErrCorrupt means a filesystem shows signs of corruption, with
+	// HealthCheck set.
+	ErrCorrupt = errors.New("filesystem has errors")
+
+	// ErrKernelError means the kernel logged an I/O or filesystem
+	// error on a device while it was being resized, with
+	// WatchKernelLog set.
+	ErrKernelError = errors.New("kernel logged an error")
+
+	// ErrNoGrowth means a step's tool succeeded but the layer's size,
+	// read back afterwards, didn't change.
+	ErrNoGrowth = errors.New("size didn't change")
+
+	// ErrBusy means a device or LVM lock was busy, or udev hadn't
+	// settled. It's transient; see IsTransient.
+	ErrBusy = errors.New("busy")
+
+	// ErrCommandTimeout means an external command ran past its
+	// CommandTimeout and was killed; see HangError.
+	ErrCommandTimeout = errors.New("timed out")
+)
+
+// ErrToolMissing is returned when an external command the resize
+// needs isn't installed. It matches exec.ErrNotFound with errors.Is.
+type ErrToolMissing struct {
+	Tool string // command name, like "resize2fs"
+}
+
+func (e ErrToolMissing) Error() string { return e.Tool + " not found in $PATH" }
+
+func (e ErrToolMissing) Unwrap() error { return exec.ErrNotFound }
+
+// An UnsupportedError is returned for layouts the package doesn't know
+// how to grow, such as a filesystem type or partition table it doesn't
+// support. It may wrap a sentinel such as ErrUnsupportedFilesystem.
+type UnsupportedError struct {
+	msg string
+	err error
+}
+
+func (e UnsupportedError) Error() string { return e.msg }
+
+func (e UnsupportedError) Unwrap() error { return e.err }
+
+// Unsupportedf returns an UnsupportedError. Like fmt.Errorf, a %w verb
+// makes it wrap that argument.
+func Unsupportedf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	return UnsupportedError{err.Error(), errors.Unwrap(err)}
+}
+
+// toolErr converts a failure to start a missing command into
+// ErrToolMissing, and tags a failed command whose output says why it
+// failed with the matching sentinel. Converting err twice is harmless.
+func toolErr(err error, out []byte) error {
+	switch err.(type) {
+	case causeError, ErrToolMissing:
+		return err // already converted
+	}
+	var ee *exec.Error
+	if errors.As(err, &ee) && errors.Is(ee.Err, exec.ErrNotFound) {
+		return ErrToolMissing{Tool: filepath.Base(ee.Name)}
+	}
+	// A tool at a path, as from ToolPaths or ToolDirs, that isn't there.
+	var pe *os.PathError
+	if errors.As(err, &pe) && pe.Op == "fork/exec" && errors.Is(pe.Err, syscall.ENOENT) {
+		return ErrToolMissing{Tool: filepath.Base(pe.Path)}
+	}
+	var xe *exec.ExitError
+	if errors.As(err, &xe) && len(out) == 0 {
+		out = xe.Stderr
+	}
+	switch {
+	case bytes.Contains(out, []byte("Insufficient free space")),
+		bytes.Contains(out, []byte("No space left on device")):
+		return causeError{ErrNoFreeSpace, err}
+	case bytes.Contains(out, []byte("Device or resource busy")),
+		bytes.Contains(out, []byte("Resource temporarily unavailable")),
+		bytes.Contains(out, []byte("Can't get lock")),
+		bytes.Contains(out, []byte("Failed to lock")),
+		bytes.Contains(out, []byte("not initialized in udev database")):
+		return causeError{ErrBusy, err}
+	case bytes.Contains(out, []byte("Read-only file system")):
+		return causeError{ErrReadOnly, err}
+	}
+	return err
+}
+
+// A causeError tags err with a sentinel cause, while still unwrapping
+// to err so an *exec.ExitError stays visible to errors.As.
+type causeError struct {
+	cause error
+	err   error
+}
+
+func (e causeError) Error() string { return e.cause.Error() + ": " + e.err.Error() }
+
+func (e causeError) Unwrap() error { return e.err }
+
+func (e causeError) Is(target error) bool { return target == e.cause }
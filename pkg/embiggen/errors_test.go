@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestToolErr(t *testing.T) {
+	missing := exec.Command("embiggen-no-such-tool").Run()
+	failed := exec.Command("false").Run()
+	tests := []struct {
+		err  error
+		out  string
+		want error
+	}{
+		{missing, "", exec.ErrNotFound},
+		{failed, "  Insufficient free space: 2560 extents needed, but only 0 available", ErrNoFreeSpace},
+		{failed, "resize2fs: No space left on device while trying to resize /dev/sda1", ErrNoFreeSpace},
+		{failed, "xfs_growfs: Read-only file system", ErrReadOnly},
+		{failed, "  Can't get lock for vg0.", ErrBusy},
+		{failed, "sfdisk: cannot open /dev/sda: Device or resource busy", ErrBusy},
+		{failed, "boom", nil},
+	}
+	for i, tt := range tests {
+		err := toolErr(tt.err, []byte(tt.out))
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%d. toolErr(%v, %q) = %v; want it to match %v", i, tt.err, tt.out, err, tt.want)
+		}
+		var ee *exec.ExitError
+		if tt.err == failed && !errors.As(err, &ee) {
+			t.Errorf("%d. toolErr(%v, %q) = %v; lost the *exec.ExitError", i, tt.err, tt.out, err)
+		}
+	}
+	var tm ErrToolMissing
+	if err := toolErr(missing, nil); !errors.As(err, &tm) || tm.Tool != "embiggen-no-such-tool" {
+		t.Errorf("toolErr(%v) = %v; want ErrToolMissing{embiggen-no-such-tool}", missing, err)
+	}
+}
+
+func TestUnsupportedf(t *testing.T) {
+	err := Unsupportedf("%w type %q", ErrUnsupportedFilesystem, "zfs")
+	var ue UnsupportedError
+	if !errors.As(err, &ue) || !errors.Is(err, ErrUnsupportedFilesystem) {
+		t.Errorf("Unsupportedf = %#v; want an UnsupportedError wrapping ErrUnsupportedFilesystem", err)
+	}
+	if got, want := err.Error(), `unsupported filesystem type "zfs"`; got != want {
+		t.Errorf("Error() = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type frozenMountKey struct{}
+
+// freezesFS reports whether e's step gets a Freeze or Quiesce: the
+// partition layers, which are rewritten under a mounted filesystem
+// with nothing else stopping writes. (LVM suspends its devices, which
+// freezes the filesystem, by itself.)
+func freezesFS(e Resizer) bool {
+	switch e.Layer() {
+	case "partition", "gpart":
+		return true
+	}
+	return false
+}
+
+// freeze quiesces the application and freezes mnt, as configured,
+// returning a func to undo both. That's also done after FreezeTimeout
+// no matter what.
+func freeze(ctx context.Context, mnt string) (thaw func(), err error) {
+	o := opts(ctx)
+	timeout := o.freezeTimeout()
+	var undo []func() error
+	var once sync.Once
+	undoAll := func() {
+		once.Do(func() {
+			for i := len(undo) - 1; i >= 0; i-- {
+				if err := undo[i](); err != nil {
+					warnf(ctx, "thawing %s: %v", mnt, err)
+				}
+			}
+		})
+	}
+	if o.Quiesce != nil {
+		resume, err := quiesce(ctx, mnt)
+		if err != nil {
+			return nil, err
+		}
+		if resume != nil {
+			undo = append(undo, resume)
+		}
+	}
+	if o.Freeze {
+		if args := freezeArgs(mnt, true); args == nil {
+			warnf(ctx, "not freezing %s: fsfreeze is Linux-only", mnt)
+		} else if o.DryRun {
+			dryRunCommand(ctx, args...)
+			dryRunCommand(ctx, freezeArgs(mnt, false)...)
+		} else {
+			fctx, cancel := context.WithTimeout(ctx, timeout)
+			out, err := runLogged(fctx, command(ctx, args[0], args[1:]...))
+			cancel()
+			if err != nil {
+				undoAll()
+				return nil, fmt.Errorf("freezing %s: %w, %s", mnt, err, out)
+			}
+			undo = append(undo, func() error {
+				args := freezeArgs(mnt, false)
+				// Not ctx, which may be why the step ended.
+				tctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				if out, err := runLogged(tctx, command(ctx, args[0], args[1:]...)); err != nil {
+					return fmt.Errorf("%w, %s", err, out)
+				}
+				return nil
+			})
+		}
+	}
+	t := time.AfterFunc(timeout, func() {
+		warnf(ctx, "%s still frozen after %v; thawing it", mnt, timeout)
+		undoAll()
+	})
+	return func() { t.Stop(); undoAll() }, nil
+}
+
+// quiesce calls Quiesce, giving up on it after FreezeTimeout.
+func quiesce(ctx context.Context, mnt string) (resume func() error, err error) {
+	o := opts(ctx)
+	timeout := o.freezeTimeout()
+	type result struct {
+		resume func() error
+		err    error
+	}
+	qctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan result, 1)
+	go func() {
+		resume, err := o.Quiesce(qctx, mnt)
+		done <- result{resume, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("quiescing %s: %w", mnt, r.err)
+		}
+		return r.resume, nil
+	case <-qctx.Done():
+		// If it quiesces after all, resume it.
+		go func() {
+			if r := <-done; r.err == nil && r.resume != nil {
+				if err := r.resume(); err != nil {
+					warnf(ctx, "resuming %s after quiescing timed out: %v", mnt, err)
+				}
+			}
+		}()
+		return nil, fmt.Errorf("quiescing %s: %w after %v", mnt, ErrCommandTimeout, timeout)
+	}
+}
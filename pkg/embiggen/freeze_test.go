@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFreezeTimeout(t *testing.T) {
+	o := &Options{FreezeTimeout: 20 * time.Millisecond}
+	ctx := WithOptions(context.Background(), o)
+
+	resumed := make(chan string, 2)
+	o.Quiesce = func(ctx context.Context, mnt string) (func() error, error) {
+		return func() error { resumed <- mnt; return nil }, nil
+	}
+	thaw, err := freeze(ctx, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("not resumed after FreezeTimeout")
+	}
+	thaw()
+	if len(resumed) != 0 {
+		t.Error("resumed twice")
+	}
+
+	o.Quiesce = func(ctx context.Context, mnt string) (func() error, error) {
+		<-ctx.Done()
+		time.Sleep(time.Second) // a hook that ignores its context
+		return nil, nil
+	}
+	if _, err := freeze(ctx, "/data"); !errors.Is(err, ErrCommandTimeout) {
+		t.Errorf("freeze with a stuck Quiesce = %v; want ErrCommandTimeout", err)
+	}
+}
@@ -0,0 +1,498 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileSystemResizer returns the Resizer for the filesystem mounted at
+// mnt, which grows it and the layers under it as far as lim allows.
+func FileSystemResizer(ctx context.Context, mnt string, lim Limit) (Resizer, error) {
+	fs, err := statFS(ctx, mnt)
+	if err != nil {
+		return nil, err
+	}
+	e := platformResizer(fs, lim)
+	if e == nil && growableFSTypes[fs.FSType] {
+		e = FSResizer{fs, lim}
+	}
+	if e == nil {
+		return nil, Unsupportedf("%w type %q", ErrUnsupportedFilesystem, fs.FSType)
+	}
+	if isDisabled(ctx, e.Layer()) {
+		return nil, Unsupportedf("not growing %v; %s is disabled", e, e.Layer())
+	}
+	return e, nil
+}
+
+// An FSResizer grows an ext2/3/4, XFS or btrfs filesystem.
+type FSResizer struct {
+	fs  FSStat
+	lim Limit
+}
+
+func (e FSResizer) String() string {
+	return fmt.Sprintf("%s filesystem at %s", e.fs.FSType, e.fs.Mnt)
+}
+
+func (e FSResizer) Layer() string  { return "filesystem" }
+func (e FSResizer) FS() FSStat     { return e.fs }
+func (e FSResizer) Limit() Limit   { return e.lim }
+func (e FSResizer) Device() string { return e.fs.Dev }
+
+func (e FSResizer) DepResizer(ctx context.Context) (Resizer, error) {
+	return depResizer(ctx, e.fs.Dev, e.lim, e.builtinDep)
+}
+
+func (e FSResizer) builtinDep(ctx context.Context) (Resizer, error) {
+	dev := e.fs.Dev
+	if dev == "/dev/root" {
+		return nil, errors.New("unexpected device /dev/root from StatFS")
+	}
+	if d, err := ProbeDevice(dev); err == nil {
+		switch {
+		case d.IsLV():
+			return LVResizer{dev, e.lim}, nil
+		case d.Partition > 0:
+			vlogf(ctx, "FSResizer.DepResizer: returning PartitionResizer(%q)", dev)
+			return PartitionResizer{dev, e.lim}, nil
+		}
+		return nil, Unsupportedf("don't know how to resize block device %q", dev)
+	}
+	// No sysfs; go by its name.
+	if (strings.HasPrefix(dev, "/dev/sd") ||
+		strings.HasPrefix(dev, "/dev/vd") ||
+		strings.HasPrefix(dev, "/dev/mmcblk") ||
+		strings.HasPrefix(dev, "/dev/nvme")) &&
+		devEndsInNumber(dev) {
+		vlogf(ctx, "FSResizer.DepResizer: returning PartitionResizer(%q)", dev)
+		return PartitionResizer{dev, e.lim}, nil
+	}
+	if strings.HasPrefix(dev, "/dev/mapper") ||
+		strings.HasPrefix(filepath.Base(dev), "dm-") {
+		return LVResizer{dev, e.lim}, nil
+	}
+	return nil, Unsupportedf("don't know how to resize block device %q", dev)
+}
+
+// command returns the command that grows the filesystem, or nil if
+// it's already as big as e.lim allows.
+func (e FSResizer) command(ctx context.Context) (*exec.Cmd, error) {
+	if e.lim.Max == 0 && e.lim.MinGrowth == 0 {
+		return e.growCommand(ctx, 0, 0), nil
+	}
+
+	// Never ask for more than the device below can hold.
+	devSize, err := BlockDevSize(e.fs.Dev)
+	if err != nil {
+		return nil, err
+	}
+	st, err := statFS(ctx, e.fs.Mnt)
+	if err != nil {
+		return nil, err
+	}
+	bsize := int64(st.Statfs.Bsize)
+	cur, err := e.FSBytes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	target := devSize
+	if e.lim.Max > 0 && e.lim.Max < target {
+		target = e.lim.Max
+	}
+	if target <= cur || target-cur < e.lim.MinGrowth {
+		return nil, nil
+	}
+	if e.lim.Max == 0 {
+		target = 0
+	}
+	return e.growCommand(ctx, target, bsize), nil
+}
+
+// growCommand returns the command to grow the filesystem to target
+// bytes, or to fill its device if target is 0.
+func (e FSResizer) growCommand(ctx context.Context, target, bsize int64) *exec.Cmd {
+	if target == 0 {
+		switch e.fs.FSType {
+		case "xfs":
+			return command(ctx, "xfs_growfs", "-d", e.fs.Mnt)
+		case "btrfs":
+			return command(ctx, "btrfs", "filesystem", "resize", "max", e.fs.Mnt)
+		}
+		return command(ctx, "resize2fs", e.fs.Dev)
+	}
+	switch e.fs.FSType {
+	case "xfs":
+		return command(ctx, "xfs_growfs", "-D", strconv.FormatInt(target/bsize, 10), e.fs.Mnt)
+	case "btrfs":
+		return command(ctx, "btrfs", "filesystem", "resize", strconv.FormatInt(target, 10), e.fs.Mnt)
+	}
+	return command(ctx, "resize2fs", e.fs.Dev, fmt.Sprintf("%dK", target>>10))
+}
+
+func (e FSResizer) Resize(ctx context.Context) error {
+	o := opts(ctx)
+	cmd, err := e.command(ctx)
+	if err != nil || cmd == nil {
+		return err
+	}
+	if err := confirmStep(ctx, "grow %v by running %s", e, shellJoin(cmd.Args)); err != nil {
+		return err
+	}
+	var snap string
+	if o.Snapshot {
+		if snap, err = snapshotLV(ctx, e.fs.Dev); err != nil {
+			return err
+		}
+	}
+	if o.DryRun {
+		dryRunCommand(ctx, cmd.Args...)
+		return nil
+	}
+	out, err := runLogged(ctx, cmd)
+	if err != nil {
+		if e.fs.FSType == "xfs" && bytes.Contains(out, []byte("too small")) {
+			// A target less than a block bigger rounds down to
+			// the current size. Nothing to do.
+			return nil
+		}
+		if snap != "" {
+			// ctx may be why it failed.
+			keepSnapshot(context.Background(), snap)
+		}
+		return fmt.Errorf("running %v: %w, %s", cmd.Args, err, out)
+	}
+	return nil
+}
+
+func (e FSResizer) State(ctx context.Context) (string, error) {
+	st, err := statFS(ctx, e.fs.Mnt)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v blocks", st.Statfs.Blocks), nil
+}
+
+func (e FSResizer) Size(ctx context.Context) (int64, error) {
+	st, err := statFS(ctx, e.fs.Mnt)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Statfs.Blocks) * int64(st.Statfs.Bsize), nil
+}
+
+func (e FSResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	cur, err := e.Size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	devSize, err := BlockDevSize(e.fs.Dev)
+	if err != nil {
+		return 0, err
+	}
+	// An upper bound: the filesystem's own metadata isn't counted.
+	target := devSize + depGrowth
+	if e.lim.Max > 0 && e.lim.Max < target {
+		target = e.lim.Max
+	}
+	if target < cur {
+		return cur, nil
+	}
+	return target, nil
+}
+
+var (
+	xfsDataRx   = regexp.MustCompile(`(?m)^data\s+=\s+bsize=(\d+)\s+blocks=(\d+)`)
+	btrfsDevRx  = regexp.MustCompile(`(?m)^\s*devid\s+\d+\s+size\s+(\d+)\s+used\s+\d+\s+path\s+(\S+)`)
+	e2fsCountRx = regexp.MustCompile(`(?m)^Block count:\s+(\d+)`)
+	e2fsSizeRx  = regexp.MustCompile(`(?m)^Block size:\s+(\d+)`)
+)
+
+// FSBytes returns the size of the filesystem itself in bytes. Unlike
+// Size, which uses statfs, it includes the filesystem's own metadata,
+// so it can be compared with the size of the device below.
+func (e FSResizer) FSBytes(ctx context.Context) (int64, error) {
+	switch e.fs.FSType {
+	case "xfs":
+		// data     =                       bsize=4096   blocks=2621440, imaxpct=25
+		out, err := output(ctx, command(ctx, "xfs_info", e.fs.Mnt))
+		if err != nil {
+			return 0, fmt.Errorf("running xfs_info %s: %w", e.fs.Mnt, execErr(err))
+		}
+		m := xfsDataRx.FindSubmatch(out)
+		if m == nil {
+			return 0, fmt.Errorf("no data section in xfs_info %s output: %q", e.fs.Mnt, out)
+		}
+		bsize, _ := strconv.ParseInt(string(m[1]), 10, 64)
+		blocks, _ := strconv.ParseInt(string(m[2]), 10, 64)
+		return bsize * blocks, nil
+	case "btrfs":
+		// devid    1 size 10737418240 used 536870912 path /dev/sdb
+		out, err := output(ctx, command(ctx, "btrfs", "filesystem", "show", "--raw", e.fs.Mnt))
+		if err != nil {
+			return 0, fmt.Errorf("running btrfs filesystem show %s: %w", e.fs.Mnt, execErr(err))
+		}
+		for _, m := range btrfsDevRx.FindAllSubmatch(out, -1) {
+			if string(m[2]) == e.fs.Dev {
+				return strconv.ParseInt(string(m[1]), 10, 64)
+			}
+		}
+		return 0, fmt.Errorf("device %s not in btrfs filesystem show %s output: %q", e.fs.Dev, e.fs.Mnt, out)
+	}
+	out, err := output(ctx, command(ctx, "dumpe2fs", "-h", e.fs.Dev))
+	if err != nil {
+		return 0, fmt.Errorf("running dumpe2fs -h %s: %w", e.fs.Dev, execErr(err))
+	}
+	mc, ms := e2fsCountRx.FindSubmatch(out), e2fsSizeRx.FindSubmatch(out)
+	if mc == nil || ms == nil {
+		return 0, fmt.Errorf("no block count or size in dumpe2fs -h %s output", e.fs.Dev)
+	}
+	count, _ := strconv.ParseInt(string(mc[1]), 10, 64)
+	bsize, _ := strconv.ParseInt(string(ms[1]), 10, 64)
+	return count * bsize, nil
+}
+
+// growableFSTypes are the filesystem types FileSystemResizer supports.
+var growableFSTypes = map[string]bool{
+	"ext2":  true,
+	"ext3":  true,
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+// volatileFSTypes are filesystem types that are never grown: ones in
+// memory, and read-only images.
+var volatileFSTypes = map[string]bool{
+	"tmpfs":    true,
+	"ramfs":    true,
+	"devtmpfs": true,
+	"squashfs": true,
+	"iso9660":  true,
+	"cd9660":   true,
+	"cramfs":   true,
+	"erofs":    true,
+}
+
+// ramDisk reports whether dev is a compressed RAM disk (zram) or a
+// RAM disk, which can't be grown in place.
+func ramDisk(dev string) bool {
+	name := strings.TrimPrefix(dev, "/dev/")
+	return (strings.HasPrefix(name, "zram") || strings.HasPrefix(name, "ram")) && devEndsInNumber(name)
+}
+
+// NonGrowable describes the filesystem at mnt if it can never be
+// grown, like "tmpfs" or "ext4 on RAM disk /dev/zram0", and returns ""
+// if it might be, including if mnt can't be looked at now. Callers
+// trying many mount points, like a daemon, can skip those quietly
+// instead of failing.
+func NonGrowable(mnt string) string {
+	fs, err := StatFS(mnt)
+	if err != nil {
+		return ""
+	}
+	if volatileFSTypes[fs.FSType] {
+		return fs.FSType
+	}
+	if ramDisk(fs.Dev) {
+		return fmt.Sprintf("%s on RAM disk %s", fs.FSType, fs.Dev)
+	}
+	return ""
+}
+
+// ResizableMounts returns the mount points of filesystems that
+// FileSystemResizer knows how to grow, one per device.
+func ResizableMounts(ctx context.Context) ([]string, error) {
+	ms, err := mountTable()
+	if err != nil {
+		return nil, err
+	}
+	var mnts []string
+	seen := map[string]bool{}
+	for _, m := range ms {
+		if !strings.HasPrefix(m.Source, "/dev/") || !growableFSTypes[m.FSType] {
+			continue
+		}
+		if ramDisk(m.Source) {
+			vlogf(ctx, "%s: skipping %s on RAM disk %s", m.Mnt, m.FSType, m.Source)
+			continue
+		}
+		if seen[m.Source] {
+			continue // a bind mount of one we have
+		}
+		seen[m.Source] = true
+		mnts = append(mnts, m.Mnt)
+	}
+	return mnts, nil
+}
+
+// MountPoint returns where the filesystem on dev, a device path like
+// "/dev/disk/by-uuid/..." that may be a symlink, is mounted, preferring
+// a mount of the whole filesystem to bind mounts. If no filesystem is
+// on dev itself, as when it's a disk with partitions or LVM on it, it
+// returns the mount point of the first filesystem grown with dev under
+// it.
+func MountPoint(dev string) (string, error) {
+	real, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return "", err
+	}
+	ms, err := mountTable()
+	if err != nil {
+		return "", err
+	}
+	var majMin string
+	if d, err := ProbeDevice(real); err == nil {
+		majMin = d.MajMin
+	}
+	var found string
+	for _, m := range ms {
+		if m.Source != real && m.Source != dev && (majMin == "" || m.MajMin != majMin) {
+			continue
+		}
+		if m.Root == "/" || m.Root == "" {
+			return m.Mnt, nil
+		}
+		if found == "" {
+			found = m.Mnt
+		}
+	}
+	if found != "" {
+		return found, nil
+	}
+	mnts, err := ResizableMounts(context.Background())
+	if err != nil {
+		return "", err
+	}
+	for _, mnt := range mnts {
+		if sizes, err := StackSizes(mnt); err == nil {
+			if _, ok := sizes[real]; ok {
+				return mnt, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no filesystem on %s (%s) is mounted", dev, real)
+}
+
+// MountOptions returns the options the filesystem at mnt is mounted
+// with, the per-mount ones like "noatime" followed by the filesystem's
+// own like "data=ordered", for mounting it again the same way after
+// unmounting it. It's "" where the mount table doesn't record them.
+func MountOptions(mnt string) (string, error) {
+	ms, err := mountTable()
+	if err != nil {
+		return "", err
+	}
+	for i := len(ms) - 1; i >= 0; i-- { // the last mount over mnt is the one in use
+		if ms[i].Mnt == mnt {
+			return mergeMountOptions(ms[i].MntOpts, ms[i].Opts), nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't a mount point", mnt)
+}
+
+// mergeMountOptions joins per-mount and superblock options, dropping
+// duplicates, the superblock's own "rw" or "ro" (the per-mount one
+// wins), and "seclabel", which the kernel reports but mount rejects.
+func mergeMountOptions(mntOpts, superOpts string) string {
+	var opts []string
+	seen := map[string]bool{}
+	add := func(s string, super bool) {
+		for _, o := range strings.Split(s, ",") {
+			if o == "" || seen[o] || o == "seclabel" || super && (o == "rw" || o == "ro") {
+				continue
+			}
+			seen[o] = true
+			opts = append(opts, o)
+		}
+	}
+	add(mntOpts, false)
+	add(superOpts, true)
+	return strings.Join(opts, ",")
+}
+
+// An FSStat describes a mounted filesystem.
+type FSStat struct {
+	Mnt    string // "/"
+	Dev    string // "/dev/sda3"
+	FSType string // "ext4"
+	Statfs unix.Statfs_t
+}
+
+// StatFS describes the filesystem mounted at mnt. If mnt is a bind
+// mount or btrfs subvolume mount, the FSStat's Mnt is where the whole
+// filesystem is mounted, if it is; if it's an overlay filesystem, it
+// describes the filesystem holding the overlay's upper directory.
+func StatFS(mnt string) (FSStat, error) {
+	return statFS(context.Background(), mnt)
+}
+
+// statFS is StatFS, logging how mnt was mapped to a mount with ctx's
+// Options.
+func statFS(ctx context.Context, mnt string) (fs FSStat, err error) {
+	err = unix.Statfs(mnt, &fs.Statfs)
+	if err != nil {
+		return
+	}
+	fs.Mnt, fs.Dev, fs.FSType, err = mountEntry(ctx, mnt, &fs.Statfs)
+	if err != nil {
+		return
+	}
+	if fs.Mnt != mnt {
+		err = unix.Statfs(fs.Mnt, &fs.Statfs)
+	}
+	return fs, err
+}
+
+// findDevRoot finds which block device (e.g. "/dev/nvme0n1p1") patches the device number of /dev/root.
+func findDevRoot() (string, error) {
+	fis, err := ioutil.ReadDir("/dev")
+	if err != nil {
+		return "", err
+	}
+	dev := map[string]uint64{}
+	for _, fi := range fis {
+		if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+			continue
+		}
+		dev[fi.Name()] = fi.Sys().(*syscall.Stat_t).Rdev
+	}
+	wantDevnum, ok := dev["root"]
+	if !ok {
+		return "", errors.New("/dev/root not found in /dev")
+	}
+	for baseName, devNum := range dev {
+		if devNum == wantDevnum && baseName != "root" {
+			return "/dev/" + baseName, nil
+		}
+	}
+	return "", errors.New("no block device in /dev had device number like /dev/root")
+}
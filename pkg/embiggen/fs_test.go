@@ -0,0 +1,40 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import "testing"
+
+func TestRAMDisk(t *testing.T) {
+	for dev, want := range map[string]bool{
+		"/dev/zram0":           true,
+		"/dev/ram1":            true,
+		"/dev/sda1":            false,
+		"/dev/ramdsk":          false,
+		"/dev/mapper/ram-root": false,
+	} {
+		if got := ramDisk(dev); got != want {
+			t.Errorf("ramDisk(%q) = %v; want %v", dev, got, want)
+		}
+	}
+}
+
+func TestMergeMountOptions(t *testing.T) {
+	got := mergeMountOptions("rw,nosuid,noatime", "rw,seclabel,noatime,data=ordered")
+	if want := "rw,nosuid,noatime,data=ordered"; got != want {
+		t.Errorf("mergeMountOptions = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,427 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+// FreeBSD's layers: UFS grown with growfs, ZFS pools grown with
+// "zpool online -e", and GEOM partitions grown with gpart.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountEntry returns the device and filesystem type mounted at mnt,
+// which statfs already knows, and mnt itself as the mount to resize.
+func mountEntry(ctx context.Context, mnt string, st *unix.Statfs_t) (real, dev, fstype string, err error) {
+	if unix.ByteSliceToString(st.Mntonname[:]) != mnt {
+		return "", "", "", errors.New("mount point not found")
+	}
+	return mnt, unix.ByteSliceToString(st.Mntfromname[:]), unix.ByteSliceToString(st.Fstypename[:]), nil
+}
+
+// platformResizer returns the Resizer for a UFS or ZFS filesystem.
+func platformResizer(fs FSStat, lim Limit) Resizer {
+	switch fs.FSType {
+	case "ufs":
+		return ufsResizer{fs, lim}
+	case "zfs":
+		return zfsResizer{strings.SplitN(fs.Dev, "/", 2)[0], lim}
+	}
+	return nil
+}
+
+// ReadOnly reports whether the filesystem is mounted read-only.
+func (fs FSStat) ReadOnly() bool { return fs.Statfs.Flags&unix.MNT_RDONLY != 0 }
+
+// remountArgs returns the command to remount mnt read-write.
+func remountArgs(mnt string) []string { return []string{"mount", "-u", "-o", "rw", mnt} }
+
+// freezeArgs returns nil: FreeBSD has no fsfreeze.
+func freezeArgs(mnt string, freeze bool) []string { return nil }
+
+// geomProvider returns the GEOM provider of dev, like "da0p2" for
+// "/dev/da0p2" or "/dev/gpt/rootfs".
+func geomProvider(ctx context.Context, dev string) (string, error) {
+	name := strings.TrimPrefix(dev, "/dev/")
+	if !strings.Contains(name, "/") {
+		return name, nil
+	}
+	out, err := output(ctx, command(ctx, "glabel", "status", "-s"))
+	if err != nil {
+		return "", fmt.Errorf("running glabel status: %w", execErr(err))
+	}
+	if p, ok := parseGlabelStatus(out)[name]; ok {
+		return p, nil
+	}
+	return "", fmt.Errorf("no GEOM label %s", name)
+}
+
+// diskinfo returns the sector size and media size of provider.
+func diskinfo(ctx context.Context, provider string) (sector, size int64, err error) {
+	out, err := output(ctx, command(ctx, "diskinfo", provider))
+	if err != nil {
+		return 0, 0, fmt.Errorf("running diskinfo %s: %w", provider, execErr(err))
+	}
+	return parseDiskinfo(out)
+}
+
+// partitionBelow returns the gpartResizer for dev, or nil if dev is a
+// whole disk.
+func partitionBelow(ctx context.Context, dev string, lim Limit) (Resizer, error) {
+	p, err := geomProvider(ctx, dev)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok := splitProvider(p); !ok {
+		return nil, nil
+	}
+	return gpartResizer{p, lim}, nil
+}
+
+// runChange runs a command that changes something, or says it would.
+func runChange(ctx context.Context, what fmt.Stringer, args ...string) error {
+	if opts(ctx).DryRun {
+		dryRunCommand(ctx, args...)
+		return nil
+	}
+	if err := confirmStep(ctx, "grow %v by running %s", what, shellJoin(args)); err != nil {
+		return err
+	}
+	cmd := command(ctx, args[0], args[1:]...)
+	if out, err := runLogged(ctx, cmd); err != nil {
+		return fmt.Errorf("running %v: %w, %s", args, err, out)
+	}
+	return nil
+}
+
+type ufsResizer struct {
+	fs  FSStat
+	lim Limit
+}
+
+func (e ufsResizer) String() string { return "ufs filesystem at " + e.fs.Mnt }
+func (e ufsResizer) Layer() string  { return "filesystem" }
+func (e ufsResizer) Device() string { return e.fs.Dev }
+func (e ufsResizer) FS() FSStat     { return e.fs }
+
+func (e ufsResizer) State(ctx context.Context) (string, error) {
+	st, err := statFS(ctx, e.fs.Mnt)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v blocks", st.Statfs.Blocks), nil
+}
+
+func (e ufsResizer) Size(ctx context.Context) (int64, error) {
+	st, err := statFS(ctx, e.fs.Mnt)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Statfs.Blocks) * int64(st.Statfs.Bsize), nil
+}
+
+func (e ufsResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	cur, err := e.Size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	p, err := geomProvider(ctx, e.fs.Dev)
+	if err != nil {
+		return 0, err
+	}
+	_, devSize, err := diskinfo(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	target := devSize + depGrowth
+	if e.lim.Max > 0 && e.lim.Max < target {
+		target = e.lim.Max
+	}
+	if target < cur {
+		return cur, nil
+	}
+	return target, nil
+}
+
+func (e ufsResizer) Resize(ctx context.Context) error {
+	p, err := geomProvider(ctx, e.fs.Dev)
+	if err != nil {
+		return err
+	}
+	_, devSize, err := diskinfo(ctx, p)
+	if err != nil {
+		return err
+	}
+	cur, err := e.Size(ctx)
+	if err != nil {
+		return err
+	}
+	// statfs doesn't count UFS's own metadata, so this is only a
+	// rough check; growfs says if there's nothing to do.
+	target := devSize
+	if e.lim.Max > 0 && e.lim.Max < target {
+		target = e.lim.Max
+	}
+	if target <= cur || target-cur < e.lim.MinGrowth {
+		return nil
+	}
+	args := []string{"growfs", "-y"}
+	if e.lim.Max > 0 {
+		args = append(args, "-s", strconv.FormatInt(target/512, 10))
+	}
+	return runChange(ctx, e, append(args, e.fs.Mnt)...)
+}
+
+func (e ufsResizer) DepResizer(ctx context.Context) (Resizer, error) {
+	return depResizer(ctx, e.fs.Dev, e.lim, func(ctx context.Context) (Resizer, error) { return partitionBelow(ctx, e.fs.Dev, e.lim) })
+}
+
+// A zfsResizer grows a ZFS pool into its vdev once the vdev has grown.
+// It can only grow a pool of one device, and always grows it to fill
+// the device.
+type zfsResizer struct {
+	pool string
+	lim  Limit
+}
+
+func (e zfsResizer) String() string { return "ZFS pool " + e.pool }
+func (e zfsResizer) Layer() string  { return "zfs-pool" }
+
+func (e zfsResizer) Device() string {
+	dev, _ := e.vdev(context.Background())
+	return dev
+}
+
+// vdev returns the pool's only device.
+func (e zfsResizer) vdev(ctx context.Context) (string, error) {
+	out, err := output(ctx, command(ctx, "zpool", "list", "-vHP", e.pool))
+	if err != nil {
+		return "", fmt.Errorf("running zpool list %s: %w", e.pool, execErr(err))
+	}
+	devs := zpoolLeaves(out)
+	if len(devs) != 1 {
+		return "", Unsupportedf("ZFS pool %s has %d devices; only pools of one can be grown", e.pool, len(devs))
+	}
+	return devs[0], nil
+}
+
+// prop returns the pool's numeric property name, like "size", with
+// "-" as 0.
+func (e zfsResizer) prop(ctx context.Context, name string) (int64, error) {
+	out, err := output(ctx, command(ctx, "zpool", "list", "-Hp", "-o", name, e.pool))
+	if err != nil {
+		return 0, fmt.Errorf("running zpool list %s: %w", e.pool, execErr(err))
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "-" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (e zfsResizer) State(ctx context.Context) (string, error) {
+	n, err := e.prop(ctx, "size")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d bytes", n), nil
+}
+
+func (e zfsResizer) Size(ctx context.Context) (int64, error) { return e.prop(ctx, "size") }
+
+func (e zfsResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	cur, err := e.Size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	expand, err := e.prop(ctx, "expandsize")
+	if err != nil {
+		return 0, err
+	}
+	return cur + expand + depGrowth, nil
+}
+
+func (e zfsResizer) Resize(ctx context.Context) error {
+	expand, err := e.prop(ctx, "expandsize")
+	if err != nil || expand == 0 {
+		return err
+	}
+	dev, err := e.vdev(ctx)
+	if err != nil {
+		return err
+	}
+	return runChange(ctx, e, "zpool", "online", "-e", e.pool, dev)
+}
+
+func (e zfsResizer) DepResizer(ctx context.Context) (Resizer, error) {
+	dev, err := e.vdev(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return depResizer(ctx, dev, e.lim, func(ctx context.Context) (Resizer, error) { return partitionBelow(ctx, dev, e.lim) })
+}
+
+// A gpartResizer grows a GEOM partition, like "da0p2", into the free
+// space after it.
+type gpartResizer struct {
+	provider string
+	lim      Limit
+}
+
+func (e gpartResizer) String() string { return "partition " + e.provider }
+func (e gpartResizer) Layer() string  { return "partition" }
+func (e gpartResizer) Device() string { return "/dev/" + e.provider }
+
+// table returns the partition table e is in, and its sector size
+// and media size.
+func (e gpartResizer) table(ctx context.Context) (t *gpartTable, sector, media int64, err error) {
+	geom, _, _ := splitProvider(e.provider)
+	out, err := output(ctx, command(ctx, "gpart", "show", "-p", geom))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("running gpart show %s: %w", geom, execErr(err))
+	}
+	if t, err = parseGpartShow(out); err != nil {
+		return nil, 0, 0, err
+	}
+	sector, media, err = diskinfo(ctx, geom)
+	return t, sector, media, err
+}
+
+// end returns where the usable sectors of t would end after a gpart
+// recover: GPT keeps 33 sectors for its backup at the end of the disk.
+func end(t *gpartTable, sector, media int64) int64 {
+	n := media / sector
+	if t.scheme == "GPT" {
+		n -= 33
+	}
+	return n
+}
+
+func (e gpartResizer) entry(t *gpartTable) (gpartEntry, error) {
+	for _, p := range t.entries {
+		if p.name == e.provider {
+			return p, nil
+		}
+	}
+	return gpartEntry{}, fmt.Errorf("no partition %s in %s", e.provider, t.geom)
+}
+
+func (e gpartResizer) State(ctx context.Context) (string, error) {
+	t, _, _, err := e.table(ctx)
+	if err != nil {
+		return "", err
+	}
+	p, err := e.entry(t)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d sectors", p.size), nil
+}
+
+func (e gpartResizer) Size(ctx context.Context) (int64, error) {
+	t, sector, _, err := e.table(ctx)
+	if err != nil {
+		return 0, err
+	}
+	p, err := e.entry(t)
+	if err != nil {
+		return 0, err
+	}
+	return p.size * sector, nil
+}
+
+// growth returns how many bytes the partition can grow by.
+func (e gpartResizer) growth(ctx context.Context) (int64, error) {
+	t, sector, media, err := e.table(ctx)
+	if err != nil {
+		return 0, err
+	}
+	p, err := e.entry(t)
+	if err != nil {
+		return 0, err
+	}
+	n, err := t.growable(e.provider, end(t, sector, media))
+	if err != nil {
+		return 0, err
+	}
+	return e.lim.capBytes(p.size*sector, n*sector), nil
+}
+
+func (e gpartResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	cur, err := e.Size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err := e.growth(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return cur + n, nil
+}
+
+func (e gpartResizer) Resize(ctx context.Context) error {
+	o := opts(ctx)
+	n, err := e.growth(ctx)
+	if err != nil {
+		return err
+	}
+	if n == 0 || n < e.lim.MinGrowth {
+		return nil
+	}
+	t, sector, _, err := e.table(ctx)
+	if err != nil {
+		return err
+	}
+	geom, index, _ := splitProvider(e.provider)
+	if t.corrupt {
+		if err := runChange(ctx, e, "gpart", "recover", geom); err != nil {
+			return err
+		}
+	}
+	args := []string{"gpart", "resize", "-i", strconv.Itoa(index), "-a", "4k"}
+	if e.lim.Max > 0 {
+		cur, err := e.Size(ctx)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-s", strconv.FormatInt((cur+n)/sector, 10))
+	}
+	args = append(args, geom)
+	if o.DryRun {
+		dryRunCommand(ctx, args...)
+		return nil
+	}
+	if err := confirmStep(ctx, "grow %v by running %s", e, shellJoin(args)); err != nil {
+		return err
+	}
+	if o.BeforeRewrite != nil {
+		if err := o.BeforeRewrite(ctx, "/dev/"+geom); err != nil {
+			return err
+		}
+	}
+	if out, err := runLogged(ctx, command(ctx, args[0], args[1:]...)); err != nil {
+		return fmt.Errorf("running %v: %w, %s", args, err, out)
+	}
+	return nil
+}
+
+func (e gpartResizer) DepResizer(ctx context.Context) (Resizer, error) { return nil, nil }
@@ -0,0 +1,166 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+// Parsers for FreeBSD's gpart, glabel, diskinfo and zpool output. They
+// build everywhere so they can be tested anywhere.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A gpartEntry is a line of "gpart show -p" output: a partition, or
+// free space if name is "".
+type gpartEntry struct {
+	start, size int64  // in sectors
+	name, typ   string // "da0p2", "freebsd-ufs"
+}
+
+// A gpartTable is the "gpart show -p" output for one geom.
+type gpartTable struct {
+	geom, scheme string // "da0", "GPT"
+	start, size  int64  // the usable sectors
+	corrupt      bool   // the disk grew, so the GPT backup header is misplaced
+	entries      []gpartEntry
+}
+
+// parseGpartShow parses "gpart show -p <geom>" output, like
+//
+//	=>      40  41942960    da0  GPT  (20G)
+//	        40      1024  da0p1  freebsd-boot  (512K)
+//	      1064  39844864  da0p2  freebsd-ufs  (19G)
+//	  39845928   2097072         - free -  (1.0G)
+func parseGpartShow(out []byte) (*gpartTable, error) {
+	var t *gpartTable
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	for bs.Scan() {
+		f := strings.Fields(bs.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if f[0] == "=>" {
+			if len(f) < 5 || t != nil {
+				return nil, fmt.Errorf("bad gpart show header %q", bs.Text())
+			}
+			t = &gpartTable{geom: f[3], scheme: f[4], corrupt: strings.Contains(bs.Text(), "[CORRUPT]")}
+			t.start, _ = strconv.ParseInt(f[1], 10, 64)
+			t.size, _ = strconv.ParseInt(f[2], 10, 64)
+			continue
+		}
+		if t == nil || len(f) < 4 {
+			return nil, fmt.Errorf("unexpected gpart show line %q", bs.Text())
+		}
+		var e gpartEntry
+		var err error
+		if e.start, err = strconv.ParseInt(f[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("bad gpart show line %q", bs.Text())
+		}
+		if e.size, err = strconv.ParseInt(f[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("bad gpart show line %q", bs.Text())
+		}
+		if f[2] != "-" {
+			e.name, e.typ = f[2], f[3]
+		}
+		t.entries = append(t.entries, e)
+	}
+	if t == nil {
+		return nil, fmt.Errorf("no partition table in gpart show output %q", out)
+	}
+	return t, bs.Err()
+}
+
+// growable returns the sectors partition name could grow by: the
+// free space right after it, or with a corrupt table, up to end, the
+// last usable sector plus one once the table is recovered.
+func (t *gpartTable) growable(name string, end int64) (int64, error) {
+	for i, e := range t.entries {
+		if e.name != name {
+			continue
+		}
+		if i+1 < len(t.entries) {
+			if next := t.entries[i+1]; next.name == "" {
+				return next.size, nil
+			}
+			return 0, nil
+		}
+		if t.corrupt && end > e.start+e.size {
+			return end - (e.start + e.size), nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("no partition %s in %s", name, t.geom)
+}
+
+// gpartProviderRx splits a partition provider like "da0p2" or
+// "vtbd0s1" into its geom and index.
+var gpartProviderRx = regexp.MustCompile(`^(.*\d)[ps](\d+)$`)
+
+// splitProvider returns the geom and index of partition provider p.
+func splitProvider(p string) (geom string, index int, ok bool) {
+	m := gpartProviderRx.FindStringSubmatch(p)
+	if m == nil {
+		return "", 0, false
+	}
+	index, _ = strconv.Atoi(m[2])
+	return m[1], index, true
+}
+
+// parseGlabelStatus parses "glabel status -s" output, like
+// "gpt/rootfs  N/A  da0p2", into a map from label to provider.
+func parseGlabelStatus(out []byte) map[string]string {
+	m := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) == 3 {
+			m[f[0]] = f[2]
+		}
+	}
+	return m
+}
+
+// parseDiskinfo parses "diskinfo <provider>" output, like
+// "da0	512	21474836480	41943040	0	0	2610	255	63", into the
+// sector size and media size in bytes.
+func parseDiskinfo(out []byte) (sector, size int64, err error) {
+	f := strings.Fields(string(out))
+	if len(f) < 3 {
+		return 0, 0, fmt.Errorf("bad diskinfo output %q", out)
+	}
+	if sector, err = strconv.ParseInt(f[1], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("bad diskinfo output %q", out)
+	}
+	if size, err = strconv.ParseInt(f[2], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("bad diskinfo output %q", out)
+	}
+	return sector, size, nil
+}
+
+// zpoolLeaves returns the device paths of the leaf vdevs in
+// "zpool list -vHP <pool>" output.
+func zpoolLeaves(out []byte) []string {
+	var devs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.Fields(line); len(f) > 0 && strings.HasPrefix(f[0], "/dev/") {
+			devs = append(devs, f[0])
+		}
+	}
+	return devs
+}
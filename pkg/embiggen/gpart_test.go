@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGpartShow(t *testing.T) {
+	out := []byte(`=>      40  41942960    da0  GPT  (20G)
+        40      1024  da0p1  freebsd-boot  (512K)
+      1064  39844864  da0p2  freebsd-ufs  (19G)
+  39845928   2097072         - free -  (1.0G)
+`)
+	tbl, err := parseGpartShow(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &gpartTable{geom: "da0", scheme: "GPT", start: 40, size: 41942960, entries: []gpartEntry{
+		{40, 1024, "da0p1", "freebsd-boot"},
+		{1064, 39844864, "da0p2", "freebsd-ufs"},
+		{39845928, 2097072, "", ""},
+	}}
+	if !reflect.DeepEqual(tbl, want) {
+		t.Fatalf("parseGpartShow = %+v; want %+v", tbl, want)
+	}
+	tests := []struct {
+		name    string
+		corrupt bool
+		want    int64
+	}{
+		{"da0p2", false, 2097072},
+		{"da0p1", false, 0},
+		{"da0p2", true, 2097072}, // the free space is already in the table
+	}
+	for _, tt := range tests {
+		tbl.corrupt = tt.corrupt
+		if got, err := tbl.growable(tt.name, 83886047); err != nil || got != tt.want {
+			t.Errorf("growable(%s), corrupt %v = %d, %v; want %d", tt.name, tt.corrupt, got, err, tt.want)
+		}
+	}
+
+	// After the disk grows, gpart shows the old table as corrupt.
+	tbl, err = parseGpartShow([]byte(`=>      40  41942960  vtbd0  GPT  (40G) [CORRUPT]
+        40  41942960  vtbd0p1  freebsd-ufs  (20G)
+`))
+	if err != nil || !tbl.corrupt {
+		t.Fatalf("parseGpartShow of a corrupt table = %+v, %v", tbl, err)
+	}
+	if got, _ := tbl.growable("vtbd0p1", 83886047); got != 83886047-41943000 {
+		t.Errorf("growable of a corrupt table = %d; want %d", got, 83886047-41943000)
+	}
+}
+
+func TestSplitProvider(t *testing.T) {
+	tests := []struct {
+		p     string
+		geom  string
+		index int
+	}{
+		{"da0p2", "da0", 2},
+		{"nvd0p10", "nvd0", 10},
+		{"vtbd1s1", "vtbd1", 1},
+		{"ada0", "", 0},
+	}
+	for _, tt := range tests {
+		geom, index, ok := splitProvider(tt.p)
+		if geom != tt.geom || index != tt.index || ok != (tt.geom != "") {
+			t.Errorf("splitProvider(%q) = %q, %d, %v; want %q, %d", tt.p, geom, index, ok, tt.geom, tt.index)
+		}
+	}
+}
+
+func TestGeomCommandOutput(t *testing.T) {
+	labels := parseGlabelStatus([]byte("gpt/gptboot0     N/A  da0p1\n  gpt/rootfs     N/A  da0p2\n"))
+	if labels["gpt/rootfs"] != "da0p2" {
+		t.Errorf("parseGlabelStatus: gpt/rootfs = %q; want da0p2", labels["gpt/rootfs"])
+	}
+	sector, size, err := parseDiskinfo([]byte("da0\t512\t21474836480\t41943040\t0\t0\t2610\t255\t63\n"))
+	if err != nil || sector != 512 || size != 21474836480 {
+		t.Errorf("parseDiskinfo = %d, %d, %v", sector, size, err)
+	}
+	devs := zpoolLeaves([]byte("zroot\t19.5G\t2.1G\t17.4G\t-\t1G\t1%\t10%\t1.00x\tONLINE\t-\n\t/dev/gpt/zfs0\t19.5G\t2.1G\t17.4G\t-\t1G\t1%\t10.7%\t-\tONLINE\n"))
+	if !reflect.DeepEqual(devs, []string{"/dev/gpt/zfs0"}) {
+		t.Errorf("zpoolLeaves = %q", devs)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	e2fsStateRx      = regexp.MustCompile(`(?m)^Filesystem state:\s+(.+)$`)
+	e2fsErrorCountRx = regexp.MustCompile(`(?m)^FS Error count:\s+(\d+)$`)
+	xfsMagicRx       = regexp.MustCompile(`(?m)^magicnum = 0x58465342$`)
+	xfsInProgressRx  = regexp.MustCompile(`(?m)^inprogress = 0$`)
+)
+
+// checkHealth returns an error wrapping ErrCorrupt if fs looks damaged.
+// The checks are cheap and read-only: the ext2/3/4 superblock's state
+// and error count, the XFS superblock, btrfs's device error counters,
+// and the kernel log for errors on fs's device.
+func checkHealth(ctx context.Context, fs FSStat) error {
+	vlogf(ctx, "Checking the health of %s ...", fs.Mnt)
+	var problem string
+	switch fs.FSType {
+	case "ext2", "ext3", "ext4":
+		out, err := output(ctx, command(ctx, "dumpe2fs", "-h", fs.Dev))
+		if err != nil {
+			return fmt.Errorf("running dumpe2fs -h %s: %w", fs.Dev, execErr(err))
+		}
+		if m := e2fsStateRx.FindSubmatch(out); m != nil && bytes.Contains(m[1], []byte("error")) {
+			problem = fmt.Sprintf("its superblock's state is %q", bytes.TrimSpace(m[1]))
+		} else if m := e2fsErrorCountRx.FindSubmatch(out); m != nil && string(m[1]) != "0" {
+			problem = fmt.Sprintf("its superblock counts %s errors", m[1])
+		}
+	case "xfs":
+		out, err := output(ctx, command(ctx, "xfs_db", "-r", "-c", "sb 0", "-c", "print magicnum inprogress", fs.Dev))
+		if err != nil {
+			return fmt.Errorf("running xfs_db -r %s: %w", fs.Dev, execErr(err))
+		}
+		if !xfsMagicRx.Match(out) || !xfsInProgressRx.Match(out) {
+			problem = fmt.Sprintf("its superblock looks bad: %q", bytes.TrimSpace(out))
+		}
+	case "btrfs":
+		out, err := output(ctx, command(ctx, "btrfs", "device", "stats", fs.Mnt))
+		if err != nil {
+			return fmt.Errorf("running btrfs device stats %s: %w", fs.Mnt, execErr(err))
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if f := strings.Fields(line); len(f) == 2 && f[1] != "0" &&
+				(strings.HasSuffix(f[0], ".corruption_errs") || strings.HasSuffix(f[0], ".generation_errs")) {
+				problem = fmt.Sprintf("btrfs device stats reports %s", line)
+				break
+			}
+		}
+	}
+	if problem == "" {
+		problem = kernelFSErrors(ctx, fs.Dev)
+	}
+	if problem != "" {
+		return fmt.Errorf("%w: not growing %s: %s; check it with fsck first", ErrCorrupt, fs.Mnt, problem)
+	}
+	return nil
+}
+
+// kernelFSErrors returns the first filesystem error the kernel has
+// logged for dev since boot, like "EXT4-fs error (device sda1): ...",
+// or "" if there's none or the log can't be read.
+func kernelFSErrors(ctx context.Context, dev string) string {
+	out, err := output(ctx, command(ctx, "dmesg"))
+	if err != nil {
+		vlogf(ctx, "Not checking the kernel log for errors on %s: %v", dev, execErr(err))
+		return ""
+	}
+	if line := fsErrorLine(out, filepath.Base(dev)); line != "" {
+		return "the kernel logged " + line
+	}
+	return ""
+}
+
+// fsErrorLine returns the first line of kernel log out that reports an
+// I/O or filesystem error on device name, like "sda1".
+func fsErrorLine(out []byte, name string) string {
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	for bs.Scan() {
+		if line := bs.Text(); isDeviceErrorLine(line, name) {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import "testing"
+
+func TestFSErrorLine(t *testing.T) {
+	dmesg := []byte(`[    1.234567] EXT4-fs (sda1): mounted filesystem with ordered data mode. Opts: (null)
+[    2.000000] XFS (sdb1): Mounting V5 Filesystem
+[ 1234.500000] EXT4-fs error (device sda1): ext4_lookup:1601: inode #2: comm ls: deleted inode referenced: 12
+[ 1300.000000] XFS (sdb1): Metadata corruption detected at xfs_inode_buf_verify+0x1a/0x50
+[ 1400.000000] BTRFS error (device sdc1): bdev /dev/sdc1 errs: wr 0, rd 0, flush 0, corrupt 1, gen 0
+[ 1500.000000] EXT4-fs (sda10): error count since last fsck: 3
+[ 1600.000000] blk_update_request: I/O error, dev sdd, sector 2048 op 0x1:(WRITE) flags 0x0 phys_seg 1 prio class 0
+`)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"sda1", "[ 1234.500000] EXT4-fs error (device sda1): ext4_lookup:1601: inode #2: comm ls: deleted inode referenced: 12"},
+		{"sdb1", "[ 1300.000000] XFS (sdb1): Metadata corruption detected at xfs_inode_buf_verify+0x1a/0x50"},
+		{"sdc1", "[ 1400.000000] BTRFS error (device sdc1): bdev /dev/sdc1 errs: wr 0, rd 0, flush 0, corrupt 1, gen 0"},
+		{"sda10", "[ 1500.000000] EXT4-fs (sda10): error count since last fsck: 3"},
+		{"sdd", "[ 1600.000000] blk_update_request: I/O error, dev sdd, sector 2048 op 0x1:(WRITE) flags 0x0 phys_seg 1 prio class 0"},
+		{"sdd1", ""},
+	}
+	for _, tt := range tests {
+		if got := fsErrorLine(dmesg, tt.name); got != tt.want {
+			t.Errorf("fsErrorLine(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
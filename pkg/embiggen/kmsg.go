@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A kernelLogWatcher reads the kernel log in the background and
+// collects the messages that report errors on its devices.
+type kernelLogWatcher struct {
+	r io.ReadCloser
+
+	mu     sync.Mutex
+	names  map[string]bool // kernel device names, like "sda1" and "dm-0"
+	errors []string
+}
+
+type kernelLogWatcherKey struct{}
+
+// watchKernelLog starts watching the kernel log for errors on the
+// devices later passed to add. It returns nil if the kernel log can't
+// be read.
+func watchKernelLog(ctx context.Context) *kernelLogWatcher {
+	r, err := openKernelLog()
+	if err != nil {
+		vlogf(ctx, "Not watching the kernel log: %v", err)
+		return nil
+	}
+	w := &kernelLogWatcher{r: r, names: map[string]bool{}}
+	go w.run(ctx)
+	return w
+}
+
+func (w *kernelLogWatcher) run(ctx context.Context) {
+	for {
+		msg, err := readKernelLogRecord(w.r)
+		if err != nil {
+			return
+		}
+		w.mu.Lock()
+		var hit bool
+		for name := range w.names {
+			if isDeviceErrorLine(msg, name) {
+				hit = true
+				w.errors = append(w.errors, msg)
+				break
+			}
+		}
+		w.mu.Unlock()
+		if hit {
+			warnf(ctx, "the kernel logged an error on a device being resized; stopping after the step in progress: %s", msg)
+		}
+	}
+}
+
+// add adds dev, and the disk it's a partition of, to the devices w
+// watches for errors.
+func (w *kernelLogWatcher) add(dev string) {
+	if w == nil || !strings.HasPrefix(dev, "/dev/") {
+		return
+	}
+	if p, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = p // /dev/mapper/vg-lv is logged as dm-N
+	}
+	name := filepath.Base(dev)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.names[name] = true
+	if _, err := os.Stat("/sys/class/block/" + name + "/partition"); err == nil {
+		if p, err := filepath.EvalSymlinks("/sys/class/block/" + name + "/.."); err == nil {
+			w.names[filepath.Base(p)] = true
+		}
+	}
+}
+
+// errorCount returns how many errors w has seen so far.
+func (w *kernelLogWatcher) errorCount() int {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.errors)
+}
+
+// errorsSince returns the errors w has seen after the first n.
+func (w *kernelLogWatcher) errorsSince(n int) []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.errors[n:]...)
+}
+
+func (w *kernelLogWatcher) stop() {
+	if w != nil {
+		w.r.Close()
+	}
+}
+
+// watcherFrom returns the kernelLogWatcher of ctx, if any.
+func watcherFrom(ctx context.Context) *kernelLogWatcher {
+	w, _ := ctx.Value(kernelLogWatcherKey{}).(*kernelLogWatcher)
+	return w
+}
+
+// isDeviceErrorLine reports whether kernel log message line reports an
+// I/O error on the device called name, like "sda" or "dm-0", or a
+// filesystem error on it.
+func isDeviceErrorLine(line, name string) bool {
+	if strings.Contains(line, "I/O error, dev "+name+",") ||
+		strings.Contains(line, "I/O error on dev "+name+",") {
+		return true
+	}
+	if !strings.Contains(line, "(device "+name+")") && !strings.Contains(line, "("+name+")") {
+		return false
+	}
+	lower := strings.ToLower(line)
+	return strings.Contains(lower, "error") || strings.Contains(lower, "corrupt")
+}
@@ -0,0 +1,29 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"errors"
+	"io"
+)
+
+// openKernelLog fails: FreeBSD has no /dev/kmsg.
+func openKernelLog() (io.ReadCloser, error) {
+	return nil, errors.New("no /dev/kmsg on FreeBSD")
+}
+
+func readKernelLogRecord(r io.Reader) (string, error) { return "", io.EOF }
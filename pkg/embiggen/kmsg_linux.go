@@ -0,0 +1,62 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// openKernelLog opens /dev/kmsg, positioned after the messages already
+// logged.
+func openKernelLog() (io.ReadCloser, error) {
+	// Non-blocking, so Go's poller reads it and Close interrupts a read.
+	f, err := os.OpenFile("/dev/kmsg", os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readKernelLogRecord returns the text of the next /dev/kmsg record,
+// which is "priority,seq,usec,flags;text" and one read per record.
+func readKernelLogRecord(r io.Reader) (string, error) {
+	for {
+		buf := make([]byte, 8192)
+		n, err := r.Read(buf)
+		if errors.Is(err, syscall.EPIPE) {
+			continue // messages were overwritten before we read them
+		}
+		if err != nil {
+			return "", err
+		}
+		rec := buf[:n]
+		if i := bytes.IndexByte(rec, '\n'); i >= 0 {
+			rec = rec[:i] // drop the key=value continuation lines
+		}
+		if i := bytes.IndexByte(rec, ';'); i >= 0 {
+			return string(rec[i+1:]), nil
+		}
+	}
+}
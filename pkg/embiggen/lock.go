@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lock files, so a manual run and the daemon don't both rewrite the
+// same partition table at once.
+const (
+	globalLockPath = "/run/embiggen-disk.lock"
+	deviceLockDir  = "/run/embiggen-disk"
+)
+
+// lockPollInterval is how often lockFile tries again for a lock that's
+// held.
+const lockPollInterval = 250 * time.Millisecond
+
+// A Lock is an exclusive flock on a lock file. The kernel drops it
+// if the process dies.
+type Lock struct{ f *os.File }
+
+// lockFile takes an exclusive flock on path, creating it if needed and
+// waiting for whoever holds it, unless ctx is done first.
+func lockFile(ctx context.Context, path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		held, _ := ioutil.ReadFile(path)
+		infof(ctx, "waiting for another embiggen-disk (pid %s) to release %s", held, path)
+		t := time.NewTicker(lockPollInterval)
+		for err == unix.EWOULDBLOCK {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-t.C:
+				err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+			}
+		}
+		t.Stop()
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %v", path, err)
+	}
+	// For the message above, in whoever's next.
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	return &Lock{f}, nil
+}
+
+// Unlock releases l. It's a no-op on a nil Lock.
+func (l *Lock) Unlock() {
+	if l != nil {
+		l.f.Close()
+	}
+}
+
+// LockGlobal takes the lock held by any embiggen-disk while it makes
+// changes. Dry runs change nothing, so they don't lock.
+func LockGlobal(ctx context.Context) (*Lock, error) {
+	if opts(ctx).DryRun {
+		return nil, nil
+	}
+	return lockFile(ctx, globalLockPath)
+}
+
+// lockDevice takes the lock for changes to the block device dev, such
+// as rewriting its partition table.
+func lockDevice(ctx context.Context, dev string) (*Lock, error) {
+	if opts(ctx).DryRun {
+		return nil, nil
+	}
+	if err := os.MkdirAll(deviceLockDir, 0755); err != nil {
+		return nil, err
+	}
+	return lockFile(ctx, filepath.Join(deviceLockDir, filepath.Base(dev)+".lock"))
+}
@@ -0,0 +1,398 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An LVResizer grows an LVM logical volume into free space in its
+// volume group.
+type LVResizer struct {
+	dev string // /dev/mapper/debianvg-root
+	lim Limit
+}
+
+func (r LVResizer) String() string { return fmt.Sprintf("LVM LV %s", r.dev) }
+func (r LVResizer) Layer() string  { return "lvm-lv" }
+func (r LVResizer) Device() string { return r.dev }
+
+type lvState struct {
+	dev        string // 0th element in lvdisplay -c
+	vg         string // 1
+	numSectors int64  // 6
+}
+
+func (r LVResizer) state(ctx context.Context) (s lvState, err error) {
+	s.dev = r.dev
+	if d, err := ProbeDevice(r.dev); err == nil {
+		if vg, _, ok := d.VGLV(); ok {
+			s.vg, s.numSectors = vg, d.Size/512
+			return s, nil
+		}
+	}
+	// # lvdisplay -c /dev/mapper/debvg-root
+	//   /dev/debvg/root:debvg:3:1:-1:1:8434778112:1029636:-1:0:-1:254:0
+	outb, err := output(ctx, command(ctx, "lvdisplay", "-c", s.dev))
+	if err != nil {
+		return s, fmt.Errorf("running lvdisplay -c %s: %w", s.dev, execErr(err))
+	}
+	f := strings.Split(strings.TrimSpace(string(outb)), ":")
+	if len(f) < 13 {
+		return s, fmt.Errorf("too few expected fields in lvdisplay -c %s output: %q", s.dev, outb)
+	}
+	s.vg = f[1]
+	s.numSectors, err = strconv.ParseInt(f[6], 10, 64)
+	if err != nil {
+		return s, fmt.Errorf("bogus field at index 6 in lvdisplay -c %s output: %q: %v", s.dev, outb, err)
+	}
+	return s, nil
+}
+
+// VG returns the name of the LV's volume group, and its size and free
+// space in bytes.
+func (r LVResizer) VG(ctx context.Context) (name string, size, free int64, err error) {
+	lvs, err := r.state(ctx)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	vgs, err := getVGState(ctx, lvs.vg)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return vgs.name, vgs.totalExtents * vgs.extentSize, vgs.freeExtents * vgs.extentSize, nil
+}
+
+func (r LVResizer) DepResizer(ctx context.Context) (Resizer, error) {
+	lvs, err := r.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pv, err := r.pv(ctx, lvs.vg)
+	if err != nil {
+		return nil, err
+	}
+	if addsDisks(ctx, lvs.vg) {
+		vg := VGResizer{lvs.vg, pv, r.lim}
+		if isDisabled(ctx, vg.Layer()) {
+			vlogf(ctx, "leaving %v alone; %s is disabled", vg, vg.Layer())
+			return nil, nil
+		}
+		return vg, nil
+	}
+	if pv == "" {
+		return nil, nil
+	}
+	return pvResizer(ctx, pv, r.lim), nil
+}
+
+// pv returns the device of the LV's PV in vg, or "" if there's none.
+func (r LVResizer) pv(ctx context.Context, vg string) (string, error) {
+	if d, err := ProbeDevice(r.dev); err == nil && len(d.Slaves) > 0 {
+		// TODO: support LVs with more than one PV, as below.
+		return d.Slaves[0], nil
+	}
+
+	out, err := output(ctx, command(ctx, "pvdisplay", "-c"))
+	if err != nil {
+		return "", fmt.Errorf("running pvdisplay -c: %w", execErr(err))
+	}
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	for bs.Scan() {
+		f := strings.Split(strings.TrimSpace(bs.Text()), ":")
+		if len(f) < 2 || f[1] != vg {
+			continue
+		}
+		// TODO: support LVs with more than one PV. But that's
+		// not a problem I have with cloudy things. So skip
+		// for now. Probably change the DepResizer method to
+		// return []Resizer.
+		return f[0], nil
+	}
+	return "", nil
+}
+
+// pvResizer returns the PVResizer for the PV dev, or nil if that layer
+// is disabled.
+func pvResizer(ctx context.Context, dev string, lim Limit) Resizer {
+	pv := PVResizer{dev, lim}
+	if isDisabled(ctx, pv.Layer()) {
+		vlogf(ctx, "leaving %v alone; %s is disabled", pv, pv.Layer())
+		return nil
+	}
+	return pv
+}
+
+func (r LVResizer) State(ctx context.Context) (string, error) {
+	lvs, err := r.state(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sectors=%d", lvs.numSectors), nil
+}
+
+func (r LVResizer) Size(ctx context.Context) (int64, error) {
+	lvs, err := r.state(ctx)
+	return lvs.numSectors * 512, err
+}
+
+// growExtents returns how many extents r's LV may grow by, if the VG
+// had extraFree more bytes free than it does now.
+func (r LVResizer) growExtents(ctx context.Context, extraFree int64) (int64, error) {
+	lvs, err := r.state(ctx)
+	if err != nil {
+		return 0, err
+	}
+	vgs, err := getVGState(ctx, lvs.vg)
+	if err != nil {
+		return 0, err
+	}
+	// Take the -use share of the LV's current size plus the VG
+	// free space, so repeated runs don't keep eating into the
+	// headroom left by the previous one.
+	cur := lvs.numSectors * 512
+	free := vgs.freeExtents*vgs.extentSize + extraFree - r.lim.VGReserve.Of(vgs.totalExtents*vgs.extentSize)
+	if free < 0 {
+		free = 0
+	}
+	avail := r.lim.share(cur+free) - cur
+	grow := r.lim.capBytes(cur, avail) / vgs.extentSize
+	if r.lim.LVMax > 0 {
+		need := (r.lim.LVMax - cur + vgs.extentSize - 1) / vgs.extentSize
+		if need < 0 {
+			need = 0
+		}
+		if need > 0 && need*vgs.extentSize < r.lim.MinGrowth {
+			// Take a MinGrowth step rather than none.
+			need = (r.lim.MinGrowth + vgs.extentSize - 1) / vgs.extentSize
+		}
+		if need < grow {
+			grow = need
+		}
+	}
+	if grow*vgs.extentSize < r.lim.MinGrowth {
+		return 0, nil
+	}
+	return grow, nil
+}
+
+func (r LVResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	lvs, err := r.state(ctx)
+	if err != nil {
+		return 0, err
+	}
+	vgs, err := getVGState(ctx, lvs.vg)
+	if err != nil {
+		return 0, err
+	}
+	grow, err := r.growExtents(ctx, depGrowth)
+	return lvs.numSectors*512 + grow*vgs.extentSize, err
+}
+
+func (r LVResizer) Resize(ctx context.Context) error {
+	lvDev := r.dev
+	arg := "+100%FREE"
+	if r.lim != (Limit{}) {
+		grow, err := r.growExtents(ctx, 0)
+		if err != nil || grow == 0 {
+			return err
+		}
+		arg = fmt.Sprintf("+%d", grow)
+	}
+	if opts(ctx).DryRun {
+		dryRunCommand(ctx, "lvextend", "-l", arg, lvDev)
+		return nil
+	}
+	if err := confirmStep(ctx, "run lvextend -l %s %s", arg, lvDev); err != nil {
+		return err
+	}
+	out, err := runLogged(ctx, command(ctx, "lvextend", "-l", arg, lvDev))
+	if useLVMFallback(ctx, err) {
+		return r.resizeWithFallback(ctx)
+	}
+	if err != nil {
+		if strings.Contains(string(out), "matches existing size") {
+			return nil
+		}
+		var extraMsg string
+		if len(out) > 0 {
+			extraMsg = fmt.Sprintf("; output=%s", out)
+		}
+		return fmt.Errorf("lvextend on %s: %w%s", lvDev, err, extraMsg)
+	}
+	return nil
+}
+
+// resizeWithFallback grows the LV with LVMFallback, by as much as
+// Resize would with lvextend.
+func (r LVResizer) resizeWithFallback(ctx context.Context) error {
+	o := opts(ctx)
+	d, err := ProbeDevice(r.dev)
+	if err != nil {
+		return err
+	}
+	vg, lv, ok := d.VGLV()
+	if !ok {
+		return fmt.Errorf("%s isn't an LVM LV", r.dev)
+	}
+	grow, err := r.growExtents(ctx, 0)
+	if err != nil || grow == 0 {
+		return err
+	}
+	extentSize, _, _, err := o.LVMFallback.VG(ctx, vg)
+	if err != nil {
+		return fallbackErr("lvextend", err)
+	}
+	size := d.Size + grow*extentSize
+	t0 := time.Now()
+	err = o.LVMFallback.ResizeLV(ctx, vg, lv, size)
+	logCommand(ctx, time.Since(t0), "LVMFallback.ResizeLV", vg+"/"+lv, strconv.FormatInt(size, 10))
+	return fallbackErr("lvextend", err)
+}
+
+// A PVResizer grows an LVM physical volume to fill its device.
+type PVResizer struct {
+	dev string // "/dev/sda3" or potentially a whole disk e.g. "/dev/sdb"
+	lim Limit
+}
+
+func (r PVResizer) String() string { return fmt.Sprintf("LVM PV %s", r.dev) }
+func (r PVResizer) Layer() string  { return "lvm-pv" }
+func (r PVResizer) Device() string { return r.dev }
+
+// sectors returns the size of the PV in sectors, as reported by pvdisplay.
+func (r PVResizer) sectors(ctx context.Context) (string, error) {
+	dev := r.dev
+	out, err := output(ctx, command(ctx, "pvdisplay", "-c", dev))
+	if useLVMFallback(ctx, err) {
+		n, err := opts(ctx).LVMFallback.PVSize(ctx, dev)
+		return strconv.FormatInt(n/512, 10), fallbackErr("pvdisplay", err)
+	}
+	if err != nil {
+		return "", execErr(err)
+	}
+	f := strings.Split(strings.TrimSpace(string(out)), ":")
+	if len(f) < 3 {
+		return "", fmt.Errorf("bogus pvdisplay -c %s output: %q", dev, out)
+	}
+	return f[2], nil
+}
+
+func (r PVResizer) State(ctx context.Context) (string, error) {
+	n, err := r.sectors(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sectors=%v", n), nil
+}
+
+func (r PVResizer) Size(ctx context.Context) (int64, error) {
+	v, err := r.sectors(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bogus pvdisplay -c %s size %q: %v", r.dev, v, err)
+	}
+	return n * 512, nil
+}
+
+func (r PVResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	n, err := r.Size(ctx)
+	return n + depGrowth, err
+}
+
+func (r PVResizer) Resize(ctx context.Context) error {
+	o := opts(ctx)
+	dev := r.dev
+	if o.DryRun {
+		dryRunCommand(ctx, "pvresize", dev)
+		return nil
+	}
+	if err := checkWritable(dev); err != nil {
+		return err
+	}
+	if err := confirmStep(ctx, "run pvresize %s", dev); err != nil {
+		return err
+	}
+	out, err := runLogged(ctx, command(ctx, "pvresize", dev))
+	if useLVMFallback(ctx, err) {
+		t0 := time.Now()
+		err = o.LVMFallback.ResizePV(ctx, dev)
+		logCommand(ctx, time.Since(t0), "LVMFallback.ResizePV", dev)
+		return fallbackErr("pvresize", err)
+	}
+	if err != nil {
+		return fmt.Errorf("pvresize %s: %w, %s", dev, err, out)
+	}
+	return nil
+}
+
+func (r PVResizer) DepResizer(ctx context.Context) (Resizer, error) {
+	return depResizer(ctx, r.dev, r.lim, func(context.Context) (Resizer, error) {
+		if devEndsInNumber(r.dev) {
+			return PartitionResizer{r.dev, r.lim}, nil
+		}
+		return nil, nil
+	})
+}
+
+type vgState struct {
+	name         string // 0th element in vgdisplay -c
+	extentSize   int64  // 12, in bytes (vgdisplay reports KiB)
+	totalExtents int64  // 13
+	freeExtents  int64  // 15
+}
+
+func getVGState(ctx context.Context, vg string) (s vgState, err error) {
+	s.name = vg
+	// # vgdisplay -c debvg
+	//   debvg:r/w:772:-1:0:2:2:-1:0:1:1:8438943744:4096:2060289:2060289:0:...
+	outb, err := output(ctx, command(ctx, "vgdisplay", "-c", vg))
+	if useLVMFallback(ctx, err) {
+		s.extentSize, s.totalExtents, s.freeExtents, err = opts(ctx).LVMFallback.VG(ctx, vg)
+		return s, fallbackErr("vgdisplay", err)
+	}
+	if err != nil {
+		return s, fmt.Errorf("running vgdisplay -c %s: %w", vg, execErr(err))
+	}
+	f := strings.Split(strings.TrimSpace(string(outb)), ":")
+	if len(f) < 16 {
+		return s, fmt.Errorf("too few expected fields in vgdisplay -c %s output: %q", vg, outb)
+	}
+	kb, err := strconv.ParseInt(f[12], 10, 64)
+	if err != nil {
+		return s, fmt.Errorf("bogus field at index 12 in vgdisplay -c %s output: %q: %v", vg, outb, err)
+	}
+	s.extentSize = kb << 10
+	s.totalExtents, err = strconv.ParseInt(f[13], 10, 64)
+	if err != nil {
+		return s, fmt.Errorf("bogus field at index 13 in vgdisplay -c %s output: %q: %v", vg, outb, err)
+	}
+	s.freeExtents, err = strconv.ParseInt(f[15], 10, 64)
+	if err != nil {
+		return s, fmt.Errorf("bogus field at index 15 in vgdisplay -c %s output: %q: %v", vg, outb, err)
+	}
+	return s, nil
+}
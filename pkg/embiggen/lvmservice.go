@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// An LVMService does what the LVM commands do, for hosts where they
+// aren't installed, like minimal containers, but a service such as
+// lvmdbusd is there to ask.
+type LVMService interface {
+	// VG returns the extent size in bytes, and the number of extents
+	// and of free extents, of the volume group vg.
+	VG(ctx context.Context, vg string) (extentSize, extents, free int64, err error)
+	// PVSize returns the size in bytes of the PV on dev.
+	PVSize(ctx context.Context, dev string) (int64, error)
+	// ResizeLV grows the LV vg/lv to size bytes.
+	ResizeLV(ctx context.Context, vg, lv string, size int64) error
+	// ResizePV grows the PV on dev to fill it.
+	ResizePV(ctx context.Context, dev string) error
+}
+
+// useLVMFallback reports whether err, from running an LVM command,
+// means to use LVMFallback instead.
+func useLVMFallback(ctx context.Context, err error) bool {
+	var tm ErrToolMissing
+	return opts(ctx).LVMFallback != nil && errors.As(err, &tm)
+}
+
+// fallbackErr returns err, from LVMFallback standing in for tool,
+// saying that tool is missing too.
+func fallbackErr(tool string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w, and %v", ErrToolMissing{Tool: tool}, err)
+}
+
+// RequiredTools returns the external commands r runs, so their absence
+// can be reported before anything is changed.
+func RequiredTools(r Resizer) []string {
+	switch r := r.(type) {
+	case FSResizer:
+		switch r.FS().FSType {
+		case "xfs":
+			return []string{"xfs_growfs", "xfs_info"}
+		case "btrfs":
+			return []string{"btrfs"}
+		}
+		return []string{"resize2fs", "dumpe2fs"}
+	case LVResizer:
+		return []string{"lvdisplay", "vgdisplay", "pvdisplay", "lvextend"}
+	case PVResizer:
+		return []string{"pvdisplay", "pvresize"}
+	case VGResizer:
+		return []string{"blkid", "pvcreate", "vgextend"}
+	case PartitionResizer:
+		return []string{"sfdisk", "blkid"}
+	}
+	return nil
+}
+
+// checkTools returns an ErrToolMissing for the first command missing
+// for any layer of e's chain, naming the layer that needs it, so a
+// resize doesn't stop halfway for want of a tool. LVM commands aren't
+// needed if there's an LVMFallback, except to add disks to a VG.
+func checkTools(ctx context.Context, e Resizer) error {
+	chain, err := Chain(ctx, e)
+	if err != nil {
+		return nil // resize reports it
+	}
+	for _, r := range chain {
+		switch r.(type) {
+		case LVResizer, PVResizer:
+			if opts(ctx).LVMFallback != nil {
+				continue
+			}
+		}
+		for _, tool := range RequiredTools(r) {
+			if _, err := LookTool(ctx, tool); err != nil {
+				return fmt.Errorf("%v needs %w", r, ErrToolMissing{Tool: tool})
+			}
+		}
+	}
+	return nil
+}
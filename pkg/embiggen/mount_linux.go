@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountEntry returns the device and filesystem type mounted at mnt,
+// from the mount table, and the mount to resize it through: mnt, or if
+// that's a bind mount or btrfs subvolume, the mount of the whole
+// filesystem; see realMount.
+func mountEntry(ctx context.Context, mnt string, st *unix.Statfs_t) (real, dev, fstype string, err error) {
+	ms, err := mountTable()
+	if err != nil {
+		return "", "", "", err
+	}
+	m, ok := realMount(ctx, ms, mnt)
+	if !ok {
+		return "", "", "", errors.New("mount point not found")
+	}
+	if m.FSType == "overlay" {
+		upper := overlayUpperDir(m.Opts)
+		if upper == "" {
+			return "", "", "", Unsupportedf("%s is an overlay filesystem with no writable upper directory", mnt)
+		}
+		if m, ok = coveringMount(ms, upper); !ok {
+			return "", "", "", fmt.Errorf("no mount holds %s, the upper directory of the overlay filesystem at %s", upper, mnt)
+		}
+		vlogf(ctx, "%s is an overlay filesystem whose upper directory %s is on %s; resizing that", mnt, upper, m.Mnt)
+		if m, ok = realMount(ctx, ms, m.Mnt); !ok {
+			return "", "", "", errors.New("mount point not found")
+		}
+	} else if m.Mnt != mnt {
+		vlogf(ctx, "%s is %s of %s mounted at %s; resizing that", mnt, describeRoot(m.FSType, m.Root), m.Source, m.Mnt)
+	}
+	if dev, err = mountDev(m); err != nil {
+		return "", "", "", fmt.Errorf("failed to map %s to real device: %v", m.Source, err)
+	}
+	return m.Mnt, dev, m.FSType, nil
+}
+
+// realMount returns the entry in ms for the filesystem visible at mnt.
+// If that mounts a directory of the filesystem rather than its root, as
+// a bind mount or btrfs subvolume mount does, it returns the entry
+// mounting the whole filesystem instead, if there is one, with Root set
+// to the directory mnt shows.
+func realMount(ctx context.Context, ms []mountInfo, mnt string) (mountInfo, bool) {
+	// The last mount on mnt is the one that's visible.
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		if m.Mnt != mnt {
+			continue
+		}
+		if m.Root == "/" || m.Root == "" {
+			return m, true
+		}
+		for _, w := range ms {
+			if w.MajMin == m.MajMin && w.Root == "/" && w.FSType == m.FSType {
+				w.Root = m.Root
+				return w, true
+			}
+		}
+		vlogf(ctx, "%s is %s of %s, whose root isn't mounted", mnt, describeRoot(m.FSType, m.Root), m.Source)
+		return m, true
+	}
+	return mountInfo{}, false
+}
+
+// overlayUpperDir returns the upperdir option of an overlay
+// filesystem's options, or "" if it has none, as a read-only overlay
+// doesn't.
+func overlayUpperDir(opts string) string {
+	for _, o := range strings.Split(opts, ",") {
+		if strings.HasPrefix(o, "upperdir=") {
+			return strings.TrimPrefix(o, "upperdir=")
+		}
+	}
+	return ""
+}
+
+// coveringMount returns the visible mount in ms that holds path: the
+// last of those with the longest mount point that's path or a parent
+// of it.
+func coveringMount(ms []mountInfo, path string) (mountInfo, bool) {
+	var best mountInfo
+	found := false
+	for _, m := range ms {
+		if m.Mnt != path && m.Mnt != "/" && !strings.HasPrefix(path, m.Mnt+"/") {
+			continue
+		}
+		if !found || len(m.Mnt) >= len(best.Mnt) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// describeRoot describes a mount of directory root of a filesystem of
+// type fstype.
+func describeRoot(fstype, root string) string {
+	if fstype == "btrfs" {
+		return fmt.Sprintf("btrfs subvolume %s", root)
+	}
+	return fmt.Sprintf("a bind mount of %s", root)
+}
+
+// platformResizer returns nil: Linux filesystems are handled by
+// FSResizer.
+func platformResizer(fs FSStat, lim Limit) Resizer { return nil }
+
+// ReadOnly reports whether the filesystem is mounted read-only.
+func (fs FSStat) ReadOnly() bool { return fs.Statfs.Flags&unix.ST_RDONLY != 0 }
+
+// remountArgs returns the command to remount mnt read-write.
+func remountArgs(mnt string) []string { return []string{"mount", "-o", "remount,rw", mnt} }
+
+// freezeArgs returns the command to freeze mnt, or thaw it.
+func freezeArgs(mnt string, freeze bool) []string {
+	if freeze {
+		return []string{"fsfreeze", "--freeze", mnt}
+	}
+	return []string{"fsfreeze", "--unfreeze", mnt}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Options configure how the package resizes: whether it changes
+// anything, what it logs, the callbacks it makes and the limits it
+// keeps to. They're passed in the context, with WithOptions, to
+// FileSystemResizer, Resize and the other functions and methods that
+// take one, so that each caller in a process can have its own.
+//
+// Start from DefaultOptions: the zero Options doesn't retry, time out
+// commands or watch the kernel log.
+type Options struct {
+	// DryRun makes Resizers print what they would do, with DryRunf,
+	// instead of doing it.
+	DryRun bool
+
+	// Verbose makes Resizers log details such as partition tables, at
+	// LevelDebug through Logf.
+	Verbose bool
+
+	// Logf, if non-nil, is passed the package's log messages.
+	Logf func(level Level, format string, args ...interface{})
+
+	// DryRunf prints a DryRun message. If nil, it's printed to stdout.
+	DryRunf func(format string, args ...interface{})
+
+	// Confirm, if non-nil, is asked before each change, which it
+	// describes like "run pvresize /dev/sda3". An error cancels the
+	// change and is returned from Resize.
+	Confirm func(step string) error
+
+	// Lease, if non-nil, is called before rewriting the partition
+	// table of disk, which may be shared with other hosts. release, if
+	// non-nil, is called when it's done.
+	Lease func(ctx context.Context, disk string) (release func() error, err error)
+
+	// BeforeRewrite, if non-nil, is called just before the partition
+	// table of disk is rewritten to grow a partition, once Confirm has
+	// approved it. An error leaves the table alone and is returned from
+	// Resize.
+	BeforeRewrite func(ctx context.Context, disk string) error
+
+	// StartSpan, if non-nil, is called as each resize step and command
+	// starts, with attributes as key, value pairs. finish, if non-nil,
+	// is called with its result.
+	StartSpan func(name string, kv ...string) (finish func(error))
+
+	// Interrupt, if non-nil, is called between layers. If it returns an
+	// error, Resize stops and returns it. Unlike cancelling Resize's
+	// context, it never stops a step midway.
+	Interrupt func() error
+
+	// VolumeID, if non-nil, returns the ID of the cloud volume that dev
+	// is on, for Change.VolumeID.
+	VolumeID func(dev string) string
+
+	// Freeze makes Resize freeze the filesystem with fsfreeze while
+	// the partition table under it is rewritten, for workloads that
+	// need a crash-consistent window. Linux-only.
+	Freeze bool
+
+	// Quiesce, if non-nil, is called before the partition table under
+	// mount point mnt is rewritten, for applications to quiesce, and
+	// resume, if non-nil, after. It should stop when ctx is done, and
+	// resume should return within FreezeTimeout.
+	Quiesce func(ctx context.Context, mnt string) (resume func() error, err error)
+
+	// FreezeTimeout bounds how long a filesystem stays frozen or an
+	// application quiesced. It's thawed then even if the step isn't
+	// done, so a stuck step can't hang everything writing to it. 0
+	// means the default, 30s.
+	FreezeTimeout time.Duration
+
+	// HealthCheck makes Resize check a filesystem for signs of
+	// corruption before growing it, and refuse to if it finds any,
+	// since growing a damaged filesystem can make recovering it harder.
+	HealthCheck bool
+
+	// WatchKernelLog makes Resize watch the kernel log while it runs,
+	// and stop before its next step if the kernel logs an I/O or
+	// filesystem error on a device being resized. The step in progress
+	// is left to finish, as killing it could leave a half-written
+	// partition table. The error is also recorded in the Change of the
+	// step that was running. It's Linux-only.
+	WatchKernelLog bool
+
+	// RemountRW makes Resize remount a read-only filesystem read-write
+	// before growing it, when that looks safe: the kernel found no
+	// errors on it and /etc/fstab doesn't mount it read-only, as with a
+	// root filesystem still read-only early in boot. Otherwise a
+	// read-only filesystem isn't grown.
+	RemountRW bool
+
+	// Retries is how many times a step that fails transiently, such
+	// as on a busy device or LVM lock, is retried.
+	Retries int
+
+	// RetryWait is how long to wait before the first retry. It
+	// doubles with each one.
+	RetryWait time.Duration
+
+	// CommandTimeout is how long an external command may run before
+	// it's taken to be hung and killed. Growing a huge ext4
+	// filesystem can take minutes. 0 means no limit.
+	CommandTimeout time.Duration
+
+	// CommandTimeouts overrides CommandTimeout for particular tools,
+	// by command name, like "resize2fs".
+	CommandTimeouts map[string]time.Duration
+
+	// Snapshot makes FSResizer take an LVM snapshot of a filesystem's
+	// LV before growing it, when the VG has SnapshotSize free, so a
+	// failed grow can be rolled back with lvconvert --merge.
+	Snapshot bool
+
+	// SnapshotSize is the copy-on-write space given to a Snapshot.
+	SnapshotSize int64
+
+	// SnapshotKeep is how long a Snapshot of a filesystem that grew
+	// fine is kept, to check it, before RemoveExpiredSnapshots removes
+	// it. A snapshot of one that failed to grow is kept until removed
+	// by hand.
+	SnapshotKeep time.Duration
+
+	// ToolPaths maps external commands, like "resize2fs", to the
+	// programs to run for them, in place of searching for them.
+	ToolPaths map[string]string
+
+	// ToolDirs, if non-empty, are the only directories searched for
+	// external commands not in ToolPaths, instead of $PATH. They're
+	// also the commands' own $PATH.
+	ToolDirs []string
+
+	// LVMFallback, if non-nil, is used for LVM layers when the LVM
+	// commands they'd run are missing.
+	LVMFallback LVMService
+
+	// AddDisksTo names the LVM volume groups that blank disks are
+	// added to, as new PVs, before growing an LV in them. It's off for
+	// every VG by default, as it claims any disk with no partition
+	// table, filesystem or other signature on it.
+	AddDisksTo []string
+
+	// Disable turns off the named detectors or built-in layers, like
+	// "partition" or "lvm-lv". A disabled layer, and everything under
+	// it, is left alone; a disabled filesystem isn't supported at all.
+	// CheckLayers checks the names.
+	Disable []string
+}
+
+// defaultFreezeTimeout is the FreezeTimeout if it's 0.
+const defaultFreezeTimeout = 30 * time.Second
+
+// DefaultOptions returns the Options used for a context without any.
+func DefaultOptions() *Options {
+	return &Options{
+		FreezeTimeout:  defaultFreezeTimeout,
+		WatchKernelLog: true,
+		Retries:        3,
+		RetryWait:      time.Second,
+		CommandTimeout: 10 * time.Minute,
+		SnapshotSize:   1 << 30,
+		SnapshotKeep:   time.Hour,
+	}
+}
+
+// defaults are the Options of a context without any. They're never
+// changed.
+var defaults = DefaultOptions()
+
+type optionsKey struct{}
+
+// WithOptions returns a copy of ctx that carries o. o shouldn't be
+// changed while it's in use.
+func WithOptions(ctx context.Context, o *Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, o)
+}
+
+// OptionsFrom returns a copy of the Options ctx carries, or of the
+// defaults, for callbacks and for deriving a context with different
+// ones.
+func OptionsFrom(ctx context.Context) Options {
+	return *opts(ctx)
+}
+
+// opts returns the Options ctx carries, or the defaults.
+func opts(ctx context.Context) *Options {
+	if o, ok := ctx.Value(optionsKey{}).(*Options); ok && o != nil {
+		return o
+	}
+	return defaults
+}
+
+// freezeTimeout returns o's FreezeTimeout, or the default if it's 0.
+func (o *Options) freezeTimeout() time.Duration {
+	if o.FreezeTimeout <= 0 {
+		return defaultFreezeTimeout
+	}
+	return o.FreezeTimeout
+}
+
+// dryRunf prints a DryRun message with the DryRunf of ctx's Options.
+func dryRunf(ctx context.Context, format string, args ...interface{}) {
+	if f := opts(ctx).DryRunf; f != nil {
+		f(format, args...)
+		return
+	}
+	fmt.Printf("[dry-run] "+format+"\n", args...)
+}
@@ -0,0 +1,593 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	lvmGPTTypeID       = "E6D6D379-F507-44C2-A23C-238F2A3DF928"
+	rootx8664GPTTypeID = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+	linuxGPTTypeID     = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+)
+
+// A PartitionResizer grows a partition into free space after it on its
+// disk.
+type PartitionResizer struct {
+	dev string // "/dev/sda3"
+	lim Limit
+}
+
+// DiskDev maps "/dev/sda3" to "/dev/sda". It returns an error if
+// partDev isn't a partition device it recognizes.
+func DiskDev(partDev string) (string, error) {
+	if !strings.HasPrefix(partDev, "/dev/") {
+		return "", fmt.Errorf("bogus partition dev %q", partDev)
+	}
+	if d, err := ProbeDevice(partDev); err == nil && d.Disk != "" {
+		return d.Disk, nil
+	}
+	if strings.HasPrefix(partDev, "/dev/sd") || strings.HasPrefix(partDev, "/dev/vd") {
+		return strings.TrimRight(partDev, "0123456789"), nil
+	}
+	if strings.HasPrefix(partDev, "/dev/mmcblk") {
+		v := strings.TrimRight(partDev, "0123456789")
+		v = strings.TrimSuffix(v, "p")
+		return v, nil
+	}
+	if strings.HasPrefix(partDev, "/dev/nvme") {
+		chopP := regexp.MustCompile(`p\d+$`)
+		if !chopP.MatchString(partDev) {
+			return "", fmt.Errorf("partition %q doesn't look like an nvme partition", partDev)
+		}
+		return chopP.ReplaceAllString(partDev, ""), nil
+	}
+	return "", Unsupportedf("can't tell which disk partition %q is on", partDev)
+}
+
+func (p PartitionResizer) String() string { return fmt.Sprintf("partition %s", p.dev) }
+func (p PartitionResizer) Layer() string  { return "partition" }
+func (p PartitionResizer) Device() string { return p.dev }
+
+func (p PartitionResizer) State(ctx context.Context) (string, error) {
+	n, err := readInt64File(fmt.Sprintf("/sys/class/block/%s/size", filepath.Base(p.dev)))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d sectors", n), nil
+}
+
+func (p PartitionResizer) Size(ctx context.Context) (int64, error) {
+	n, err := readInt64File(fmt.Sprintf("/sys/class/block/%s/size", filepath.Base(p.dev)))
+	return n * 512, err
+}
+
+func (p PartitionResizer) DepResizer(ctx context.Context) (Resizer, error) { return nil, nil }
+
+// A partGrowth is how a PartitionResizer would grow its partition.
+type partGrowth struct {
+	diskDev string
+	pt      *partitionTable
+	part    sfdiskLine
+	extend  int64 // sectors to grow by; 0 for none
+}
+
+// growth works out how far p's partition can grow, without changing
+// anything.
+func (p PartitionResizer) growth(ctx context.Context) (g partGrowth, err error) {
+	partDev := p.dev
+	diskDev, err := DiskDev(partDev)
+	if err != nil {
+		return g, err
+	}
+	g.diskDev = diskDev
+	vlogf(ctx, "Getting partition table for %q ...", diskDev)
+	pt, err := getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return g, err
+	}
+	g.pt = pt
+	if len(pt.parts) == 0 {
+		return g, Unsupportedf("device %q has no partitions", diskDev)
+	}
+	vlogf(ctx, "Device %q has %d partitions.", diskDev, len(pt.parts))
+	var isGPT bool
+	switch t := pt.Meta("label"); t {
+	case "dos":
+	case "gpt":
+		isGPT = true
+	case "":
+		// Old version of sfdisk? See https://github.com/google/embiggen-disk/issues/6
+		// Use blkid to figure out what it is.
+		// But only trust the value "dos", because if it's gpt and sfdisk
+		// is old and doesn't support gpt, we don't want to use that old sfdisk
+		// to manipulate the gpt tables.
+		out, err := output(ctx, command(ctx, "blkid", "-o", "export", diskDev))
+		if err != nil {
+			return g, fmt.Errorf("error running blkid: %w", execErr(err))
+		}
+		m := regexp.MustCompile(`(?m)^PTTYPE=(.+)\n`).FindSubmatch(out)
+		if m == nil {
+			return g, fmt.Errorf("`blkid -o export %s` lacked PTTYPE line, got: %s", diskDev, out)
+		}
+		if got := string(m[1]); got != "dos" {
+			return g, Unsupportedf("Old sfdisk and `blkid -o export %s` reports unexpected PTTYPE=%s", diskDev, got)
+		}
+	default:
+		// It might work, but fail as a precaution. Untested.
+		return g, Unsupportedf("unsupported partition table type %q on %s", t, diskDev)
+	}
+
+	part, ok := pt.partition(partDev)
+	if !ok {
+		return g, fmt.Errorf("partition %s not found on %s", partDev, diskDev)
+	}
+	if last, ok := pt.lastNonZeroPartition(); ok && last.Start() > part.Start() {
+		return g, Unsupportedf("can't grow %s: %w; %s follows it", partDev, ErrNotLastPartition, last.dev)
+	}
+	g.part = part
+	lastType := part.Type()
+
+	if isGPT {
+		switch lastType {
+		case lvmGPTTypeID, rootx8664GPTTypeID, linuxGPTTypeID:
+		default:
+			return g, Unsupportedf("unknown GPT partition type %q for %s", lastType, part.dev)
+		}
+	} else {
+		switch lastType {
+		case "83":
+		default:
+			return g, Unsupportedf("unknown MBR partition type %q for %s", lastType, part.dev)
+		}
+	}
+
+	if opts(ctx).Verbose {
+		var cur bytes.Buffer
+		pt.Write(&cur)
+		vlogf(ctx, "Current partition table:\n%s", cur.Bytes())
+	}
+
+	size, err := readInt64File("/sys/block/" + filepath.Base(diskDev) + "/size")
+	if err != nil {
+		return g, err
+	}
+	end := part.Start() + part.Size()
+	remain := size - end
+	if opts(ctx).Verbose {
+		vlogf(ctx, "Cur size: %d; part start: %d, size: %d, end: %d; remaining after final partition: %d",
+			size, part.Start(), part.Size(), end, remain)
+	}
+	sectorSize := 512 // TODO: get from /sys/block/sda/queue/hw_sector_size
+	endReserve := (int64(1<<20) + p.lim.Reserve) / int64(sectorSize)
+	if remain <= endReserve {
+		// partition at max size; no need to extend
+		return g, nil
+	}
+
+	avail := remain - endReserve
+	if p.lim.Use != 0 {
+		// Only let the partition end within the -use share of the disk.
+		if n := p.lim.share(size*512)/512 - end; n < avail {
+			avail = n
+		}
+	}
+	extend := p.lim.capBytes(part.Size()*512, avail*512) / 512
+	if extend <= 0 {
+		// partition already at the requested size
+		return g, nil
+	}
+	if extend*512 < p.lim.MinGrowth {
+		vlogf(ctx, "Partition %s could grow by only %d sectors; below -min-growth, skipping.", partDev, extend)
+		return g, nil
+	}
+	g.extend = extend
+	return g, nil
+}
+
+func (p PartitionResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	g, err := p.growth(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return (g.part.Size() + g.extend) * 512, nil
+}
+
+func (p PartitionResizer) Resize(ctx context.Context) error {
+	o := opts(ctx)
+	vlogf(ctx, "Resizing partition %q ...", p.dev)
+	disk, err := DiskDev(p.dev)
+	if err != nil {
+		return err
+	}
+	lk, err := lockDevice(ctx, disk)
+	if err != nil {
+		return err
+	}
+	defer lk.Unlock()
+	if o.Lease != nil && !o.DryRun {
+		release, err := o.Lease(ctx, disk)
+		if err != nil {
+			return err
+		}
+		if release != nil {
+			defer func() {
+				if err := release(); err != nil {
+					warnf(ctx, "releasing the lease for %s: %v", disk, err)
+				}
+			}()
+		}
+	}
+	g, err := p.growth(ctx)
+	if err != nil {
+		return err
+	}
+	if g.extend == 0 {
+		// The table may already be grown, by another host sharing
+		// the disk or a run that died before telling the kernel.
+		if cur, err := p.Size(ctx); err == nil && !o.DryRun && cur < g.part.Size()*512 {
+			infof(ctx, "partition table of %s already grows %s; telling the kernel", g.diskDev, p.dev)
+			t0 := time.Now()
+			err = retry(ctx, "BLKPG_RESIZE_PARTITION "+g.part.dev, func() error {
+				return updateKernelPartition(g.diskDev, g.part)
+			})
+			logCommand(ctx, time.Since(t0), "ioctl", "BLKPG_RESIZE_PARTITION", g.part.dev)
+			return err
+		}
+		return nil
+	}
+	diskDev, pt, part, extend := g.diskDev, g.pt, g.part, g.extend
+	if err := checkWritable(diskDev); err != nil {
+		return err
+	}
+	partDev := part.dev
+	if err := part.SetSize(part.Size() + extend); err != nil {
+		return err
+	}
+	pt.RemoveMeta("last-lba") // or sfdisk complains
+
+	var newPart bytes.Buffer
+	pt.Write(&newPart)
+	if o.Verbose {
+		vlogf(ctx, "Need to extend disk by %d sectors (%d bytes, %0.03f GiB); new partition table to write:\n%s",
+			extend, extend*512, float64(extend)*512/(1<<30), newPart.Bytes())
+	}
+
+	cmd := command(ctx, "sfdisk", "-f", "--no-reread", "--no-tell-kernel", diskDev)
+	if o.DryRun {
+		dryRunCommand(ctx, cmd.Args...)
+		dryRunf(ctx, "with this sfdisk script on stdin:\n%s", newPart.Bytes())
+		dryRunf(ctx, "would've told the kernel with ioctl(%s, BLKPG_RESIZE_PARTITION, {pno: %d, start: %d, length: %d})",
+			diskDev, part.pno, part.Start()*512, part.Size()*512)
+		return nil
+	}
+
+	if err := confirmStep(ctx, "rewrite the partition table of %s, growing %s by %s", diskDev, partDev, HumanSize(extend*512)); err != nil {
+		return err
+	}
+	if o.BeforeRewrite != nil {
+		if err := o.BeforeRewrite(ctx, diskDev); err != nil {
+			return err
+		}
+	}
+	vlogf(ctx, "Setting new partition table...")
+	var outBuf syncBuffer
+	finish := startSpan(ctx, "sfdisk", "command", strings.Join(cmd.Args, " "))
+	t0 := time.Now()
+	err = retry(ctx, "sfdisk "+diskDev, func() error {
+		c := cloneCmd(cmd)
+		c.Stdin = bytes.NewReader(newPart.Bytes())
+		outBuf = syncBuffer{}
+		c.Stdout = &outBuf
+		c.Stderr = &outBuf
+		if err := run(ctx, c); err != nil {
+			return toolErr(err, outBuf.Bytes())
+		}
+		return nil
+	})
+	if o.Verbose {
+		vlogf(ctx, "sfdisk output:\n%s", outBuf.Bytes())
+	}
+	logCommand(ctx, time.Since(t0), cmd.Args...)
+	finish(err)
+	if err != nil {
+		return fmt.Errorf("sfdisk: %w: %s", err, outBuf.Bytes())
+	}
+
+	// Tell the kernel.
+	finish = startSpan(ctx, "rescan", "device", diskDev, "partition", part.dev)
+	t0 = time.Now()
+	err = retry(ctx, "BLKPG_RESIZE_PARTITION "+part.dev, func() error {
+		return updateKernelPartition(diskDev, part)
+	})
+	logCommand(ctx, time.Since(t0), "ioctl", "BLKPG_RESIZE_PARTITION", part.dev)
+	finish(err)
+	if err != nil {
+		return fmt.Errorf("updating kernel of %s partition change: %v", partDev, err)
+	}
+	return nil
+}
+
+type partitionTable struct {
+	meta  []string // without newlines
+	parts []sfdiskLine
+}
+
+func (pt *partitionTable) Meta(k string) string {
+	for _, row := range pt.meta {
+		if strings.HasPrefix(row, k) &&
+			strings.HasPrefix(row, k+":") {
+			return strings.TrimSpace(row[len(k)+1:])
+		}
+	}
+	return ""
+}
+
+func (pt *partitionTable) RemoveMeta(key string) {
+	var newMeta []string
+	for _, meta := range pt.meta {
+		if strings.HasPrefix(meta, key) &&
+			strings.HasPrefix(meta, key+": ") {
+			continue
+		}
+		newMeta = append(newMeta, meta)
+	}
+	pt.meta = newMeta
+}
+
+func (pt *partitionTable) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, meta := range pt.meta {
+		buf.WriteString(meta)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	for _, part := range pt.parts {
+		buf.WriteString(part.String())
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// partition returns the line for partition dev.
+func (pt *partitionTable) partition(dev string) (part sfdiskLine, ok bool) {
+	for _, part := range pt.parts {
+		if part.dev == dev {
+			return part, true
+		}
+	}
+	return
+}
+
+func (pt *partitionTable) lastNonZeroPartition() (part sfdiskLine, ok bool) {
+	for i := len(pt.parts) - 1; i >= 0; i-- {
+		part = pt.parts[i]
+		if part.Type() == "0" && part.Start() == 0 && part.Size() == 0 {
+			// Skip useless partitions.
+			// See https://github.com/google/embiggen-disk/issues/6#issuecomment-429055087
+			continue
+		}
+		return part, true
+	}
+	return
+}
+
+type sfdiskLine struct {
+	dev  string   // "/dev/sda1"
+	attr []string // key=value or key ("type=83", "bootable", "size=497664")
+	pno  int      //partition number
+}
+
+func (sl sfdiskLine) String() string {
+	return fmt.Sprintf("%s : %s", sl.dev, strings.Join(sl.attr, ", "))
+}
+
+func (sl sfdiskLine) Attr(key string) string {
+	for _, attr := range sl.attr {
+		if key == attr {
+			return key // Attr("bootable") == "bootable", not "true" or empty string
+		}
+		if strings.HasPrefix(attr, key) &&
+			strings.HasPrefix(attr, key+"=") {
+			return strings.TrimSpace(attr[len(key)+1:])
+		}
+	}
+	return ""
+}
+
+func (sl sfdiskLine) SetSize(size int64) error {
+	for i, attr := range sl.attr {
+		if strings.HasPrefix(attr, "size=") {
+			sl.attr[i] = fmt.Sprintf("size=%d", size)
+			return nil
+		}
+	}
+	return fmt.Errorf("sfdisk line for %s has no size attribute", sl.dev)
+}
+
+func (sl sfdiskLine) AttrInt64(key string) (int64, error) {
+	v := sl.Attr(key)
+	if v == "" {
+		return 0, fmt.Errorf("device %q has no attribute %q", sl.dev, key)
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("device %q attribute %q is non-integer: %q", sl.dev, key, v)
+	}
+	return n, nil
+}
+
+func (sl sfdiskLine) Type() string {
+	// sfdisk from util-linux 2.29.2 on Debian under Proxmox/Qemu reports type:
+	v := sl.Attr("type")
+	if v != "" {
+		return v
+	}
+	// But sfdisk from util-linux 2.23.2 on CentOS 7.5 on Azure uses "Id":
+	return sl.Attr("Id")
+}
+
+// Start returns the partition's first sector. parsePartitionTable
+// checks that it's there.
+func (sl sfdiskLine) Start() int64 {
+	n, _ := sl.AttrInt64("start")
+	return n
+}
+
+// Size returns the partition's size in sectors. parsePartitionTable
+// checks that it's there.
+func (sl sfdiskLine) Size() int64 {
+	n, _ := sl.AttrInt64("size")
+	return n
+}
+
+func getPartitionTable(ctx context.Context, dev string) (*partitionTable, error) {
+	out, err := output(ctx, command(ctx, "sfdisk", "-d", dev))
+	if err != nil {
+		return nil, fmt.Errorf("running sfdisk -d %s: %w", dev, execErr(err))
+	}
+	pt, err := parsePartitionTable(out)
+	if err != nil {
+		return nil, fmt.Errorf("sfdisk -d %s: %w", dev, err)
+	}
+	return pt, nil
+}
+
+// parsePartitionTable parses the output of sfdisk -d.
+func parsePartitionTable(out []byte) (*partitionTable, error) {
+	pt := new(partitionTable)
+	lines := strings.Split(string(out), "\n")
+	var pno int
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			if pt.parts == nil {
+				pt.parts = make([]sfdiskLine, 0)
+			}
+			continue
+		}
+		if pt.parts == nil {
+			pt.meta = append(pt.meta, line)
+		} else {
+			f := strings.SplitN(string(line), ":", 2)
+			if len(f) < 2 {
+				return nil, Unsupportedf("unsupported sfdisk line %q", line)
+			}
+			dev := strings.TrimSpace(f[0])
+			rest := strings.TrimSpace(f[1])
+			pno++
+			part := sfdiskLine{dev: dev, pno: pno}
+			for _, attr := range strings.Split(rest, ",") {
+				attr = strings.TrimSpace(attr)
+				attr = eqRx.ReplaceAllString(attr, "=")
+				part.attr = append(part.attr, attr)
+			}
+			for _, key := range []string{"start", "size"} {
+				if _, err := part.AttrInt64(key); err != nil {
+					return nil, Unsupportedf("unsupported sfdisk line %q: %v", line, err)
+				}
+			}
+			pt.parts = append(pt.parts, part)
+		}
+	}
+	return pt, nil
+}
+
+var eqRx = regexp.MustCompile(`\s*=\s*`)
+
+// checkWritable returns an error wrapping ErrReadOnly if the kernel
+// has block device dev marked read-only.
+func checkWritable(dev string) error {
+	if ro, err := readInt64File("/sys/class/block/" + filepath.Base(dev) + "/ro"); err == nil && ro == 1 {
+		return fmt.Errorf("%w: block device %s", ErrReadOnly, dev)
+	}
+	return nil
+}
+
+func readInt64File(f string) (int64, error) {
+	x, err := ioutil.ReadFile(f)
+	if err != nil {
+		return 0, err
+	}
+	x = bytes.TrimSpace(x)
+	n, err := strconv.ParseInt(string(x), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// BlockDevSize returns the size in bytes of the block device dev,
+// such as "/dev/sda1" or "/dev/mapper/debvg-root".
+func BlockDevSize(dev string) (int64, error) {
+	real, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return 0, err
+	}
+	// Always in 512 byte units, regardless of the device's sector size.
+	n, err := readInt64File("/sys/class/block/" + filepath.Base(real) + "/size")
+	if err != nil {
+		return 0, err
+	}
+	return n * 512, nil
+}
+
+func devEndsInNumber(d string) bool {
+	return len(d) > 0 && unicode.IsNumber(rune(d[len(d)-1]))
+}
+
+/*
+
+Notes on sfdisk output:
+
+can be GPT:
+
+label: gpt
+label-id: 841DBE6B-6A8D-43E1-93E1-D765373DDE3B
+device: /dev/sda
+unit: sectors
+first-lba: 34
+last-lba: 10485726
+
+/dev/sda1 : start=        2048, size=      192512, type=21686148-6449-6E6F-744E-656564454649, uuid=D7F261B7-9D9A-4864-AB85-A68ED9CD7CF0
+/dev/sda2 : start=      194560, size=      391168, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, uuid=B3EB025F-F682-4FE4-8F97-96974ADFD3BF
+/dev/sda3 : start=      585728, size=     9897984, type=E6D6D379-F507-44C2-A23C-238F2A3DF928, uuid=654CE2C8-5871-4DBE-A829-F3C4D953BBB9
+
+or MBR:
+
+label: dos
+label-id: 0xeba7536a
+device: /dev/sda
+unit: sectors
+
+/dev/sda1 : start=        2048, size=      497664, type=83, bootable
+/dev/sda2 : start=      501758, size=   209211394, type=5
+/dev/sda5 : start=      501760, size=   209211392, type=83
+
+*/
@@ -0,0 +1,25 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import "errors"
+
+// updateKernelPartition isn't needed on FreeBSD, where gpart resizes
+// partitions through GEOM, and sfdisk isn't used.
+func updateKernelPartition(diskDev string, part sfdiskLine) error {
+	return errors.New("BLKPG is Linux-only")
+}
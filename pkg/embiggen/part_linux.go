@@ -0,0 +1,48 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// updateKernelPartition tells the kernel part of diskDev has a new
+// size, with BLKPG_RESIZE_PARTITION, as the disk is in use.
+func updateKernelPartition(diskDev string, part sfdiskLine) error {
+	devf, err := os.Open(diskDev)
+	if err != nil {
+		return err
+	}
+	defer devf.Close()
+	arg := &unix.BlkpgIoctlArg{
+		Op: unix.BLKPG_RESIZE_PARTITION,
+		Data: (*byte)(unsafe.Pointer(&unix.BlkpgPartition{
+			Start:  part.Start() * 512,
+			Length: part.Size() * 512,
+			Pno:    int32(part.pno),
+		})),
+	}
+
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(devf.Fd()), unix.BLKPG, uintptr(unsafe.Pointer(arg))); e != 0 {
+		return syscall.Errno(e)
+	}
+	return nil
+}
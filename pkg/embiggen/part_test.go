@@ -0,0 +1,58 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePartitionTable(t *testing.T) {
+	const dump = `label: dos
+label-id: 0x2e5a4b1c
+device: /dev/sda
+unit: sectors
+
+/dev/sda1 : start=        2048, size=    20969472, type=83, bootable
+`
+	pt, err := parsePartitionTable([]byte(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, ok := pt.partition("/dev/sda1")
+	if !ok || part.Start() != 2048 || part.Size() != 20969472 {
+		t.Fatalf("partition /dev/sda1 = %v, %v; want start 2048, size 20969472", part, ok)
+	}
+	if err := part.SetSize(41940992); err != nil || part.Size() != 41940992 {
+		t.Errorf("SetSize(41940992) = %v, leaving size %d", err, part.Size())
+	}
+
+	for _, line := range []string{
+		"/dev/sda1 : start=2048, type=83",
+		"/dev/sda1 : start=2048, size=lots, type=83",
+		"/dev/sda1 : size=20969472, type=83",
+	} {
+		_, err := parsePartitionTable([]byte("label: dos\n\n" + line + "\n"))
+		var ue UnsupportedError
+		if !errors.As(err, &ue) {
+			t.Errorf("parsing %q = %v; want an UnsupportedError", line, err)
+		}
+	}
+	if err := (sfdiskLine{dev: "/dev/sda1", attr: []string{"start=2048"}}).SetSize(1); err == nil {
+		t.Error("SetSize on a line without a size succeeded; want error")
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// CheckPrivileges returns an error wrapping ErrPermission, naming what's
+// missing, if the process lacks a privilege that a layer of e's chain
+// needs to grow, or can't open a device it writes to read-write. Resize
+// checks this before changing anything.
+func CheckPrivileges(ctx context.Context, e Resizer) error {
+	chain, err := Chain(ctx, e)
+	if err != nil {
+		return nil // Resize reports it
+	}
+	for _, r := range chain {
+		if err := checkCapabilities(r); err != nil {
+			return err
+		}
+		for _, dev := range writtenDevices(r) {
+			if err := checkOpenRW(dev); err != nil {
+				return fmt.Errorf("%w: growing %v needs to write to %s: %v", ErrPermission, r, dev, err)
+			}
+		}
+	}
+	return nil
+}
+
+// writtenDevices returns the block devices that growing r opens to
+// write: the disk under a partition, and an LVM PV.
+func writtenDevices(r Resizer) []string {
+	switch r := r.(type) {
+	case PartitionResizer:
+		if disk, err := DiskDev(r.Device()); err == nil {
+			return []string{disk} // else Resize reports it
+		}
+	case PVResizer:
+		return []string{r.Device()}
+	}
+	return nil
+}
+
+// checkOpenRW returns an error if dev can't be opened read-write for
+// lack of permission. Read-only devices are left to checkWritable.
+func checkOpenRW(dev string) error {
+	if d, err := ProbeDevice(dev); err == nil && d.ReadOnly {
+		return nil
+	}
+	f, err := os.OpenFile(dev, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return err
+		}
+		return nil
+	}
+	return f.Close()
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkCapabilities returns an error if the process isn't root, which
+// GEOM changes and growfs need.
+func checkCapabilities(r Resizer) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("%w: growing %v needs root", ErrPermission, r)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// A capability is a Linux capability, by number and name.
+type capability struct {
+	n    uint
+	name string
+}
+
+var (
+	capSysAdmin    = capability{unix.CAP_SYS_ADMIN, "CAP_SYS_ADMIN"}
+	capSysResource = capability{unix.CAP_SYS_RESOURCE, "CAP_SYS_RESOURCE"}
+)
+
+// neededCapabilities returns the capabilities the kernel requires to
+// grow r: the BLKPG and device-mapper ioctls, XFS and btrfs growth,
+// and fsfreeze need CAP_SYS_ADMIN, and ext4's online resize needs
+// CAP_SYS_RESOURCE.
+func neededCapabilities(r Resizer) []capability {
+	switch r := r.(type) {
+	case FSResizer:
+		switch r.FS().FSType {
+		case "xfs", "btrfs":
+			return []capability{capSysAdmin}
+		}
+		return []capability{capSysResource}
+	case PartitionResizer:
+		return []capability{capSysAdmin}
+	case LVResizer, VGResizer, PVResizer:
+		return []capability{capSysAdmin}
+	}
+	return nil
+}
+
+// checkCapabilities returns an error if the process lacks one of the
+// capabilities r needs. If its capabilities can't be read, it's
+// assumed to have them.
+func checkCapabilities(r Resizer) error {
+	b, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return nil
+	}
+	eff, err := parseCapEff(string(b))
+	if err != nil {
+		return nil
+	}
+	for _, c := range neededCapabilities(r) {
+		if eff&(1<<c.n) == 0 {
+			return fmt.Errorf("%w: growing %v needs %s; run as root, or grant it with systemd's AmbientCapabilities= or setcap", ErrPermission, r, c.name)
+		}
+	}
+	return nil
+}
+
+// parseCapEff returns the effective capability set from the contents
+// of /proc/PID/status.
+func parseCapEff(status string) (uint64, error) {
+	for _, line := range strings.Split(status, "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			return strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("no CapEff in status")
+}
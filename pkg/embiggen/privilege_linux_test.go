@@ -0,0 +1,44 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import "testing"
+
+func TestParseCapEff(t *testing.T) {
+	tests := []struct {
+		status   string
+		admin    bool
+		resource bool
+		ok       bool
+	}{
+		{"Name:\tembiggen-disk\nCapInh:\t0000000000000000\nCapPrm:\t000001ffffffffff\nCapEff:\t000001ffffffffff\n", true, true, true},
+		{"CapEff:\t0000000000200000\n", true, false, true},
+		{"CapEff:\t0000000001000000\n", false, true, true},
+		{"CapEff:\t0000000000000000\n", false, false, true},
+		{"Name:\tsh\n", false, false, false},
+	}
+	for _, tt := range tests {
+		eff, err := parseCapEff(tt.status)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCapEff(%q) error = %v; want ok %v", tt.status, err, tt.ok)
+			continue
+		}
+		if admin, resource := eff&(1<<capSysAdmin.n) != 0, eff&(1<<capSysResource.n) != 0; admin != tt.admin || resource != tt.resource {
+			t.Errorf("parseCapEff(%q) = %#x: CAP_SYS_ADMIN %v, CAP_SYS_RESOURCE %v; want %v, %v", tt.status, eff, admin, resource, tt.admin, tt.resource)
+		}
+	}
+}
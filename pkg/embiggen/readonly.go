@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// fstabFile is where the configured mounts are.
+var fstabFile = "/etc/fstab"
+
+// checkMountWritable returns an error wrapping ErrReadOnly if fs is
+// mounted read-only, after remounting it read-write if RemountRW is
+// set and it's safe to.
+func checkMountWritable(ctx context.Context, fs FSStat) error {
+	o := opts(ctx)
+	if !fs.ReadOnly() {
+		return nil
+	}
+	if !o.RemountRW {
+		return fmt.Errorf("%w: %s is mounted read-only, maybe after filesystem errors; not growing it (see -remount-rw)", ErrReadOnly, fs.Mnt)
+	}
+	if why := remountUnsafe(fs); why != "" {
+		return fmt.Errorf("%w: %s is mounted read-only and %s; not remounting it read-write", ErrReadOnly, fs.Mnt, why)
+	}
+	args := remountArgs(fs.Mnt)
+	if o.DryRun {
+		dryRunCommand(ctx, args...)
+		return nil
+	}
+	if err := confirmStep(ctx, "remount %s read-write by running %s", fs.Mnt, shellJoin(args)); err != nil {
+		return err
+	}
+	infof(ctx, "%s is mounted read-only; remounting it read-write", fs.Mnt)
+	if out, err := runLogged(ctx, command(ctx, args[0], args[1:]...)); err != nil {
+		return fmt.Errorf("%w: remounting %s read-write: %v, %s", ErrReadOnly, fs.Mnt, err, out)
+	}
+	return nil
+}
+
+// remountUnsafe returns why remounting fs read-write is unsafe, or ""
+// if it isn't.
+func remountUnsafe(fs FSStat) string {
+	if err := checkWritable(fs.Dev); err != nil {
+		return "its device is read-only"
+	}
+	if n, err := readInt64File(filepath.Join("/sys/fs", fs.FSType, filepath.Base(fs.Dev), "errors_count")); err == nil && n > 0 {
+		return fmt.Sprintf("the kernel found %d errors on it", n)
+	}
+	if fstabReadOnly(fs.Mnt) {
+		return "/etc/fstab mounts it read-only"
+	}
+	return ""
+}
+
+// fstabReadOnly reports whether /etc/fstab mounts mnt read-only.
+func fstabReadOnly(mnt string) bool {
+	fstab, err := ioutil.ReadFile(fstabFile)
+	if err != nil {
+		return false
+	}
+	bs := bufio.NewScanner(bytes.NewReader(fstab))
+	for bs.Scan() {
+		f := strings.Fields(bs.Text())
+		if len(f) < 4 || strings.HasPrefix(f[0], "#") || f[1] != mnt {
+			continue
+		}
+		for _, o := range strings.Split(f[3], ",") {
+			if o == "ro" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFstabReadOnly(t *testing.T) {
+	defer func(f string) { fstabFile = f }(fstabFile)
+	dir, err := ioutil.TempDir("", "fstab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fstabFile = filepath.Join(dir, "fstab")
+	fstab := `# <file system> <mount point> <type> <options> <dump> <pass>
+UUID=1234 / ext4 errors=remount-ro 0 1
+/dev/sdb1 /srv xfs ro,noatime 0 2
+#/dev/sdc1 /data ext4 ro 0 2
+/dev/sdc1 /data ext4 defaults 0 2
+`
+	if err := ioutil.WriteFile(fstabFile, []byte(fstab), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		mnt  string
+		want bool
+	}{
+		{"/", false},
+		{"/srv", true},
+		{"/data", false},
+		{"/missing", false},
+	}
+	for _, tt := range tests {
+		if got := fstabReadOnly(tt.mnt); got != tt.want {
+			t.Errorf("fstabReadOnly(%q) = %v; want %v", tt.mnt, got, tt.want)
+		}
+	}
+}
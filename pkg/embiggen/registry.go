@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A DetectorFunc returns the Resizer for block device dev if it's a
+// layer the detector knows, like a vendor SAN volume or a custom
+// device-mapper target, or (nil, nil) if it isn't.
+type DetectorFunc func(ctx context.Context, dev string, lim Limit) (Resizer, error)
+
+type detector struct {
+	name string
+	fn   DetectorFunc
+}
+
+var (
+	registryMu sync.Mutex
+	detectors  []detector
+)
+
+// builtinLayers are the Layers of the built-in Resizers, which
+// Options.Disable also accepts.
+var builtinLayers = []string{"filesystem", "lvm-lv", "lvm-vg", "lvm-pv", "partition", "ufs", "zfs-pool", "gpart"}
+
+// Register adds a detector for the device under each filesystem, LVM
+// PV or other layer. Detectors are asked before the built-in ones, in
+// the order they were registered. It panics if name is already taken.
+func Register(name string, fn DetectorFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if fn == nil {
+		panic("embiggen: Register detector is nil")
+	}
+	if isLayerName(name) {
+		panic("embiggen: Register called twice for " + name)
+	}
+	detectors = append(detectors, detector{name, fn})
+}
+
+// CheckLayers returns an error if any of names, as for
+// Options.Disable, isn't a built-in layer or registered detector.
+func CheckLayers(names ...string) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, name := range names {
+		if !isLayerName(name) {
+			return fmt.Errorf("unknown resizer %q; want one of %s", name, strings.Join(layerNames(), ", "))
+		}
+	}
+	return nil
+}
+
+func isLayerName(name string) bool {
+	for _, n := range layerNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// layerNames returns the built-in layers and registered detectors.
+func layerNames() []string {
+	names := append([]string(nil), builtinLayers...)
+	for _, d := range detectors {
+		names = append(names, d.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isDisabled reports whether the layer or detector name is disabled
+// in ctx's Options.
+func isDisabled(ctx context.Context, name string) bool {
+	for _, n := range opts(ctx).Disable {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// depResizer returns the Resizer for dev, the device under some layer:
+// a registered detector's, else builtin's. It returns nil if that's
+// disabled.
+func depResizer(ctx context.Context, dev string, lim Limit, builtin func(context.Context) (Resizer, error)) (Resizer, error) {
+	registryMu.Lock()
+	ds := append([]detector(nil), detectors...)
+	registryMu.Unlock()
+	for _, d := range ds {
+		if isDisabled(ctx, d.name) {
+			continue
+		}
+		r, err := d.fn(ctx, dev, lim)
+		if err != nil {
+			return nil, fmt.Errorf("%s detector on %s: %w", d.name, dev, err)
+		}
+		if r != nil {
+			vlogf(ctx, "%s detector: %v", d.name, r)
+			return r, nil
+		}
+	}
+	r, err := builtin(ctx)
+	if err != nil || r == nil {
+		return r, err
+	}
+	if isDisabled(ctx, r.Layer()) {
+		vlogf(ctx, "leaving %v alone; %s is disabled", r, r.Layer())
+		return nil, nil
+	}
+	return r, nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"testing"
+)
+
+// A fakeResizer is a layer that's never grown.
+type fakeResizer struct{ layer, dev string }
+
+func (f fakeResizer) String() string                                      { return f.layer + " " + f.dev }
+func (f fakeResizer) Layer() string                                       { return f.layer }
+func (f fakeResizer) Device() string                                      { return f.dev }
+func (f fakeResizer) State(context.Context) (string, error)               { return "", nil }
+func (f fakeResizer) Size(context.Context) (int64, error)                 { return 0, nil }
+func (f fakeResizer) Attainable(context.Context, int64) (int64, error)    { return 0, nil }
+func (f fakeResizer) Resize(context.Context) error                        { return nil }
+func (f fakeResizer) DepResizer(context.Context) (dep Resizer, err error) { return nil, nil }
+
+func TestDepResizer(t *testing.T) {
+	defer func(d []detector) { detectors = d }(detectors)
+	detectors = nil
+
+	Register("san", func(ctx context.Context, dev string, lim Limit) (Resizer, error) {
+		if dev == "/dev/san0" {
+			return fakeResizer{"san", dev}, nil
+		}
+		return nil, nil
+	})
+	builtin := func(context.Context) (Resizer, error) { return fakeResizer{"partition", "/dev/sda1"}, nil }
+
+	tests := []struct {
+		dev     string
+		disable []string
+		want    string // the Resizer's String, or "" for none
+	}{
+		{"/dev/san0", nil, "san /dev/san0"},
+		{"/dev/sda1", nil, "partition /dev/sda1"},
+		{"/dev/san0", []string{"san"}, "partition /dev/sda1"},
+		{"/dev/sda1", []string{"partition"}, ""},
+	}
+	for _, tt := range tests {
+		if err := CheckLayers(tt.disable...); err != nil {
+			t.Fatal(err)
+		}
+		ctx := WithOptions(context.Background(), &Options{Disable: tt.disable})
+		r, err := depResizer(ctx, tt.dev, Limit{}, builtin)
+		if err != nil {
+			t.Errorf("depResizer(%q) with %v disabled: %v", tt.dev, tt.disable, err)
+			continue
+		}
+		got := ""
+		if r != nil {
+			got = r.String()
+		}
+		if got != tt.want {
+			t.Errorf("depResizer(%q) with %v disabled = %q; want %q", tt.dev, tt.disable, got, tt.want)
+		}
+	}
+	if err := CheckLayers("nosuch"); err == nil {
+		t.Error("CheckLayers(nosuch) succeeded; want error")
+	}
+}
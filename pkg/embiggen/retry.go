@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// IsTransient reports whether err is a failure that may go away if
+// the step is retried: a busy device, LVM lock contention, or a device
+// udev hasn't caught up with yet.
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrBusy) || errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN)
+}
+
+// retry calls f until it succeeds, fails other than transiently, or
+// has been retried Options.Retries times, backing off exponentially
+// from Options.RetryWait. what describes the step for the log.
+func retry(ctx context.Context, what string, f func() error) error {
+	o := opts(ctx)
+	wait := o.RetryWait
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= o.Retries || !IsTransient(err) {
+			return err
+		}
+		infof(ctx, "%s: %v; retrying in %v", what, err, wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		wait *= 2
+	}
+}
+
+// cloneCmd returns a new, unstarted copy of cmd to run again. Stdin,
+// Stdout and Stderr aren't copied.
+func cloneCmd(cmd *exec.Cmd) *exec.Cmd {
+	c := exec.Command(cmd.Path, cmd.Args[1:]...)
+	c.Args, c.Env, c.Dir = cmd.Args, cmd.Env, cmd.Dir
+	return c
+}
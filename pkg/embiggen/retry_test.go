@@ -0,0 +1,50 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := WithOptions(context.Background(), &Options{Retries: 3, RetryWait: time.Millisecond})
+
+	tests := []struct {
+		errs  []error // returned by successive tries
+		want  error
+		tries int
+	}{
+		{[]error{nil}, nil, 1},
+		{[]error{syscall.EBUSY, causeError{ErrBusy, errors.New("exit status 5")}, nil}, nil, 3},
+		{[]error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, nil}, syscall.EBUSY, 4},
+		{[]error{syscall.EBUSY, syscall.EIO, nil}, syscall.EIO, 2},
+	}
+	for i, tt := range tests {
+		tries := 0
+		err := retry(ctx, "test", func() error {
+			tries++
+			return tt.errs[tries-1]
+		})
+		if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) || tries != tt.tries {
+			t.Errorf("%d. retry = %v after %d tries; want %v after %d", i, err, tries, tt.want, tt.tries)
+		}
+	}
+}
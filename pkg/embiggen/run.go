@@ -0,0 +1,191 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// killGrace is how long to wait for a killed command to exit before
+// giving up on it. A process stuck in the kernel (state D) ignores
+// SIGKILL until its I/O finishes, which on dead storage is never.
+var killGrace = 10 * time.Second
+
+// unkilledTools are the tools that write partition tables. Killing
+// one midway could leave a half-written table, so when one outlives
+// its timeout it's only warned about, and waited for.
+var unkilledTools = map[string]bool{"sfdisk": true, "partx": true, "gpart": true}
+
+// commandTimeout returns the timeout for the command name.
+func commandTimeout(ctx context.Context, name string) time.Duration {
+	o := opts(ctx)
+	if d, ok := o.CommandTimeouts[filepath.Base(name)]; ok {
+		return d
+	}
+	return o.CommandTimeout
+}
+
+// A HangError is returned for a command killed because it ran past
+// its timeout, or its context was done, with what the process was
+// doing, to tell hung storage from a slow tool.
+type HangError struct {
+	Command    string
+	PID        int
+	Elapsed    time.Duration
+	State      string // from /proc/PID/stat, like "D" for uninterruptible sleep
+	WChan      string // kernel function it was waiting in, if known
+	Stack      string // kernel stack, if readable
+	Unkillable bool   // still running after SIGKILL, and abandoned
+	err        error  // ErrCommandTimeout or the context's error
+}
+
+func (e *HangError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %v after %v", e.Command, e.err, e.Elapsed.Round(time.Second))
+	if e.State != "" {
+		fmt.Fprintf(&b, "; pid %d was in state %s", e.PID, e.State)
+		if e.State == "D" {
+			b.WriteString(" (uninterruptible sleep, likely hung storage I/O)")
+		}
+	}
+	if e.WChan != "" {
+		fmt.Fprintf(&b, " in %s", e.WChan)
+	}
+	if e.Unkillable {
+		fmt.Fprintf(&b, "; it didn't exit %v after SIGKILL and was abandoned", killGrace)
+	}
+	if e.Stack != "" {
+		fmt.Fprintf(&b, "; kernel stack:\n%s", e.Stack)
+	}
+	return b.String()
+}
+
+func (e *HangError) Unwrap() error { return e.err }
+
+// run runs cmd, which has its Stdin, Stdout and Stderr set, like
+// cmd.Run, but kills it if ctx is done or it outlives its timeout,
+// returning a *HangError. One of the unkilledTools isn't killed for
+// outliving its timeout.
+func run(ctx context.Context, cmd *exec.Cmd) error {
+	t0 := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timeout <-chan time.Time
+	if d := commandTimeout(ctx, cmd.Args[0]); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	he := &HangError{Command: shellJoin(cmd.Args), PID: cmd.Process.Pid}
+	for he.err == nil {
+		select {
+		case err := <-done:
+			return err
+		case <-timeout:
+			if unkilledTools[filepath.Base(cmd.Args[0])] {
+				state, wchan, _ := procState(he.PID)
+				warnf(ctx, "%s has run for %v (state %s %s); not killing it, as it may be writing a partition table", he.Command, time.Since(t0).Round(time.Second), state, wchan)
+				timeout = nil
+				continue
+			}
+			he.err = ErrCommandTimeout
+		case <-ctx.Done():
+			he.err = ctx.Err()
+		}
+	}
+	he.Elapsed = time.Since(t0)
+	he.State, he.WChan, he.Stack = procState(he.PID)
+	cmd.Process.Kill()
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		he.Unkillable = true
+	}
+	return he
+}
+
+// procState returns the state, wait channel and kernel stack of
+// process pid from /proc, where it can.
+func procState(pid int) (state, wchan, stack string) {
+	dir := "/proc/" + strconv.Itoa(pid) + "/"
+	if stat, err := ioutil.ReadFile(dir + "stat"); err == nil {
+		// "pid (comm) S ..."; comm may hold spaces and parens.
+		if i := bytes.LastIndexByte(stat, ')'); i >= 0 {
+			if f := strings.Fields(string(stat[i+1:])); len(f) > 0 {
+				state = f[0]
+			}
+		}
+	}
+	if b, err := ioutil.ReadFile(dir + "wchan"); err == nil && string(b) != "0" {
+		wchan = string(b)
+	}
+	if b, err := ioutil.ReadFile(dir + "stack"); err == nil {
+		stack = strings.TrimSpace(string(b))
+	}
+	return
+}
+
+// output runs cmd like cmd.Output, with run's timeout. It's retried if
+// it fails transiently.
+func output(ctx context.Context, cmd *exec.Cmd) (out []byte, err error) {
+	err = retry(ctx, shellJoin(cmd.Args), func() error {
+		var stdout, stderr syncBuffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := run(ctx, cmd)
+		if ee, ok := err.(*exec.ExitError); ok {
+			ee.Stderr = stderr.Bytes()
+		}
+		out = stdout.Bytes()
+		cmd = cloneCmd(cmd)
+		if err != nil {
+			return toolErr(err, nil)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// A syncBuffer is a bytes.Buffer that's safe to read while an
+// abandoned command may still be writing to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRunTimeout(t *testing.T) {
+	o := DefaultOptions()
+	o.CommandTimeouts = map[string]time.Duration{"sleep": 50 * time.Millisecond}
+	ctx := WithOptions(context.Background(), o)
+
+	_, err := output(ctx, exec.Command("sleep", "10"))
+	var he *HangError
+	if !errors.As(err, &he) || !errors.Is(err, ErrCommandTimeout) {
+		t.Fatalf("output(sleep 10) = %v; want a HangError for ErrCommandTimeout", err)
+	}
+	if he.Unkillable {
+		t.Errorf("sleep wasn't killed: %v", err)
+	}
+	if runtime.GOOS == "linux" && he.State != "S" {
+		t.Errorf("State = %q; want S (sleeping)", he.State)
+	}
+
+	if out, err := output(ctx, exec.Command("echo", "hi")); err != nil || string(out) != "hi\n" {
+		t.Errorf("output(echo hi) = %q, %v; want \"hi\\n\"", out, err)
+	}
+
+	// Partition table writers are waited for, not killed.
+	unkilledTools["sleep"] = true
+	defer delete(unkilledTools, "sleep")
+	if _, err := output(ctx, exec.Command("sleep", "0.3")); err != nil {
+		t.Errorf("output(sleep 0.3) as a partition table writer = %v; want it left to finish", err)
+	}
+}
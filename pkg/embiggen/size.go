@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Limit bounds how far the Resizers in a chain grow their layer.
+// The zero value means to grow every layer to fill the space available.
+type Limit struct {
+	Max int64   // upper bound on the size of each layer in bytes, or 0 for none
+	Use float64 // percentage of the device or VG free space to use, or 0 for all
+
+	Reserve   int64  // bytes to leave unpartitioned at the end of the disk
+	VGReserve Amount // space to keep free in an LV's volume group
+	MinGrowth int64  // don't bother growing a layer by less than this many bytes
+	LVMax     int64  // size an LVM LV needs to reach, rounded up to whole extents and at least MinGrowth more, or 0 to fill the VG
+}
+
+// An Amount is a size in bytes or a percentage of some whole.
+type Amount struct {
+	Bytes   int64
+	Percent float64 // if non-zero, used instead of Bytes
+}
+
+// Of returns the amount in bytes, given the whole that a percentage is
+// relative to.
+func (a Amount) Of(whole int64) int64 {
+	if a.Percent != 0 {
+		return int64(float64(whole) * a.Percent / 100)
+	}
+	return a.Bytes
+}
+
+// share returns the part of n bytes that l lets a layer occupy: all of
+// them, or the Use percentage.
+func (l Limit) share(n int64) int64 {
+	if l.Use == 0 {
+		return n
+	}
+	return int64(float64(n) * l.Use / 100)
+}
+
+// capBytes returns how many bytes a layer currently of size cur may
+// grow by, given that avail bytes are available to it.
+func (l Limit) capBytes(cur, avail int64) int64 {
+	if l.Max > 0 && cur+avail > l.Max {
+		avail = l.Max - cur
+	}
+	if avail < 0 {
+		return 0
+	}
+	return avail
+}
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// siSuffixes are the decimal suffixes ParseSize accepts.
+var siSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1e12},
+	{"GB", 1e9},
+	{"MB", 1e6},
+	{"KB", 1e3},
+}
+
+// ParseSize parses sizes like "512", "100M", "20G", "1.5TiB" or "20GB"
+// into bytes. Suffixes are case-insensitive. K, M, G and T, with or
+// without "iB", are binary (powers of 1024); KB, MB, GB and TB are SI
+// (powers of 1000).
+func ParseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, ss := range siSuffixes {
+		if strings.HasSuffix(v, ss.suffix) {
+			v = strings.TrimSuffix(v, ss.suffix)
+			mult = ss.mult
+			break
+		}
+	}
+	if mult == 1 {
+		v = strings.TrimSuffix(v, "IB")
+		for _, ss := range sizeSuffixes {
+			if strings.HasSuffix(v, ss.suffix) {
+				v = strings.TrimSuffix(v, ss.suffix)
+				mult = ss.mult
+				break
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q; want a number of bytes, optionally with a suffix like G or GiB (binary) or GB (SI)", s)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+// FormatSize formats n bytes using the largest binary suffix that
+// divides it evenly, the inverse of ParseSize.
+func FormatSize(n int64) string {
+	for _, ss := range sizeSuffixes {
+		if n != 0 && n%ss.mult == 0 {
+			return fmt.Sprintf("%d%s", n/ss.mult, ss.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// HumanSize formats n bytes for people, like "49.8G".
+func HumanSize(n int64) string {
+	for _, ss := range sizeSuffixes {
+		if n >= ss.mult && ss.mult > 1 {
+			return strconv.FormatFloat(float64(n)/float64(ss.mult), 'f', 1, 64) + ss.suffix
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"512", 512},
+		{"1K", 1 << 10},
+		{"100M", 100 << 20},
+		{"20g", 20 << 30},
+		{"1.5TiB", 3 << 39},
+		{"8B", 8},
+		{"20GB", 20e9},
+		{"1.5tb", 1.5e12},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d; want %d", tt.in, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "G", "-1G", "12X", "1GIBB"} {
+		if _, err := ParseSize(bad); err == nil {
+			t.Errorf("ParseSize(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestLimitCapBytes(t *testing.T) {
+	tests := []struct {
+		lim        Limit
+		cur, avail int64
+		want       int64
+	}{
+		{Limit{}, 10, 90, 90},
+		{Limit{Max: 50}, 10, 90, 40},
+		{Limit{Max: 50}, 60, 90, 0},
+		{Limit{Max: 500}, 10, 90, 90},
+	}
+	for _, tt := range tests {
+		if got := tt.lim.capBytes(tt.cur, tt.avail); got != tt.want {
+			t.Errorf("%+v.capBytes(%d, %d) = %d; want %d", tt.lim, tt.cur, tt.avail, got, tt.want)
+		}
+	}
+}
+
+func TestLimitShare(t *testing.T) {
+	l := Limit{Use: 80}
+	if got, want := l.share(1000), int64(800); got != want {
+		t.Errorf("share(1000) = %d; want %d", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotExpiresTag prefixes the LVM tag that records, as a Unix
+// time, when a snapshot may be removed.
+const snapshotExpiresTag = "embiggen_expires="
+
+// snapshotLV takes an LVM snapshot of dev, returning its "vg/lv" name,
+// or "" if dev isn't an LV or its VG lacks the free space.
+func snapshotLV(ctx context.Context, dev string) (string, error) {
+	out, err := output(ctx, command(ctx, "lvs", "--noheadings", "--separator", ":", "-o", "vg_name,lv_name", dev))
+	if err != nil {
+		vlogf(ctx, "Not snapshotting %s, which isn't an LVM LV: %v", dev, execErr(err))
+		return "", nil
+	}
+	f := strings.Split(strings.TrimSpace(string(out)), ":")
+	if len(f) != 2 {
+		return "", fmt.Errorf("bogus lvs %s output: %q", dev, out)
+	}
+	vg, lv := f[0], f[1]
+	vgs, err := getVGState(ctx, vg)
+	if err != nil {
+		return "", err
+	}
+	if free := vgs.freeExtents * vgs.extentSize; free < opts(ctx).SnapshotSize {
+		warnf(ctx, "not snapshotting %s/%s before growing it: VG %s has %s free, less than the %s snapshot size", vg, lv, vg, HumanSize(free), HumanSize(opts(ctx).SnapshotSize))
+		return "", nil
+	}
+	expires := time.Now().Add(opts(ctx).SnapshotKeep).Unix()
+	snap := fmt.Sprintf("%s-embiggen-%d", lv, time.Now().Unix())
+	args := []string{"lvcreate", "--snapshot", "-L", fmt.Sprintf("%db", opts(ctx).SnapshotSize), "-n", snap,
+		"--addtag", snapshotExpiresTag + strconv.FormatInt(expires, 10), vg + "/" + lv}
+	if opts(ctx).DryRun {
+		dryRunCommand(ctx, args...)
+		return vg + "/" + snap, nil
+	}
+	if out, err := runLogged(ctx, command(ctx, args[0], args[1:]...)); err != nil {
+		return "", fmt.Errorf("snapshotting %s/%s: %w, %s", vg, lv, err, out)
+	}
+	infof(ctx, "took snapshot %s/%s of %s before growing it; it's removed after %v", vg, snap, dev, opts(ctx).SnapshotKeep)
+	return vg + "/" + snap, nil
+}
+
+// keepSnapshot stops RemoveExpiredSnapshots removing snap, taken before
+// a grow that failed, and says how to roll back to it.
+func keepSnapshot(ctx context.Context, snap string) {
+	out, err := output(ctx, command(ctx, "lvs", "--noheadings", "-o", "lv_tags", snap))
+	if err == nil {
+		for _, tag := range strings.Split(strings.TrimSpace(string(out)), ",") {
+			if strings.HasPrefix(tag, snapshotExpiresTag) {
+				if out, err := runLogged(ctx, command(ctx, "lvchange", "--deltag", tag, snap)); err != nil {
+					warnf(ctx, "keeping snapshot %s: %v, %s", snap, err, out)
+				}
+			}
+		}
+	}
+	warnf(ctx, "kept snapshot %s from before the failed grow; roll back with `lvconvert --merge %s` (applied when the LV is next activated, like on reboot), or remove it with `lvremove %s`", snap, snap, snap)
+}
+
+// RemoveExpiredSnapshots removes the LVM snapshots taken with Snapshot
+// whose SnapshotKeep has passed. It does nothing without LVM.
+func RemoveExpiredSnapshots(ctx context.Context) error {
+	if opts(ctx).DryRun {
+		return nil
+	}
+	out, err := output(ctx, command(ctx, "lvs", "--noheadings", "--separator", ":", "-o", "vg_name,lv_name,lv_tags"))
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("running lvs: %w", execErr(err))
+	}
+	now := time.Now().Unix()
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	for bs.Scan() {
+		f := strings.Split(strings.TrimSpace(bs.Text()), ":")
+		if len(f) != 3 {
+			continue
+		}
+		for _, tag := range strings.Split(f[2], ",") {
+			if !strings.HasPrefix(tag, snapshotExpiresTag) {
+				continue
+			}
+			if t, err := strconv.ParseInt(strings.TrimPrefix(tag, snapshotExpiresTag), 10, 64); err != nil || t > now {
+				continue
+			}
+			snap := f[0] + "/" + f[1]
+			if out, err := runLogged(ctx, command(ctx, "lvremove", "-f", snap)); err != nil {
+				return fmt.Errorf("removing expired snapshot %s: %w, %s", snap, err, out)
+			}
+			infof(ctx, "removed snapshot %s, kept %v after a successful grow", snap, opts(ctx).SnapshotKeep)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fallbackToolPaths are where to look for commands that aren't in
+// $PATH, as it may not have the sbin directories.
+var fallbackToolPaths = map[string]string{
+	"sfdisk": "/sbin/sfdisk",
+}
+
+// LookTool returns the program run for the external command name, with
+// ctx's Options, or an error if there isn't one.
+func LookTool(ctx context.Context, name string) (string, error) {
+	return exec.LookPath(toolPath(ctx, name))
+}
+
+// toolPath returns the program to run for the external command name.
+func toolPath(ctx context.Context, name string) string {
+	o := opts(ctx)
+	if p := o.ToolPaths[name]; p != "" {
+		return p
+	}
+	if len(o.ToolDirs) > 0 {
+		for _, dir := range o.ToolDirs {
+			p := filepath.Join(dir, name)
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+				return p
+			}
+		}
+		// Not there, so running it fails as a missing tool.
+		return filepath.Join(o.ToolDirs[0], name)
+	}
+	if p, err := exec.LookPath(name); err == nil {
+		return p
+	}
+	if p := fallbackToolPaths[name]; p != "" {
+		return p
+	}
+	return name
+}
+
+// command is exec.Command for the external command name, run from
+// toolPath, and with Options.ToolDirs as its $PATH if they're set.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	dirs := opts(ctx).ToolDirs
+	cmd := exec.Command(toolPath(ctx, name), args...)
+	cmd.Args[0] = name
+	if len(dirs) > 0 {
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, "PATH=") {
+				cmd.Env = append(cmd.Env, kv)
+			}
+		}
+		cmd.Env = append(cmd.Env, "PATH="+strings.Join(dirs, string(os.PathListSeparator)))
+	}
+	return cmd
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestToolPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embiggen-tools")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "resize2fs"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithOptions(context.Background(), &Options{
+		ToolPaths: map[string]string{"xfs_growfs": "/opt/xfs/xfs_growfs"},
+		ToolDirs:  []string{"/nonexistent", dir},
+	})
+	tests := []struct{ name, want string }{
+		{"xfs_growfs", "/opt/xfs/xfs_growfs"},
+		{"resize2fs", filepath.Join(dir, "resize2fs")},
+		{"sfdisk", "/nonexistent/sfdisk"},
+	}
+	for _, tt := range tests {
+		if got := toolPath(ctx, tt.name); got != tt.want {
+			t.Errorf("toolPath(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	cmd := command(ctx, "resize2fs", "/dev/sda1")
+	if cmd.Args[0] != "resize2fs" {
+		t.Errorf("Args[0] = %q; want resize2fs", cmd.Args[0])
+	}
+	if env := cmd.Env[len(cmd.Env)-1]; env != "PATH=/nonexistent:"+dir {
+		t.Errorf("last of Env = %q; want only the tool dirs in PATH", env)
+	}
+	_, err = output(ctx, command(ctx, "sfdisk", "-d", "/dev/sda"))
+	var tm ErrToolMissing
+	if !errors.As(err, &tm) || tm.Tool != "sfdisk" {
+		t.Errorf("running a tool missing from ToolDirs: %v; want ErrToolMissing for sfdisk", err)
+	}
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// execErr adds the stderr of a failed command to err, keeping err
+// available to errors.As, and converts it with toolErr.
+func execErr(err error) error {
+	detail := toolErr(err, nil)
+	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+		return fmt.Errorf("%w; stderr: %s", detail, ee.Stderr)
+	}
+	return detail
+}
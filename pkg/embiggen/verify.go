@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import "context"
+
+// minVerifiedGrowth is the least expected growth that Resize insists
+// on seeing. Below it, rounding to blocks, extents and metadata can
+// rightly leave a layer's size unchanged.
+const minVerifiedGrowth = 16 << 20
+
+// expectedGrowth returns about how many bytes Resize of e, now size
+// bytes, should grow it by. sure is whether that's known well enough
+// to call it a failure if e doesn't grow: for other layers, it's
+// Attainable's upper bound.
+func expectedGrowth(ctx context.Context, e Resizer, size int64) (n int64, sure bool) {
+	switch r := e.(type) {
+	case FSResizer:
+		// Attainable is only an upper bound; compare the filesystem's
+		// own idea of its size to its device's.
+		devSize, err := BlockDevSize(r.fs.Dev)
+		if err != nil {
+			return 0, false
+		}
+		cur, err := r.FSBytes(ctx)
+		if err != nil {
+			return 0, false
+		}
+		if r.lim.Max > 0 && r.lim.Max < devSize {
+			devSize = r.lim.Max
+		}
+		if n = devSize - cur; n < r.lim.MinGrowth {
+			return 0, true
+		}
+		sure = true
+	case PVResizer:
+		devSize, err := BlockDevSize(r.dev)
+		if err != nil {
+			return 0, false
+		}
+		n, sure = devSize-size, true
+	default:
+		att, err := e.Attainable(ctx, 0)
+		if err != nil {
+			return 0, false
+		}
+		n = att - size
+		switch e.(type) {
+		case PartitionResizer, LVResizer:
+			sure = true
+		}
+	}
+	if n < 0 {
+		return 0, sure
+	}
+	return n, sure
+}
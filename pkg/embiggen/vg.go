@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package embiggen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// addDisksMu keeps VGResizers from claiming the same blank disk.
+var addDisksMu sync.Mutex
+
+// addsDisks reports whether blank disks are added to vg.
+func addsDisks(ctx context.Context, vg string) bool {
+	for _, v := range opts(ctx).AddDisksTo {
+		if v == vg {
+			return true
+		}
+	}
+	return false
+}
+
+// A VGResizer grows an LVM volume group by adding blank disks to it as
+// PVs. It's only in a chain for the VGs in AddDisksTo, between the LV
+// and its PV.
+type VGResizer struct {
+	vg  string // "datavg"
+	pv  string // the LV's PV, grown first: "/dev/sdb"
+	lim Limit
+}
+
+func (r VGResizer) String() string { return fmt.Sprintf("LVM VG %s", r.vg) }
+func (r VGResizer) Layer() string  { return "lvm-vg" }
+func (r VGResizer) Device() string { return "/dev/" + r.vg }
+
+func (r VGResizer) State(ctx context.Context) (string, error) {
+	vgs, err := getVGState(ctx, r.vg)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("extents=%d", vgs.totalExtents), nil
+}
+
+func (r VGResizer) Size(ctx context.Context) (int64, error) {
+	vgs, err := getVGState(ctx, r.vg)
+	return vgs.totalExtents * vgs.extentSize, err
+}
+
+func (r VGResizer) Attainable(ctx context.Context, depGrowth int64) (int64, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	disks, err := BlankDisks(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range disks {
+		n += d.Size
+	}
+	return n + depGrowth, nil
+}
+
+func (r VGResizer) Resize(ctx context.Context) error {
+	addDisksMu.Lock()
+	defer addDisksMu.Unlock()
+	disks, err := BlankDisks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, d := range disks {
+		if opts(ctx).DryRun {
+			dryRunCommand(ctx, "pvcreate", d.Path)
+			dryRunCommand(ctx, "vgextend", r.vg, d.Path)
+			continue
+		}
+		if err := confirmStep(ctx, "add blank disk %s (%s) to %v by running pvcreate %s and vgextend %s %s", d.Path, HumanSize(d.Size), r, d.Path, r.vg, d.Path); err != nil {
+			return err
+		}
+		infof(ctx, "adding blank disk %s (%s) to %v", d.Path, HumanSize(d.Size), r)
+		if out, err := runLogged(ctx, command(ctx, "pvcreate", d.Path)); err != nil {
+			return fmt.Errorf("pvcreate %s: %w, %s", d.Path, err, out)
+		}
+		if out, err := runLogged(ctx, command(ctx, "vgextend", r.vg, d.Path)); err != nil {
+			return fmt.Errorf("vgextend %s %s: %w, %s", r.vg, d.Path, err, out)
+		}
+	}
+	return nil
+}
+
+func (r VGResizer) DepResizer(ctx context.Context) (Resizer, error) {
+	if r.pv == "" {
+		return nil, nil
+	}
+	return pvResizer(ctx, r.pv, r.lim), nil
+}
+
+// hasSignature reports whether blkid finds a partition table,
+// filesystem, PV or other signature on dev. If it can't tell, it says
+// there is one.
+func hasSignature(ctx context.Context, dev string) bool {
+	_, err := output(ctx, command(ctx, "blkid", "-p", dev))
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 2 {
+		return false // nothing found
+	}
+	return true
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// planMain implements the "plan <mount-point>" subcommand.
+func planMain(args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+	mnt := args[0]
+	lim, err := resolveLimit(mnt)
+	if err == nil {
+		lim, err = withLVFree(mnt, lim)
+	}
+	if err != nil {
+		exitf(exitCode(nil, err), "error planning %s: %v", mnt, err)
+	}
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		exitf(exitCode(nil, err), "error planning %s: %v", mnt, err)
+	}
+	nodes, err := planStack(e)
+	if err != nil {
+		exitf(exitCode(nil, err), "error planning %s: %v", mnt, err)
+	}
+	writePlan(os.Stdout, nodes)
+	os.Exit(0)
+}
+
+// A planNode is one layer of the storage stack under a mount point,
+// as shown by the plan subcommand.
+type planNode struct {
+	name       string           // "partition /dev/sda3", "disk /dev/sda"
+	cur, att   int64            // current and attainable size in bytes
+	info       string           // extra detail, like VG free space
+	resizer    embiggen.Resizer // or nil for the disk and VG
+	attainable bool             // whether att is known
+	err        error
+}
+
+// planStack works out the storage stack under e and how big each
+// layer could get, bottom (disk) first. It changes nothing.
+func planStack(e embiggen.Resizer) ([]*planNode, error) {
+	chain, err := embiggen.Chain(runCtx, e)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*planNode
+	var depGrowth int64
+	for i := len(chain) - 1; i >= 0; i-- {
+		r := chain[i]
+		switch r := r.(type) {
+		case embiggen.PartitionResizer:
+			n := &planNode{name: "disk of " + r.Device()}
+			dev, err := embiggen.DiskDev(r.Device())
+			if err == nil {
+				n.name = "disk " + dev
+				n.cur, err = embiggen.BlockDevSize(dev)
+			}
+			n.err = err
+			n.att, n.attainable = n.cur, n.err == nil
+			nodes = append(nodes, n)
+		case embiggen.LVResizer:
+			if i+1 < len(chain) {
+				if _, ok := chain[i+1].(embiggen.VGResizer); ok {
+					break // the VG is a layer of its own
+				}
+			}
+			if vg, total, free, err := r.VG(runCtx); err == nil {
+				nodes = append(nodes, &planNode{
+					name:       "LVM VG " + vg,
+					cur:        total,
+					att:        total + depGrowth,
+					attainable: true,
+					info:       embiggen.HumanSize(free) + " free",
+				})
+			}
+		}
+		n := &planNode{name: r.String(), resizer: r}
+		if fsr, ok := r.(embiggen.FSResizer); ok {
+			if st, err := embiggen.StatFS(fsr.FS().Mnt); err == nil {
+				n.info = embiggen.HumanSize(int64(st.Statfs.Bavail)*int64(st.Statfs.Bsize)) + " free"
+			}
+		}
+		if n.cur, n.err = r.Size(runCtx); n.err == nil {
+			n.att, n.err = r.Attainable(runCtx, depGrowth)
+			n.attainable = n.err == nil
+		}
+		if n.attainable && n.att > n.cur {
+			depGrowth = n.att - n.cur
+		} else {
+			depGrowth = 0
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// writePlan writes nodes as a tree, bottom layer first.
+func writePlan(w io.Writer, nodes []*planNode) {
+	for _, line := range planLines(nodes) {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// planLines formats nodes as the lines of a tree, bottom layer first.
+func planLines(nodes []*planNode) []string {
+	lines := make([]string, len(nodes))
+	for i, n := range nodes {
+		prefix := ""
+		if i > 0 {
+			prefix = strings.Repeat("   ", i-1) + "└─ "
+		}
+		lines[i] = fmt.Sprintf("%s%s: %s", prefix, n.name, n.describe())
+	}
+	return lines
+}
+
+func (n *planNode) growable() bool {
+	return n.err == nil && n.attainable && n.att > n.cur
+}
+
+func (n *planNode) describe() string {
+	var desc string
+	switch {
+	case n.err != nil:
+		desc = fmt.Sprintf("error: %v", n.err)
+	case !n.growable():
+		desc = embiggen.HumanSize(n.cur)
+	default:
+		desc = fmt.Sprintf("%s → %s (+%s)", embiggen.HumanSize(n.cur), embiggen.HumanSize(n.att), embiggen.HumanSize(n.att-n.cur))
+	}
+	if n.info != "" {
+		desc += ", " + n.info
+	}
+	return desc
+}
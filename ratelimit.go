@@ -0,0 +1,326 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	partitionRateLimit = flag.String("partition-rate-limit", "", "rewrite partition tables at most this often, as count/duration, e.g. \"1/30m\"; a partition that would go past it is grown on a later check; empty for no limit")
+	maintenanceWindows stringsFlag
+)
+
+func init() {
+	flag.Var(&maintenanceWindows, "maintenance-window", "in daemon mode, only grow targets during this window of local time, like \"02:00-04:00\" or \"Sat,Sun 00:00-06:00\"; may be repeated")
+}
+
+// errRateLimited is returned by Resize when growing a partition would
+// go past -partition-rate-limit.
+var errRateLimited = errors.New("partition rewrite rate limit reached")
+
+// A tokenBucket allows n events per every, in bursts of up to n.
+type tokenBucket struct {
+	n     int
+	every time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	at     time.Time // when tokens was last topped up
+	taken  bool      // since the last save
+}
+
+// parseRate parses a rate like "1/30m" into a full tokenBucket.
+func parseRate(s string) (*tokenBucket, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("bad rate %q; want count/duration, like 1/30m", s)
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("bad rate %q; want a positive count", s)
+	}
+	every, err := time.ParseDuration(s[i+1:])
+	if err != nil || every <= 0 {
+		return nil, fmt.Errorf("bad rate %q; want a positive duration", s)
+	}
+	return &tokenBucket{n: n, every: every, tokens: float64(n)}, nil
+}
+
+// A savedBucket is a tokenBucket's tokens, saved in the -state-dir so
+// that restarting doesn't refill it.
+type savedBucket struct {
+	Tokens float64   `json:"tokens"`
+	At     time.Time `json:"at"`
+}
+
+// rateLimitPath returns where the -partition-rate-limit's tokens are
+// saved, or "" if they aren't.
+func rateLimitPath() string {
+	if *stateDir == "" {
+		return ""
+	}
+	return filepath.Join(*stateDir, "ratelimit.json")
+}
+
+// load restores b's tokens from path, if they were saved there.
+func (b *tokenBucket) load(path string) {
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var s savedBucket
+	if err == nil {
+		err = json.Unmarshal(data, &s)
+	}
+	if err != nil {
+		warnf("ignoring saved rate limit: %v", err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens, b.at = s.Tokens, s.At
+	if b.tokens > float64(b.n) {
+		b.tokens = float64(b.n)
+	}
+}
+
+// save saves b's tokens to path, if any were taken since it was last
+// saved. Errors are only logged.
+func (b *tokenBucket) save(path string) {
+	if path == "" || *dry {
+		return
+	}
+	b.mu.Lock()
+	s, taken := savedBucket{b.tokens, b.at}, b.taken
+	b.taken = false
+	b.mu.Unlock()
+	if !taken {
+		return
+	}
+	if err := writeJSON(path, s); err != nil {
+		warnf("saving rate limit: %v", err)
+	}
+}
+
+// take takes a token at now if there's one, or else returns how long
+// until there is.
+func (b *tokenBucket) take(now time.Time) (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.at.IsZero() {
+		b.tokens += float64(b.n) * float64(now.Sub(b.at)) / float64(b.every)
+		if b.tokens > float64(b.n) {
+			b.tokens = float64(b.n)
+		}
+	}
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.taken = true
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) * float64(b.every) / float64(b.n)), false
+}
+
+// A window is a daily span of local time, on some days of the week.
+// One whose end is before its start runs past midnight.
+type window struct {
+	days       [7]bool // by time.Weekday, of the start; none for every day
+	start, end int     // minutes since midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseWindow parses a window like "02:00-04:00", "Mon-Fri 22:00-02:00"
+// or "Sat,Sun 00:00-24:00".
+func parseWindow(s string) (window, error) {
+	var w window
+	f := strings.Fields(s)
+	if len(f) == 0 || len(f) > 2 {
+		return w, fmt.Errorf("bad maintenance window %q; want [days] HH:MM-HH:MM", s)
+	}
+	if len(f) == 2 {
+		for _, d := range strings.Split(f[0], ",") {
+			from, to := d, d
+			if i := strings.Index(d, "-"); i >= 0 {
+				from, to = d[:i], d[i+1:]
+			}
+			a, ok := weekdays[strings.ToLower(from)]
+			b, ok2 := weekdays[strings.ToLower(to)]
+			if !ok || !ok2 {
+				return w, fmt.Errorf("bad maintenance window %q: unknown day %q", s, d)
+			}
+			for day := a; ; day = (day + 1) % 7 {
+				w.days[day] = true
+				if day == b {
+					break
+				}
+			}
+		}
+	}
+	span := f[len(f)-1]
+	i := strings.Index(span, "-")
+	if i < 0 {
+		return w, fmt.Errorf("bad maintenance window %q; want [days] HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.start, err = parseClock(span[:i]); err != nil || w.start == 24*60 {
+		return w, fmt.Errorf("bad maintenance window %q: bad start %q", s, span[:i])
+	}
+	if w.end, err = parseClock(span[i+1:]); err != nil {
+		return w, fmt.Errorf("bad maintenance window %q: bad end %q", s, span[i+1:])
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("bad maintenance window %q: it's empty", s)
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day like "02:30" into minutes since
+// midnight. "24:00" is the end of the day.
+func parseClock(s string) (int, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	h, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil || len(s[i+1:]) != 2 || m < 0 || m > 59 || h < 0 || h > 24 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains reports whether t is in w.
+func (w window) contains(t time.Time) bool {
+	m, day := t.Hour()*60+t.Minute(), t.Weekday()
+	if w.end < w.start {
+		if m < w.end {
+			day = (day + 6) % 7 // the window started yesterday
+		} else if m < w.start {
+			return false
+		}
+	} else if m < w.start || m >= w.end {
+		return false
+	}
+	return w.days == [7]bool{} || w.days[day]
+}
+
+// inWindows reports whether t is in any of ws, or ws is empty.
+func inWindows(ws []window, t time.Time) bool {
+	for _, w := range ws {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return len(ws) == 0
+}
+
+// nextWindow returns when the next of ws after t starts, to the minute.
+func nextWindow(ws []window, t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	for i := 0; i < 8*24*60; i++ {
+		if t = t.Add(time.Minute); inWindows(ws, t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+var (
+	// rewriteLimit is the -partition-rate-limit, or nil for none.
+	rewriteLimit *tokenBucket
+	// windows are the -maintenance-window ones. Empty means any time.
+	windows []window
+)
+
+// setupRateLimit sets rewriteLimit and windows from the flags, or else
+// the config file. A new rewriteLimit's tokens are restored from the
+// -state-dir, and one of the same rate is kept, tokens and all, so
+// neither restarting nor reloading the config refills it.
+func setupRateLimit(c *config) error {
+	rate := flagOr("partition-rate-limit", *partitionRateLimit, c.PartitionRateLimit)
+	var b *tokenBucket
+	if rate != "" {
+		var err error
+		if b, err = parseRate(rate); err != nil {
+			return err
+		}
+		if old := rewriteLimit; old != nil && old.n == b.n && old.every == b.every {
+			b = old
+		} else {
+			b.load(rateLimitPath())
+		}
+	}
+	specs := c.MaintenanceWindows
+	if flagGiven("maintenance-window") {
+		specs = maintenanceWindows
+	}
+	var ws []window
+	for _, s := range specs {
+		w, err := parseWindow(s)
+		if err != nil {
+			return err
+		}
+		ws = append(ws, w)
+	}
+	rewriteLimit, windows = b, ws
+	return nil
+}
+
+// beforeRewrite is engineOpts.BeforeRewrite, taking a
+// token from rewriteLimit. It's saved by saveRateLimit, as the
+// filesystem with the state directory may be frozen now.
+func beforeRewrite(_ context.Context, disk string) error {
+	if rewriteLimit == nil {
+		return nil
+	}
+	wait, ok := rewriteLimit.take(time.Now())
+	if !ok {
+		return fmt.Errorf("%s: %w; next rewrite allowed in %v", disk, errRateLimited, wait.Round(time.Second))
+	}
+	return nil
+}
+
+// saveRateLimit saves the tokens beforeRewrite took, once Resize has
+// returned and any -freeze is thawed.
+func saveRateLimit() {
+	if rewriteLimit != nil {
+		rewriteLimit.save(rateLimitPath())
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b, err := parseRate("2/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at   time.Duration
+		ok   bool
+		wait time.Duration
+	}{
+		{0, true, 0},
+		{time.Minute, true, 0},
+		{2 * time.Minute, false, 28 * time.Minute},
+		{31 * time.Minute, true, 0},
+		{32 * time.Minute, false, 28 * time.Minute},
+		{5 * time.Hour, true, 0},
+		{5 * time.Hour, true, 0},
+		{5 * time.Hour, false, 30 * time.Minute},
+	}
+	for i, tt := range tests {
+		wait, ok := b.take(t0.Add(tt.at))
+		if ok != tt.ok || wait.Round(time.Second) != tt.wait {
+			t.Errorf("%d: take at +%v = %v, %v; want %v, %v", i, tt.at, wait, ok, tt.wait, tt.ok)
+		}
+	}
+
+	// A restart doesn't refill it.
+	dir, err := ioutil.TempDir("", "embiggen-ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ratelimit.json")
+	b, _ = parseRate("1/1h")
+	b.save(path)
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("saved a bucket nothing was taken from")
+	}
+	b.take(t0)
+	b.save(path)
+	b, _ = parseRate("1/1h")
+	b.load(path)
+	if wait, ok := b.take(t0.Add(time.Minute)); ok || wait != 59*time.Minute {
+		t.Errorf("take after reloading a used bucket = %v, %v; want 59m0s, false", wait, ok)
+	}
+
+	for _, s := range []string{"", "30m", "0/1h", "1/soon", "1/0s"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("parseRate(%q) succeeded; want error", s)
+		}
+	}
+}
+
+func TestWindows(t *testing.T) {
+	// 2024-03-01 was a Friday.
+	at := func(day int, clock string) time.Time {
+		tm, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, 3, day, tm.Hour(), tm.Minute(), 0, 0, time.Local)
+	}
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"02:00-04:00", at(1, "02:00"), true},
+		{"02:00-04:00", at(1, "04:00"), false},
+		{"Sat,Sun 02:00-04:00", at(1, "03:00"), false},
+		{"Sat,Sun 02:00-04:00", at(2, "03:00"), true},
+		{"Mon-Fri 22:00-02:00", at(1, "23:00"), true},
+		{"Mon-Fri 22:00-02:00", at(2, "01:00"), true}, // Friday night's
+		{"Mon-Fri 22:00-02:00", at(2, "23:00"), false},
+		{"Fri-Mon 00:00-24:00", at(3, "12:00"), true},
+		{"Fri-Mon 00:00-24:00", at(5, "12:00"), false},
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.window)
+		if err != nil {
+			t.Errorf("parseWindow(%q): %v", tt.window, err)
+			continue
+		}
+		if got := w.contains(tt.t); got != tt.want {
+			t.Errorf("%q contains %v = %v; want %v", tt.window, tt.t, got, tt.want)
+		}
+	}
+	for _, s := range []string{"", "02:00", "Someday 02:00-04:00", "02:00-02:00", "25:00-26:00", "2:0-4:00", "Mon 02:00-04:00 extra"} {
+		if _, err := parseWindow(s); err == nil {
+			t.Errorf("parseWindow(%q) succeeded; want error", s)
+		}
+	}
+
+	w, _ := parseWindow("Sat 02:00-04:00")
+	if got, want := nextWindow([]window{w}, at(1, "12:34")), at(2, "02:00"); !got.Equal(want) {
+		t.Errorf("nextWindow = %v; want %v", got, want)
+	}
+	if !inWindows(nil, at(1, "12:34")) {
+		t.Error("inWindows with no windows = false; want true")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// A report is the machine-readable result of resizing one mount point,
+// written by -output=json.
+type report struct {
+	Mount    string             `json:"mount"`
+	DryRun   bool               `json:"dryRun,omitempty"`
+	Layers   []layerReport      `json:"layers"` // top (filesystem) first
+	Changes  []embiggen.Change  `json:"changes"`
+	Commands []embiggen.Command `json:"commands"`
+	Error    string             `json:"error,omitempty"`
+}
+
+type layerReport struct {
+	Resizer     string `json:"resizer"`
+	BeforeBytes int64  `json:"beforeBytes"`
+	AfterBytes  int64  `json:"afterBytes"`
+	Error       string `json:"error,omitempty"`
+}
+
+// resizeReport is like Resize but also returns a report of every
+// Resizer in e's chain. It resizes with ctx.
+func resizeReport(ctx context.Context, mnt string, e embiggen.Resizer) (*report, error) {
+	rep := &report{Mount: mnt, DryRun: dryRun(ctx), Changes: []embiggen.Change{}}
+	chain, _ := embiggen.Chain(ctx, e) // on error, Resize will report it
+	for _, r := range chain {
+		lr := layerReport{Resizer: r.String()}
+		var err error
+		if lr.BeforeBytes, err = r.Size(ctx); err != nil {
+			lr.Error = err.Error()
+		}
+		rep.Layers = append(rep.Layers, lr)
+	}
+
+	if err := embiggen.RemoveExpiredSnapshots(ctx); err != nil {
+		warnf("%v", err)
+	}
+	rctx, cmds := embiggen.WithCommandLog(ctx)
+	changes, err := embiggen.Resize(rctx, e)
+	saveRateLimit()
+	rep.Changes = append(rep.Changes, changes...)
+	rep.Commands = append([]embiggen.Command{}, cmds.Commands()...)
+	if err != nil {
+		rep.Error = err.Error()
+	}
+	for i, r := range chain {
+		n, err := r.Size(ctx)
+		if err != nil {
+			rep.Layers[i].Error = err.Error()
+			continue
+		}
+		rep.Layers[i].AfterBytes = n
+	}
+	return rep, err
+}
+
+func (rep *report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
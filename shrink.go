@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// A shrinkPlan is the ordered list of commands that shrink a
+// filesystem, and the LVM LV below it if any, to a smaller size.
+//
+// Shrinking is the reverse of Resize: the filesystem must shrink
+// before the layer below it, or data past the new end is lost.
+// Partitions are never shrunk.
+type shrinkPlan struct {
+	fs    embiggen.FSStat
+	size  int64      // target size in bytes
+	lv    string     // LV below the filesystem, or empty
+	steps [][]string // commands to run, in order
+	notes []string   // things the operator should know
+}
+
+func newShrinkPlan(mnt string, size int64) (*shrinkPlan, error) {
+	fs, err := embiggen.StatFS(mnt)
+	if err != nil {
+		return nil, err
+	}
+	if fs.Mnt != mnt {
+		return nil, fmt.Errorf("%s is a bind mount or subvolume of the filesystem at %s; shrink it there", mnt, fs.Mnt)
+	}
+	cur := int64(fs.Statfs.Blocks) * int64(fs.Statfs.Bsize)
+	if size >= cur {
+		return nil, fmt.Errorf("-size %s isn't smaller than the current size of %s (%s)", embiggen.FormatSize(size), mnt, embiggen.FormatSize(cur))
+	}
+	used := int64(fs.Statfs.Blocks-fs.Statfs.Bfree) * int64(fs.Statfs.Bsize)
+	if size <= used {
+		return nil, fmt.Errorf("-size %s is smaller than the %s already used on %s", embiggen.FormatSize(size), embiggen.FormatSize(used), mnt)
+	}
+	p := &shrinkPlan{fs: fs, size: size}
+	if strings.HasPrefix(fs.Dev, "/dev/mapper") || strings.HasPrefix(filepath.Base(fs.Dev), "dm-") {
+		p.lv = fs.Dev
+	} else {
+		p.notes = append(p.notes, fmt.Sprintf("%s is not an LVM LV; only the filesystem will be shrunk and the space freed stays inside it", fs.Dev))
+	}
+
+	switch fs.FSType {
+	case "ext2", "ext3", "ext4":
+		// ext filesystems can only shrink offline.
+		if mnt == "/" {
+			return nil, errors.New("can't shrink the root filesystem; ext filesystems must be unmounted to shrink")
+		}
+		p.steps = append(p.steps,
+			[]string{"umount", mnt},
+			[]string{"e2fsck", "-f", "-y", fs.Dev},
+			[]string{"resize2fs", fs.Dev, fmt.Sprintf("%dK", size>>10)},
+		)
+	case "btrfs":
+		p.steps = append(p.steps, []string{"btrfs", "filesystem", "resize", fmt.Sprint(size), mnt})
+	case "xfs":
+		return nil, errors.New("XFS filesystems can't be shrunk")
+	default:
+		return nil, fmt.Errorf("shrinking %s filesystems isn't supported", fs.FSType)
+	}
+	if p.lv != "" {
+		// lvreduce rounds up to a whole extent, so the LV is never
+		// smaller than the filesystem.
+		p.steps = append(p.steps, []string{"lvreduce", "-f", "-L", fmt.Sprintf("%db", size), p.lv})
+	}
+	if p.offline() {
+		// Mount it again with the options it has now, not the defaults.
+		opts, err := embiggen.MountOptions(mnt)
+		if err != nil {
+			return nil, err
+		}
+		remount := []string{"mount", "-t", fs.FSType}
+		if opts != "" {
+			remount = append(remount, "-o", opts)
+		}
+		p.steps = append(p.steps, append(remount, fs.Dev, mnt))
+	}
+	return p, nil
+}
+
+func (p *shrinkPlan) Write(w io.Writer) {
+	fmt.Fprintf(w, "Plan to shrink %s filesystem at %s (%s) to %s:\n", p.fs.FSType, p.fs.Mnt, p.fs.Dev, embiggen.FormatSize(p.size))
+	for i, st := range p.steps {
+		fmt.Fprintf(w, "  %d. %s\n", i+1, strings.Join(st, " "))
+	}
+	for _, n := range p.notes {
+		fmt.Fprintf(w, "Note: %s\n", n)
+	}
+	if *drain && p.offline() {
+		fmt.Fprintf(w, "The Kubernetes node %s will be cordoned and drained first, and uncordoned after.\n", nodeName())
+	}
+}
+
+// confirm asks the operator twice, in different ways, whether to go
+// ahead. It reports whether both answers were right.
+func (p *shrinkPlan) confirm(r io.Reader, w io.Writer) bool {
+	br := bufio.NewReader(r)
+	ask := func(prompt string) string {
+		fmt.Fprint(w, prompt)
+		line, _ := br.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+	if ask("Shrinking can lose data if interrupted. Have you backed it up? Type \"yes\": ") != "yes" {
+		return false
+	}
+	return ask(fmt.Sprintf("Type the device name %s to shrink it: ", p.fs.Dev)) == p.fs.Dev
+}
+
+func (p *shrinkPlan) run() (changes []string, err error) {
+	before := embiggen.FormatSize(int64(p.fs.Statfs.Blocks) * int64(p.fs.Statfs.Bsize))
+	for _, st := range p.steps {
+		if *dry {
+			embiggen.DryRunCommand(st...)
+			continue
+		}
+		t0 := time.Now()
+		out, err := exec.Command(st[0], st[1:]...).CombinedOutput()
+		p.audit(st, time.Since(t0), err)
+		if err != nil {
+			err = fmt.Errorf("running %s: %v, %s", strings.Join(st, " "), err, out)
+			if st[0] != "umount" && p.offline() {
+				// Try to leave things mounted as we found them.
+				last := p.steps[len(p.steps)-1]
+				if out, merr := exec.Command(last[0], last[1:]...).CombinedOutput(); merr != nil {
+					err = fmt.Errorf("%v; remounting also failed: %v, %s", err, merr, out)
+				}
+			}
+			return changes, err
+		}
+		if st[0] == "lvreduce" {
+			changes = append(changes, fmt.Sprintf("LVM LV %s: reduced to %s", p.lv, embiggen.FormatSize(p.size)))
+		}
+	}
+	if !*dry {
+		changes = append(changes, fmt.Sprintf("%s filesystem at %s: before: %s, after: %s", p.fs.FSType, p.fs.Mnt, before, embiggen.FormatSize(p.size)))
+	}
+	return changes, nil
+}
+
+// audit records running step st of p in the audit log.
+func (p *shrinkPlan) audit(st []string, d time.Duration, err error) {
+	ae := auditEntry{
+		Mount:       p.fs.Mnt,
+		Action:      "shrink",
+		Device:      p.fs.Dev,
+		Commands:    []string{strings.Join(st, " ")},
+		BeforeBytes: int64(p.fs.Statfs.Blocks) * int64(p.fs.Statfs.Bsize),
+		AfterBytes:  p.size,
+		Duration:    d,
+		Outcome:     "ok",
+	}
+	if err != nil {
+		ae.Outcome, ae.Error = "failed", err.Error()
+	}
+	audit(ae)
+}
+
+// shrinkFS shrinks the filesystem at mnt to size bytes, after showing
+// the plan and getting confirmation. With -dry-run it only shows the
+// plan.
+func shrinkFS(mnt string, size int64) ([]string, error) {
+	p, err := newShrinkPlan(mnt, size)
+	if err != nil {
+		return nil, err
+	}
+	p.Write(os.Stdout)
+	if !*dry && !p.confirm(os.Stdin, os.Stdout) {
+		return nil, errors.New("not confirmed; nothing changed")
+	}
+	lk, err := embiggen.LockGlobal(runCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer lk.Unlock()
+	if !*drain || !p.offline() {
+		return p.run()
+	}
+	var changes []string
+	err = drained(func() (err error) {
+		changes, err = p.run()
+		return err
+	})
+	return changes, err
+}
+
+// offline reports whether p unmounts the filesystem.
+func (p *shrinkPlan) offline() bool {
+	return p.steps[0][0] == "umount"
+}
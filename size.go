@@ -0,0 +1,245 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// sizeFlag is a flag.Value for sizes like "100G" (an absolute size)
+// or "+20G" (growth relative to the current size).
+type sizeFlag struct {
+	bytes    int64
+	relative bool
+	set      bool
+}
+
+func (f *sizeFlag) String() string {
+	if !f.set {
+		return ""
+	}
+	if f.relative {
+		return "+" + embiggen.FormatSize(f.bytes)
+	}
+	return embiggen.FormatSize(f.bytes)
+}
+
+func (f *sizeFlag) Set(s string) error {
+	rel := strings.HasPrefix(s, "+")
+	n, err := embiggen.ParseSize(strings.TrimPrefix(s, "+"))
+	if err != nil {
+		return err
+	}
+	f.bytes, f.relative, f.set = n, rel, true
+	return nil
+}
+
+// resolve returns the absolute size in bytes that f describes, given
+// the current size cur.
+func (f *sizeFlag) resolve(cur int64) int64 {
+	if f.relative {
+		return cur + f.bytes
+	}
+	return f.bytes
+}
+
+// bytesFlag is a flag.Value for absolute sizes like "10G".
+type bytesFlag int64
+
+func (f *bytesFlag) String() string {
+	if *f == 0 {
+		return ""
+	}
+	return embiggen.FormatSize(int64(*f))
+}
+
+func (f *bytesFlag) Set(s string) error {
+	n, err := embiggen.ParseSize(s)
+	if err != nil {
+		return err
+	}
+	*f = bytesFlag(n)
+	return nil
+}
+
+// amountFlag is a flag.Value for amounts given either as a size
+// ("10G") or as a percentage of some whole ("15%").
+type amountFlag embiggen.Amount
+
+func (f *amountFlag) String() string {
+	if f.Percent != 0 {
+		return strconv.FormatFloat(f.Percent, 'f', -1, 64) + "%"
+	}
+	if f.Bytes != 0 {
+		return embiggen.FormatSize(f.Bytes)
+	}
+	return ""
+}
+
+func (f *amountFlag) Set(s string) error {
+	if strings.HasSuffix(s, "%") {
+		var p percentFlag
+		if err := p.Set(s); err != nil {
+			return err
+		}
+		*f = amountFlag{Percent: float64(p)}
+		return nil
+	}
+	n, err := embiggen.ParseSize(s)
+	if err != nil {
+		return err
+	}
+	*f = amountFlag{Bytes: n}
+	return nil
+}
+
+// mountSizesFlag is a repeatable flag.Value mapping mount points to
+// sizes, given as "/var/log=50G".
+type mountSizesFlag map[string]int64
+
+func (f mountSizesFlag) String() string { return strings.Join(f.values(), ",") }
+
+func (f mountSizesFlag) values() []string {
+	var kv []string
+	for mnt, n := range f {
+		kv = append(kv, mnt+"="+embiggen.FormatSize(n))
+	}
+	sort.Strings(kv)
+	return kv
+}
+
+func (f mountSizesFlag) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid value %q; want mount-point=size", s)
+	}
+	n, err := embiggen.ParseSize(s[i+1:])
+	if err != nil {
+		return err
+	}
+	f[filepath.Clean(s[:i])] = n
+	return nil
+}
+
+// percentFlag is a flag.Value for percentages like "80%".
+type percentFlag float64
+
+func (f *percentFlag) String() string {
+	if *f == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(*f), 'f', -1, 64) + "%"
+}
+
+func (f *percentFlag) Set(s string) error {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || v <= 0 || v > 100 {
+		return fmt.Errorf("invalid percentage %q; want a value in (0%%, 100%%]", s)
+	}
+	*f = percentFlag(v)
+	return nil
+}
+
+// resolveLimit returns the limit for growing the filesystem mounted at
+// mnt, as configured by flags and the config file. A relative -size is resolved against the
+// current size of the filesystem's device, so it's only applied once
+// even in daemon mode.
+func resolveLimit(mnt string) (embiggen.Limit, error) {
+	p, err := policyFor(mnt)
+	if err != nil {
+		return embiggen.Limit{}, err
+	}
+	l := embiggen.Limit{
+		Use:       float64(p.use),
+		Reserve:   int64(p.reserve),
+		VGReserve: embiggen.Amount(p.vgReserve),
+		MinGrowth: int64(p.minGrowth),
+	}
+	if p.size.set {
+		var cur int64
+		if p.size.relative {
+			m, err := targetMount(mnt)
+			if err != nil {
+				return l, err
+			}
+			fs, err := embiggen.StatFS(m)
+			if err != nil {
+				return l, err
+			}
+			if cur, err = embiggen.BlockDevSize(fs.Dev); err != nil {
+				return l, err
+			}
+		}
+		l.Max = p.size.resolve(cur)
+	}
+	// A -max-size cap wins over everything else.
+	if max := int64(p.maxSize); max > 0 && (l.Max == 0 || l.Max > max) {
+		l.Max = max
+	}
+	return l, nil
+}
+
+// withLVFree returns lim with its LVMax set per mnt's -lv-free policy,
+// if it has one, from how full the filesystem is now.
+func withLVFree(mnt string, lim embiggen.Limit) (embiggen.Limit, error) {
+	p, err := policyFor(mnt)
+	if err != nil || p.lvFree == 0 {
+		return lim, err
+	}
+	max, _, err := lvFreeMax(mnt, float64(p.lvFree))
+	if err != nil {
+		return lim, fmt.Errorf("applying -lv-free: %w", err)
+	}
+	lim.LVMax = max
+	return lim, nil
+}
+
+// lvFreeMax returns how big the device under the filesystem at mnt
+// needs to be for keep percent of the filesystem to be free, or its
+// current size if that much already is, and whether it's short.
+func lvFreeMax(mnt string, keep float64) (max int64, short bool, err error) {
+	fs, err := embiggen.StatFS(mnt)
+	if err != nil {
+		return 0, false, err
+	}
+	dev, err := embiggen.BlockDevSize(fs.Dev)
+	if err != nil {
+		return 0, false, err
+	}
+	bsize := int64(fs.Statfs.Bsize)
+	want := lvFreeSize(int64(fs.Statfs.Blocks)*bsize, int64(fs.Statfs.Bavail)*bsize, keep)
+	if size := int64(fs.Statfs.Blocks) * bsize; want > size {
+		return dev + want - size, true, nil
+	}
+	return dev, false, nil
+}
+
+// lvFreeSize returns how big a filesystem of size bytes, avail of them
+// available, would have to be for keep percent of it to be available.
+// Space the filesystem reserves, like ext4's for root, counts as used.
+func lvFreeSize(size, avail int64, keep float64) int64 {
+	if keep > 99 {
+		keep = 99
+	}
+	return int64(float64(size-avail) / (1 - keep/100))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+func TestSizeFlag(t *testing.T) {
+	var f sizeFlag
+	if err := f.Set("+20G"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.resolve(10<<30), int64(30<<30); got != want {
+		t.Errorf("resolve = %d; want %d", got, want)
+	}
+	if got := f.String(); got != "+20G" {
+		t.Errorf("String = %q; want +20G", got)
+	}
+	if err := f.Set("100G"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.resolve(10<<30), int64(100<<30); got != want {
+		t.Errorf("resolve = %d; want %d", got, want)
+	}
+}
+
+func TestPercentFlag(t *testing.T) {
+	var f percentFlag
+	if err := f.Set("80%"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := float64(f), 80.0; got != want {
+		t.Errorf("f = %v; want %v", got, want)
+	}
+	for _, bad := range []string{"0%", "101%", "x%"} {
+		if err := f.Set(bad); err == nil {
+			t.Errorf("Set(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestAmountFlag(t *testing.T) {
+	var f amountFlag
+	if err := f.Set("10G"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := embiggen.Amount(f).Of(1<<40), int64(10<<30); got != want {
+		t.Errorf("Of = %d; want %d", got, want)
+	}
+	if err := f.Set("15%"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := embiggen.Amount(f).Of(1000), int64(150); got != want {
+		t.Errorf("Of = %d; want %d", got, want)
+	}
+}
+
+func TestMountSizesFlag(t *testing.T) {
+	f := mountSizesFlag{}
+	for _, v := range []string{"/var/log=50G", "/srv/=1T"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if got, want := f.String(), "/srv=1T,/var/log=50G"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+	if err := f.Set("50G"); err == nil {
+		t.Error("Set without mount point succeeded; want error")
+	}
+}
+
+func TestLVFreeSize(t *testing.T) {
+	tests := []struct {
+		size, avail int64
+		keep        float64
+		want        int64
+	}{
+		{100 << 30, 50 << 30, 20, 62.5 * (1 << 30)},
+		{100 << 30, 10 << 30, 20, 112.5 * (1 << 30)},
+		{100 << 30, 0, 50, 200 << 30},
+	}
+	for _, tt := range tests {
+		if got := lvFreeSize(tt.size, tt.avail, tt.keep); got != tt.want {
+			t.Errorf("lvFreeSize(%d, %d, %v) = %d; want %d", tt.size, tt.avail, tt.keep, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var stateDir = flag.String("state-dir", "/var/lib/embiggen-disk", "in daemon mode, remember each target's failures here across restarts, along with what's left of the -partition-rate-limit; empty to disable")
+
+// maxRetryWait is the longest the daemon waits to retry a target that
+// keeps failing.
+const maxRetryWait = time.Hour
+
+// A targetState is what the daemon remembers about a target between
+// checks, and across restarts in the -state-dir.
+type targetState struct {
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastResize  time.Time `json:"lastResize,omitempty"`
+	Failures    int       `json:"failures,omitempty"` // in a row
+	Tripped     bool      `json:"tripped,omitempty"`  // too many failures; leave it alone
+	Paused      bool      `json:"paused,omitempty"`   // by the control API
+	LastError   string    `json:"lastError,omitempty"`
+	// NextAutoGrow is the earliest the cloud volume may be enlarged
+	// again, per -auto-grow-interval.
+	NextAutoGrow time.Time `json:"nextAutoGrow,omitempty"`
+	// Generation identifies the devices and sizes under the target
+	// when it last failed. If they change, it's worth trying again.
+	Generation string `json:"generation,omitempty"`
+}
+
+// retryAt returns when a target that's failed st.Failures times in a
+// row should next be tried: after a wait that doubles with each
+// failure, starting at wait.
+func (st *targetState) retryAt(wait time.Duration) time.Time {
+	if st.Failures == 0 {
+		return time.Time{}
+	}
+	for i := 1; i < st.Failures && wait < maxRetryWait; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return st.LastAttempt.Add(wait)
+}
+
+func statePath() string {
+	if *stateDir == "" {
+		return ""
+	}
+	return filepath.Join(*stateDir, "state.json")
+}
+
+// loadStates reads the target states saved by saveStates. A missing
+// or unreadable file just means starting afresh.
+func loadStates() map[string]*targetState {
+	states := map[string]*targetState{}
+	path := statePath()
+	if path == "" {
+		return states
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return states
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &states)
+	}
+	if err != nil {
+		warnf("ignoring saved state: %v", err)
+		return map[string]*targetState{}
+	}
+	return states
+}
+
+// saveStates writes states to the -state-dir, atomically. Errors are
+// only logged.
+func saveStates(states map[string]*targetState) {
+	path := statePath()
+	if path == "" || *dry {
+		return
+	}
+	if err := writeStates(path, states); err != nil {
+		warnf("saving state: %v", err)
+	}
+}
+
+func writeStates(path string, states map[string]*targetState) error {
+	return writeJSON(path, states)
+}
+
+// writeJSON writes v to path as JSON, atomically.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// fullCheckInterval is how often -diff-sizes checks a target fully even
+// though its sizes haven't changed.
+const fullCheckInterval = time.Hour
+
+// A sizeSnapshot is a target's sizeFingerprint when a check found
+// nothing to do.
+type sizeSnapshot struct {
+	sizes string
+	at    time.Time
+}
+
+// sizeFingerprint returns the sizes of the filesystem mounted at mnt and
+// the devices under it, as read cheaply from statfs and sysfs, in a
+// form that can be compared between checks. With -lv-free, it includes
+// whether the filesystem is short of free space, and with
+// -add-disks-to, every disk, so an attached one counts as a change.
+func sizeFingerprint(mnt string) (string, error) {
+	sizes, err := embiggen.StackSizes(mnt)
+	if err != nil {
+		return "", err
+	}
+	if p, err := policyFor(mnt); err == nil && p.lvFree > 0 {
+		if _, short, err := lvFreeMax(mnt, float64(p.lvFree)); err == nil && short {
+			sizes["lv-free-short"] = 1
+		}
+	}
+	if len(engineOpts.AddDisksTo) > 0 {
+		disks, _ := filepath.Glob("/sys/block/*/size")
+		for _, f := range disks {
+			if b, err := ioutil.ReadFile(f); err == nil {
+				sizes[filepath.Dir(f)], _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+			}
+		}
+	}
+	return formatSizes(sizes), nil
+}
+
+func formatSizes(sizes map[string]int64) string {
+	var keys []string
+	for k := range sizes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%d\n", k, sizes[k])
+	}
+	return b.String()
+}
+
+// deviceGeneration returns a fingerprint of the devices under mnt and
+// their sizes, including the whole disk under a partition.
+func deviceGeneration(mnt string, lim embiggen.Limit) (string, error) {
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		return "", err
+	}
+	chain, err := embiggen.Chain(runCtx, e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, r := range chain {
+		n, err := r.Size(runCtx)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s=%d\n", r.Device(), n)
+		if p, ok := r.(embiggen.PartitionResizer); ok {
+			disk, err := embiggen.DiskDev(p.Device())
+			if err != nil {
+				return "", err
+			}
+			n, err := embiggen.BlockDevSize(disk)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s=%d\n", disk, n)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
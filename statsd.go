@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var metricsURL = flag.String("metrics", "", "in daemon mode, also push metrics to StatsD/DogStatsD, as \"statsd://host:8125\", optionally with \"?tags=env:prod,team:storage\"")
+
+// A statsdSink sends metrics over UDP in the DogStatsD format, which
+// plain StatsD servers accept minus the tags.
+type statsdSink struct {
+	conn net.Conn
+	tags []string
+}
+
+// statsd is where to push metrics, or nil. Set by setupStatsd.
+var statsd *statsdSink
+
+// setupStatsd sets statsd from -metrics or the config file.
+func setupStatsd() error {
+	raw := flagOr("metrics", *metricsURL, cfg.Metrics)
+	if raw == "" {
+		statsd = nil
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "statsd" || u.Host == "" {
+		return fmt.Errorf("bad -metrics %q; want statsd://host:port", raw)
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return fmt.Errorf("-metrics: %v", err)
+	}
+	s := &statsdSink{conn: conn}
+	if t := u.Query().Get("tags"); t != "" {
+		s.tags = strings.Split(t, ",")
+	}
+	statsd = s
+	return nil
+}
+
+// line formats one metric, with s's tags and any more.
+func (s *statsdSink) line(name string, val interface{}, typ string, tags ...string) string {
+	l := fmt.Sprintf("embiggen.%s:%v|%s", name, val, typ)
+	if all := append(append([]string(nil), s.tags...), tags...); len(all) > 0 {
+		l += "|#" + strings.Join(all, ",")
+	}
+	return l
+}
+
+// send sends lines, batched into datagrams. Errors are ignored, as
+// with UDP they'd mostly go unseen anyway.
+func (s *statsdSink) send(lines []string) {
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+len(l) > 1400 {
+			s.conn.Write(buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l)
+	}
+	if buf.Len() > 0 {
+		s.conn.Write(buf.Bytes())
+	}
+}
+
+// statsdCheck pushes the outcome of growing mnt, and its sizes now.
+func statsdCheck(mnt string, lim embiggen.Limit, changes []embiggen.Change, err error) {
+	s := statsd
+	if s == nil {
+		return
+	}
+	mt := "mount:" + mnt
+	lines := []string{s.line("resize.attempts", 1, "c", mt)}
+	if err != nil {
+		lines = append(lines, s.line("resize.failures", 1, "c", mt))
+	} else {
+		lines = append(lines, s.line("resize.successes", 1, "c", mt))
+	}
+	for _, c := range changes {
+		lt := "layer:" + c.Layer
+		lines = append(lines,
+			s.line("layers_resized", 1, "c", mt, lt),
+			s.line("layer_resize_duration", c.Duration.Milliseconds(), "ms", lt))
+	}
+	if st, err := embiggen.StatFS(mnt); err == nil {
+		bs := int64(st.Statfs.Bsize)
+		lines = append(lines,
+			s.line("filesystem.size_bytes", int64(st.Statfs.Blocks)*bs, "g", mt),
+			s.line("filesystem.free_bytes", int64(st.Statfs.Bavail)*bs, "g", mt))
+	}
+	if e, err := embiggen.FileSystemResizer(runCtx, mnt, lim); err == nil {
+		if n, err := reclaimable(e); err == nil {
+			lines = append(lines, s.line("unclaimed_bytes", n, "g", mt))
+		}
+	}
+	s.send(lines)
+}
@@ -0,0 +1,595 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	unitPath   = flag.String("unit-path", "/etc/systemd/system/embiggen-disk.service", "where the systemd subcommand installs the unit file")
+	copyBinary = flag.Bool("copy-binary", false, "with systemd install, copy this binary to "+installedBinary+" and have the unit run that")
+	unitMode   = flag.String("mode", "daemon", "what the systemd subcommand installs: daemon, a long-running service, or timer, a oneshot service run by a timer")
+	onCalendar = flag.String("on-calendar", "*:0/5", "with systemd -mode=timer, when to run, as a systemd OnCalendar= time")
+	socketUnit = flag.Bool("socket-activation", false, "with systemd install, also install a socket unit that owns the -control-socket, passes it to the daemon, and starts the daemon on demand")
+	hardenUnit = flag.Bool("harden-unit", true, "sandbox the systemd unit, limiting it to the devices, capabilities and paths a disk tool needs; -harden-unit=false if hooks need more")
+)
+
+// unitHardening are the sandboxing directives for the unit with
+// -harden-unit. The daemon needs the block devices, device-mapper
+// control and, to watch for I/O errors, /dev/kmsg, CAP_SYS_ADMIN for resize ioctls, CAP_SYS_RESOURCE for ext4's
+// online resize, CAP_SYS_RAWIO for raw partition table writes, and
+// CAP_IPC_LOCK for LVM's mlock; writes to
+// its own state, logs and locks, and LVM's metadata backups; and
+// sockets for netlink uevents, journald, LVM and notifications.
+var unitHardening = []string{
+	"CapabilityBoundingSet=CAP_SYS_ADMIN CAP_SYS_RESOURCE CAP_SYS_RAWIO CAP_IPC_LOCK",
+	"NoNewPrivileges=true",
+	"DevicePolicy=closed",
+	"DeviceAllow=block-* rw",
+	"DeviceAllow=/dev/mapper/control rw",
+	"DeviceAllow=/dev/kmsg r",
+	"ProtectSystem=full",
+	"ProtectHome=true",
+	"ProtectControlGroups=true",
+	"ProtectKernelModules=true",
+	"PrivateTmp=true",
+	"ReadWritePaths=-/etc/lvm -/run -/var/lib/embiggen-disk -/var/log/embiggen-disk",
+	"RestrictAddressFamilies=AF_UNIX AF_NETLINK AF_INET AF_INET6",
+	"RestrictNamespaces=true",
+	"RestrictRealtime=true",
+	"RestrictSUIDSGID=true",
+	"LockPersonality=true",
+	"SystemCallArchitectures=native",
+}
+
+// hardening returns unitHardening for a unit growing targets. It
+// leaves out ProtectHome if any of them is under the home directories
+// it hides, as they couldn't be grown.
+func hardening(targets []string) []string {
+	var h []string
+	for _, d := range unitHardening {
+		if d == "ProtectHome=true" && underHome(targets) {
+			continue
+		}
+		h = append(h, d)
+	}
+	return h
+}
+
+// underHome reports whether any of mnts is in a directory ProtectHome
+// hides.
+func underHome(mnts []string) bool {
+	for _, mnt := range mnts {
+		mnt = filepath.Clean(mnt)
+		for _, home := range []string{"/home", "/root", "/run/user"} {
+			if mnt == home || strings.HasPrefix(mnt, home+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const installedBinary = "/usr/local/sbin/embiggen-disk"
+
+// A unit is the systemd service installed by the systemd subcommand.
+type unit struct {
+	binary string
+	mode   string   // "daemon" or "timer"
+	args   []string // for binary
+	harden bool     // sandbox with unitHardening
+	socket string   // name of the socket unit passing it the control socket, if any
+}
+
+// file returns u's unit file. In daemon mode it adds -daemon to the
+// command line; the daemon tells systemd when it's ready and pings the
+// watchdog while its loop is alive, so a daemon stuck in a check is
+// restarted. In timer mode it's a oneshot, started by timerFile's
+// timer.
+func (u unit) file() string {
+	cmd := []string{systemdQuote(u.binary)}
+	if u.mode == "daemon" {
+		cmd = append(cmd, "-daemon")
+	}
+	for _, a := range u.args {
+		cmd = append(cmd, systemdQuote(a))
+	}
+	var deps, sandbox string
+	if u.socket != "" {
+		deps = "Requires=" + u.socket + "\nAfter=" + u.socket + "\n"
+	}
+	if u.harden {
+		targets := cfg.mounts()
+		for _, a := range u.args {
+			if !strings.HasPrefix(a, "-") {
+				targets = append(targets, a)
+			}
+		}
+		sandbox = strings.Join(hardening(targets), "\n") + "\n"
+	}
+	if u.mode == "timer" {
+		return `[Unit]
+Description=embiggen-disk
+After=local-fs.target
+
+[Service]
+Type=oneshot
+# 1 means there was nothing to grow.
+SuccessExitStatus=1
+ExecStart=` + strings.Join(cmd, " ") + `
+` + sandbox
+	}
+	return `[Unit]
+Description=embiggen-disk
+` + deps + `
+[Service]
+Type=notify
+NotifyAccess=main
+WatchdogSec=2min
+Restart=on-failure
+ExecStart=` + strings.Join(cmd, " ") + `
+` + sandbox + `
+[Install]
+WantedBy=multi-user.target
+`
+}
+
+// timerFile returns the timer that starts the timer mode service at
+// calendar times.
+func timerFile(calendar string) string {
+	return `[Unit]
+Description=Run embiggen-disk periodically
+
+[Timer]
+OnCalendar=` + calendar + `
+Persistent=true
+RandomizedDelaySec=30s
+
+[Install]
+WantedBy=timers.target
+`
+}
+
+// socketFile returns the socket unit for the control socket at path.
+// Connecting to it starts the service if it isn't running.
+func socketFile(path string) string {
+	return `[Unit]
+Description=embiggen-disk control socket
+
+[Socket]
+ListenStream=` + path + `
+SocketMode=0660
+RemoveOnStop=true
+
+[Install]
+WantedBy=sockets.target
+`
+}
+
+// siblingPath returns the path of the unit next to the -unit-path
+// service with the given suffix, like ".timer".
+func siblingPath(suffix string) string {
+	return strings.TrimSuffix(*unitPath, ".service") + suffix
+}
+
+// systemdQuote quotes s for a unit file command line, if needed,
+// and escapes systemd's % specifiers and $ variables.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer("%", "%%", "$", "$$").Replace(s)
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// unitBinary returns the path of the binary for the unit to run: this
+// one, or a copy of it at installedBinary with -copy-binary.
+func unitBinary() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	if !*copyBinary {
+		if strings.HasPrefix(exe, os.TempDir()+"/") {
+			warnf("%s looks temporary, as from go run; consider -copy-binary", exe)
+		}
+		return exe, nil
+	}
+	if exe == installedBinary {
+		return exe, nil
+	}
+	data, err := ioutil.ReadFile(exe)
+	if err != nil {
+		return "", err
+	}
+	// Write then rename, so a running copy isn't disturbed.
+	tmp := installedBinary + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, installedBinary); err != nil {
+		return "", err
+	}
+	return installedBinary, nil
+}
+
+// unitOnlyFlags are flags for the systemd and kubernetes subcommands
+// themselves, not to be passed on to the daemon.
+var unitOnlyFlags = map[string]bool{"unit-path": true, "copy-binary": true, "mode": true, "on-calendar": true, "harden-unit": true, "socket-activation": true, "daemon": true, "image": true, "namespace": true, "host-root": true}
+
+// systemdMain implements the "systemd [install|uninstall|status]"
+// subcommand. Flags given to install, before or after "systemd", are
+// passed on to the daemon in the unit, along with a mount point for
+// each -target.
+func systemdMain(args []string) {
+	cmd := "install"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	if cmd != "install" && len(args) > 0 {
+		usage()
+	}
+	daemonArgs, err := unitArgs(givenFlags(), args)
+	if err != nil {
+		exitf(exitUsage, "systemd %s: %v", cmd, err)
+	}
+	timerPath, socketPath := siblingPath(".timer"), siblingPath(".socket")
+	unitName, timerName, socketName := filepath.Base(*unitPath), filepath.Base(timerPath), filepath.Base(socketPath)
+	switch cmd {
+	case "install":
+		if *unitMode != "daemon" && *unitMode != "timer" {
+			exitf(exitUsage, "unsupported -mode %q; want daemon or timer", *unitMode)
+		}
+		if *unitMode == "timer" && *socketUnit {
+			exitf(exitUsage, "-socket-activation needs -mode=daemon")
+		}
+		if *socketUnit && *controlSocket == "" {
+			exitf(exitUsage, "-socket-activation needs a -control-socket")
+		}
+		bin, err := unitBinary()
+		if err != nil {
+			fatalf("error finding the binary for the unit to run: %v", err)
+		}
+		// Stop and remove what an install with other flags left
+		// that this one doesn't want.
+		if *unitMode == "daemon" {
+			removeUnit(timerPath)
+		} else if _, err := os.Stat(*unitPath); err == nil {
+			mustSystemctl("disable", "--now", unitName)
+		}
+		if !*socketUnit {
+			removeUnit(socketPath)
+		}
+		u := unit{binary: bin, mode: *unitMode, args: daemonArgs, harden: *hardenUnit}
+		if *socketUnit {
+			u.socket = socketName
+		}
+		writeUnit(*unitPath, u.file())
+		switch {
+		case *unitMode == "timer":
+			writeUnit(timerPath, timerFile(*onCalendar))
+			mustSystemctl("daemon-reload")
+			mustSystemctl("enable", timerName)
+			mustSystemctl("restart", timerName)
+			systemdStatus(timerName)
+			fmt.Printf("Installed and started %s, running %s at %s.\n", timerName, bin, *onCalendar)
+			return
+		case *socketUnit:
+			writeUnit(socketPath, socketFile(*controlSocket))
+			mustSystemctl("daemon-reload")
+			mustSystemctl("enable", socketName, unitName)
+			// The socket can't be restarted under a running service.
+			mustSystemctl("stop", unitName)
+			mustSystemctl("restart", socketName)
+			mustSystemctl("start", unitName)
+			systemdStatus(socketName, unitName)
+			fmt.Printf("Installed and started %s and %s on %s, running %s.\n", socketName, unitName, *controlSocket, bin)
+			return
+		}
+		mustSystemctl("daemon-reload")
+		mustSystemctl("enable", unitName)
+		mustSystemctl("restart", unitName)
+		systemdStatus(unitName)
+		fmt.Printf("Installed and started %s, running %s.\n", unitName, bin)
+	case "uninstall":
+		var removed bool
+		// Stopping waits for any step in progress to finish.
+		for _, p := range []string{timerPath, socketPath, *unitPath} {
+			removed = removeUnit(p) || removed
+		}
+		if !removed {
+			fmt.Printf("%s isn't installed.\n", *unitPath)
+			return
+		}
+		mustSystemctl("daemon-reload")
+		fmt.Printf("Stopped, disabled and removed %s.\n", unitName)
+	case "status":
+		var units []string
+		for _, p := range []string{timerPath, socketPath} {
+			if _, err := os.Stat(p); err == nil {
+				units = append(units, filepath.Base(p))
+			}
+		}
+		os.Exit(systemdStatus(append(units, unitName)...))
+	default:
+		usage()
+	}
+}
+
+// writeUnit writes a unit file, exiting on failure. Only root can
+// read it, as the daemon's flags in it may be secrets, like
+// -slack-webhook-url or an Authorization -webhook-header.
+func writeUnit(path, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		fatalf("error writing %s: %v", path, err)
+	}
+	// WriteFile keeps the mode of a unit that's already there.
+	if err := os.Chmod(path, 0600); err != nil {
+		fatalf("error writing %s: %v", path, err)
+	}
+}
+
+// removeUnit stops, disables and removes the unit file at path, if
+// it's there, and reports whether it was.
+func removeUnit(path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	mustSystemctl("disable", "--now", filepath.Base(path))
+	if err := os.Remove(path); err != nil {
+		fatalf("error removing %s: %v", path, err)
+	}
+	return true
+}
+
+// sdListeners returns the sockets passed by systemd socket activation,
+// if any.
+func sdListeners() []net.Listener {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return nil
+	}
+	var lns []net.Listener
+	for fd := 3; fd < 3+n; fd++ {
+		syscall.CloseOnExec(fd) // not for hooks
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			warnf("ignoring socket passed by systemd: %v", err)
+			continue
+		}
+		lns = append(lns, ln)
+	}
+	return lns
+}
+
+// A unitFlag is a flag.Value that sets a global flag and also records
+// it for the unit's command line.
+type unitFlag struct {
+	f    *flag.Flag
+	args *[]string
+}
+
+func (u unitFlag) String() string { return "" }
+
+func (u unitFlag) IsBoolFlag() bool {
+	b, ok := u.f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func (u unitFlag) Set(s string) error {
+	if err := u.f.Value.Set(s); err != nil {
+		return err
+	}
+	if !unitOnlyFlags[u.f.Name] {
+		*u.args = append(*u.args, "-"+u.f.Name+"="+s)
+	}
+	return nil
+}
+
+// A repeatedFlag is a flag.Value that may be given more than once.
+// Its String joins its values in a way its Set needn't split, so
+// they're passed on one at a time.
+type repeatedFlag interface {
+	values() []string
+}
+
+// givenFlags returns the flags given on the command line, as
+// "-name=value", for the unit's command line.
+func givenFlags() []string { return setFlags(flag.CommandLine) }
+
+// setFlags returns the flags set in fs as "-name=value", with a
+// repeatedFlag given once for each of its values.
+func setFlags(fs *flag.FlagSet) []string {
+	var flags []string
+	fs.Visit(func(f *flag.Flag) {
+		if unitOnlyFlags[f.Name] {
+			return
+		}
+		if r, ok := f.Value.(repeatedFlag); ok {
+			for _, v := range r.values() {
+				flags = append(flags, "-"+f.Name+"="+v)
+			}
+			return
+		}
+		flags = append(flags, "-"+f.Name+"="+f.Value.String())
+	})
+	return flags
+}
+
+// unitArgs returns the daemon's command line for the unit: flags, as
+// given before "systemd", and those in args, which are the same flags
+// plus -target, followed by the targets. With none of either, it's
+// "-verbose /", or just "-verbose" if the config file has targets.
+func unitArgs(flags, args []string) ([]string, error) {
+	var targets []string
+	fs := flag.NewFlagSet("systemd", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(unitFlag{f, &flags}, f.Name, f.Usage)
+	})
+	fs.Var((*stringsFlag)(&targets), "target", "mount point for the daemon to grow; may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q; give mount points with -target", fs.Arg(0))
+	}
+	if len(flags) == 0 {
+		flags = []string{"-verbose"}
+	}
+	if len(targets) == 0 && len(cfg.Targets) == 0 {
+		targets = []string{"/"}
+	}
+	return append(flags, targets...), nil
+}
+
+// stringsFlag is a repeatable flag.Value of strings.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) values() []string { return *f }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// mustSystemctl runs systemctl with args, exiting if it fails.
+func mustSystemctl(args ...string) {
+	if err := systemctl(args...); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// systemctl runs systemctl with args, returning its output in the
+// error if it fails.
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running systemctl %s: %v, %s", strings.Join(args, " "), execErr(err), bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// systemdStatus shows systemctl status for the unit and returns its
+// exit code: 0 if it's running, 3 if not, 4 if it isn't installed.
+func systemdStatus(units ...string) int {
+	cmd := exec.Command("systemctl", append([]string{"status", "--no-pager"}, units...)...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	if err != nil {
+		fatalf("running systemctl status: %v", err)
+	}
+	return 0
+}
+
+// sdNotify sends state, like "READY=1", to systemd if it's listening.
+// Errors are ignored: not running under systemd is fine.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		vlogf("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
+
+// watchdogBusyLimit is how long a single check may run before the
+// watchdog stops being pinged, letting systemd restart the daemon.
+// Growing a big filesystem can legitimately take a while.
+const watchdogBusyLimit = 30 * time.Minute
+
+// loopBusy is when the check in progress started, or zero between
+// checks.
+var loopBusy struct {
+	sync.Mutex
+	since time.Time
+}
+
+func setBusy(busy bool) {
+	loopBusy.Lock()
+	defer loopBusy.Unlock()
+	if busy {
+		loopBusy.since = time.Now()
+	} else {
+		loopBusy.since = time.Time{}
+	}
+}
+
+// startWatchdog pings the systemd watchdog, if it's enabled for this
+// process, at half its interval for as long as the daemon isn't stuck
+// in a check.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	every := time.Duration(usec) * time.Microsecond / 2
+	vlogf("pinging the systemd watchdog every %v", every)
+	go func() {
+		for range time.Tick(every) {
+			loopBusy.Lock()
+			since := loopBusy.since
+			loopBusy.Unlock()
+			if !since.IsZero() && time.Since(since) > watchdogBusyLimit {
+				warnf("check running for %v; no longer pinging the systemd watchdog", time.Since(since).Round(time.Second))
+				continue
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/usr/local/sbin/embiggen-disk", "/usr/local/sbin/embiggen-disk"},
+		{"/opt/my tools/embiggen-disk", `"/opt/my tools/embiggen-disk"`},
+		{"/opt/50%/embiggen-disk", "/opt/50%%/embiggen-disk"},
+		{`/opt/a"b c/$x`, `"/opt/a\"b c/$$x"`},
+	}
+	for _, tt := range tests {
+		if got := systemdQuote(tt.in); got != tt.want {
+			t.Errorf("systemdQuote(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnitFile(t *testing.T) {
+	u := unit{binary: "/usr/local/sbin/embiggen-disk", mode: "daemon", args: []string{"-verbose", "/"}}.file()
+	if !strings.Contains(u, "\nExecStart=/usr/local/sbin/embiggen-disk -daemon -verbose /\n") {
+		t.Errorf("unit file doesn't run the binary given:\n%s", u)
+	}
+	u = unit{binary: "/usr/local/sbin/embiggen-disk", mode: "timer", args: []string{"/"}, harden: true}.file()
+	for _, want := range []string{"\nType=oneshot\n", "\nSuccessExitStatus=1\n", "\nExecStart=/usr/local/sbin/embiggen-disk /\n"} {
+		if !strings.Contains(u, want) {
+			t.Errorf("timer mode unit file lacks %q:\n%s", want, u)
+		}
+	}
+	if !strings.Contains(u, "\nCapabilityBoundingSet=CAP_SYS_ADMIN CAP_SYS_RESOURCE CAP_SYS_RAWIO CAP_IPC_LOCK\n") {
+		t.Errorf("hardened unit file lacks a capability bounding set:\n%s", u)
+	}
+	if strings.Contains(u, "[Install]") {
+		t.Errorf("timer mode unit file has an [Install] section; only its timer should:\n%s", u)
+	}
+	for _, want := range []string{"\nDeviceAllow=/dev/kmsg r\n", "\nProtectHome=true\n"} {
+		if !strings.Contains(u, want) {
+			t.Errorf("hardened unit file for / lacks %q:\n%s", want, u)
+		}
+	}
+	u = unit{binary: "/usr/local/sbin/embiggen-disk", mode: "daemon", args: []string{"-verbose", "/", "/home"}, harden: true}.file()
+	if strings.Contains(u, "ProtectHome") {
+		t.Errorf("hardened unit file for /home hides it:\n%s", u)
+	}
+}
+
+func TestUnitArgs(t *testing.T) {
+	defer func(i time.Duration, h string) { *interval, *postResizeHook = i, h }(*interval, *postResizeHook)
+	got, err := unitArgs(nil, []string{"-target", "/", "-target", "/var", "-interval", "60s", "-post-resize-hook", "systemctl restart kubelet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-interval=60s", "-post-resize-hook=systemctl restart kubelet", "/", "/var"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unitArgs = %q; want %q", got, want)
+	}
+	if *interval != time.Minute {
+		t.Errorf("-interval after unitArgs = %v; want 1m", *interval)
+	}
+	u := unit{binary: "/sbin/embiggen-disk", mode: "daemon", args: got, harden: true}.file()
+	if !strings.Contains(u, `ExecStart=/sbin/embiggen-disk -daemon -interval=60s "-post-resize-hook=systemctl restart kubelet" / /var`) {
+		t.Errorf("bad ExecStart in unit:\n%s", u)
+	}
+
+	if _, err := unitArgs([]string{"-verbose=true"}, []string{"/var"}); err == nil {
+		t.Errorf("unitArgs with a bare mount point succeeded; want error")
+	}
+}
+
+func TestUnitArgsRepeatedFlags(t *testing.T) {
+	parse := func(args []string) (*flag.FlagSet, mountSizesFlag, headersFlag, *stringsFlag) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		sizes, headers, windows := mountSizesFlag{}, headersFlag{}, new(stringsFlag)
+		fs.Var(sizes, "max-size", "")
+		fs.Var(headers, "webhook-header", "")
+		fs.Var(windows, "maintenance-window", "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return fs, sizes, headers, windows
+	}
+	fs, sizes, headers, windows := parse([]string{
+		"-max-size", "/a=1G", "-max-size", "/b=2G",
+		"-webhook-header", "Authorization: Bearer x", "-webhook-header", "X-Env: prod",
+		"-maintenance-window", "Sat 02:00-04:00", "-maintenance-window", "Sun 02:00-04:00",
+	})
+	args, err := unitArgs(setFlags(fs), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sizes2, headers2, windows2 := parse(args[:len(args)-1]) // less the target, /
+	if !reflect.DeepEqual(sizes2, sizes) || !reflect.DeepEqual(headers2, headers) || !reflect.DeepEqual(*windows2, *windows) {
+		t.Errorf("unitArgs = %q, which parses as %v, %v, %q; want %v, %v, %q", args, sizes2, headers2, *windows2, sizes, headers, *windows)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+// isDeviceTarget reports whether target names a device, like
+// /dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123, rather than
+// a mount point.
+func isDeviceTarget(target string) bool {
+	if !strings.HasPrefix(target, "/dev/") {
+		return false
+	}
+	fi, err := os.Stat(target)
+	return err != nil || !fi.IsDir() // a missing device may come back
+}
+
+// targetMount returns the mount point to grow for target: target
+// itself, or for a device target, where the filesystem on or above the
+// device it links to is mounted now. It's looked up each time, as
+// kernel names like /dev/nvme1n1 change across reboots and reattaches.
+func targetMount(target string) (string, error) {
+	if !isDeviceTarget(target) {
+		return target, nil
+	}
+	return embiggen.MountPoint(target)
+}
+
+// mountsDevice reports whether mount point mnt is where device target
+// target is mounted now.
+func mountsDevice(mnt, target string) bool {
+	if !isDeviceTarget(target) || isDeviceTarget(mnt) {
+		return false
+	}
+	m, err := targetMount(target)
+	return err == nil && m == mnt
+}
@@ -0,0 +1,32 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestIsDeviceTarget(t *testing.T) {
+	for target, want := range map[string]bool{
+		"/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123": true, // not attached
+		"/dev/null":       true,
+		"/var/lib/docker": false,
+		"/":               false,
+	} {
+		if got := isDeviceTarget(target); got != want {
+			t.Errorf("isDeviceTarget(%q) = %v; want %v", target, got, want)
+		}
+	}
+}
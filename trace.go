@@ -0,0 +1,200 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var otlpEndpoint = flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector to send a trace of each resize to, like \"http://localhost:4318\"; defaults to $OTEL_EXPORTER_OTLP_ENDPOINT")
+
+// A span is one timed step of a resize, in OpenTelemetry terms.
+type span struct {
+	traceID, id, parent string // hex
+	name                string
+	start, end          time.Time
+	attrs               map[string]string
+	err                 error
+}
+
+// A tracer collects the spans of one resize until they're exported.
+type tracer struct {
+	traceID string
+	spans   []*span
+	open    []*span // innermost last
+}
+
+// tracing is the trace of the resize in progress, or nil if there's
+// none or tracing is off.
+var tracing *tracer
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startTrace begins tracing a resize of mnt, if an OTLP endpoint is
+// set, and returns its root span.
+func startTrace(mnt string) *span {
+	tracing = nil
+	if otlpURL() == "" {
+		return nil
+	}
+	tracing = &tracer{traceID: randHex(16)}
+	return startSpan("embiggen "+mnt, "mount", mnt, "dry_run", strconv.FormatBool(*dry))
+}
+
+// startSpan starts a child of the innermost open span, with attributes
+// given as key, value pairs. It returns nil if there's no trace.
+func startSpan(name string, kv ...string) *span {
+	if tracing == nil {
+		return nil
+	}
+	s := &span{traceID: tracing.traceID, id: randHex(8), name: name, start: time.Now(), attrs: map[string]string{}}
+	if n := len(tracing.open); n > 0 {
+		s.parent = tracing.open[n-1].id
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.attrs[kv[i]] = kv[i+1]
+	}
+	tracing.spans = append(tracing.spans, s)
+	tracing.open = append(tracing.open, s)
+	return s
+}
+
+// finish ends s, recording err if it's non-nil. A nil span is a no-op.
+func (s *span) finish(err error) {
+	if s == nil || tracing == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	for i := len(tracing.open) - 1; i >= 0; i-- {
+		if tracing.open[i] == s {
+			tracing.open = tracing.open[:i]
+			break
+		}
+	}
+}
+
+// endTrace finishes the root span and sends the trace to the OTLP
+// endpoint. Errors sending it are only logged.
+func endTrace(root *span, err error) {
+	if root == nil || tracing == nil {
+		return
+	}
+	root.finish(err)
+	t := tracing
+	tracing = nil
+	body, jerr := json.Marshal(t.otlp())
+	if jerr != nil {
+		warnf("encoding trace: %v", jerr)
+		return
+	}
+	if err := postJSON(otlpURL(), body, cfg.Tracing.Headers); err != nil {
+		warnf("sending trace to %s: %v", otlpURL(), err)
+	}
+}
+
+// otlpURL returns where to POST traces: the traces path of the
+// -otlp-endpoint flag, or else of the config file's tracing endpoint,
+// or else of $OTEL_EXPORTER_OTLP_ENDPOINT.
+func otlpURL() string {
+	ep := *otlpEndpoint
+	if !flagGiven("otlp-endpoint") && cfg.Tracing.Endpoint != "" {
+		ep = cfg.Tracing.Endpoint
+	}
+	if ep == "" || strings.HasSuffix(ep, "/v1/traces") {
+		return ep
+	}
+	return strings.TrimSuffix(ep, "/") + "/v1/traces"
+}
+
+// otlp returns t as an OTLP/JSON ExportTraceServiceRequest.
+func (t *tracer) otlp() interface{} {
+	type kv struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	}
+	attrs := func(m map[string]string) []kv {
+		var l []kv
+		for k, v := range m {
+			a := kv{Key: k}
+			a.Value.StringValue = v
+			l = append(l, a)
+		}
+		return l
+	}
+	type status struct {
+		Code    int    `json:"code"` // 1 ok, 2 error
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string `json:"traceId"`
+		SpanID            string `json:"spanId"`
+		ParentSpanID      string `json:"parentSpanId,omitempty"`
+		Name              string `json:"name"`
+		Kind              int    `json:"kind"` // internal
+		StartTimeUnixNano string `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string `json:"endTimeUnixNano"`
+		Attributes        []kv   `json:"attributes,omitempty"`
+		Status            status `json:"status"`
+	}
+	var spans []otlpSpan
+	for _, s := range t.spans {
+		end := s.end
+		if end.IsZero() {
+			end = time.Now() // not finished, as after a panic
+		}
+		o := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parent,
+			Name:              s.name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+			Attributes:        attrs(s.attrs),
+			Status:            status{Code: 1},
+		}
+		if s.err != nil {
+			o.Status = status{Code: 2, Message: s.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+	host, _ := os.Hostname()
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attrs(map[string]string{"service.name": "embiggen-disk", "host.name": host}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "embiggen-disk"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
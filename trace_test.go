@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	type otlpSpan struct {
+		TraceID, SpanID, ParentSpanID, Name string
+		Status                              struct{ Code int }
+	}
+	var got struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("bad OTLP body: %v", err)
+		}
+	}))
+	defer srv.Close()
+	defer func(old string) { *otlpEndpoint = old }(*otlpEndpoint)
+	*otlpEndpoint = srv.URL
+
+	root := startTrace("/data")
+	sp := startSpan("resize lvm-lv", "device", "/dev/vg/data")
+	startSpan("lvextend").finish(errors.New("exit status 5"))
+	sp.finish(nil)
+	endTrace(root, nil)
+
+	if path != "/v1/traces" {
+		t.Errorf("POSTed to %q; want /v1/traces", path)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %+v", got)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans; want 3", len(spans))
+	}
+	r, l, c := spans[0], spans[1], spans[2]
+	if r.Name != "embiggen /data" || r.ParentSpanID != "" || len(r.TraceID) != 32 {
+		t.Errorf("root span = %+v", r)
+	}
+	if l.ParentSpanID != r.SpanID || c.ParentSpanID != l.SpanID || c.TraceID != r.TraceID {
+		t.Errorf("bad span tree: %+v", spans)
+	}
+	if c.Status.Code != 2 || l.Status.Code != 1 {
+		t.Errorf("statuses = %d, %d; want 2 (error), 1 (ok)", c.Status.Code, l.Status.Code)
+	}
+	if tracing != nil {
+		t.Errorf("trace still in progress after endTrace")
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+	"golang.org/x/sys/unix"
+)
+
+// tuiRefresh is how often the tui subcommand re-reads the device tree.
+const tuiRefresh = 5 * time.Second
+
+// A tuiRow is one line of the tui view: either a mount point heading
+// (node is nil) or one layer of the stack under it.
+type tuiRow struct {
+	mnt  string
+	node *planNode
+	line string
+}
+
+type tui struct {
+	mnts    []string
+	rows    []tuiRow
+	cursor  int
+	status  string
+	pending *tuiRow // awaiting y/N before growing
+}
+
+// tuiMain implements the "tui [mount-point...]" subcommand.
+func tuiMain(args []string) {
+	mnts := args
+	if len(mnts) == 0 {
+		var err error
+		if mnts, err = embiggen.ResizableMounts(runCtx); err != nil {
+			fatalf("error listing mounts: %v", err)
+		}
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		fatalf("the tui subcommand needs a terminal")
+	}
+	// The tui asks before growing anything itself, and a second
+	// prompt on stdin would fight with the key reader.
+	*confirm = false
+
+	fd := int(os.Stdin.Fd())
+	saved, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		fatalf("error reading terminal settings: %v", err)
+	}
+	raw := *saved
+	raw.Lflag &^= unix.ECHO | unix.ICANON
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		fatalf("error setting terminal to raw mode: %v", err)
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l") // alternate screen, hide cursor
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		unix.IoctlSetTermios(fd, ioctlSetTermios, saved)
+	}()
+
+	keys := make(chan string)
+	go readKeys(keys)
+
+	t := &tui{mnts: mnts}
+	t.load()
+	t.draw()
+	tick := time.NewTicker(tuiRefresh)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.load()
+		case k, ok := <-keys:
+			if !ok || !t.key(k) {
+				return
+			}
+		}
+		t.draw()
+	}
+}
+
+// readKeys sends each key pressed on stdin to keys, with arrow keys
+// as "up" and "down". It closes keys on EOF.
+func readKeys(keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil || n == 0 {
+			return
+		}
+		b := buf[:n]
+		switch {
+		case bytes.Equal(b, []byte("\x1b[A")), bytes.Equal(b, []byte("\x1bOA")):
+			keys <- "up"
+		case bytes.Equal(b, []byte("\x1b[B")), bytes.Equal(b, []byte("\x1bOB")):
+			keys <- "down"
+		default:
+			for _, c := range b {
+				keys <- string(c)
+			}
+		}
+	}
+}
+
+// key handles a key press, returning false if the tui should exit.
+func (t *tui) key(k string) bool {
+	if t.pending != nil {
+		r := t.pending
+		t.pending = nil
+		if k == "y" || k == "Y" {
+			t.grow(r)
+			t.load()
+		} else {
+			t.status = "Not growing " + r.node.name + "."
+		}
+		return true
+	}
+	switch k {
+	case "q", "Q", "\x03", "\x04":
+		return false
+	case "up", "k":
+		if t.cursor > 0 {
+			t.cursor--
+		}
+	case "down", "j":
+		if t.cursor < len(t.rows)-1 {
+			t.cursor++
+		}
+	case "r":
+		t.load()
+		t.status = "Refreshed."
+	case "g", "\r", "\n":
+		if t.cursor >= len(t.rows) {
+			break
+		}
+		r := &t.rows[t.cursor]
+		switch {
+		case r.node == nil:
+			t.status = "Select a layer under " + r.mnt + " to grow it."
+		case r.node.resizer == nil:
+			t.status = r.node.name + " can't be grown from here."
+		case !r.node.growable():
+			t.status = r.node.name + " is already as big as it can get."
+		default:
+			t.pending = r
+			t.status = fmt.Sprintf("Grow %s to %s? [y/N]", r.node.name, embiggen.HumanSize(r.node.att))
+		}
+	}
+	return true
+}
+
+// grow resizes the layer in r, and the layers it depends on.
+func (t *tui) grow(r *tuiRow) {
+	lk, err := embiggen.LockGlobal(runCtx)
+	if err != nil {
+		t.status = fmt.Sprintf("Error growing %s: %v", r.node.name, err)
+		return
+	}
+	defer lk.Unlock()
+	ctx, cmds := embiggen.WithCommandLog(runCtx)
+	root := startTrace(r.mnt)
+	changes, err := embiggen.Resize(ctx, r.node.resizer)
+	saveRateLimit()
+	endTrace(root, err)
+	auditResize(ctx, r.mnt, changes, cmds.Commands(), err)
+	switch {
+	case err != nil:
+		t.status = fmt.Sprintf("Error growing %s: %v", r.node.name, err)
+	case len(changes) == 0:
+		t.status = "No changes made."
+	default:
+		var sb strings.Builder
+		for i, c := range changes {
+			if i > 0 {
+				sb.WriteString("; ")
+			}
+			sb.WriteString(c.String())
+		}
+		t.status = sb.String()
+	}
+}
+
+// load re-reads the device tree under each mount point, keeping the
+// cursor on the same row where it can.
+func (t *tui) load() {
+	var rows []tuiRow
+	for _, mnt := range t.mnts {
+		rows = append(rows, tuiRow{mnt: mnt, line: mnt})
+		nodes, err := tuiPlan(mnt)
+		if err != nil {
+			rows = append(rows, tuiRow{mnt: mnt, line: "└─ error: " + err.Error()})
+			continue
+		}
+		for i, line := range planLines(nodes) {
+			rows = append(rows, tuiRow{mnt: mnt, node: nodes[i], line: "   " + line})
+		}
+	}
+	t.rows = rows
+	if t.cursor >= len(rows) {
+		t.cursor = len(rows) - 1
+	}
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+}
+
+func tuiPlan(mnt string) ([]*planNode, error) {
+	lim, err := resolveLimit(mnt)
+	if err != nil {
+		return nil, err
+	}
+	e, err := embiggen.FileSystemResizer(runCtx, mnt, lim)
+	if err != nil {
+		return nil, err
+	}
+	return planStack(e)
+}
+
+func (t *tui) draw() {
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	title := "embiggen-disk"
+	if *dry {
+		title += " (dry run)"
+	}
+	sb.WriteString(title + " — " + time.Now().Format("15:04:05") + "\r\n\r\n")
+	for i, r := range t.rows {
+		line := r.line
+		if r.node != nil && r.node.growable() {
+			line = colorize(true, ansiGreen, line)
+		} else if r.node == nil && strings.Contains(line, "error:") {
+			line = colorize(true, ansiRed, line)
+		}
+		if i == t.cursor {
+			line = "\x1b[7m" + line + ansiReset
+		}
+		sb.WriteString(line + "\r\n")
+	}
+	sb.WriteString("\r\n" + colorize(true, ansiYellow, t.status) + "\r\n")
+	sb.WriteString("↑/↓ select  g grow  r refresh  q quit\r\n")
+	fmt.Print(sb.String())
+}
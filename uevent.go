@@ -0,0 +1,46 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// ueventScanInterval is the default poll interval when uevents are
+// being watched, so polling only catches what they miss.
+const ueventScanInterval = 5 * time.Minute
+
+// ueventSettle is how long to wait after a resize uevent for the
+// others in its burst (the disk, then each partition) before checking.
+const ueventSettle = time.Second
+
+// parseUevent parses a kernel uevent message, like
+// "change@/devices/...\x00ACTION=change\x00SUBSYSTEM=block\x00...",
+// into its KEY=value pairs.
+func parseUevent(b []byte) map[string]string {
+	ev := map[string]string{}
+	for i, f := range bytes.Split(b, []byte{0}) {
+		if i == 0 {
+			continue // action@devpath, repeated as ACTION and DEVPATH
+		}
+		if kv := bytes.SplitN(f, []byte("="), 2); len(kv) == 2 {
+			ev[string(kv[0])] = string(kv[1])
+		}
+	}
+	return ev
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchResizes subscribes to the kernel's uevents and sends the name
+// of each block device the kernel reports resized on the returned
+// channel. The channel is closed if reading uevents fails.
+func watchResizes() (<-chan string, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("opening uevent socket: %v", err)
+	}
+	// Group 1 is the kernel's own broadcasts, as opposed to udev's.
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding uevent socket: %v", err)
+	}
+	c := make(chan string)
+	go func() {
+		defer close(c)
+		defer unix.Close(fd)
+		buf := make([]byte, 64<<10)
+		for {
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EINTR || err == unix.ENOBUFS {
+				continue
+			}
+			if err != nil {
+				warnf("reading uevents: %v; falling back to polling", err)
+				return
+			}
+			ev := parseUevent(buf[:n])
+			if rescan, ok := capacityChanged(ev); ok && *vmwareRescan && onVMware() {
+				// The rescan makes the kernel report the disk
+				// resized, below.
+				vlogf("SCSI device %s reports its capacity changed; rescanning", ev["DEVPATH"])
+				if err := ioutil.WriteFile(rescan, []byte("1"), 0200); err != nil {
+					warnf("rescanning %s: %v", ev["DEVPATH"], err)
+				}
+				continue
+			}
+			if ev["SUBSYSTEM"] == "block" && ev["ACTION"] == "change" && ev["RESIZE"] == "1" {
+				c <- ev["DEVNAME"]
+			}
+		}
+	}()
+	return c, nil
+}
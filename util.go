@@ -27,3 +27,20 @@ func execErrDetail(err error) string {
 	}
 	return err.Error()
 }
+
+// execErr is like execErrDetail but keeps err available to errors.As.
+func execErr(err error) error {
+	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+		return fmt.Errorf("%w; stderr: %s", err, ee.Stderr)
+	}
+	return err
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
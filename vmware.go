@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bwagner5/embiggen-disk/pkg/embiggen"
+)
+
+var vmwareRescan = flag.Bool("vmware-rescan", true, "in daemon mode on VMware guests, rescan the SCSI disks under the targets before each check and when vSphere reports their capacity changed, so \"Expand disk\" is picked up right away")
+
+var (
+	vmwareOnce  sync.Once
+	vmwareGuest bool
+)
+
+// onVMware reports whether this is a VMware guest: the DMI vendor
+// says so, or the VMware Tools daemon is running.
+func onVMware() bool {
+	vmwareOnce.Do(func() {
+		if b, err := ioutil.ReadFile("/sys/class/dmi/id/sys_vendor"); err == nil && strings.Contains(string(b), "VMware") {
+			vmwareGuest = true
+			return
+		}
+		comms, _ := filepath.Glob("/proc/[0-9]*/comm")
+		for _, c := range comms {
+			if b, err := ioutil.ReadFile(c); err == nil && strings.TrimSpace(string(b)) == "vmtoolsd" {
+				vmwareGuest = true
+				return
+			}
+		}
+	})
+	return vmwareGuest
+}
+
+// rescanVMwareDisk rescans the SCSI disk under mnt, since vSphere
+// doesn't always tell the guest when a virtual disk is expanded.
+func rescanVMwareDisk(mnt string, lim embiggen.Limit) {
+	disk, err := backingDisk(mnt, lim)
+	if err != nil || !strings.HasPrefix(filepath.Base(disk), "sd") {
+		return
+	}
+	if err := rescanDisk(disk); err != nil {
+		vlogf("%s: %v", mnt, err)
+	}
+}
+
+// capacityChanged reports whether uevent ev is a SCSI device's unit
+// attention saying its capacity changed, which vSphere sends when a
+// disk is expanded, returning the device's sysfs rescan file.
+func capacityChanged(ev map[string]string) (string, bool) {
+	if ev["SUBSYSTEM"] != "scsi" || ev["ACTION"] != "change" || ev["SDEV_UA"] != "CAPACITY_DATA_HAS_CHANGED" {
+		return "", false
+	}
+	return filepath.Join("/sys", ev["DEVPATH"], "rescan"), true
+}